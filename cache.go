@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+)
+
+var cacheFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "cache-dir",
+		Usage: "the cache dir to look at, overriding the config file (default: the system temp dir)"},
+}
+
+var cacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "look at or clean up local copies of files",
+	Subcommands: []cli.Command{
+		{
+			Name:   "du",
+			Usage:  "show how much space local copies take up",
+			Flags:  cacheFlags,
+			Action: cacheDu,
+		},
+		{
+			Name:   "ls",
+			Usage:  "list local copies, largest first",
+			Flags:  cacheFlags,
+			Action: cacheLs,
+		},
+		{
+			Name:   "clear",
+			Usage:  "remove local copies left behind by mnt-gdrive processes that are no longer running",
+			Flags:  cacheFlags,
+			Action: cacheClear,
+		},
+	},
+}
+
+// cacheFiles returns the local copies in the cache dir that ctx and the
+// config file pick.
+func cacheFiles(ctx *cli.Context) ([]phantomfile.CacheFile, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	if ctx.IsSet("cache-dir") {
+		cfg.CacheDir = config.ExpandHome(ctx.String("cache-dir"))
+	}
+	phantomfile.SetTempDir(cfg.CacheDir)
+	return phantomfile.CacheFiles()
+}
+
+func cacheDu(ctx *cli.Context) error {
+	files, err := cacheFiles(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var inUse, orphaned int64
+	for _, f := range files {
+		if f.InUse {
+			inUse += f.Size
+		} else {
+			orphaned += f.Size
+		}
+	}
+	fmt.Printf("cache dir %s\n", phantomfile.CacheDir())
+	fmt.Printf("in use    %s\n", formatBytes(inUse))
+	fmt.Printf("orphaned  %s\n", formatBytes(orphaned))
+	fmt.Printf("total     %s\n", formatBytes(inUse+orphaned))
+	return nil
+}
+
+func cacheLs(ctx *cli.Context) error {
+	files, err := cacheFiles(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	for _, f := range files {
+		fmt.Printf("%8s  %-8s %7d  %s  %s\n",
+			formatBytes(f.Size), cacheFileState(f), f.Pid,
+			f.ModTime.Format("2006-01-02 15:04"), filepath.Base(f.Path))
+	}
+	return nil
+}
+
+func cacheFileState(f phantomfile.CacheFile) string {
+	if f.InUse {
+		return "in use"
+	}
+	return "orphaned"
+}
+
+func cacheClear(ctx *cli.Context) error {
+	if _, err := cacheFiles(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	removed, freed, err := phantomfile.RemoveOrphans()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("Removed %d local copies, freeing %s\n", removed, formatBytes(freed))
+
+	// these may be open, or have changes that haven't been uploaded
+	// yet, so we leave them to their process
+	left, err := phantomfile.CacheFiles()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if len(left) != 0 {
+		fmt.Printf("Kept %d local copies belonging to running mnt-gdrive processes; unmount to have them cleaned up\n", len(left))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+)
+
+var connectionsCommand = cli.Command{
+	Name:      "connections",
+	Usage:     "show how a running mount has been using its connections to google",
+	ArgsUsage: "MOUNTPOINT",
+	Action:    connections,
+}
+
+func connections(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("You must specify a single argument which is the mount point of a running mount.", 1)
+	}
+	sockPath, err := control.SocketPath(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	var cs gdrive.ConnStats
+	err = control.Call(sockPath, control.OpConnections, func(dec *json.Decoder) error {
+		return dec.Decode(&cs)
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("requests        %d\n", cs.Requests)
+	fmt.Printf("new connections %d\n", cs.NewConns)
+	fmt.Printf("reused          %d\n", cs.ReusedConns)
+	fmt.Printf("tls handshakes  %d\n", cs.TLSHandshakes)
+	fmt.Printf("dns lookups     %d\n", cs.DNSLookups)
+	fmt.Printf("errors          %d\n", cs.Errors)
+	fmt.Printf("stalled         %d\n", cs.Stalls)
+	fmt.Printf("retried         %d\n", cs.Retries)
+	return nil
+}
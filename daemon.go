@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// set in the environment of the background process started by
+// --daemon, which finds the write end of a pipe back to its parent on
+// file descriptor 3
+const daemonEnv = "MNT_GDRIVE_DAEMON"
+
+const daemonReadyFd = 3
+
+// isDaemonChild returns true if we are the background process started
+// by daemonize.
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonPaths returns the default pidfile and log file for a mount
+// running in the background.  They live next to its control socket.
+func daemonPaths(sockPath string) (pidfile string, logfile string) {
+	base := strings.TrimSuffix(sockPath, filepath.Ext(sockPath))
+	return base + ".pid", base + ".log"
+}
+
+// daemonize starts a copy of ourselves in the background with the same
+// arguments and waits until it reports that the mount is ready (or
+// that it failed).
+func daemonize(logfile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(logfile), 0700); err != nil {
+		return err
+	}
+	logf, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logf.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logf
+	cmd.Stderr = logf
+	cmd.ExtraFiles = []*os.File{w}
+	// leave our session, so that closing the terminal we were started
+	// from doesn't take the mount with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	b, _ := ioutil.ReadAll(r)
+	switch msg := strings.TrimSpace(string(b)); msg {
+	case "ok":
+		return nil
+	case "":
+		return fmt.Errorf("mount failed in the background, see %s", logfile)
+	default:
+		return fmt.Errorf("mount failed in the background: %s", msg)
+	}
+}
+
+// daemonReady tells the process that started us whether the mount
+// worked, if we were started by daemonize.
+func daemonReady(mountErr error) {
+	if !isDaemonChild() {
+		return
+	}
+	f := os.NewFile(daemonReadyFd, "daemon-ready")
+	if mountErr != nil {
+		fmt.Fprintln(f, mountErr)
+	} else {
+		fmt.Fprintln(f, "ok")
+	}
+	f.Close()
+}
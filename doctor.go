@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/mntgdrive"
+
+	"golang.org/x/net/context"
+)
+
+var doctorCommand = cli.Command{
+	Name:  "doctor",
+	Usage: "check that everything needed to mount a drive is in place",
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "w, writeable",
+			Usage: "Check the setup needed for writeable mode"},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "the cache dir to check, overriding the config file (default: the system temp dir)"},
+	}, driveFlags...),
+	Action: doctor,
+}
+
+func doctor(ctx *cli.Context) error {
+	readonly := !ctx.Bool("writeable")
+
+	mountOpts, err := mntgdrive.ConfigOptions()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if ctx.IsSet("cache-dir") {
+		mountOpts.CacheDir = config.ExpandHome(ctx.String("cache-dir"))
+	}
+	opts, err := driveOptions(ctx, readonly)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	checks := gdrive.Diagnose(context.Background(), opts)
+	checks = append(checks, checkFuse()...)
+	checks = append(checks, checkCacheDir(mountOpts.CacheDir, mountOpts.CacheSizeMB))
+
+	failed := 0
+	for _, c := range checks {
+		if c.Err == nil {
+			fmt.Printf("ok      %s\n", c.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAILED  %s: %v\n        %s\n", c.Name, c.Err, c.Fix)
+	}
+	if failed != 0 {
+		return cli.NewExitError(fmt.Sprintf("%d check(s) failed", failed), 1)
+	}
+	return nil
+}
+
+// checkFuse verifies that we will be able to mount a fuse filesystem.
+func checkFuse() []gdrive.Check {
+	var checks []gdrive.Check
+
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err == nil {
+		f.Close()
+	}
+	checks = append(checks, gdrive.Check{
+		Name: "/dev/fuse",
+		Err:  err,
+		Fix:  "Install fuse, load the fuse kernel module (modprobe fuse) and make sure your user can read and write /dev/fuse."})
+
+	_, err = exec.LookPath("fusermount")
+	checks = append(checks, gdrive.Check{
+		Name: "fusermount",
+		Err:  err,
+		Fix:  "Install the fuse package that provides fusermount and make sure it is on your PATH."})
+
+	return checks
+}
+
+// checkCacheDir verifies that mount will be able to keep local copies
+// of files in dir, with sizeMB to spare.
+func checkCacheDir(dir string, sizeMB int64) gdrive.Check {
+	name := dir
+	if name == "" {
+		name = os.TempDir()
+	}
+	return gdrive.Check{
+		Name: fmt.Sprintf("cache dir %s", name),
+		Err:  mntgdrive.CheckCacheDir(dir, sizeMB),
+		Fix:  "Make sure the cache dir is writeable and has room, or pick another one with --cache-dir or cacheDir in the config file."}
+}
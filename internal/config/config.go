@@ -0,0 +1,194 @@
+// Package config reads and writes the mnt-gdrive configuration file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+const fileName = "config.json"
+
+// Config holds settings that apply to every mount, unless overridden
+// on the command line.
+type Config struct {
+	// CacheDir is where we keep local copies of file content.  If
+	// empty, we use the system temp dir.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// CacheSizeMB is how much space we try to stay under in CacheDir.
+	// Zero means no limit.
+	CacheSizeMB int64 `json:"cacheSizeMB,omitempty"`
+	// CacheQuotasMB limits how much space files in each top-level
+	// folder, by name, may take up in the cache.  Folders that aren't
+	// listed are only limited by CacheSizeMB.
+	CacheQuotasMB map[string]int64 `json:"cacheQuotasMB,omitempty"`
+	// Scope is how much of the drive we were authorized to touch:
+	// full (the default) or file, for just the files we created.
+	Scope string `json:"scope,omitempty"`
+	// ReadonlyPaths are folders, relative to the top of the mount,
+	// that we never change, even when mounted writeable.  That
+	// includes everything below them.
+	ReadonlyPaths []string `json:"readonlyPaths,omitempty"`
+	// Rules say what to do with files and folders created in
+	// particular places.  The first rule that covers a new file or
+	// folder is the one we follow.
+	Rules []Rule `json:"rules,omitempty"`
+	// Excludes are name patterns, like *.iso or node_modules/ (just
+	// folders), for files and folders we hide, along with everything
+	// below them.
+	Excludes []string `json:"excludes,omitempty"`
+	// Owners maps google account email addresses to local uids, so
+	// files other people own in drive are owned by the matching local
+	// user.  Files owned by people who aren't listed look like ours.
+	Owners map[string]uint32 `json:"owners,omitempty"`
+	// ExportFormats say what to export google docs files (and similar)
+	// as, by kind, e.g. document, spreadsheet or presentation.  Kinds
+	// that aren't listed keep the default.
+	ExportFormats map[string]ExportFormat `json:"exportFormats,omitempty"`
+	// Mounts are what we mount when we aren't given a mount point on
+	// the command line.  They all share one pool of connections to
+	// google, and one limit on how fast we send requests.
+	Mounts []Mount `json:"mounts,omitempty"`
+	// RequestsPerSecond limits how fast we send requests to google,
+	// across every mount.  Zero means no limit.
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+}
+
+// Mount says what to mount where.
+type Mount struct {
+	Mountpoint string `json:"mountpoint"`
+	// RootFolder is the path of the folder to present as the root,
+	// e.g. Projects/2016.  Empty means the top of the drive.
+	RootFolder string `json:"rootFolder,omitempty"`
+	// RootFolderID is the id of the folder to present as the root.
+	// Set at most one of RootFolder and RootFolderID.
+	RootFolderID string `json:"rootFolderId,omitempty"`
+	// SharedDriveID, if set, is the id of the shared drive to mount
+	// instead of My Drive.
+	SharedDriveID string `json:"sharedDriveId,omitempty"`
+	// Profile, if set, names the google account to mount, as
+	// authorized with 'mnt-gdrive setup --profile'.  Empty means the
+	// one given on the command line, or the default account.
+	Profile string `json:"profile,omitempty"`
+	// VolumeName, if set, is the name the mount goes by in Finder and
+	// in the list of mounted file systems.  {email} and {root} are
+	// replaced by the account's email address and the name of what
+	// is mounted.
+	VolumeName string `json:"volumeName,omitempty"`
+	// VolumeIcon, if set, is an .icns file that Finder shows as the
+	// mount's icon.
+	VolumeIcon string `json:"volumeIcon,omitempty"`
+	// Proxy, if set, is the http or https proxy used for all of the
+	// mount's drive traffic, in place of the one given on the command
+	// line.
+	Proxy string `json:"proxy,omitempty"`
+	// CABundle, if set, is a file of PEM encoded certificates the
+	// mount trusts instead of the system roots, in place of the one
+	// given on the command line.
+	CABundle string `json:"caBundle,omitempty"`
+}
+
+// Rule says what to do with files and folders created below Path.
+type Rule struct {
+	// Path is a folder, relative to the top of the mount.
+	Path string `json:"path"`
+	// Description, if set, is given to everything created below Path.
+	Description string `json:"description,omitempty"`
+	// FolderID, if set, is the drive folder that files created below
+	// Path are moved to once their content has been uploaded.
+	FolderID string `json:"folderId,omitempty"`
+	// ShareWith lists who everything created below Path is shared
+	// with.
+	ShareWith []Share `json:"shareWith,omitempty"`
+}
+
+// ExportFormat says what to export one kind of google docs file as.
+type ExportFormat struct {
+	// MimeType is the format to ask drive for, e.g.
+	// application/vnd.oasis.opendocument.text.
+	MimeType string `json:"mimeType"`
+	// Extension, if set, is added to the end of the names of files of
+	// this kind, e.g. .odt.
+	Extension string `json:"extension,omitempty"`
+}
+
+// Share says who to share something with.
+type Share struct {
+	// Email is the address of the user or group.
+	Email string `json:"email"`
+	// Type is "user" (the default) or "group".
+	Type string `json:"type,omitempty"`
+	// Role is "reader" (the default), "commenter" or "writer".
+	Role string `json:"role,omitempty"`
+}
+
+// Dir returns the directory that holds our configuration, including
+// the client secret.
+func Dir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine home directory: %v", err)
+	}
+	return filepath.Join(usr.HomeDir, ".config", "mnt-gdrive"), nil
+}
+
+// Path returns the path of the configuration file.
+func Path() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fileName), nil
+}
+
+// ExpandHome returns p with a leading ~ replaced by the home directory.
+func ExpandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(usr.HomeDir, p[1:])
+}
+
+// Load reads the configuration file.  If there isn't one, it returns
+// an empty configuration.
+func Load() (*Config, error) {
+	p, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", p, err)
+	}
+	return c, nil
+}
+
+// Save writes the configuration file, creating its directory if needed.
+func (c *Config) Save() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, fileName), append(b, '\n'), 0600)
+}
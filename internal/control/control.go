@@ -0,0 +1,200 @@
+// Package control implements a unix socket that lets other processes
+// talk to a running mount.
+package control
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+)
+
+// Ops that mnt-gdrive handles, beyond watch
+const (
+	// OpUmount asks a mount to upload any pending changes and unmount.
+	OpUmount = "umount"
+	// OpConnections asks a mount how it has been using its connections
+	// to google.
+	OpConnections = "connections"
+	// OpStatus asks a mount how healthy it is.
+	OpStatus = "status"
+	// OpJobs asks a mount for the status of its jobs.
+	OpJobs = "jobs"
+	// OpCancel asks a mount to cancel the job whose id is the only
+	// argument.
+	OpCancel = "cancel"
+	// OpResync starts a job that lists every folder we know of below
+	// the path that is the only argument again, catching up with
+	// anything the change feed missed.
+	OpResync = "resync"
+)
+
+// Request is what a client sends, as a single line of json, right
+// after connecting.
+type Request struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+}
+
+// Handler handles one kind of request.  Anything it encodes is sent
+// back to the client.  The connection is closed when it returns.
+type Handler func(req Request, enc *json.Encoder) error
+
+// SocketPath returns the path of the control socket for a mountpoint.
+func SocketPath(mountpoint string) (string, error) {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, fmt.Sprintf("mnt-gdrive-%d", os.Getuid()))
+	// socket paths are limited to around 100 bytes, so we don't use
+	// the mountpoint directly
+	sum := sha1.Sum([]byte(abs))
+	return filepath.Join(dir, fmt.Sprintf("%x.sock", sum[:8])), nil
+}
+
+// Server accepts connections on a control socket.
+type Server struct {
+	path string
+	ln   net.Listener
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	watchers map[chan Event]bool
+}
+
+// Listen creates the socket at path, replacing any stale socket left
+// behind by an earlier mount.
+func Listen(path string) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s is in use by another mount", path)
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		path:     path,
+		ln:       ln,
+		handlers: map[string]Handler{},
+		watchers: map[chan Event]bool{}}
+	s.Handle(opWatch, s.watch)
+	return s, nil
+}
+
+// Handle registers h to handle requests for op.
+func (s *Server) Handle(op string, h Handler) {
+	s.mu.Lock()
+	s.handlers[op] = h
+	s.mu.Unlock()
+}
+
+// HandleAction registers fn to handle requests for op that only
+// report whether they worked.
+func (s *Server) HandleAction(op string, fn func() error) {
+	s.Handle(op, func(req Request, enc *json.Encoder) error {
+		var reply errorReply
+		if err := fn(); err != nil {
+			reply.Error = err.Error()
+		}
+		return enc.Encode(reply)
+	})
+}
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			logging.Warnf("control: no longer accepting connections on %s: %v", s.path, err)
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	var req Request
+	if err := json.NewDecoder(bufio.NewReader(c)).Decode(&req); err != nil {
+		logging.Warnf("control: bad request: %v", err)
+		return
+	}
+	s.mu.Lock()
+	h, ok := s.handlers[req.Op]
+	s.mu.Unlock()
+	enc := json.NewEncoder(c)
+	if !ok {
+		enc.Encode(errorReply{fmt.Sprintf("unknown op %q", req.Op)})
+		return
+	}
+	if err := h(req, enc); err != nil {
+		logging.Warnf("control: %s failed: %v", req.Op, err)
+	}
+}
+
+// Close stops accepting connections and removes the socket.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for w := range s.watchers {
+		close(w)
+		delete(s.watchers, w)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// Call connects to the control socket at path, sends a request for
+// op and passes the decoder for the replies to fn.
+func Call(path string, op string, fn func(dec *json.Decoder) error) error {
+	return CallRequest(path, Request{Op: op}, fn)
+}
+
+// CallRequest is like Call, for requests with arguments.
+func CallRequest(path string, req Request, fn func(dec *json.Decoder) error) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("unable to reach mount (is it running?): %v", err)
+	}
+	defer c.Close()
+	if err = json.NewEncoder(c).Encode(req); err != nil {
+		return err
+	}
+	return fn(json.NewDecoder(c))
+}
+
+// Do asks the mount whose control socket is at path to perform op,
+// returning any error it reports.
+func Do(path string, op string) error {
+	return Call(path, op, func(dec *json.Decoder) error {
+		var reply errorReply
+		if err := dec.Decode(&reply); err != nil {
+			return err
+		}
+		if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) (*Server, string) {
+	dir, err := ioutil.TempDir("", "control-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.sock")
+	s, err := Listen(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s, dir
+}
+
+func TestWatch(t *testing.T) {
+	s, dir := testServer(t)
+	defer os.RemoveAll(dir)
+
+	got := make(chan Event)
+	done := make(chan error)
+	go func() {
+		done <- Watch(s.path, func(e Event) error {
+			got <- e
+			return nil
+		})
+	}()
+
+	want := Event{Type: EventCreated, ID: "file_one_id", Name: "file one", Path: "dir one/file one"}
+	// the watcher may not be registered yet, so keep publishing until it sees something
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(5 * time.Second)
+loop:
+	for {
+		select {
+		case <-tick.C:
+			s.Publish(want)
+		case e := <-got:
+			if e != want {
+				t.Fatalf("got %#v, want %#v", e, want)
+			}
+			break loop
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	tick.Stop()
+	go func() {
+		// drain anything published before we stopped
+		for range got {
+		}
+	}()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Watch returned %v after the server closed", err)
+	}
+}
+
+func TestListenInUse(t *testing.T) {
+	s, dir := testServer(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	if _, err := Listen(s.path); err == nil {
+		t.Fatal("expected a second Listen on the same path to fail")
+	}
+}
+
+func TestUnknownOp(t *testing.T) {
+	s, dir := testServer(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	err := Call(s.path, "bogus", func(dec *json.Decoder) error {
+		var reply errorReply
+		if err := dec.Decode(&reply); err != nil {
+			return err
+		}
+		if reply.Error == "" {
+			t.Error("expected an error reply")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDo(t *testing.T) {
+	s, dir := testServer(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	s.HandleAction("ok", func() error { return nil })
+	s.HandleAction("fail", func() error { return errors.New("boom") })
+
+	if err := Do(s.path, "ok"); err != nil {
+		t.Errorf("ok: %v", err)
+	}
+	if err := Do(s.path, "fail"); err == nil || err.Error() != "boom" {
+		t.Errorf("fail: got %v, want boom", err)
+	}
+}
@@ -0,0 +1,95 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+)
+
+const opWatch = "watch"
+
+// how many events we will queue up for a slow watcher before we start
+// dropping them
+const watchBacklog = 256
+
+// Types of events
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventRemoved = "removed"
+)
+
+// Event describes a remote change that was applied to the mount.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	Name string    `json:"name,omitempty"`
+	// Path is relative to the mountpoint, or empty if we don't know
+	// how the node connects to the root
+	Path string `json:"path,omitempty"`
+}
+
+// Publish sends e to everyone watching.  It never blocks; watchers
+// that fall too far behind miss events.
+func (s *Server) Publish(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.watchers {
+		select {
+		case w <- e:
+		default:
+			logging.Warnf("control: dropping %s event for %q, watcher is too slow", e.Type, e.ID)
+		}
+	}
+}
+
+func (s *Server) watch(req Request, enc *json.Encoder) error {
+	w := make(chan Event, watchBacklog)
+	s.mu.Lock()
+	s.watchers[w] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.watchers[w] {
+			delete(s.watchers, w)
+		}
+		s.mu.Unlock()
+	}()
+
+	for e := range w {
+		if err := enc.Encode(e); err != nil {
+			// most likely the watcher went away
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch streams events from the control socket at path to fn until
+// the mount goes away or fn returns an error.
+func Watch(path string, fn func(Event) error) error {
+	return Call(path, opWatch, func(dec *json.Decoder) error {
+		for {
+			var reply struct {
+				Event
+				Error string `json:"error"`
+			}
+			if err := dec.Decode(&reply); err == io.EOF {
+				// the mount went away
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if reply.Error != "" {
+				return errors.New(reply.Error)
+			}
+			if err := fn(reply.Event); err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package control
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// how many jobs that are over we remember, so their results can still
+// be read for a while
+const maxFinishedJobs = 20
+
+// JobStatus is how far a job has got.
+type JobStatus struct {
+	ID    string   `json:"id"`
+	Op    string   `json:"op"`
+	Args  []string `json:"args,omitempty"`
+	State string   `json:"state"`
+	// Done out of Total steps are finished.  Total is zero until the
+	// job knows it, and may grow as the job finds more to do.
+	Done     int64     `json:"done"`
+	Total    int64     `json:"total"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// JobReply is how a mount answers requests that start or cancel a job.
+type JobReply struct {
+	Job   *JobStatus `json:"job,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// Job is a long running operation a mount does for a client, which
+// the client can check on or cancel after it has gone away.
+type Job struct {
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// Progress says that done out of total steps are finished.
+func (j *Job) Progress(done, total int64) {
+	j.mu.Lock()
+	j.status.Done = done
+	j.status.Total = total
+	j.mu.Unlock()
+}
+
+// Status returns how far j has got.
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Finished is closed once j is over, however it ended.
+func (j *Job) Finished() <-chan struct{} {
+	return j.finished
+}
+
+// Jobs keeps track of the jobs a mount is running, and of those that
+// ended recently.
+type Jobs struct {
+	mu   sync.Mutex
+	last int
+	// oldest first
+	jobs []*Job
+}
+
+// NewJobs returns an empty set of jobs.
+func NewJobs() *Jobs {
+	return &Jobs{}
+}
+
+// Start runs fn as a new job for op, with args, in the background.
+// fn should say how it is getting on with j.Progress and give up when
+// ctx is done, which it is when the job is cancelled or parent is.
+func (js *Jobs) Start(parent context.Context, op string, args []string, fn func(ctx context.Context, j *Job) error) *Job {
+	ctx, cancel := context.WithCancel(parent)
+	js.mu.Lock()
+	js.last++
+	j := &Job{
+		cancel:   cancel,
+		finished: make(chan struct{}),
+		status: JobStatus{
+			ID:      strconv.Itoa(js.last),
+			Op:      op,
+			Args:    args,
+			State:   JobRunning,
+			Started: time.Now()}}
+	js.jobs = append(js.jobs, j)
+	js.forgetFinishedLocked()
+	js.mu.Unlock()
+
+	go func() {
+		defer close(j.finished)
+		defer cancel()
+		err := fn(ctx, j)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.status.Finished = time.Now()
+		switch {
+		case err != nil && ctx.Err() == context.Canceled:
+			j.status.State = JobCancelled
+		case err != nil:
+			j.status.State = JobFailed
+			j.status.Error = err.Error()
+		default:
+			j.status.State = JobDone
+		}
+	}()
+	return j
+}
+
+// forgetFinishedLocked drops the oldest jobs that are over, beyond
+// maxFinishedJobs of them.  Must be called with js.mu held.
+func (js *Jobs) forgetFinishedLocked() {
+	over := 0
+	for _, j := range js.jobs {
+		if j.Status().State != JobRunning {
+			over++
+		}
+	}
+	kept := js.jobs[:0]
+	for _, j := range js.jobs {
+		if over > maxFinishedJobs && j.Status().State != JobRunning {
+			over--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	js.jobs = kept
+}
+
+// Get returns the job with id, if we remember it.
+func (js *Jobs) Get(id string) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, j := range js.jobs {
+		if j.status.ID == id {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the status of every job we remember, oldest first.
+func (js *Jobs) List() []JobStatus {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	statuses := []JobStatus{}
+	for _, j := range js.jobs {
+		statuses = append(statuses, j.Status())
+	}
+	return statuses
+}
+
+// Cancel asks the job with id to stop.  It doesn't wait for it to.
+func (js *Jobs) Cancel(id string) error {
+	j, ok := js.Get(id)
+	if !ok {
+		return fmt.Errorf("no job %s", id)
+	}
+	j.cancel()
+	return nil
+}
@@ -0,0 +1,91 @@
+package control
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func waitFor(t *testing.T, j *Job) JobStatus {
+	select {
+	case <-j.Finished():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for job %s", j.Status().ID)
+	}
+	return j.Status()
+}
+
+func TestJobStates(t *testing.T) {
+	js := NewJobs()
+
+	done := js.Start(context.Background(), "test", nil, func(ctx context.Context, j *Job) error {
+		j.Progress(3, 3)
+		return nil
+	})
+	if st := waitFor(t, done); st.State != JobDone || st.Done != 3 || st.Total != 3 || st.Finished.IsZero() {
+		t.Errorf("got %+v, expected a finished job that did 3 of 3", st)
+	}
+
+	failed := js.Start(context.Background(), "test", nil, func(ctx context.Context, j *Job) error {
+		return errors.New("broken")
+	})
+	if st := waitFor(t, failed); st.State != JobFailed || st.Error != "broken" {
+		t.Errorf("got %+v, expected a failed job", st)
+	}
+
+	cancelled := js.Start(context.Background(), "test", nil, func(ctx context.Context, j *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if st := cancelled.Status(); st.State != JobRunning {
+		t.Errorf("got %+v, expected a running job", st)
+	}
+	if err := js.Cancel(cancelled.Status().ID); err != nil {
+		t.Fatal(err)
+	}
+	if st := waitFor(t, cancelled); st.State != JobCancelled || st.Error != "" {
+		t.Errorf("got %+v, expected a cancelled job", st)
+	}
+
+	if err := js.Cancel("nope"); err == nil {
+		t.Error("expected an error cancelling a job that doesn't exist")
+	}
+	if got := len(js.List()); got != 3 {
+		t.Errorf("got %d jobs, expected 3", got)
+	}
+}
+
+func TestForgetFinishedJobs(t *testing.T) {
+	js := NewJobs()
+	running := js.Start(context.Background(), "test", nil, func(ctx context.Context, j *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer js.Cancel(running.Status().ID)
+	for i := 0; i < maxFinishedJobs+5; i++ {
+		waitFor(t, js.Start(context.Background(), "test", nil, func(ctx context.Context, j *Job) error {
+			return nil
+		}))
+	}
+	// the next job to start forgets the oldest that are over
+	js.Start(context.Background(), "test", nil, func(ctx context.Context, j *Job) error {
+		return nil
+	})
+
+	sts := js.List()
+	if len(sts) != maxFinishedJobs+2 {
+		t.Fatalf("got %d jobs, expected %d", len(sts), maxFinishedJobs+2)
+	}
+	if sts[0].ID != running.Status().ID {
+		t.Errorf("got %s first, expected the running job to be kept", sts[0].ID)
+	}
+	if want := strconv.Itoa(7); sts[1].ID != want {
+		t.Errorf("got %s second, expected %s", sts[1].ID, want)
+	}
+	if _, ok := js.Get("2"); ok {
+		t.Error("expected job 2 to have been forgotten")
+	}
+}
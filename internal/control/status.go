@@ -0,0 +1,22 @@
+package control
+
+import "time"
+
+// MountStatus is what a mount reports about itself when asked for its
+// status.
+type MountStatus struct {
+	// when we last fetched changes from google without error
+	LastChanges time.Time `json:"last_changes"`
+	// set when that was long enough ago to be more than a blip
+	Stale          bool   `json:"stale"`
+	DirtyFiles     int    `json:"dirty_files"`
+	PendingRenames int    `json:"pending_renames"`
+	CacheDir       string `json:"cache_dir"`
+	CacheBytes     int64  `json:"cache_bytes"`
+	Requests       uint64 `json:"requests"`
+	Errors         uint64 `json:"errors"`
+	// closed files whose changes we are still trying to upload, and
+	// how many uploads have failed so far
+	RetryingUploads int    `json:"retrying_uploads"`
+	UploadFailures  uint64 `json:"upload_failures"`
+}
@@ -1,11 +1,15 @@
 package fakedrive
 
 import (
+	"crypto/md5"
 	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"time"
 
 	"bazil.org/fuse"
 	"golang.org/x/net/context"
@@ -32,7 +36,7 @@ func MakeDir(id string, name string, parentID string) *gdrive.Node {
 	if parentID != "" {
 		parents = []string{parentID}
 	}
-	return &gdrive.Node{ID: id, Name: name, ParentIDs: parents, MimeType: "application/vnd.google-apps.folder"}
+	return &gdrive.Node{ID: id, Name: name, ParentIDs: parents, MimeType: "application/vnd.google-apps.folder", OwnedByMe: true, CanEdit: true, CanRename: true, CanTrash: true, CanAddChildren: true}
 }
 
 func contentForTextFile(id string) []byte {
@@ -47,22 +51,71 @@ func MakeTextFile(id string, name string, parentID string) *gdrive.Node {
 		Name:          name,
 		ParentIDs:     parents,
 		MimeType:      "text/plain",
-		FileExtension: ".txt"}
-	n.Size = uint64(len(contentForTextFile(id)))
+		FileExtension: ".txt",
+		OwnedByMe:     true,
+		CanEdit:       true,
+		CanRename:     true,
+		CanTrash:      true,
+		CanLock:       true}
+	content := contentForTextFile(id)
+	n.Size = uint64(len(content))
+	n.MD5 = fmt.Sprintf("%x", md5.Sum(content))
 	return n
 }
 
+// MakeShortcut returns a new gdrive shortcut to targetID, suitable for
+// testing.
+func MakeShortcut(id string, name string, parentID string, targetID string) *gdrive.Node {
+	return &gdrive.Node{
+		ID:               id,
+		Name:             name,
+		ParentIDs:        []string{parentID},
+		MimeType:         gdrive.ShortcutMimeType,
+		ShortcutTargetID: targetID,
+		OwnedByMe:        true,
+		CanEdit:          true,
+		CanRename:        true,
+		CanTrash:         true}
+}
+
 // Drive represents a fake drive, for integration testing
 type Drive struct {
 	allNodes []*gdrive.Node
 	// Maps from id to the content.  If no entry, we fall back to
 	// calling contentForTextFile
 	contentMap map[string][]byte
+	// Maps from id to the content of every upload, oldest first
+	uploads map[string][][]byte
+	// Maps from id to the description
+	descriptions map[string]string
+	// Maps from id to who it has been shared with
+	shares map[string][]*gdrive.Permission
+	// How many permissions we have ever made, for their ids
+	permissions int
+	// Maps from id to whether it is starred
+	starred map[string]bool
+	// How many times Edit has been called
+	edits int
+	// The shared drives we can see, and the fake drive for each, by id
+	sharedDrives []*gdrive.SharedDrive
+	drives       map[string]*Drive
+	// The fake drive for the app data folder, if any
+	appData *Drive
+	// If set, office files we create become google docs files (and
+	// similar)
+	convertUploads bool
 }
 
 // NewDrive returns a new fake drive.
 func NewDrive(allNodes []*gdrive.Node) *Drive {
-	return &Drive{allNodes, map[string][]byte{}}
+	return &Drive{allNodes, map[string][]byte{}, map[string][][]byte{}, map[string]string{}, map[string][]*gdrive.Permission{}, 0, map[string]bool{}, 0, nil, map[string]*Drive{}, nil, false}
+}
+
+// RevisionTime is when we pretend revision i (counting from 1) of a
+// file was made.  Revision 1 is the original content and each upload
+// adds one.
+func RevisionTime(i int) time.Time {
+	return time.Date(2016, 1, i, 0, 0, 0, 0, time.UTC)
 }
 
 func (fake *Drive) newID() (id string) {
@@ -79,7 +132,7 @@ func (fake *Drive) newID() (id string) {
 }
 
 // FetchNode looks up a node by id in our in-memory data structure.
-func (fake *Drive) FetchNode(id string) (n *gdrive.Node, err error) {
+func (fake *Drive) FetchNode(ctx context.Context, id string) (n *gdrive.Node, err error) {
 	for _, n := range fake.allNodes {
 		if n.ID == id {
 			return n, nil
@@ -89,22 +142,39 @@ func (fake *Drive) FetchNode(id string) (n *gdrive.Node, err error) {
 }
 
 // CreateNode creates a fake node and puts it into our in memory data structure.
-func (fake *Drive) CreateNode(parentID string, name string, dir bool) (n *gdrive.Node, err error) {
+func (fake *Drive) CreateNode(ctx context.Context, parentID string, name string, dir bool) (n *gdrive.Node, err error) {
 	id := fake.newID()
 	if dir {
 		n = MakeDir(id, name, parentID)
 	} else {
 		n = MakeTextFile(id, name, parentID)
+		if mimeType, ok := gdrive.ConvertedMimeType(name); ok && fake.convertUploads {
+			n.MimeType = mimeType
+			n.FileExtension = ""
+			n.Size = 0
+			n.MD5 = ""
+		}
 	}
+	fake.allNodes = append(fake.allNodes, n)
 	return n, nil
 }
 
-// FetchChildren looks up the children in memory for an id.
+// ConvertUploads makes office files we create into google docs files
+// (and similar), the way drive does when it converts uploads.
+func (fake *Drive) ConvertUploads() {
+	fake.convertUploads = true
+}
+
+// FetchChildren looks up the children in memory for an id, leaving
+// out trashed ones.
 func (fake *Drive) FetchChildren(ctx context.Context, id string) (children []*gdrive.Node, err error) {
-	if _, err := fake.FetchNode(id); err != nil {
+	if _, err := fake.FetchNode(ctx, id); err != nil {
 		return nil, err
 	}
 	for _, n := range fake.allNodes {
+		if n.Trashed {
+			continue
+		}
 		for _, p := range n.ParentIDs {
 			if p == id {
 				children = append(children, n)
@@ -115,6 +185,16 @@ func (fake *Drive) FetchChildren(ctx context.Context, id string) (children []*gd
 	return children, nil
 }
 
+// FetchTrash returns the nodes that are marked as trashed.
+func (fake *Drive) FetchTrash(ctx context.Context) (trashed []*gdrive.Node, err error) {
+	for _, n := range fake.allNodes {
+		if n.Trashed {
+			trashed = append(trashed, n)
+		}
+	}
+	return trashed, nil
+}
+
 // Download copies content from our in memory node into a file.
 func (fake *Drive) Download(ctx context.Context, id string, f *os.File) error {
 	content, ok := fake.contentMap[id]
@@ -126,6 +206,15 @@ func (fake *Drive) Download(ctx context.Context, id string, f *os.File) error {
 	return nil
 }
 
+// Export writes content that says what id was exported as.
+func (fake *Drive) Export(ctx context.Context, id string, mimeType string, f *os.File) error {
+	if _, err := fake.FetchNode(ctx, id); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(f, "%s export of %s", mimeType, id)
+	return err
+}
+
 // Upload copies content for our in memory node from a file.
 func (fake *Drive) Upload(ctx context.Context, id string, f *os.File) error {
 	if _, err := f.Seek(0, 0); err != nil {
@@ -137,12 +226,50 @@ func (fake *Drive) Upload(ctx context.Context, id string, f *os.File) error {
 	}
 	fmt.Printf(":: fake uploading %q to %q\n", content, id)
 	fake.contentMap[id] = content
+	fake.uploads[id] = append(fake.uploads[id], content)
+	if n, err := fake.FetchNode(ctx, id); err == nil {
+		n.Size = uint64(len(content))
+		n.MD5 = fmt.Sprintf("%x", md5.Sum(content))
+		n.Version++
+	}
+	return nil
+}
+
+func (fake *Drive) revisionContents(id string) [][]byte {
+	return append([][]byte{contentForTextFile(id)}, fake.uploads[id]...)
+}
+
+// FetchRevisions returns the original content of a file, plus one
+// revision per upload.  Revision ids count up from 1.
+func (fake *Drive) FetchRevisions(ctx context.Context, id string) (revs []*gdrive.Revision, err error) {
+	if _, err = fake.FetchNode(ctx, id); err != nil {
+		return nil, err
+	}
+	for i, content := range fake.revisionContents(id) {
+		revs = append(revs, &gdrive.Revision{
+			ID:           strconv.Itoa(i + 1),
+			ModifiedTime: RevisionTime(i + 1),
+			Size:         uint64(len(content)),
+			MD5:          fmt.Sprintf("%x", md5.Sum(content))})
+	}
+	return revs, nil
+}
+
+// DownloadRevision copies the content of one of the revisions
+// described by FetchRevisions into a file.
+func (fake *Drive) DownloadRevision(ctx context.Context, id string, revID string, f *os.File) error {
+	contents := fake.revisionContents(id)
+	i, err := strconv.Atoi(revID)
+	if err != nil || i < 1 || i > len(contents) {
+		return fuse.ENOENT
+	}
+	f.Write(contents[i-1])
 	return nil
 }
 
 // Rename moves and/or renames a node.
 func (fake *Drive) Rename(ctx context.Context, id string, newName string, oldParentID string, newParentID string) (n *gdrive.Node, err error) {
-	n, err = fake.FetchNode(id)
+	n, err = fake.FetchNode(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +284,132 @@ func (fake *Drive) Rename(ctx context.Context, id string, newName string, oldPar
 	return n, nil
 }
 
+// Describe records the description of a node.
+func (fake *Drive) Describe(ctx context.Context, id string, description string) error {
+	n, err := fake.FetchNode(ctx, id)
+	if err != nil {
+		return err
+	}
+	fake.descriptions[id] = description
+	n.Description = description
+	return nil
+}
+
+// Description returns what Describe last set for id.
+func (fake *Drive) Description(id string) string {
+	return fake.descriptions[id]
+}
+
+// Edit makes every change in e to a node.
+func (fake *Drive) Edit(ctx context.Context, id string, e gdrive.Edit) (*gdrive.Node, error) {
+	fake.edits++
+	n, err := fake.Rename(ctx, id, e.Name, e.OldParentID, e.NewParentID)
+	if err != nil {
+		return nil, err
+	}
+	if e.Starred != nil {
+		fake.starred[id] = *e.Starred
+		n.Starred = *e.Starred
+	}
+	if e.Description != nil {
+		fake.descriptions[id] = *e.Description
+		n.Description = *e.Description
+	}
+	if e.Locked != nil {
+		n.Locked = *e.Locked
+		n.LockReason = ""
+		if n.Locked {
+			n.LockReason = e.LockReason
+		}
+	}
+	if len(e.AppProperties) > 0 {
+		// a new map, so nobody holding the old one sees it change
+		props := map[string]string{}
+		for k, v := range n.AppProperties {
+			props[k] = v
+		}
+		for k, v := range e.AppProperties {
+			if v == nil {
+				delete(props, k)
+			} else {
+				props[k] = *v
+			}
+		}
+		n.AppProperties = props
+	}
+	return n, nil
+}
+
+// Starred returns what Edit last set for whether id is starred.
+func (fake *Drive) Starred(id string) bool {
+	return fake.starred[id]
+}
+
+// Edits returns how many times Edit has been called.
+func (fake *Drive) Edits() int {
+	return fake.edits
+}
+
+// Share records who a node has been shared with.
+func (fake *Drive) Share(ctx context.Context, id string, kind string, email string, role string) error {
+	if _, err := fake.FetchNode(ctx, id); err != nil {
+		return err
+	}
+	fake.permissions++
+	p := &gdrive.Permission{ID: fmt.Sprintf("perm_%d", fake.permissions), Type: kind, Email: email, Role: role}
+	fake.shares[id] = append(fake.shares[id], p)
+	return nil
+}
+
+// Shares returns who id has been shared with, as kind:email:role.
+func (fake *Drive) Shares(id string) []string {
+	var shares []string
+	for _, p := range fake.shares[id] {
+		shares = append(shares, p.Type+":"+p.Email+":"+p.Role)
+	}
+	return shares
+}
+
+// Permissions returns who id has been shared with.  Like drive, it
+// only tells those who may change id.
+func (fake *Drive) Permissions(ctx context.Context, id string) ([]*gdrive.Permission, error) {
+	n, err := fake.FetchNode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !n.CanEdit {
+		return nil, fuse.EPERM
+	}
+	var perms []*gdrive.Permission
+	for _, p := range fake.shares[id] {
+		cp := *p
+		perms = append(perms, &cp)
+	}
+	return perms, nil
+}
+
+// ChangePermission changes the role of a permission Share made.
+func (fake *Drive) ChangePermission(ctx context.Context, id string, permissionID string, role string) error {
+	for _, p := range fake.shares[id] {
+		if p.ID == permissionID {
+			p.Role = role
+			return nil
+		}
+	}
+	return fuse.ENOENT
+}
+
+// Unshare removes a permission Share made.
+func (fake *Drive) Unshare(ctx context.Context, id string, permissionID string) error {
+	for i, p := range fake.shares[id] {
+		if p.ID == permissionID {
+			fake.shares[id] = append(fake.shares[id][:i:i], fake.shares[id][i+1:]...)
+			return nil
+		}
+	}
+	return fuse.ENOENT
+}
+
 // Trash removes the node entry if it exists and the content entry, if it exists.
 func (fake *Drive) Trash(ctx context.Context, id string) error {
 	for i, node := range fake.allNodes {
@@ -169,6 +422,100 @@ func (fake *Drive) Trash(ctx context.Context, id string) error {
 	return nil
 }
 
+// Untrash takes a node out of the trash and puts it in newParentID.
+func (fake *Drive) Untrash(ctx context.Context, id string, newName string, oldParentIDs []string, newParentID string) (n *gdrive.Node, err error) {
+	n, err = fake.FetchNode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Trashed {
+		return nil, fmt.Errorf("%q is not in the trash", id)
+	}
+	n.Trashed = false
+	n.Name = newName
+	n.ParentIDs = []string{newParentID}
+	return n, nil
+}
+
+// AddSharedDrive makes a shared drive, holding nodes, that we can see.
+// One of nodes should be a folder with the same id as the drive, which
+// is the top of the drive.
+func (fake *Drive) AddSharedDrive(id string, name string, nodes []*gdrive.Node) *Drive {
+	d := NewDrive(nodes)
+	fake.sharedDrives = append(fake.sharedDrives, &gdrive.SharedDrive{ID: id, Name: name})
+	fake.drives[id] = d
+	return d
+}
+
+// SharedDrives returns the shared drives added with AddSharedDrive.
+func (fake *Drive) SharedDrives(ctx context.Context) ([]*gdrive.SharedDrive, error) {
+	return fake.sharedDrives, nil
+}
+
+// Computers returns the folders other than root that have no parent,
+// which is what the top folders of computers that back up to drive
+// look like.
+func (fake *Drive) Computers(ctx context.Context) (computers []*gdrive.Node, err error) {
+	for _, n := range fake.allNodes {
+		if n.Dir() && len(n.ParentIDs) == 0 && n.ID != "root" && !n.Trashed {
+			computers = append(computers, n)
+		}
+	}
+	return computers, nil
+}
+
+// SharedWithMe returns the nodes that aren't trashed and that someone
+// else owns outside of a shared drive, which is what drive would say
+// was shared with us.
+func (fake *Drive) SharedWithMe(ctx context.Context) (shared []*gdrive.Node, err error) {
+	for _, n := range fake.allNodes {
+		if !n.Mine() && !n.Trashed {
+			shared = append(shared, n)
+		}
+	}
+	return shared, nil
+}
+
+// Recent returns up to count files that aren't trashed, most recently
+// modified first, as we don't know when anything was viewed.
+func (fake *Drive) Recent(ctx context.Context, count int) (recent []*gdrive.Node, err error) {
+	for _, n := range fake.allNodes {
+		if !n.Dir() && !n.Trashed {
+			recent = append(recent, n)
+		}
+	}
+	sort.SliceStable(recent, func(i, j int) bool { return recent[i].Mtime.After(recent[j].Mtime) })
+	if len(recent) > count {
+		recent = recent[:count]
+	}
+	return recent, nil
+}
+
+// ForSharedDrive returns the fake drive added for driveID.
+func (fake *Drive) ForSharedDrive(driveID string) (gdrive.DriveLike, error) {
+	d, ok := fake.drives[driveID]
+	if !ok {
+		return nil, fmt.Errorf("no shared drive %q", driveID)
+	}
+	return d, nil
+}
+
+// AddAppData makes an app data folder holding nodes.  One of nodes
+// should be a folder with the id "appDataFolder", which is the top of
+// it.
+func (fake *Drive) AddAppData(nodes []*gdrive.Node) *Drive {
+	fake.appData = NewDrive(nodes)
+	return fake.appData
+}
+
+// ForAppData returns the fake drive added with AddAppData.
+func (fake *Drive) ForAppData() (gdrive.DriveLike, error) {
+	if fake.appData == nil {
+		return nil, fmt.Errorf("no app data folder")
+	}
+	return fake.appData, nil
+}
+
 // ProcessChanges doesn't work yet.
 func (fake *Drive) ProcessChanges(changeHandler func(*gdrive.Change, *gdrive.ChangeStats)) (gdrive.ChangeStats, error) {
 	log.Fatal("implement me")
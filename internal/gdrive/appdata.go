@@ -0,0 +1,19 @@
+package gdrive
+
+// ForAppData returns a service, like gd, for working with the hidden
+// app data folder, whose id is "appDataFolder".  It has its own place
+// in the change feed, starting from now.
+func (gd *Gdrive) ForAppData() (DriveLike, error) {
+	token, err := getStartPageToken(gd.svc, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Gdrive{
+		svc:          gd.svc,
+		space:        "appDataFolder",
+		queries:      newQueryCache(gd.queries.ttl),
+		children:     newChildCounts(),
+		others:       gd.others,
+		stallTimeout: gd.stallTimeout,
+		pageToken:    token}, nil
+}
@@ -2,7 +2,8 @@ package gdrive
 
 import (
 	"fmt"
-	"log"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
 
 	"google.golang.org/api/drive/v3"
 )
@@ -17,8 +18,14 @@ type Change struct {
 }
 
 // GetStartPageToken fetches the start page token to use for changes.
-func getStartPageToken(service *drive.Service) (string, error) {
-	token, err := service.Changes.GetStartPageToken().Do()
+// If driveID is set, the token is for changes within that shared
+// drive.
+func getStartPageToken(service *drive.Service, driveID string) (string, error) {
+	call := service.Changes.GetStartPageToken().SupportsAllDrives(true)
+	if driveID != "" {
+		call.DriveId(driveID)
+	}
+	token, err := call.Do()
 	if err != nil {
 		return "", err
 	}
@@ -44,21 +51,31 @@ func (gd *Gdrive) ProcessChanges(changeHandler func(*Change, *ChangeStats)) (Cha
 		// now we are getting notified every time the view time for
 		// something gets updated and that isn't useful.  Maybe we can
 		// exclude that field and get fewer notifications.
-		cl, err := gd.svc.Changes.List(token).
+		call := gd.svc.Changes.List(token).
 			IncludeRemoved(true).
-			RestrictToMyDrive(true).
-			Fields(changeFields).
-			Do()
+			SupportsAllDrives(true).
+			Fields(changeFields)
+		switch {
+		case gd.space != "":
+			call.Spaces(gd.space)
+		case gd.driveID != "":
+			call.DriveId(gd.driveID).IncludeItemsFromAllDrives(true)
+		default:
+			call.RestrictToMyDrive(true)
+		}
+		cl, err := call.Do()
 		if err != nil {
-			log.Printf("Error fetching changes: %v", err)
+			logging.Errorf("Error fetching changes: %v", err)
 			return cs, err
 		}
 		for _, gChange := range cl.Changes {
 			var n *Node
+			gd.queries.invalidate(gChange.FileId)
 			if gChange.File != nil {
+				gd.queries.invalidate(gChange.FileId, gChange.File.Parents...)
 				n, err = newNode(gChange.FileId, gChange.File)
 				if err != nil {
-					log.Printf("Error converting changes %#v: %v", gChange, err)
+					logging.Errorf("Error converting changes %#v: %v", gChange, err)
 					return cs, err
 				}
 				ch := &Change{n.ID, gChange.Removed, n}
@@ -0,0 +1,22 @@
+package gdrive
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Drive has no way to ask for folders without parents, so we ask for
+// every folder we own and pick those out.
+const computersQuery = "mimeType = 'application/vnd.google-apps.folder' and 'me' in owners and trashed = false"
+
+// Computers returns the top folder of each computer that backs up to
+// the drive, i.e. what the web UI shows under Computers.  They are the
+// only folders we own that have no parent, since they aren't in My
+// Drive.  Shared drives and the app data folder have none.
+func (gd *Gdrive) Computers(ctx context.Context) ([]*Node, error) {
+	if gd.driveID != "" || gd.space != "" {
+		return nil, nil
+	}
+	return gd.listFiles(ctx, computersQuery, "", func(n *Node) bool {
+		return len(n.ParentIDs) == 0 && gd.includeNode(n)
+	})
+}
@@ -0,0 +1,83 @@
+package gdrive
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+)
+
+// ConnStats counts what it took to make our requests to google.  If
+// most requests need a new connection, a TLS handshake or a DNS
+// lookup, tuning keep-alives may help.
+type ConnStats struct {
+	Requests      uint64 `json:"requests"`
+	NewConns      uint64 `json:"new_conns"`
+	ReusedConns   uint64 `json:"reused_conns"`
+	TLSHandshakes uint64 `json:"tls_handshakes"`
+	DNSLookups    uint64 `json:"dns_lookups"`
+	// Errors counts requests that failed or that google turned down
+	Errors uint64 `json:"errors"`
+	// Stalls counts downloads that went quiet for so long we tried
+	// again
+	Stalls uint64 `json:"stalls"`
+	// Retries counts requests we sent again after a transient error
+	Retries uint64 `json:"retries"`
+}
+
+// only access via atomic
+var connStats ConnStats
+
+// Connections returns the counts for every request made so far.
+func Connections() ConnStats {
+	return ConnStats{
+		Requests:      atomic.LoadUint64(&connStats.Requests),
+		NewConns:      atomic.LoadUint64(&connStats.NewConns),
+		ReusedConns:   atomic.LoadUint64(&connStats.ReusedConns),
+		TLSHandshakes: atomic.LoadUint64(&connStats.TLSHandshakes),
+		DNSLookups:    atomic.LoadUint64(&connStats.DNSLookups),
+		Errors:        atomic.LoadUint64(&connStats.Errors),
+		Stalls:        atomic.LoadUint64(&connStats.Stalls),
+		Retries:       atomic.LoadUint64(&connStats.Retries),
+	}
+}
+
+// countingTransport counts into connStats what each request it makes
+// needed.
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddUint64(&connStats.Requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&connStats.ReusedConns, 1)
+			} else {
+				atomic.AddUint64(&connStats.NewConns, 1)
+			}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			atomic.AddUint64(&connStats.DNSLookups, 1)
+		},
+		TLSHandshakeStart: func() {
+			atomic.AddUint64(&connStats.TLSHandshakes, 1)
+		},
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil || resp.StatusCode >= 400 {
+		atomic.AddUint64(&connStats.Errors, 1)
+	}
+	if logging.Enabled(logging.Debug) {
+		status := "failed"
+		if err == nil {
+			status = resp.Status
+		}
+		logging.For(req.Context()).Debugf("%s %s: %s after %v", req.Method, req.URL.Path, status, time.Since(start))
+	}
+	return resp, err
+}
@@ -0,0 +1,68 @@
+package gdrive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCountingTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	}))
+	defer ts.Close()
+
+	before := Connections()
+	client := &http.Client{Transport: &countingTransport{base: http.DefaultTransport.(*http.Transport).Clone()}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	after := Connections()
+
+	if got := after.Requests - before.Requests; got != 2 {
+		t.Errorf("counted %d requests, want 2", got)
+	}
+	if got := after.NewConns - before.NewConns; got != 1 {
+		t.Errorf("counted %d new connections, want 1", got)
+	}
+	if got := after.ReusedConns - before.ReusedConns; got != 1 {
+		t.Errorf("counted %d reused connections, want 1", got)
+	}
+	if got := after.Errors - before.Errors; got != 0 {
+		t.Errorf("counted %d errors, want 0", got)
+	}
+}
+
+func TestCountingTransportErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	before := Connections()
+	client := &http.Client{Transport: &countingTransport{base: http.DefaultTransport.(*http.Transport).Clone()}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := Connections().Errors - before.Errors; got != 1 {
+		t.Errorf("counted %d errors, want 1", got)
+	}
+}
+
+func TestWithTransportKeepAlives(t *testing.T) {
+	tr, err := newTransport(Options{MaxIdleConnsPerHost: 16, DisableKeepAlives: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.MaxIdleConnsPerHost != 16 || !tr.DisableKeepAlives {
+		t.Errorf("got MaxIdleConnsPerHost=%d, DisableKeepAlives=%t", tr.MaxIdleConnsPerHost, tr.DisableKeepAlives)
+	}
+}
@@ -0,0 +1,150 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const tokenInfoURL = "https://www.googleapis.com/oauth2/v3/tokeninfo"
+
+// Check is the result of checking one part of our setup.  Err is nil
+// if the check passed.  Fix describes what the user can do about a
+// failure.
+type Check struct {
+	Name string
+	Err  error
+	Fix  string
+}
+
+// Diagnose checks, in order, each of the things we need to talk to
+// google drive, without prompting the user for anything.  It stops
+// at the first failure, since later checks depend on earlier ones.
+func Diagnose(ctx context.Context, opts Options) []Check {
+	var checks []Check
+	add := func(name string, err error, fix string) bool {
+		checks = append(checks, Check{name, err, fix})
+		return err == nil
+	}
+
+	ctx, err := withTransport(ctx, opts)
+	if !add("proxy settings", err, "Check the proxy url and ca bundle you specified.") {
+		return checks
+	}
+
+	secretFile, err := secretFilePath()
+	if !add("client secret location", err, "Make sure $HOME is set and points to your home directory.") {
+		return checks
+	}
+	scope := scopeFor(opts)
+	config, err := clientConfig(scopesFor(opts)...)
+	if !add("client secret", err, fmt.Sprintf("Run 'mnt-gdrive setup', or follow 'Step 1: Turn on the Drive API' at https://developers.google.com/drive/v3/web/quickstart/go and save the client_secret.json file as %s", secretFile)) {
+		return checks
+	}
+
+	if !add("profile", CheckProfile(opts.Profile), "Use a profile name made of letters, digits, - and _.") {
+		return checks
+	}
+	cacheFile, err := tokenCacheFile(opts.Profile)
+	if !add("token location", err, "Make sure $HOME is set and points to your home directory.") {
+		return checks
+	}
+	tok, err := tokenFromFile(cacheFile)
+	if !add("cached token", err, fmt.Sprintf("Run 'mnt-gdrive setup' to authorize access; the token is saved to %s", cacheFile)) {
+		return checks
+	}
+
+	ts := config.TokenSource(ctx, tok)
+	fresh, err := ts.Token()
+	if !add("token refresh", err, "The saved token was rejected.  Run 'mnt-gdrive setup' to authorize access again.") {
+		return checks
+	}
+
+	client := oauth2.NewClient(ctx, ts)
+	if opts.Scope == FileScope {
+		// a broader token would defeat the point
+		err = checkScope(ctx, client, fresh, scope)
+	} else {
+		// full access is good enough for a readonly mount
+		err = checkScope(ctx, client, fresh, scope, drive.DriveScope)
+	}
+	if !add("token scopes", err, "Run 'mnt-gdrive setup' and answer the writeable and scope questions the same way as your mount to authorize the right scope.") {
+		return checks
+	}
+	if opts.AppData {
+		err = checkScope(ctx, client, fresh, drive.DriveAppdataScope)
+		if !add("app data scope", err, "Run 'mnt-gdrive setup --app-data' to authorize access to the app data folder.") {
+			return checks
+		}
+	}
+
+	svc, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err == nil {
+		_, err = svc.About.Get().Fields("user").Context(ctx).Do()
+	}
+	if !add("drive api", err, "Check your network connection and that the Drive API is enabled for your project in the Google API console.") {
+		return checks
+	}
+
+	if opts.SharedDriveID != "" {
+		_, err = svc.Drives.Get(opts.SharedDriveID).Context(ctx).Do()
+		add("shared drive", err, "Check the shared drive id (it is the last part of the url when you open the shared drive) and that you are a member of it.")
+	}
+
+	return checks
+}
+
+// checkScope asks google which scopes tok carries and returns an
+// error if none of the wanted scopes are among them.
+func checkScope(ctx context.Context, client *http.Client, tok *oauth2.Token, want ...string) error {
+	scopes, err := tokenScopes(ctx, client, tok)
+	if err != nil {
+		return err
+	}
+	if hasScope(scopes, want...) {
+		return nil
+	}
+	return fmt.Errorf("token has scopes %q but we need %q", strings.Join(scopes, " "), want[0])
+}
+
+// tokenScopes asks google which scopes tok carries.
+func tokenScopes(ctx context.Context, client *http.Client, tok *oauth2.Token) ([]string, error) {
+	req, err := http.NewRequest("GET", tokenInfoURL+"?access_token="+url.QueryEscape(tok.AccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo returned %s", resp.Status)
+	}
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// hasScope returns true if any of want are among scopes.
+func hasScope(scopes []string, want ...string) bool {
+	for _, s := range scopes {
+		for _, w := range want {
+			if s == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,462 @@
+package gdrive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// dryRun passes reads through to the drive it wraps, but only logs the
+// changes it is asked to make.  So the mount still behaves as if they
+// were made, it remembers what each node would look like afterwards
+// and shows us that instead of what drive has.
+type dryRun struct {
+	DriveLike
+
+	mu sync.Mutex
+	// the nodes we have pretended to create or change, by id
+	nodes map[string]*Node
+	// the ids of the nodes we have pretended to change since we last
+	// reported changes
+	pending map[string]bool
+	// how many nodes we have pretended to create
+	created int
+	// maps from id to a local copy of what we would have uploaded last,
+	// so it can be read back
+	uploads map[string]string
+}
+
+// what the ids we make up for the nodes we pretend to create start with
+const dryRunIDPrefix = "dry-run-"
+
+// isCreated returns true if id is one we made up, so drive has never
+// heard of it.
+func isCreated(id string) bool {
+	return strings.HasPrefix(id, dryRunIDPrefix)
+}
+
+// NewDryRun returns a drive that reads from dl but never changes it,
+// logging each change it would have made instead.  It keeps what it
+// would have uploaded in the temp dir, so it can be read back.
+func NewDryRun(dl DriveLike) DriveLike {
+	return &dryRun{DriveLike: dl, nodes: map[string]*Node{}, pending: map[string]bool{}, uploads: map[string]string{}}
+}
+
+// node returns a copy of the node with id as we would have left it.
+func (d *dryRun) node(ctx context.Context, id string) (*Node, error) {
+	d.mu.Lock()
+	n, ok := d.nodes[id]
+	d.mu.Unlock()
+	if ok {
+		cp := *n
+		return &cp, nil
+	}
+	n, err := d.DriveLike.FetchNode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	cp := *n
+	return &cp, nil
+}
+
+// remember records n as the way we would have left it, and returns a
+// copy for the caller.
+func (d *dryRun) remember(n *Node) *Node {
+	d.mu.Lock()
+	d.nodes[n.ID] = n
+	d.pending[n.ID] = true
+	d.mu.Unlock()
+	cp := *n
+	return &cp
+}
+
+// replaceParent returns parents with oldParentID swapped for
+// newParentID.
+func replaceParent(parents []string, oldParentID string, newParentID string) []string {
+	result := []string{newParentID}
+	for _, p := range parents {
+		if p != oldParentID && p != newParentID {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func hasParent(n *Node, id string) bool {
+	for _, p := range n.ParentIDs {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dryRun) FetchNode(ctx context.Context, id string) (*Node, error) {
+	return d.node(ctx, id)
+}
+
+func (d *dryRun) FetchChildren(ctx context.Context, id string) ([]*Node, error) {
+	var real []*Node
+	if !isCreated(id) {
+		var err error
+		if real, err = d.DriveLike.FetchChildren(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var children []*Node
+	seen := map[string]bool{}
+	for _, c := range real {
+		seen[c.ID] = true
+		if n, ok := d.nodes[c.ID]; ok {
+			c = n
+		}
+		if !c.Trashed && hasParent(c, id) {
+			cp := *c
+			children = append(children, &cp)
+		}
+	}
+	for _, n := range d.nodes {
+		if !seen[n.ID] && !n.Trashed && hasParent(n, id) {
+			cp := *n
+			children = append(children, &cp)
+		}
+	}
+	return children, nil
+}
+
+func (d *dryRun) FetchTrash(ctx context.Context) ([]*Node, error) {
+	real, err := d.DriveLike.FetchTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var trashed []*Node
+	seen := map[string]bool{}
+	for _, c := range real {
+		seen[c.ID] = true
+		if n, ok := d.nodes[c.ID]; ok {
+			c = n
+		}
+		if c.Trashed {
+			cp := *c
+			trashed = append(trashed, &cp)
+		}
+	}
+	for _, n := range d.nodes {
+		if !seen[n.ID] && n.Trashed {
+			cp := *n
+			trashed = append(trashed, &cp)
+		}
+	}
+	return trashed, nil
+}
+
+func (d *dryRun) SharedWithMe(ctx context.Context) ([]*Node, error) {
+	real, err := d.DriveLike.SharedWithMe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.overlay(real), nil
+}
+
+func (d *dryRun) Recent(ctx context.Context, count int) ([]*Node, error) {
+	real, err := d.DriveLike.Recent(ctx, count)
+	if err != nil {
+		return nil, err
+	}
+	return d.overlay(real), nil
+}
+
+// overlay returns real, which came from drive, as it would be had the
+// changes we pretended to make happened, leaving out what we trashed.
+func (d *dryRun) overlay(real []*Node) []*Node {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var nodes []*Node
+	for _, c := range real {
+		if n, ok := d.nodes[c.ID]; ok {
+			c = n
+		}
+		if !c.Trashed {
+			cp := *c
+			nodes = append(nodes, &cp)
+		}
+	}
+	return nodes
+}
+
+func (d *dryRun) Download(ctx context.Context, id string, f *os.File) error {
+	d.mu.Lock()
+	uploaded, ok := d.uploads[id]
+	d.mu.Unlock()
+	if ok {
+		src, err := os.Open(uploaded)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = copyContent(ctx, id, src, f)
+		return err
+	}
+	if isCreated(id) {
+		// nothing was ever uploaded
+		return nil
+	}
+	return d.DriveLike.Download(ctx, id, f)
+}
+
+// ProcessChanges hands on drive's changes, except that nodes we have
+// pretended to change stay the way we would have left them.  Like
+// drive, it also reports the changes we pretended to make.
+func (d *dryRun) ProcessChanges(changeHandler func(*Change, *ChangeStats)) (ChangeStats, error) {
+	stats, err := d.DriveLike.ProcessChanges(func(c *Change, cs *ChangeStats) {
+		d.mu.Lock()
+		n, ok := d.nodes[c.ID]
+		delete(d.pending, c.ID)
+		d.mu.Unlock()
+		if ok {
+			cp := *n
+			c = &Change{ID: c.ID, Node: &cp}
+		}
+		changeHandler(c, cs)
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	d.mu.Lock()
+	var changes []*Change
+	for id := range d.pending {
+		cp := *d.nodes[id]
+		changes = append(changes, &Change{ID: id, Node: &cp})
+	}
+	d.pending = map[string]bool{}
+	d.mu.Unlock()
+	for _, c := range changes {
+		changeHandler(c, &stats)
+	}
+	return stats, nil
+}
+
+func (d *dryRun) CreateNode(ctx context.Context, parentID string, name string, dir bool) (*Node, error) {
+	kind := "file"
+	mimeType := "application/octet-stream"
+	if dir {
+		kind = "folder"
+		mimeType = "application/vnd.google-apps.folder"
+	}
+	d.mu.Lock()
+	d.created++
+	id := fmt.Sprintf("%s%d", dryRunIDPrefix, d.created)
+	d.mu.Unlock()
+	logging.For(ctx).Infof("dry run: would create %s %q in %s", kind, name, parentID)
+
+	now := time.Now()
+	return d.remember(&Node{
+		ID:             id,
+		Name:           name,
+		Ctime:          now,
+		Mtime:          now,
+		ParentIDs:      []string{parentID},
+		OwnedByMe:      true,
+		CanEdit:        true,
+		CanRename:      true,
+		CanTrash:       true,
+		CanAddChildren: dir,
+		CanLock:        !dir,
+		MimeType:       mimeType}), nil
+}
+
+func (d *dryRun) Upload(ctx context.Context, id string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	n, err := d.node(ctx, id)
+	if err != nil {
+		return err
+	}
+	logging.For(ctx).Infof("dry run: would upload %d bytes to %q (%s)", fi.Size(), n.Name, id)
+
+	cp, err := ioutil.TempFile("", "mntgdrive-dryrun-")
+	if err != nil {
+		return err
+	}
+	defer cp.Close()
+	if _, err = f.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(cp, f)
+	}
+	if err != nil {
+		os.Remove(cp.Name())
+		return err
+	}
+	d.mu.Lock()
+	if old, ok := d.uploads[id]; ok {
+		os.Remove(old)
+	}
+	d.uploads[id] = cp.Name()
+	d.mu.Unlock()
+
+	n.Size = uint64(fi.Size())
+	n.Mtime = time.Now()
+	n.Version++
+	d.remember(n)
+	return nil
+}
+
+func (d *dryRun) Rename(ctx context.Context, id string, newName string, oldParentID string, newParentID string) (*Node, error) {
+	if (oldParentID == "") != (newParentID == "") {
+		return nil, fmt.Errorf("Either both oldParentId and newParentId must be blank or they both must be non-blank")
+	}
+	n, err := d.node(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if newName != "" {
+		logging.For(ctx).Infof("dry run: would rename %q (%s) to %q", n.Name, id, newName)
+		n.Name = newName
+	}
+	if oldParentID != "" {
+		logging.For(ctx).Infof("dry run: would move %q (%s) from %s to %s", n.Name, id, oldParentID, newParentID)
+		n.ParentIDs = replaceParent(n.ParentIDs, oldParentID, newParentID)
+	}
+	return d.remember(n), nil
+}
+
+func (d *dryRun) Trash(ctx context.Context, id string) error {
+	n, err := d.node(ctx, id)
+	if err != nil {
+		return err
+	}
+	logging.For(ctx).Infof("dry run: would trash %q (%s)", n.Name, id)
+	n.Trashed = true
+	n.TrashedTime = time.Now()
+	d.remember(n)
+	return nil
+}
+
+func (d *dryRun) Untrash(ctx context.Context, id string, newName string, oldParentIDs []string, newParentID string) (*Node, error) {
+	n, err := d.node(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if newName != "" {
+		n.Name = newName
+	}
+	logging.For(ctx).Infof("dry run: would restore %q (%s) to %s", n.Name, id, newParentID)
+	n.Trashed = false
+	n.TrashedTime = time.Time{}
+	n.ParentIDs = []string{newParentID}
+	return d.remember(n), nil
+}
+
+func (d *dryRun) Describe(ctx context.Context, id string, description string) error {
+	logging.For(ctx).Infof("dry run: would describe %s as %q", id, description)
+	return nil
+}
+
+func (d *dryRun) Edit(ctx context.Context, id string, e Edit) (*Node, error) {
+	n, err := d.node(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Name != "" {
+		logging.For(ctx).Infof("dry run: would rename %q (%s) to %q", n.Name, id, e.Name)
+		n.Name = e.Name
+	}
+	if e.OldParentID != "" {
+		logging.For(ctx).Infof("dry run: would move %q (%s) from %s to %s", n.Name, id, e.OldParentID, e.NewParentID)
+		n.ParentIDs = replaceParent(n.ParentIDs, e.OldParentID, e.NewParentID)
+	}
+	if e.Starred != nil {
+		logging.For(ctx).Infof("dry run: would set starred to %t on %q (%s)", *e.Starred, n.Name, id)
+		n.Starred = *e.Starred
+	}
+	if e.Description != nil {
+		logging.For(ctx).Infof("dry run: would describe %q (%s) as %q", n.Name, id, *e.Description)
+		n.Description = *e.Description
+	}
+	if e.Locked != nil {
+		logging.For(ctx).Infof("dry run: would set locked to %t on %q (%s)", *e.Locked, n.Name, id)
+		n.Locked = *e.Locked
+	}
+	if len(e.AppProperties) > 0 {
+		logging.For(ctx).Infof("dry run: would change %d app properties of %q (%s)", len(e.AppProperties), n.Name, id)
+		n.AppProperties = withAppProperties(n.AppProperties, e.AppProperties)
+	}
+	return d.remember(n), nil
+}
+
+func (d *dryRun) Share(ctx context.Context, id string, kind string, email string, role string) error {
+	logging.For(ctx).Infof("dry run: would share %s with %s %s as %s", id, kind, email, role)
+	return nil
+}
+
+func (d *dryRun) Permissions(ctx context.Context, id string) ([]*Permission, error) {
+	if isCreated(id) {
+		return nil, nil
+	}
+	return d.DriveLike.Permissions(ctx, id)
+}
+
+func (d *dryRun) ChangePermission(ctx context.Context, id string, permissionID string, role string) error {
+	logging.For(ctx).Infof("dry run: would change permission %s of %s to %s", permissionID, id, role)
+	return nil
+}
+
+func (d *dryRun) Unshare(ctx context.Context, id string, permissionID string) error {
+	logging.For(ctx).Infof("dry run: would remove permission %s from %s", permissionID, id)
+	return nil
+}
+
+func (d *dryRun) FetchRevisions(ctx context.Context, id string) ([]*Revision, error) {
+	if isCreated(id) {
+		return nil, nil
+	}
+	return d.DriveLike.FetchRevisions(ctx, id)
+}
+
+func (d *dryRun) ForSharedDrive(driveID string) (DriveLike, error) {
+	dl, err := d.DriveLike.ForSharedDrive(driveID)
+	if err != nil {
+		return nil, err
+	}
+	return NewDryRun(dl), nil
+}
+
+func (d *dryRun) ForAppData() (DriveLike, error) {
+	dl, err := d.DriveLike.ForAppData()
+	if err != nil {
+		return nil, err
+	}
+	return NewDryRun(dl), nil
+}
+
+// withAppProperties returns a copy of props with the changes in edits
+// made.
+func withAppProperties(props map[string]string, edits map[string]*string) map[string]string {
+	changed := map[string]string{}
+	for k, v := range props {
+		changed[k] = v
+	}
+	for k, v := range edits {
+		if v == nil {
+			delete(changed, k)
+		} else {
+			changed[k] = *v
+		}
+	}
+	return changed
+}
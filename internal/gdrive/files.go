@@ -3,8 +3,11 @@ package gdrive
 import (
 	"fmt"
 	"io"
-	"log"
+	"net/http"
 	"os"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
 
 	"google.golang.org/api/drive/v3"
 
@@ -13,40 +16,49 @@ import (
 )
 
 // FetchNode looks up a Node by id and either returns it or an error.
-func (gd *Gdrive) FetchNode(id string) (n *Node, err error) {
+func (gd *Gdrive) FetchNode(ctx context.Context, id string) (n *Node, err error) {
 	f, err := gd.svc.Files.Get(id).
+		SupportsAllDrives(true).
 		Fields(fileFields).
+		Context(ctx).
 		Do()
 	if err != nil {
-		log.Print("Unable to fetch node info.", err)
+		logging.For(ctx).Errorf("Unable to fetch node info: %v", err)
 		return nil, fuse.ENODATA
 	}
 	n, err = newNode(f.Id, f)
 	if err != nil {
 		return nil, err
 	}
-	if !n.IncludeNode() {
+	if !n.IncludeNode(gd.others) {
 		return nil, fuse.ENODATA
 	}
 	return n, nil
 }
 
-// CreateNode creates a child file or directory
-func (gd *Gdrive) CreateNode(parentID string, name string, dir bool) (n *Node, err error) {
+// CreateNode creates a child file or directory.  If we convert
+// uploads, office files are created as google docs files (or similar),
+// and drive converts what we upload to them.
+func (gd *Gdrive) CreateNode(ctx context.Context, parentID string, name string, dir bool) (n *Node, err error) {
 	var mimeType string
 	if dir {
 		mimeType = "application/vnd.google-apps.folder"
+	} else if converted, ok := ConvertedMimeType(name); ok && gd.convertUploads {
+		mimeType = converted
 	}
 	f, err := gd.svc.Files.Create(&drive.File{
 		Name:     name,
 		Parents:  []string{parentID},
 		MimeType: mimeType}).
+		SupportsAllDrives(true).
 		Fields(fileFields).
+		Context(ctx).
 		Do()
 	if err != nil {
-		log.Printf("Unable to create node %q: %v", name, err)
+		logging.For(ctx).Errorf("Unable to create node %q: %v", name, err)
 		return nil, fuse.EIO
 	}
+	gd.queries.invalidate(f.Id, parentID)
 	n, err = newNode(f.Id, f)
 	if err != nil {
 		return nil, err
@@ -56,33 +68,76 @@ func (gd *Gdrive) CreateNode(parentID string, name string, dir bool) (n *Node, e
 
 // FetchChildren returns a slice of children, or an error.
 func (gd *Gdrive) FetchChildren(ctx context.Context, id string) (children []*Node, err error) {
+	// TODO(gina) we need to exclude items that are not in 'my drive', to match what
+	// we are doing in changes.  we could do it in the query below maybe, or filter it in
+	// the handler above, where we filter on name
+	return gd.listFiles(ctx, fmt.Sprintf("'%s' in parents and trashed = false", id), id, gd.includeNode)
+}
+
+// FetchTrash returns everything in the trash, including the contents
+// of trashed folders.
+func (gd *Gdrive) FetchTrash(ctx context.Context) ([]*Node, error) {
+	return gd.listFiles(ctx, "trashed = true", "", func(n *Node) bool {
+		return n.IncludeTrashed(gd.others)
+	})
+}
+
+func (gd *Gdrive) includeNode(n *Node) bool {
+	return n.IncludeNode(gd.others)
+}
+
+// Query returns the nodes matching the drive query q (e.g. "starred =
+// true and trashed = false").  Results are shared with FetchChildren's
+// cache, so views that repeat a query don't each cost a round trip.
+func (gd *Gdrive) Query(ctx context.Context, q string) ([]*Node, error) {
+	return gd.listFiles(ctx, q, "", gd.includeNode)
+}
+
+// listFiles returns the nodes matching the drive query q, from our
+// cache if we asked recently.  parentID should be set if q only lists
+// the children of that folder.  We leave out nodes that include
+// rejects.
+func (gd *Gdrive) listFiles(ctx context.Context, q string, parentID string, include func(*Node) bool) (nodes []*Node, err error) {
+	if nodes, ok := gd.queries.get(q); ok {
+		return nodes, nil
+	}
+
+	listed := 0
 	handler := func(r *drive.FileList) error {
+		listed += len(r.Files)
 		for _, f := range r.Files {
 			c, err := newNode(f.Id, f)
 			// if there was an error in newNode, we logged it and we
 			// will just skip it here
-			if err != nil || !c.IncludeNode() {
+			if err != nil || !include(c) {
 				continue
 			}
-			children = append(children, c)
+			nodes = append(nodes, c)
 		}
 		return nil
 	}
 
-	// TODO(gina) we need to exclude items that are not in 'my drive', to match what
-	// we are doing in changes.  we could do it in the query below maybe, or filter it in
-	// the handler above, where we filter on name
-
-	err = gd.svc.Files.List().
-		PageSize(pageSize).
+	call := gd.svc.Files.List().
+		PageSize(gd.children.pageSize(parentID)).
 		Fields(fileGroupFields).
-		Q(fmt.Sprintf("'%s' in parents and trashed = false", id)).
-		Pages(ctx, handler)
+		Q(q)
+	if gd.space != "" {
+		call.Spaces(gd.space)
+	}
+	if gd.driveID != "" {
+		call.Corpora("drive").
+			DriveId(gd.driveID).
+			IncludeItemsFromAllDrives(true).
+			SupportsAllDrives(true)
+	}
+	err = call.Pages(ctx, handler)
 	if err != nil {
-		log.Print("Unable to retrieve files.", err)
+		logging.Errorf("Unable to retrieve files: %v", err)
 		return nil, fuse.ENODATA
 	}
-	return children, nil
+	gd.children.record(parentID, listed)
+	gd.queries.put(q, parentID, nodes)
+	return nodes, nil
 }
 
 // Download downloads a files contents to an already open file, f.
@@ -90,45 +145,70 @@ func (gd *Gdrive) Download(ctx context.Context, id string, f *os.File) error {
 	done := ctx.Done()
 	select {
 	case <-done:
-		log.Printf("Download for %q aborted, returning before starting download.", id)
+		logging.For(ctx).Debugf("Download for %q aborted, returning before starting download.", id)
 		return ctx.Err()
 	default:
 	}
-	resp, err := gd.svc.Files.Get(id).Download()
-	if err != nil {
-		log.Printf("Unable to download %s: %v", id, err)
-		return err
-	}
-	defer resp.Body.Close()
+	return gd.download(ctx, id, f, true, func(offset int64) (*http.Response, error) {
+		call := gd.svc.Files.Get(id).SupportsAllDrives(true).Context(ctx)
+		if offset > 0 {
+			call.Header().Set("Range", rangeFrom(offset))
+		}
+		resp, err := call.Download()
+		if err != nil {
+			logging.For(ctx).Errorf("Unable to download %s: %v", id, err)
+		}
+		return resp, err
+	})
+}
 
-	totalDownloaded := 0
+// Export downloads the content of a google docs, sheets etc. file,
+// converted to mimeType, to an already open file, f.  Drive won't
+// export more than 10MB.  Exports can't be resumed, so a stalled one
+// starts over.
+func (gd *Gdrive) Export(ctx context.Context, id string, mimeType string, f *os.File) error {
+	return gd.download(ctx, id, f, false, func(int64) (*http.Response, error) {
+		resp, err := gd.svc.Files.Export(id, mimeType).Context(ctx).Download()
+		if err != nil {
+			logging.For(ctx).Errorf("Unable to export %s as %s: %v", id, mimeType, err)
+		}
+		return resp, err
+	})
+}
+
+// copyContent copies the content of the file with id from body into f,
+// stopping early if ctx is done.  It returns how many bytes it copied.
+func copyContent(ctx context.Context, id string, body io.Reader, f *os.File) (int64, error) {
+	log := logging.For(ctx)
+	done := ctx.Done()
+	var totalDownloaded int64
 	b := make([]byte, 1024*8)
 	for {
 		select {
 		case <-done:
-			log.Printf("Download for %q aborted, returning early after downloading %d bytes.", id, totalDownloaded)
-			return ctx.Err()
+			log.Debugf("Download for %q aborted, returning early after downloading %d bytes.", id, totalDownloaded)
+			return totalDownloaded, ctx.Err()
 		default:
 		}
 
-		len, err := resp.Body.Read(b)
-		totalDownloaded += len
-		log.Printf("Downloading %q fetched %d bytes", id, len)
+		len, err := body.Read(b)
+		totalDownloaded += int64(len)
+		log.Debugf("Downloading %q fetched %d bytes", id, len)
 		if len > 0 {
 			if _, err = f.Write(b[0:len]); err != nil {
-				log.Printf("Error writing to temp file during download of %q: %v", id, err)
-				return fuse.EIO
+				log.Errorf("Error writing to temp file during download of %q: %v", id, err)
+				return totalDownloaded, fuse.EIO
 			}
 		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Printf("Error fetching bytes for %s: %v", id, err)
-			return err
+			log.Errorf("Error fetching bytes for %s: %v", id, err)
+			return totalDownloaded, err
 		}
 		// else loop around again
 	}
-	return nil
+	return totalDownloaded, nil
 }
 
 // Upload copies the contents from an os file into a gdrive file
@@ -140,9 +220,11 @@ func (gd *Gdrive) Upload(ctx context.Context, id string, f *os.File) error {
 		return err
 	}
 	_, err := gd.svc.Files.Update(id, &drive.File{}).
+		SupportsAllDrives(true).
 		Context(ctx).
 		Media(f).
 		Do()
+	gd.queries.invalidate(id)
 	return err
 }
 
@@ -159,6 +241,7 @@ func (gd *Gdrive) Rename(ctx context.Context, id string, newName string, oldPare
 		file.Name = newName
 	}
 	updateCall := gd.svc.Files.Update(id, file).
+		SupportsAllDrives(true).
 		Context(ctx)
 	if oldParentID != "" {
 		updateCall.RemoveParents(oldParentID)
@@ -166,25 +249,149 @@ func (gd *Gdrive) Rename(ctx context.Context, id string, newName string, oldPare
 	}
 	updateCall.Fields(fileFields)
 	file, err = updateCall.Do()
+	gd.queries.invalidate(id, oldParentID, newParentID)
 	if err != nil {
-		log.Printf("Rename Do failed: %v", err)
+		logging.For(ctx).Errorf("Rename Do failed: %v", err)
 		return nil, err
 	}
 	n, err = newNode(file.Id, file)
 	if err != nil {
-		log.Printf("Rename newNode failed: %v", err)
+		logging.For(ctx).Errorf("Rename newNode failed: %v", err)
 		return nil, err
 	}
 	return n, nil
 }
 
+// Untrash takes a node out of the trash, naming it newName and moving
+// it from oldParentIDs to newParentID.
+func (gd *Gdrive) Untrash(ctx context.Context, id string, newName string, oldParentIDs []string, newParentID string) (n *Node, err error) {
+	// false is the zero value, so we have to insist on sending it
+	file := &drive.File{Name: newName, Trashed: false, ForceSendFields: []string{"Trashed"}}
+	updateCall := gd.svc.Files.Update(id, file).
+		SupportsAllDrives(true).
+		Context(ctx)
+	var remove []string
+	var found bool
+	for _, p := range oldParentIDs {
+		if p == newParentID {
+			found = true
+		} else {
+			remove = append(remove, p)
+		}
+	}
+	if len(remove) != 0 {
+		updateCall.RemoveParents(strings.Join(remove, ","))
+	}
+	if !found {
+		updateCall.AddParents(newParentID)
+	}
+	updateCall.Fields(fileFields)
+	file, err = updateCall.Do()
+	gd.queries.invalidate(id, append(oldParentIDs, newParentID)...)
+	if err != nil {
+		logging.For(ctx).Errorf("Untrash Do failed: %v", err)
+		return nil, err
+	}
+	return newNode(file.Id, file)
+}
+
+// Describe sets the description of a node.
+func (gd *Gdrive) Describe(ctx context.Context, id string, description string) error {
+	_, err := gd.svc.Files.Update(id, &drive.File{Description: description}).
+		SupportsAllDrives(true).
+		Context(ctx).
+		Do()
+	if err != nil {
+		logging.Errorf("Unable to describe %s: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// Edit is a change to the metadata of a node.  Fields left at their
+// zero values are left alone.
+type Edit struct {
+	Name string
+	// both empty unless the node is moving to a different folder
+	OldParentID string
+	NewParentID string
+	Starred     *bool
+	Description *string
+	// Locked, if set, locks or unlocks the node's content, giving
+	// LockReason as the reason for locking it
+	Locked     *bool
+	LockReason string
+	// AppProperties to set, with nil values for those to delete.
+	// Others are left alone.
+	AppProperties map[string]*string
+}
+
+// Empty returns true if e doesn't change anything.
+func (e Edit) Empty() bool {
+	return e.Name == "" && e.OldParentID == "" && e.NewParentID == "" &&
+		e.Starred == nil && e.Description == nil && e.Locked == nil && len(e.AppProperties) == 0
+}
+
+// Edit makes every change in e to a node with a single call.
+func (gd *Gdrive) Edit(ctx context.Context, id string, e Edit) (*Node, error) {
+	if (e.OldParentID == "") != (e.NewParentID == "") {
+		return nil, fmt.Errorf("Either both OldParentID and NewParentID must be blank or they both must be non-blank")
+	}
+	file := &drive.File{Name: e.Name}
+	// false and "" are zero values, so we have to insist on sending
+	// them
+	if e.Starred != nil {
+		file.Starred = *e.Starred
+		file.ForceSendFields = append(file.ForceSendFields, "Starred")
+	}
+	if e.Description != nil {
+		file.Description = *e.Description
+		file.ForceSendFields = append(file.ForceSendFields, "Description")
+	}
+	if e.Locked != nil {
+		r := &drive.ContentRestriction{ReadOnly: *e.Locked, ForceSendFields: []string{"ReadOnly"}}
+		if *e.Locked {
+			r.Reason = e.LockReason
+		}
+		file.ContentRestrictions = []*drive.ContentRestriction{r}
+	}
+	if len(e.AppProperties) > 0 {
+		file.AppProperties = map[string]string{}
+		for k, v := range e.AppProperties {
+			if v == nil {
+				file.NullFields = append(file.NullFields, "AppProperties."+k)
+			} else {
+				file.AppProperties[k] = *v
+			}
+		}
+		file.ForceSendFields = append(file.ForceSendFields, "AppProperties")
+	}
+	updateCall := gd.svc.Files.Update(id, file).
+		SupportsAllDrives(true).
+		Context(ctx)
+	if e.OldParentID != "" {
+		updateCall.RemoveParents(e.OldParentID)
+		updateCall.AddParents(e.NewParentID)
+	}
+	updateCall.Fields(fileFields)
+	file, err := updateCall.Do()
+	gd.queries.invalidate(id, e.OldParentID, e.NewParentID)
+	if err != nil {
+		logging.For(ctx).Errorf("Edit of %s failed: %v", id, err)
+		return nil, err
+	}
+	return newNode(file.Id, file)
+}
+
 // Trash marks an item as being trashed.
 func (gd *Gdrive) Trash(ctx context.Context, id string) error {
 	_, err := gd.svc.Files.Update(id, &drive.File{Trashed: true}).
+		SupportsAllDrives(true).
 		Context(ctx).
 		Do()
+	gd.queries.invalidate(id)
 	if err != nil {
-		log.Printf("Trash failed: %v", err)
+		logging.Errorf("Trash failed: %v", err)
 		return err
 	}
 	return nil
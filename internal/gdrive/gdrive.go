@@ -4,75 +4,495 @@ import (
 	"fmt"
 	"google.golang.org/api/option"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"os/user"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
 	"google.golang.org/api/drive/v3"
 
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
 // DriveLike is something that can perform google-drive like actions.
 type DriveLike interface {
-	FetchNode(id string) (n *Node, err error)
-	CreateNode(parentID string, name string, dir bool) (n *Node, err error)
+	FetchNode(ctx context.Context, id string) (n *Node, err error)
+	CreateNode(ctx context.Context, parentID string, name string, dir bool) (n *Node, err error)
 	FetchChildren(ctx context.Context, id string) (children []*Node, err error)
+	FetchTrash(ctx context.Context) ([]*Node, error)
 	Download(ctx context.Context, id string, f *os.File) error
+	Export(ctx context.Context, id string, mimeType string, f *os.File) error
 	Upload(ctx context.Context, id string, f *os.File) error
 	ProcessChanges(changeHandler func(*Change, *ChangeStats)) (ChangeStats, error)
 	Rename(ctx context.Context, id string, newName string, oldParentID string, newParentID string) (*Node, error)
 	Trash(ctx context.Context, id string) error
+	Untrash(ctx context.Context, id string, newName string, oldParentIDs []string, newParentID string) (*Node, error)
+	Describe(ctx context.Context, id string, description string) error
+	Edit(ctx context.Context, id string, e Edit) (*Node, error)
+	Share(ctx context.Context, id string, kind string, email string, role string) error
+	Permissions(ctx context.Context, id string) ([]*Permission, error)
+	ChangePermission(ctx context.Context, id string, permissionID string, role string) error
+	Unshare(ctx context.Context, id string, permissionID string) error
+	FetchRevisions(ctx context.Context, id string) ([]*Revision, error)
+	DownloadRevision(ctx context.Context, id string, revID string, f *os.File) error
+	SharedDrives(ctx context.Context) ([]*SharedDrive, error)
+	Computers(ctx context.Context) ([]*Node, error)
+	SharedWithMe(ctx context.Context) ([]*Node, error)
+	Recent(ctx context.Context, count int) ([]*Node, error)
+	ForSharedDrive(driveID string) (DriveLike, error)
+	ForAppData() (DriveLike, error)
 }
 
 // Gdrive corresponds to a google drive connection
 type Gdrive struct {
 	svc *drive.Service
+	// if set, we are working with this shared drive instead of My Drive
+	driveID string
+	// if set, we are working with this space (appDataFolder) instead of
+	// the drive
+	space string
+
+	queries  *queryCache
+	children *childCounts
+
+	others OthersMode
+	// if set, office files we create become google docs files (and
+	// similar)
+	convertUploads bool
+	// how long a download may go without any bytes arriving before we
+	// try again; zero means forever
+	stallTimeout time.Duration
 
 	pageMu    sync.Mutex
 	pageToken string
 }
 
+// Options controls how we connect to google drive.
+type Options struct {
+	Readonly bool
+	// Scope says how much of the drive we ask to be allowed to touch.
+	Scope ScopeMode
+	// Profile names the google account we act as.  Each profile has
+	// its own saved authorization; empty means the default one.
+	Profile string
+
+	// ProxyURL, if set, is the http or https proxy used for all drive
+	// traffic, regardless of what the environment says.
+	ProxyURL string
+	// CABundle, if set, is a file of PEM encoded certificates to trust
+	// instead of the system roots, e.g. for a proxy that intercepts
+	// TLS.
+	CABundle string
+
+	// IdleConnTimeout, if set, is how long we keep an idle connection
+	// to google around for reuse.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost, if set, is how many idle connections to each
+	// google host we keep around for reuse.
+	MaxIdleConnsPerHost int
+	// DisableKeepAlives makes us use a new connection for every request.
+	DisableKeepAlives bool
+
+	// SharedDriveID, if set, is the id of a shared drive (formerly
+	// team drive) to work with instead of My Drive.
+	SharedDriveID string
+
+	// Others says what we do with files owned by other people.
+	Others OthersMode
+
+	// AppData asks for access to the hidden app data folder, where
+	// apps keep their own state, as well as to the drive.
+	AppData bool
+
+	// ListCacheTTL is how long we reuse the results of listing a
+	// folder (or any other query).  Zero turns that off.
+	ListCacheTTL time.Duration
+
+	// ConvertUploads makes office files (.docx, .xlsx and .pptx) that
+	// we create into google docs, sheets and slides, like the web
+	// UI's "Convert uploads" setting.
+	ConvertUploads bool
+
+	// StallTimeout is how long a download may go without any bytes
+	// arriving before we give up on it and try again.  Zero means we
+	// wait forever.
+	StallTimeout time.Duration
+
+	// TokenRefreshEarly is how long before an access token expires we
+	// get a new one, so long transfers don't have it expire part way
+	// through.
+	TokenRefreshEarly time.Duration
+
+	// RetryBudget is how long a request keeps trying again after
+	// transient errors (dropped connections, rate limits and errors on
+	// google's side) when its context doesn't say.  Zero means we
+	// never try again.  See WithRetryBudget.
+	RetryBudget time.Duration
+
+	// RequestsPerSecond limits how fast we send requests to google,
+	// across every connection in a Pool.  Zero means no limit.
+	RequestsPerSecond float64
+}
+
+// Connection is an authorized http client for talking to google
+// drive.  Several services can share one, along with its pool of
+// connections.
+type Connection struct {
+	ctx    context.Context
+	client *http.Client
+	tokens oauth2.TokenSource
+}
+
+// Connect returns a Connection set up according to the transport,
+// account and scope parts of opts, in a Pool of its own.
+func Connect(opts Options) (*Connection, error) {
+	pool, err := NewPool(opts)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Connect(opts)
+}
+
+// Pool is what connections for several accounts share: the connections
+// to google themselves, and the limit on how fast we send requests.
+// Connections that go through different proxies, or trust different
+// certificates, can't share the former, so each proxy and ca bundle
+// gets its own transport.
+type Pool struct {
+	// how we set up each transport, apart from the proxy and ca bundle
+	opts    Options
+	limiter *limiter
+
+	mu sync.Mutex
+	// contexts that make oauth2 use each transport, by proxy and ca
+	// bundle
+	transports map[transportKey]context.Context
+}
+
+type transportKey struct {
+	proxyURL string
+	caBundle string
+}
+
+// NewPool returns a Pool set up according to the transport and rate
+// limiting parts of opts.
+func NewPool(opts Options) (*Pool, error) {
+	p := &Pool{opts: opts, limiter: newLimiter(opts.RequestsPerSecond), transports: map[transportKey]context.Context{}}
+	// so bad settings show up now, rather than when we first connect
+	if _, err := p.transport(opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// transport returns a context that makes oauth2 use the transport for
+// the proxy and ca bundle opts asks for, setting it up if no connection
+// in p has used them yet.
+func (p *Pool) transport(opts Options) (context.Context, error) {
+	key := transportKey{opts.ProxyURL, opts.CABundle}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ctx, ok := p.transports[key]; ok {
+		return ctx, nil
+	}
+	topts := p.opts
+	topts.ProxyURL, topts.CABundle = opts.ProxyURL, opts.CABundle
+	ctx, err := withTransport(context.Background(), topts)
+	if err != nil {
+		return nil, err
+	}
+	p.transports[key] = ctx
+	return ctx, nil
+}
+
+// Connect returns a Connection in p, set up according to the account,
+// scope, proxy and ca bundle parts of opts.
+func (p *Pool) Connect(opts Options) (*Connection, error) {
+	if err := CheckProfile(opts.Profile); err != nil {
+		return nil, err
+	}
+	ctx, err := p.transport(opts)
+	if err != nil {
+		return nil, err
+	}
+	config, err := clientConfig(scopesFor(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	client, tokens := getClient(ctx, config, opts.Profile, opts.TokenRefreshEarly)
+	var base http.RoundTripper = &countingTransport{base: client.Transport}
+	if p.limiter != nil {
+		base = &limitTransport{p.limiter, base}
+	}
+	client.Transport = &retryTransport{budget: opts.RetryBudget, base: base}
+	return &Connection{ctx, client, tokens}, nil
+}
+
 // GetService returns a drive service, or an error.
-func GetService(readonly bool) (DriveLike, error) {
-	ctx := context.Background()
+func GetService(opts Options) (DriveLike, error) {
+	conn, err := Connect(opts)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Service(opts)
+}
 
-	usr, err := user.Current()
+// Service returns a drive service that uses conn.  Only the parts of
+// opts that don't concern the connection (e.g. SharedDriveID) matter.
+func (conn *Connection) Service(opts Options) (DriveLike, error) {
+	svc, err := drive.NewService(conn.ctx, option.WithHTTPClient(conn.client))
+	if err != nil {
+		return nil, err
+	}
+	token, err := getStartPageToken(svc, opts.SharedDriveID)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to determine home directory: %v", err)
+		return nil, err
 	}
 
-	secretFile := path.Join(usr.HomeDir, ".config", "mnt-gdrive", "client_secret.json")
-	b, err := ioutil.ReadFile(secretFile)
+	return &Gdrive{
+		svc:            svc,
+		driveID:        opts.SharedDriveID,
+		queries:        newQueryCache(opts.ListCacheTTL),
+		children:       newChildCounts(),
+		others:         opts.Others,
+		convertUploads: opts.ConvertUploads,
+		stallTimeout:   opts.StallTimeout,
+		pageToken:      token}, nil
+}
+
+// CanWrite returns false if conn's token only lets us read, e.g.
+// because it was authorized for read-only mounts.
+func (conn *Connection) CanWrite(ctx context.Context) (bool, error) {
+	scopes, err := conn.Scopes(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read client secret file: %v", err)
+		return false, err
+	}
+	return hasScope(scopes, drive.DriveScope, drive.DriveFileScope), nil
+}
+
+// Scopes returns what google says the account conn uses let us do,
+// which may be less than we asked for.
+func (conn *Connection) Scopes(ctx context.Context) ([]string, error) {
+	tok, err := conn.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	return tokenScopes(ctx, conn.client, tok)
+}
+
+// UserEmail returns the email address of the account conn uses.
+func (conn *Connection) UserEmail(ctx context.Context) (string, error) {
+	svc, err := drive.NewService(conn.ctx, option.WithHTTPClient(conn.client))
+	if err != nil {
+		return "", err
+	}
+	about, err := svc.About.Get().Fields("user/emailAddress").Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return about.User.EmailAddress, nil
+}
+
+// Quota is how much storage an account has and what is using it.
+// Drive, Gmail and Photos all share the same storage.
+type Quota struct {
+	// Limit is zero when the account has unlimited storage
+	Limit int64
+	// Usage is everything, across all services
+	Usage int64
+	// UsageInDrive includes UsageInTrash
+	UsageInDrive int64
+	UsageInTrash int64
+}
+
+// Quota returns how much storage the account conn uses has, and how
+// much of it is used.
+func (conn *Connection) Quota(ctx context.Context) (Quota, error) {
+	svc, err := drive.NewService(conn.ctx, option.WithHTTPClient(conn.client))
+	if err != nil {
+		return Quota{}, err
+	}
+	about, err := svc.About.Get().Fields("storageQuota").Context(ctx).Do()
+	if err != nil {
+		return Quota{}, err
 	}
+	sq := about.StorageQuota
+	if sq == nil {
+		return Quota{}, fmt.Errorf("Drive didn't tell us the storage quota")
+	}
+	return Quota{
+		Limit:        sq.Limit,
+		Usage:        sq.Usage,
+		UsageInDrive: sq.UsageInDrive,
+		UsageInTrash: sq.UsageInDriveTrash}, nil
+}
+
+// Scope modes
+const (
+	// FullScope lets us see everything in the drive, and change it
+	// when writeable
+	FullScope ScopeMode = iota
+	// FileScope only lets us see and change files that we created
+	// ourselves.  Drive has no read-only version of it.
+	FileScope
+)
+
+// ScopeMode says how much of the drive we ask to be allowed to touch.
+type ScopeMode uint32
+
+// ParseScopeMode parses the command line form of a ScopeMode.
+func ParseScopeMode(s string) (ScopeMode, error) {
+	switch s {
+	case "full":
+		return FullScope, nil
+	case "file":
+		return FileScope, nil
+	default:
+		return FullScope, fmt.Errorf("unknown scope %q; expected full or file", s)
+	}
+}
 
+func (sm ScopeMode) String() string {
+	switch sm {
+	case FullScope:
+		return "full"
+	case FileScope:
+		return "file"
+	default:
+		return fmt.Sprintf("Unknown scope %d", sm)
+	}
+}
+
+// scopeFor returns the oauth scope we need.
+func scopeFor(opts Options) string {
 	// If modifying these scopes, delete your previously saved credentials
-	// at ~/.credentials/drive-go-quickstart.json
-	var scope string
-	if readonly {
-		scope = drive.DriveReadonlyScope
-	} else {
-		scope = drive.DriveScope
+	// at ~/.credentials/mnt-gdrive.json
+	if opts.Scope == FileScope {
+		return drive.DriveFileScope
+	}
+	if opts.Readonly {
+		return drive.DriveReadonlyScope
+	}
+	return drive.DriveScope
+}
+
+// scopesFor returns every oauth scope we need: the one for the drive
+// and any for the extras opts asks for.
+func scopesFor(opts Options) []string {
+	scopes := []string{scopeFor(opts)}
+	if opts.AppData {
+		scopes = append(scopes, drive.DriveAppdataScope)
+	}
+	return scopes
+}
+
+// secretFilePath returns the path to the client secret file.
+func secretFilePath() (string, error) {
+	dir, err := config.Dir()
+	if err != nil {
+		return "", err
 	}
+	return path.Join(dir, "client_secret.json"), nil
+}
 
-	config, err := google.ConfigFromJSON(b, scope)
+// SecretFile returns the path where we expect the client secret file.
+func SecretFile() (string, error) {
+	return secretFilePath()
+}
+
+// InstallClientSecret validates the client secret file at src and
+// copies it to where we expect to find it.
+func InstallClientSecret(src string) error {
+	b, err := ioutil.ReadFile(src)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse client secret file to config: %v", err)
+		return err
+	}
+	if _, err = google.ConfigFromJSON(b, drive.DriveReadonlyScope); err != nil {
+		return fmt.Errorf("%s doesn't look like a client secret file: %v", src, err)
 	}
-	client := getClient(ctx, config)
+	dst, err := secretFilePath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, b, 0600)
+}
 
-	svc, err := drive.NewService(ctx, option.WithHTTPClient(client))
+// Authorize sends the user through the oauth flow, even if we already
+// have a token, and saves the resulting token for later mounts.
+func Authorize(opts Options) error {
+	ctx, err := withTransport(context.Background(), opts)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err = CheckProfile(opts.Profile); err != nil {
+		return err
+	}
+	config, err := clientConfig(scopesFor(opts)...)
+	if err != nil {
+		return err
 	}
-	token, err := getStartPageToken(svc)
+	cacheFile, err := tokenCacheFile(opts.Profile)
+	if err != nil {
+		return err
+	}
+	tok, err := getTokenFromWeb(ctx, config)
+	if err != nil {
+		return err
+	}
+	return saveToken(cacheFile, tok)
+}
+
+// clientConfig reads the client secret file and builds an oauth config from it.
+func clientConfig(scopes ...string) (*oauth2.Config, error) {
+	secretFile, err := secretFilePath()
 	if err != nil {
 		return nil, err
 	}
+	b, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read client secret file: %v", err)
+	}
+
+	config, err := google.ConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse client secret file to config: %v", err)
+	}
+	return config, nil
+}
 
-	return &Gdrive{svc: svc, pageToken: token}, nil
+// FindFolder follows a slash-separated path of folder names, starting
+// at the folder with id startID, and returns the id of the folder at
+// the end of it.
+func FindFolder(ctx context.Context, dl DriveLike, startID string, folderPath string) (string, error) {
+	id := startID
+	for _, name := range strings.Split(folderPath, "/") {
+		if name == "" {
+			continue
+		}
+		children, err := dl.FetchChildren(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		next := ""
+		for _, c := range children {
+			if c.Name == name && c.Dir() {
+				next = c.ID
+				break
+			}
+		}
+		if next == "" {
+			return "", fmt.Errorf("no folder named %q", name)
+		}
+		id = next
+	}
+	return id, nil
 }
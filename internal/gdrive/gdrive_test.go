@@ -0,0 +1,46 @@
+package gdrive
+
+import (
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestScopeFor(t *testing.T) {
+	tests := []struct {
+		scope    string
+		readonly bool
+		want     string
+	}{
+		{"full", true, drive.DriveReadonlyScope},
+		{"full", false, drive.DriveScope},
+		{"file", true, drive.DriveFileScope},
+		{"file", false, drive.DriveFileScope},
+	}
+	for _, tc := range tests {
+		sm, err := ParseScopeMode(tc.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sm.String() != tc.scope {
+			t.Errorf("scope %q came back as %q", tc.scope, sm)
+		}
+		if got := scopeFor(Options{Readonly: tc.readonly, Scope: sm}); got != tc.want {
+			t.Errorf("scopeFor(%s, readonly=%t) = %q, want %q", tc.scope, tc.readonly, got, tc.want)
+		}
+	}
+	if _, err := ParseScopeMode("folder"); err == nil {
+		t.Error("expected an error for an unknown scope")
+	}
+}
+
+func TestScopesFor(t *testing.T) {
+	got := scopesFor(Options{Readonly: true})
+	if len(got) != 1 || got[0] != drive.DriveReadonlyScope {
+		t.Errorf("scopesFor(readonly) = %q", got)
+	}
+	got = scopesFor(Options{AppData: true})
+	if len(got) != 2 || got[0] != drive.DriveScope || got[1] != drive.DriveAppdataScope {
+		t.Errorf("scopesFor(app data) = %q", got)
+	}
+}
@@ -0,0 +1,80 @@
+package gdrive
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// limiter spaces out requests so we send no more than a given number
+// each second on average.  After a quiet spell it lets up to a second's
+// worth go at once.  Google's limits are per project as well as per
+// user, so every account we mount shares one.
+type limiter struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// when the next request may go
+	next time.Time
+}
+
+// newLimiter returns a limiter for perSecond requests a second, or nil
+// if perSecond is zero, which means no limit.
+func newLimiter(perSecond float64) *limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// reserve returns how long to wait before sending a request now.
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a second's worth, counting the one going now
+	burst := time.Second - l.interval
+	if burst < 0 {
+		burst = 0
+	}
+	if earliest := now.Add(-burst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	at := l.next
+	l.next = at.Add(l.interval)
+	if at.Before(now) {
+		return 0
+	}
+	return at.Sub(now)
+}
+
+// wait returns once we may send a request, or when ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	d := l.reserve(time.Now())
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitTransport waits for limiter before sending each request.
+type limitTransport struct {
+	limiter *limiter
+	base    http.RoundTripper
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context()); err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,41 @@
+package gdrive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2)
+	now := time.Now()
+	// after a quiet spell, a second's worth goes right away
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("request %d waits %v, expected none", i, d)
+		}
+	}
+	// and the rest are spaced out
+	if d := l.reserve(now); d != 500*time.Millisecond {
+		t.Errorf("third request waits %v, expected 500ms", d)
+	}
+	if d := l.reserve(now); d != time.Second {
+		t.Errorf("fourth request waits %v, expected 1s", d)
+	}
+
+	if newLimiter(0) != nil {
+		t.Error("expected no limiter when there's no limit")
+	}
+}
+
+func TestCheckProfile(t *testing.T) {
+	for _, p := range []string{"", "work", "home-2", "a_b"} {
+		if err := CheckProfile(p); err != nil {
+			t.Errorf("CheckProfile(%q): %v", p, err)
+		}
+	}
+	for _, p := range []string{"../x", "a b", "a/b", "a.json"} {
+		if CheckProfile(p) == nil {
+			t.Errorf("CheckProfile(%q) accepted it", p)
+		}
+	}
+}
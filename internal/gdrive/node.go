@@ -1,10 +1,13 @@
 package gdrive
 
 import (
-	"log"
+	"fmt"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
 	"google.golang.org/api/drive/v3"
 
 	"bazil.org/fuse"
@@ -12,7 +15,7 @@ import (
 
 const pageSize = 1000
 
-const fileFields = "id, name, ownedByMe, createdTime, modifiedTime, size, version, parents, fileExtension, mimeType, trashed"
+const fileFields = "id, name, ownedByMe, owners/emailAddress, capabilities/canEdit, capabilities/canRename, capabilities/canTrash, capabilities/canAddChildren, capabilities/canModifyContentRestriction, driveId, createdTime, modifiedTime, size, md5Checksum, starred, description, version, parents, fileExtension, mimeType, shortcutDetails/targetId, webViewLink, contentRestrictions(readOnly, reason), appProperties, trashed, trashedTime"
 const fileGroupFields = "nextPageToken, files(" + fileFields + ")"
 
 const changeFields = "changes/*, kind, newStartPageToken, nextPageToken"
@@ -30,11 +33,56 @@ type Node struct {
 	Version   int64
 	ParentIDs []string
 	OwnedByMe bool
-	Trashed   bool
+	// OwnerEmail is the email address of whoever owns the node, or
+	// empty if drive didn't say (e.g. for nodes in shared drives).
+	OwnerEmail string
+	// CanEdit is true if we are allowed to change the node
+	CanEdit bool
+	// CanRename is true if we are allowed to rename the node
+	CanRename bool
+	// CanTrash is true if we are allowed to move the node to the trash
+	CanTrash bool
+	// CanAddChildren is true if we are allowed to create things in the
+	// node, or move things into it.  Only folders have it.
+	CanAddChildren bool
+	Trashed        bool
+	// TrashedTime is when the node was put in the trash.  Drive only
+	// tells us this for nodes in shared drives.
+	TrashedTime time.Time
+	// DriveID is the id of the shared drive the node lives in, or
+	// empty if it isn't in a shared drive.
+	DriveID string
 
 	// We use these to determine if it is a folder
 	FileExtension string
 	MimeType      string
+
+	// ShortcutTargetID is the id of what the node points at, if it is
+	// a shortcut.
+	ShortcutTargetID string
+
+	// WebViewLink opens the node in a browser.
+	WebViewLink string
+
+	// MD5 is the hex md5 of the content.  Drive only keeps it for
+	// files that aren't google docs (or similar).
+	MD5 string
+
+	// Starred is true if we have starred the node.
+	Starred bool
+	// Description is the node's description, as drive shows it.
+	Description string
+
+	// Locked is true if nobody may change the node's content (drive
+	// calls it a content restriction), and LockReason says why.
+	Locked     bool
+	LockReason string
+	// CanLock is true if we are allowed to lock or unlock the node
+	CanLock bool
+
+	// AppProperties are key-value pairs that only we can see, stored
+	// with the node.
+	AppProperties map[string]string
 }
 
 // TODO(gina) we probably should not be returning fuse errors,
@@ -43,17 +91,54 @@ func newNode(id string, f *drive.File) (*Node, error) {
 	var ctime time.Time
 	ctime, err := time.Parse(time.RFC3339, f.CreatedTime)
 	if err != nil {
-		log.Printf("Error parsing ctime %#v of node %#v: %s\n", f.CreatedTime, id, err)
+		logging.Errorf("Error parsing ctime %#v of node %#v: %s\n", f.CreatedTime, id, err)
 		return nil, fuse.ENODATA
 	}
 
 	var mtime time.Time
 	mtime, err = time.Parse(time.RFC3339, f.ModifiedTime)
 	if err != nil {
-		log.Printf("Error parsing mtime %#v of node %#v: %s\n", f.ModifiedTime, id, err)
+		logging.Errorf("Error parsing mtime %#v of node %#v: %s\n", f.ModifiedTime, id, err)
 		return nil, fuse.ENODATA
 	}
 
+	var trashedTime time.Time
+	if f.TrashedTime != "" {
+		trashedTime, err = time.Parse(time.RFC3339, f.TrashedTime)
+		if err != nil {
+			logging.Errorf("Error parsing trashed time %#v of node %#v: %s\n", f.TrashedTime, id, err)
+			return nil, fuse.ENODATA
+		}
+	}
+
+	var canEdit, canRename, canTrash, canAddChildren bool
+	if f.Capabilities != nil {
+		canEdit = f.Capabilities.CanEdit
+		canRename = f.Capabilities.CanRename
+		canTrash = f.Capabilities.CanTrash
+		canAddChildren = f.Capabilities.CanAddChildren
+	}
+
+	var locked bool
+	var lockReason string
+	for _, r := range f.ContentRestrictions {
+		if r.ReadOnly {
+			locked = true
+			lockReason = r.Reason
+		}
+	}
+	canLock := f.Capabilities != nil && f.Capabilities.CanModifyContentRestriction
+
+	var ownerEmail string
+	if len(f.Owners) != 0 {
+		ownerEmail = f.Owners[0].EmailAddress
+	}
+
+	var target string
+	if f.ShortcutDetails != nil {
+		target = f.ShortcutDetails.TargetId
+	}
+
 	return &Node{id,
 		f.Name,
 		ctime,
@@ -62,9 +147,25 @@ func newNode(id string, f *drive.File) (*Node, error) {
 		f.Version,
 		f.Parents,
 		f.OwnedByMe,
+		ownerEmail,
+		canEdit,
+		canRename,
+		canTrash,
+		canAddChildren,
 		f.Trashed,
+		trashedTime,
+		f.DriveId,
 		f.FileExtension,
-		f.MimeType}, nil
+		f.MimeType,
+		target,
+		f.WebViewLink,
+		f.Md5Checksum,
+		f.Starred,
+		f.Description,
+		locked,
+		lockReason,
+		canLock,
+		f.AppProperties}, nil
 }
 
 // Dir returns true if this google file appears to be a directory.
@@ -76,8 +177,175 @@ func (n *Node) Dir() bool {
 	return false
 }
 
+// GoogleNative returns true if this google file is a google docs file
+// (or similar), which drive keeps in a format of its own, rather than
+// a file with content we can download.
+func (n *Node) GoogleNative() bool {
+	return strings.HasPrefix(n.MimeType, GoogleMimeType("")) && !n.Dir() && n.MimeType != ShortcutMimeType
+}
+
+// ShortcutMimeType is the mime type drive gives shortcuts.
+const ShortcutMimeType = "application/vnd.google-apps.shortcut"
+
+// Shortcut returns true if this google file is a shortcut to another
+// one.
+func (n *Node) Shortcut() bool {
+	return n.MimeType == ShortcutMimeType && n.ShortcutTargetID != ""
+}
+
+// ExportFormat says what we export a google docs file (or similar) as,
+// since they have no content of their own to download.
+type ExportFormat struct {
+	// MimeType is what we ask drive to export it as.
+	MimeType string
+	// Extension, if set, is added to the end of the file's name, e.g.
+	// ".docx".
+	Extension string
+}
+
+// GoogleMimeType returns the mime type drive gives google files of
+// kind, e.g. document or spreadsheet.
+func GoogleMimeType(kind string) string {
+	return "application/vnd.google-apps." + kind
+}
+
+// DefaultExportFormats returns what we export each kind of google docs
+// file (or similar) as, by its mime type, when we aren't told
+// otherwise.  Their names are left alone.
+func DefaultExportFormats() map[string]ExportFormat {
+	return map[string]ExportFormat{
+		GoogleMimeType("document"):     {MimeType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		GoogleMimeType("spreadsheet"):  {MimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		GoogleMimeType("presentation"): {MimeType: "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+		GoogleMimeType("drawing"):      {MimeType: "application/pdf"},
+	}
+}
+
+// convertible maps the extensions of office files to the google mime
+// types drive converts them to.
+var convertible = map[string]string{
+	".docx": GoogleMimeType("document"),
+	".xlsx": GoogleMimeType("spreadsheet"),
+	".pptx": GoogleMimeType("presentation"),
+}
+
+// ConvertedMimeType returns the google mime type a file called name
+// becomes when uploads are converted, if it is an office file.
+func ConvertedMimeType(name string) (string, bool) {
+	mimeType, ok := convertible[strings.ToLower(path.Ext(name))]
+	return mimeType, ok
+}
+
+// zipExportable are the google mime types that drive can export as a
+// zip archive.
+var zipExportable = map[string]bool{
+	"application/vnd.google-apps.document":    true,
+	"application/vnd.google-apps.spreadsheet": true,
+}
+
+// ZipExportable returns true if files with mimeType are google docs
+// files (or similar) that drive can export as a zip archive.  They have
+// no content of their own to download.
+func ZipExportable(mimeType string) bool {
+	return zipExportable[mimeType]
+}
+
+// Others modes
+const (
+	// HideOthers leaves out files owned by other people
+	HideOthers OthersMode = iota
+	// ReadonlyOthers shows files owned by other people, read-only
+	ReadonlyOthers
+	// EditableOthers shows files owned by other people, writeable if
+	// they let us edit them
+	EditableOthers
+)
+
+// OthersMode says what we do with files owned by other people that
+// show up in our folders.
+type OthersMode uint32
+
+// ParseOthersMode parses the command line form of an OthersMode.
+func ParseOthersMode(s string) (OthersMode, error) {
+	switch s {
+	case "hide":
+		return HideOthers, nil
+	case "readonly":
+		return ReadonlyOthers, nil
+	case "editable":
+		return EditableOthers, nil
+	default:
+		return HideOthers, fmt.Errorf("unknown mode %q for files owned by others; expected hide, readonly or editable", s)
+	}
+}
+
+func (om OthersMode) String() string {
+	switch om {
+	case HideOthers:
+		return "hide"
+	case ReadonlyOthers:
+		return "readonly"
+	case EditableOthers:
+		return "editable"
+	default:
+		return fmt.Sprintf("Unknown mode %d", om)
+	}
+}
+
+// Mine returns true if the node belongs to us.  Files in a shared
+// drive are owned by the drive rather than by anyone, so we treat
+// everything there as ours.
+func (n *Node) Mine() bool {
+	return n.OwnedByMe || n.DriveID != ""
+}
+
 // IncludeNode decides if we want to to include the node in our system
-func (n *Node) IncludeNode() bool {
-	// TODO(gina) make the OwnedByMe check configurable
-	return !n.Trashed && !strings.Contains(n.Name, "/") && n.OwnedByMe
+func (n *Node) IncludeNode(om OthersMode) bool {
+	return !n.Trashed && (n.Mine() || om != HideOthers)
+}
+
+// IncludeTrashed decides if we want to include the node when
+// presenting the trash.  It is the same as IncludeNode, except that
+// it only takes trashed nodes.
+func (n *Node) IncludeTrashed(om OthersMode) bool {
+	return n.Trashed && (n.Mine() || om != HideOthers)
+}
+
+// TrashedAt returns our best guess of when the node was put in the
+// trash.  When drive doesn't tell us, we go with the last time it was
+// modified.
+func (n *Node) TrashedAt() time.Time {
+	if !n.TrashedTime.IsZero() {
+		return n.TrashedTime
+	}
+	return n.Mtime
+}
+
+// Writeable returns true if we should let people change the node.
+func (n *Node) Writeable(om OthersMode) bool {
+	return n.CanEdit && !n.Locked && n.changeable(om)
+}
+
+// Renameable returns true if we should let people rename the node.
+// Drive doesn't let anyone rename locked nodes.
+func (n *Node) Renameable(om OthersMode) bool {
+	return n.CanRename && !n.Locked && n.changeable(om)
+}
+
+// Trashable returns true if we should let people move the node to the
+// trash.
+func (n *Node) Trashable(om OthersMode) bool {
+	return n.CanTrash && n.changeable(om)
+}
+
+// changeable returns true if om lets us change the node at all, drive
+// willing.
+func (n *Node) changeable(om OthersMode) bool {
+	return n.Mine() || om == EditableOthers
+}
+
+// Addable returns true if we should let people create things in the
+// node, or move things into it.
+func (n *Node) Addable(om OthersMode) bool {
+	return n.Dir() && n.CanAddChildren && n.Writeable(om)
 }
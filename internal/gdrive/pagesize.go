@@ -0,0 +1,53 @@
+package gdrive
+
+import "sync"
+
+// the fewest files we ask for in a page.  Drive doesn't answer any
+// faster for less.
+const minPageSize = 50
+
+// childCounts remembers how many children each folder had the last
+// time we listed it, so the next listing can ask for pages about the
+// right size: small ones for small folders, which drive answers more
+// quickly, and the biggest drive allows for big ones, so they take as
+// few round trips as possible.
+type childCounts struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func newChildCounts() *childCounts {
+	return &childCounts{m: map[string]int{}}
+}
+
+// pageSize returns the page size to list the children of parentID
+// with.  We use the biggest when we have never listed it, or aren't
+// listing the children of a folder at all.
+func (cc *childCounts) pageSize(parentID string) int64 {
+	cc.mu.Lock()
+	count, ok := cc.m[parentID]
+	cc.mu.Unlock()
+	if parentID == "" || !ok {
+		return pageSize
+	}
+	// leave room for the folder to have grown since
+	size := int64(count + count/4 + 1)
+	switch {
+	case size < minPageSize:
+		return minPageSize
+	case size > pageSize:
+		return pageSize
+	default:
+		return size
+	}
+}
+
+// record notes that parentID has count children.
+func (cc *childCounts) record(parentID string, count int) {
+	if parentID == "" {
+		return
+	}
+	cc.mu.Lock()
+	cc.m[parentID] = count
+	cc.mu.Unlock()
+}
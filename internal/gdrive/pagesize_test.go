@@ -0,0 +1,25 @@
+package gdrive
+
+import "testing"
+
+func TestPageSize(t *testing.T) {
+	cc := newChildCounts()
+	cc.record("tiny", 3)
+	cc.record("medium", 200)
+	cc.record("huge", 5000)
+	tests := []struct {
+		parentID string
+		want     int64
+	}{
+		{"", pageSize},
+		{"unknown", pageSize},
+		{"tiny", minPageSize},
+		{"medium", 251},
+		{"huge", pageSize},
+	}
+	for _, tc := range tests {
+		if got := cc.pageSize(tc.parentID); got != tc.want {
+			t.Errorf("pageSize(%q) = %d, want %d", tc.parentID, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package gdrive
+
+import (
+	"net/http"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"golang.org/x/net/context"
+)
+
+const permissionFields = "nextPageToken, permissions(id, type, emailAddress, domain, role)"
+
+// Permission says who may do what with a node.
+type Permission struct {
+	// ID is what drive calls the permission, for changing or
+	// removing it
+	ID string
+	// Type is "user", "group", "domain" or "anyone"
+	Type string
+	// Email is the email address of a user or group, the name of a
+	// domain, or empty for anyone
+	Email string
+	// Role is "owner", "organizer", "fileOrganizer", "writer",
+	// "commenter" or "reader"
+	Role string
+}
+
+// Share gives the user or group (kind) with email the role ("reader",
+// "commenter" or "writer") on a node, without emailing them about it.
+// For the "domain" kind email is the domain, and for "anyone" it is
+// empty.
+func (gd *Gdrive) Share(ctx context.Context, id string, kind string, email string, role string) error {
+	p := &drive.Permission{Type: kind, Role: role}
+	if kind == "domain" {
+		p.Domain = email
+	} else {
+		p.EmailAddress = email
+	}
+	call := gd.svc.Permissions.Create(id, p).
+		SupportsAllDrives(true).
+		Context(ctx)
+	// drive only emails users and groups, and complains if asked not
+	// to email anyone else
+	if kind == "user" || kind == "group" {
+		call.SendNotificationEmail(false)
+	}
+	if _, err := call.Do(); err != nil {
+		logging.Errorf("Unable to share %s with %s %s: %v", id, kind, email, err)
+		return err
+	}
+	return nil
+}
+
+// Permissions returns who may do what with a node.  It returns
+// fuse.EPERM if we may not see who the node is shared with, which is
+// the case unless we may share it ourselves.
+func (gd *Gdrive) Permissions(ctx context.Context, id string) ([]*Permission, error) {
+	var perms []*Permission
+	err := gd.svc.Permissions.List(id).
+		SupportsAllDrives(true).
+		Fields(permissionFields).
+		Pages(ctx, func(r *drive.PermissionList) error {
+			for _, p := range r.Permissions {
+				email := p.EmailAddress
+				if p.Type == "domain" {
+					email = p.Domain
+				}
+				perms = append(perms, &Permission{p.Id, p.Type, email, p.Role})
+			}
+			return nil
+		})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusForbidden {
+		logging.For(ctx).Debugf("Not allowed to list permissions of %s: %v", id, err)
+		return nil, fuse.EPERM
+	}
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list permissions of %s: %v", id, err)
+		return nil, err
+	}
+	return perms, nil
+}
+
+// ChangePermission gives whoever has the permission with permissionID
+// on a node the role instead.
+func (gd *Gdrive) ChangePermission(ctx context.Context, id string, permissionID string, role string) error {
+	_, err := gd.svc.Permissions.Update(id, permissionID, &drive.Permission{Role: role}).
+		SupportsAllDrives(true).
+		Context(ctx).
+		Do()
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to change permission %s of %s to %s: %v", permissionID, id, role, err)
+		return err
+	}
+	return nil
+}
+
+// Unshare removes the permission with permissionID from a node.
+func (gd *Gdrive) Unshare(ctx context.Context, id string, permissionID string) error {
+	err := gd.svc.Permissions.Delete(id, permissionID).
+		SupportsAllDrives(true).
+		Context(ctx).
+		Do()
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to remove permission %s from %s: %v", permissionID, id, err)
+		return err
+	}
+	return nil
+}
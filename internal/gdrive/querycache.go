@@ -0,0 +1,99 @@
+package gdrive
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultListCacheTTL is how long we reuse the results of a file
+// listing query when the caller doesn't say otherwise.
+const DefaultListCacheTTL = 30 * time.Second
+
+// queryCache remembers the results of file listing queries, so that
+// asking the same question again soon after doesn't cost another round
+// trip.  Entries expire after a ttl and are dropped early when a
+// change could affect them.
+type queryCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*queryEntry
+}
+
+type queryEntry struct {
+	fetched time.Time
+	// if set, the query only lists children of this parent
+	parentID string
+	ids      map[string]bool
+	nodes    []*Node
+}
+
+// newQueryCache returns a cache that keeps results for ttl.  A ttl of
+// zero turns caching off.
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{ttl: ttl, entries: map[string]*queryEntry{}}
+}
+
+// normalizeQuery makes queries that differ only in whitespace share a
+// cache entry.
+func normalizeQuery(q string) string {
+	return strings.Join(strings.Fields(q), " ")
+}
+
+// get returns the cached results for q, if we have fresh ones.
+func (qc *queryCache) get(q string) ([]*Node, bool) {
+	if qc.ttl <= 0 {
+		return nil, false
+	}
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	key := normalizeQuery(q)
+	e, ok := qc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(e.fetched) > qc.ttl {
+		delete(qc.entries, key)
+		return nil, false
+	}
+	return append([]*Node(nil), e.nodes...), true
+}
+
+// put remembers nodes as the results of q.  parentID should be set if
+// q only lists the children of one folder, which lets us keep the entry
+// when unrelated things change.
+func (qc *queryCache) put(q string, parentID string, nodes []*Node) {
+	if qc.ttl <= 0 {
+		return
+	}
+	ids := map[string]bool{}
+	for _, n := range nodes {
+		ids[n.ID] = true
+	}
+	qc.mu.Lock()
+	qc.entries[normalizeQuery(q)] = &queryEntry{
+		fetched:  time.Now(),
+		parentID: parentID,
+		ids:      ids,
+		nodes:    append([]*Node(nil), nodes...)}
+	qc.mu.Unlock()
+}
+
+// invalidate drops every entry that a change to the node with id, now
+// living under parentIDs, could affect.  That is any entry that lists
+// the node, any entry that lists one of its parents' children and any
+// entry that isn't limited to one folder.
+func (qc *queryCache) invalidate(id string, parentIDs ...string) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	for key, e := range qc.entries {
+		drop := e.parentID == "" || e.ids[id]
+		for _, p := range parentIDs {
+			drop = drop || e.parentID == p
+		}
+		if drop {
+			delete(qc.entries, key)
+		}
+	}
+}
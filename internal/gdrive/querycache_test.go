@@ -0,0 +1,67 @@
+package gdrive
+
+import (
+	"testing"
+	"time"
+)
+
+func nodes(ids ...string) []*Node {
+	var result []*Node
+	for _, id := range ids {
+		result = append(result, &Node{ID: id})
+	}
+	return result
+}
+
+func TestQueryCacheNormalizes(t *testing.T) {
+	qc := newQueryCache(time.Minute)
+	qc.put("'a' in parents  and trashed = false", "a", nodes("b"))
+	got, ok := qc.get(" 'a' in parents and\ttrashed = false")
+	if !ok || len(got) != 1 || got[0].ID != "b" {
+		t.Fatalf("get = %v, %t", got, ok)
+	}
+}
+
+func TestQueryCacheExpires(t *testing.T) {
+	qc := newQueryCache(time.Minute)
+	qc.put("q", "", nodes("b"))
+	qc.entries["q"].fetched = time.Now().Add(-2 * time.Minute)
+	if _, ok := qc.get("q"); ok {
+		t.Error("expected expired entry to be ignored")
+	}
+}
+
+func TestQueryCacheDisabled(t *testing.T) {
+	qc := newQueryCache(0)
+	qc.put("q", "", nodes("b"))
+	if _, ok := qc.get("q"); ok {
+		t.Error("expected nothing cached with a zero ttl")
+	}
+}
+
+func TestQueryCacheInvalidate(t *testing.T) {
+	qc := newQueryCache(time.Minute)
+	reset := func() {
+		qc.put("children of a", "a", nodes("a1", "a2"))
+		qc.put("children of b", "b", nodes("b1"))
+		qc.put("starred", "", nodes("b1"))
+	}
+	check := func(q string, want bool) {
+		if _, ok := qc.get(q); ok != want {
+			t.Errorf("%q cached = %t, want %t", q, ok, want)
+		}
+	}
+
+	// a change to a1 drops its folder and global queries
+	reset()
+	qc.invalidate("a1")
+	check("children of a", false)
+	check("children of b", true)
+	check("starred", false)
+
+	// a new child of b drops b's listing
+	reset()
+	qc.invalidate("new", "b")
+	check("children of a", true)
+	check("children of b", false)
+}
@@ -0,0 +1,192 @@
+package gdrive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultRetryBudget is how long a request keeps trying again after
+// transient errors, when neither its context nor the caller says
+// otherwise.  That suits background work, which would rather wait out
+// an outage than fail.
+const DefaultRetryBudget = 5 * time.Minute
+
+// DefaultInteractiveRetryBudget is how long a request made for a file
+// system operation keeps trying again, when the caller doesn't say
+// otherwise.  Someone is waiting on those, so we give up quickly.
+const DefaultInteractiveRetryBudget = 10 * time.Second
+
+const (
+	firstRetryBackoff = 250 * time.Millisecond
+	maxRetryBackoff   = 16 * time.Second
+	// how much of a rate limit error we read, looking for its reason
+	maxRetryPeek = 64 << 10
+)
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a context whose requests stop trying again
+// after transient errors once budget has passed.  A deadline on ctx
+// that comes sooner still wins.
+func WithRetryBudget(ctx context.Context, budget time.Duration) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, time.Now().Add(budget))
+}
+
+// retryDeadline returns when requests made with ctx should stop trying
+// again: the sooner of ctx's deadline and its retry budget, or the end
+// of budget from now if it has neither.
+func retryDeadline(ctx context.Context, budget time.Duration) time.Time {
+	until, ok := ctx.Value(retryBudgetKey{}).(time.Time)
+	if !ok {
+		until = time.Now().Add(budget)
+	}
+	if d, ok := ctx.Deadline(); ok && d.Before(until) {
+		until = d
+	}
+	return until
+}
+
+// retryTransport sends a request again, backing off a little more
+// each time, when it fails in a way that might not happen next time:
+// the connection dropped, google said to slow down, or google had a
+// problem of its own.  If google says how long to wait, we wait at
+// least that long.  A dropped connection only counts if sending the
+// request again can't do twice what it does, because it is idempotent
+// or we hadn't sent it yet.  We stop once the request's retry deadline
+// would pass before the next try, or if we can't send the request's
+// body again, and return the last answer we got.
+type retryTransport struct {
+	// budget applies to requests whose context says nothing
+	budget time.Duration
+	base   http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	until := retryDeadline(ctx, t.budget)
+	backoff := firstRetryBackoff
+	for try := 1; ; try++ {
+		attempt := req
+		if try > 1 {
+			attempt = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attempt.Body = body
+			}
+		}
+		var sent int32
+		attempt = attempt.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteHeaders: func() { atomic.StoreInt32(&sent, 1) },
+		}))
+		resp, err := t.base.RoundTrip(attempt)
+		if err != nil && !idempotent(req.Method) && atomic.LoadInt32(&sent) != 0 {
+			// google may have acted on it before the connection
+			// dropped
+			return resp, err
+		}
+		if !retryable(ctx, resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		// up to half as much again, so clients that failed together
+		// don't all come back together
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		if err == nil {
+			if after := retryAfter(resp); after > wait {
+				wait = after
+			}
+		}
+		if time.Now().Add(wait).After(until) {
+			return resp, err
+		}
+		status := "failed"
+		if err == nil {
+			status = resp.Status
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		atomic.AddUint64(&connStats.Retries, 1)
+		logging.For(ctx).Infof("%s %s %s (%v), trying again in %v", req.Method, req.URL.Path, status, err, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// retryable says whether a request that got resp or err might do
+// better next time.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		// giving up on a request is not something to retry
+		return ctx.Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusForbidden:
+		return rateLimited(resp)
+	}
+	return false
+}
+
+// idempotent says whether sending a request with method twice does
+// the same as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns how long resp asks us to wait before trying
+// again, or 0 if it doesn't say.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// rateLimited says whether resp, a 403, is google telling us to slow
+// down rather than that we aren't allowed.  It leaves resp's body as
+// it found it.
+func rateLimited(resp *http.Response) bool {
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRetryPeek))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(b, []byte(`"rateLimitExceeded"`)) || bytes.Contains(b, []byte(`"userRateLimitExceeded"`))
+}
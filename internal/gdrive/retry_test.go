@@ -0,0 +1,201 @@
+package gdrive
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// failingServer answers the first fails requests with status and body,
+// and the rest with "ok".  It counts the requests in tries.
+func failingServer(fails int32, status int, body string) (*httptest.Server, *int32) {
+	var tries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&tries, 1) <= fails {
+			http.Error(w, body, status)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok" + string(b)))
+	}))
+	return ts, &tries
+}
+
+func retryGet(t *testing.T, ctx context.Context, budget time.Duration, url string, body string) (int, string) {
+	client := &http.Client{Transport: &retryTransport{budget: budget, base: http.DefaultTransport}}
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestRetryTransient(t *testing.T) {
+	ts, tries := failingServer(2, http.StatusServiceUnavailable, "busy")
+	defer ts.Close()
+	before := Connections().Retries
+
+	status, got := retryGet(t, context.Background(), time.Minute, ts.URL, " again")
+	if status != http.StatusOK || got != "ok again" {
+		t.Fatalf("got %d %q, want 200 %q", status, got, "ok again")
+	}
+	if *tries != 3 {
+		t.Fatalf("got %d tries, want 3", *tries)
+	}
+	if retries := Connections().Retries - before; retries != 2 {
+		t.Fatalf("counted %d retries, want 2", retries)
+	}
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	ts, tries := failingServer(1, http.StatusForbidden, `{"error": {"errors": [{"reason": "userRateLimitExceeded"}]}}`)
+	defer ts.Close()
+
+	if status, _ := retryGet(t, context.Background(), time.Minute, ts.URL, ""); status != http.StatusOK {
+		t.Fatalf("got %d, want 200", status)
+	}
+	if *tries != 2 {
+		t.Fatalf("got %d tries, want 2", *tries)
+	}
+}
+
+func TestRetryNotForbidden(t *testing.T) {
+	body := `{"error": {"errors": [{"reason": "insufficientFilePermissions"}]}}`
+	ts, tries := failingServer(1, http.StatusForbidden, body)
+	defer ts.Close()
+
+	status, got := retryGet(t, context.Background(), time.Minute, ts.URL, "")
+	if status != http.StatusForbidden || strings.TrimSpace(got) != body {
+		t.Fatalf("got %d %q, want 403 %q", status, got, body)
+	}
+	if *tries != 1 {
+		t.Fatalf("got %d tries, want 1", *tries)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ctx    func() (context.Context, context.CancelFunc)
+		budget time.Duration
+	}{
+		{"no budget", func() (context.Context, context.CancelFunc) {
+			return context.Background(), func() {}
+		}, 0},
+		{"interactive", func() (context.Context, context.CancelFunc) {
+			return WithRetryBudget(context.Background(), 100*time.Millisecond), func() {}
+		}, time.Minute},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(WithRetryBudget(context.Background(), time.Minute), 100*time.Millisecond)
+		}, time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, tries := failingServer(100, http.StatusInternalServerError, "broken")
+			defer ts.Close()
+			ctx, cancel := tc.ctx()
+			defer cancel()
+
+			start := time.Now()
+			if status, _ := retryGet(t, ctx, tc.budget, ts.URL, ""); status != http.StatusInternalServerError {
+				t.Fatalf("got %d, want 500", status)
+			}
+			if *tries != 1 {
+				t.Fatalf("got %d tries, want 1", *tries)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Fatalf("took %v to give up", took)
+			}
+		})
+	}
+}
+
+// droppingTransport fails every request as though the connection
+// dropped, after sending the headers if sent is true.  It counts the
+// requests in tries.
+type droppingTransport struct {
+	sent  bool
+	tries int32
+}
+
+func (d *droppingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&d.tries, 1)
+	if trace := httptrace.ContextClientTrace(req.Context()); d.sent && trace != nil && trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+	return nil, errors.New("connection reset by peer")
+}
+
+func TestRetryDroppedConnection(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		sent   bool
+		retry  bool
+	}{
+		{"GET", true, true},
+		{"PUT", true, true},
+		{"POST", false, true},
+		{"POST", true, false},
+		{"PATCH", true, false},
+	} {
+		base := &droppingTransport{sent: tc.sent}
+		client := &http.Client{Transport: &retryTransport{budget: 600 * time.Millisecond, base: base}}
+		req, err := http.NewRequest(tc.method, "http://example.com/", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = client.Do(req); err == nil {
+			t.Fatalf("%s (sent %t) worked through a dropped connection", tc.method, tc.sent)
+		}
+		if retried := base.tries > 1; retried != tc.retry {
+			t.Errorf("%s (sent %t) tried %d times, want retried %t", tc.method, tc.sent, base.tries, tc.retry)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var tries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&tries, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	if status, _ := retryGet(t, context.Background(), time.Minute, ts.URL, ""); status != http.StatusOK {
+		t.Fatalf("got %d, want 200", status)
+	}
+	if took := time.Since(start); took < time.Second {
+		t.Fatalf("tried again after %v, sooner than google asked", took)
+	}
+
+	// a wait past the budget means giving up now
+	atomic.StoreInt32(&tries, 0)
+	start = time.Now()
+	if status, _ := retryGet(t, context.Background(), 500*time.Millisecond, ts.URL, ""); status != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", status)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("took %v to give up", took)
+	}
+}
@@ -0,0 +1,161 @@
+package gdrive
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"google.golang.org/api/drive/v3"
+
+	"golang.org/x/net/context"
+)
+
+const revisionFields = "nextPageToken, revisions(id, modifiedTime, size, md5Checksum)"
+
+// Revision describes one saved version of a file's content.
+type Revision struct {
+	ID           string
+	ModifiedTime time.Time
+	Size         uint64
+	// MD5 is the hex md5 of the content.  Drive only keeps it for
+	// files with content of their own, not e.g. google docs.
+	MD5 string
+}
+
+// FetchRevisions returns the revisions of the file with id, oldest
+// first.
+func (gd *Gdrive) FetchRevisions(ctx context.Context, id string) (revs []*Revision, err error) {
+	handler := func(r *drive.RevisionList) error {
+		for _, gr := range r.Revisions {
+			rev := &Revision{ID: gr.Id, Size: uint64(gr.Size), MD5: gr.Md5Checksum}
+			if rev.ModifiedTime, err = time.Parse(time.RFC3339Nano, gr.ModifiedTime); err != nil {
+				logging.Errorf("Unable to parse modified time %q of revision %s of %s: %v", gr.ModifiedTime, gr.Id, id, err)
+				return err
+			}
+			revs = append(revs, rev)
+		}
+		return nil
+	}
+	err = gd.svc.Revisions.List(id).
+		Fields(revisionFields).
+		Pages(ctx, handler)
+	if err != nil {
+		logging.Errorf("Unable to fetch revisions of %s: %v", id, err)
+		return nil, err
+	}
+	return revs, nil
+}
+
+// DownloadRevision copies the content of revision revID of the file
+// with id into f.
+func (gd *Gdrive) DownloadRevision(ctx context.Context, id string, revID string, f *os.File) error {
+	return gd.download(ctx, id, f, true, func(offset int64) (*http.Response, error) {
+		call := gd.svc.Revisions.Get(id, revID).Context(ctx)
+		if offset > 0 {
+			call.Header().Set("Range", rangeFrom(offset))
+		}
+		resp, err := call.Download()
+		if err != nil {
+			logging.Errorf("Unable to download revision %s of %s: %v", revID, id, err)
+		}
+		return resp, err
+	})
+}
+
+// MatchesRevision returns true if f holds exactly the content of rev.
+func MatchesRevision(f *os.File, rev *Revision) (bool, error) {
+	if rev.MD5 == "" {
+		return false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if uint64(fi.Size()) != rev.Size {
+		return false, nil
+	}
+	sum, err := FileMD5(f)
+	if err != nil {
+		return false, err
+	}
+	return sum == rev.MD5, nil
+}
+
+// FileMD5 returns the md5 checksum of all of f, as drive reports them.
+func FileMD5(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RestoreRevision makes revision revID of the file with id its current
+// content again, by downloading it and uploading it as a new revision.
+// Drive has no call that does that for us.
+func RestoreRevision(ctx context.Context, dl DriveLike, id string, revID string) error {
+	f, err := ioutil.TempFile("", "mntgdrive-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = dl.DownloadRevision(ctx, id, revID, f); err != nil {
+		return err
+	}
+	if err = dl.Upload(ctx, id, f); err != nil {
+		logging.Errorf("Unable to restore revision %s of %s: %v", revID, id, err)
+		return err
+	}
+	logging.Infof("Restored revision %s of %s", revID, id)
+	return nil
+}
+
+// layouts we accept for the time in a revision selector, most specific
+// first.  All but the first are taken to be in local time.
+var selectorLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// SelectRevision picks a revision from revs (which must be oldest
+// first) using selector, which is either a revision id or a time.  For
+// a time, we pick the revision that was current then, i.e. the last
+// one modified at or before it.
+func SelectRevision(revs []*Revision, selector string) (*Revision, error) {
+	for _, rev := range revs {
+		if rev.ID == selector {
+			return rev, nil
+		}
+	}
+	for _, layout := range selectorLayouts {
+		t, err := time.ParseInLocation(layout, selector, time.Local)
+		if err != nil {
+			continue
+		}
+		var found *Revision
+		for _, rev := range revs {
+			if rev.ModifiedTime.After(t) {
+				break
+			}
+			found = rev
+		}
+		if found == nil {
+			return nil, fmt.Errorf("no revision as old as %s", selector)
+		}
+		return found, nil
+	}
+	return nil, fmt.Errorf("%q is neither a revision id nor a time", selector)
+}
@@ -0,0 +1,42 @@
+package gdrive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectRevision(t *testing.T) {
+	at := func(day int) time.Time {
+		return time.Date(2016, 1, day, 12, 0, 0, 0, time.Local)
+	}
+	revs := []*Revision{
+		{ID: "a", ModifiedTime: at(1)},
+		{ID: "b", ModifiedTime: at(5)},
+		{ID: "c", ModifiedTime: at(10)},
+	}
+
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{"b", "b"},
+		{"2016-01-05T12:00", "b"},
+		{"2016-01-05T11:59", "a"},
+		{"2016-01-07", "b"},
+		{"2016-01-10T12:00:00", "c"},
+		{"2017-01-01", "c"},
+		{"2015-12-31", ""},
+		{"bogus", ""},
+	}
+	for _, tc := range tests {
+		rev, err := SelectRevision(revs, tc.selector)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%q: got %s, want an error", tc.selector, rev.ID)
+		case tc.want != "" && err != nil:
+			t.Errorf("%q: got %v, want %s", tc.selector, err, tc.want)
+		case tc.want != "" && rev.ID != tc.want:
+			t.Errorf("%q: got %s, want %s", tc.selector, rev.ID, tc.want)
+		}
+	}
+}
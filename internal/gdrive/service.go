@@ -9,56 +9,88 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
 
 // getClient uses a Context and Config to retrieve a Token
-// then generate a Client. It returns the generated Client.
-func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	cacheFile, err := tokenCacheFile()
+// then generate a Client. It returns the generated Client, along with
+// where it gets its tokens, which refreshes them early before they
+// expire.
+func getClient(ctx context.Context, config *oauth2.Config, profile string, early time.Duration) (*http.Client, oauth2.TokenSource) {
+	cacheFile, err := tokenCacheFile(profile)
 	if err != nil {
 		log.Fatalf("Unable to get path to cached credential file. %v", err)
 	}
 	tok, err := tokenFromFile(cacheFile)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(cacheFile, tok)
+		tok, err = getTokenFromWeb(ctx, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = saveToken(cacheFile, tok); err != nil {
+			log.Fatalf("Unable to cache oauth token: %v", err)
+		}
 	}
-	return config.Client(ctx, tok)
+	ts := newEarlyTokenSource(ctx, config, tok, early)
+	// with no token source, this is just the client the context says
+	// to build on
+	base := oauth2.NewClient(ctx, nil).Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &http.Client{Transport: &authTransport{source: ts, base: base}}, ts
 }
 
 // getTokenFromWeb uses Config to request a Token.
 // It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
 
 	var code string
 	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		return nil, fmt.Errorf("Unable to read authorization code %v", err)
 	}
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	tok, err := config.Exchange(ctx, code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("Unable to retrieve token from web %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
-// tokenCacheFile generates credential file path/filename.
+// tokenCacheFile generates credential file path/filename for profile.
 // It returns the generated credential path/filename.
-func tokenCacheFile() (string, error) {
+func tokenCacheFile(profile string) (string, error) {
 	usr, err := user.Current()
 	if err != nil {
 		return "", err
 	}
 	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials")
 	os.MkdirAll(tokenCacheDir, 0700)
+	name := "mnt-gdrive.json"
+	if profile != "" {
+		name = "mnt-gdrive-" + profile + ".json"
+	}
 	return filepath.Join(tokenCacheDir,
-		url.QueryEscape("mnt-gdrive.json")), err
+		url.QueryEscape(name)), err
+}
+
+// CheckProfile returns an error if profile can't name an account.
+// Profile names become part of a file name, so we keep them simple.
+func CheckProfile(profile string) error {
+	for _, r := range profile {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return fmt.Errorf("profile %q can only have letters, digits, - and _", profile)
+		}
+	}
+	return nil
 }
 
 // tokenFromFile retrieves a Token from a given file path.
@@ -76,12 +108,12 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 
 // saveToken uses a file path to create a file and store the
 // token in it.
-func saveToken(file string, token *oauth2.Token) {
+func saveToken(file string, token *oauth2.Token) error {
 	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.Create(file)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
 	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	return json.NewEncoder(f).Encode(token)
 }
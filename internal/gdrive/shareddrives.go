@@ -0,0 +1,50 @@
+package gdrive
+
+import (
+	"google.golang.org/api/drive/v3"
+
+	"golang.org/x/net/context"
+)
+
+// SharedDrive is a shared drive (formerly team drive) that we can see.
+type SharedDrive struct {
+	ID   string
+	Name string
+}
+
+// SharedDrives returns every shared drive the account is a member of.
+func (gd *Gdrive) SharedDrives(ctx context.Context) ([]*SharedDrive, error) {
+	var drives []*SharedDrive
+	err := gd.svc.Drives.List().
+		PageSize(100).
+		Fields("nextPageToken, drives(id, name)").
+		Pages(ctx, func(r *drive.DriveList) error {
+			for _, d := range r.Drives {
+				drives = append(drives, &SharedDrive{ID: d.Id, Name: d.Name})
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return drives, nil
+}
+
+// ForSharedDrive returns a service, like gd, for working with the
+// shared drive with driveID.  It has its own place in the change feed,
+// starting from now.
+func (gd *Gdrive) ForSharedDrive(driveID string) (DriveLike, error) {
+	token, err := getStartPageToken(gd.svc, driveID)
+	if err != nil {
+		return nil, err
+	}
+	return &Gdrive{
+		svc:            gd.svc,
+		driveID:        driveID,
+		queries:        newQueryCache(gd.queries.ttl),
+		children:       newChildCounts(),
+		others:         gd.others,
+		convertUploads: gd.convertUploads,
+		stallTimeout:   gd.stallTimeout,
+		pageToken:      token}, nil
+}
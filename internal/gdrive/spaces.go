@@ -0,0 +1,53 @@
+package gdrive
+
+import (
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+const sharedWithMeQuery = "sharedWithMe = true and trashed = false"
+
+const recentQuery = "mimeType != 'application/vnd.google-apps.folder' and trashed = false"
+
+// SharedWithMe returns what other people have shared with us, i.e.
+// what the web UI shows under Shared with me.  Shared drives and the
+// app data folder have none.
+func (gd *Gdrive) SharedWithMe(ctx context.Context) ([]*Node, error) {
+	if gd.driveID != "" || gd.space != "" {
+		return nil, nil
+	}
+	return gd.Query(ctx, sharedWithMeQuery)
+}
+
+// Recent returns up to count files, most recently viewed by us first,
+// like the web UI's Recent section.  Shared drives and the app data
+// folder have none.
+func (gd *Gdrive) Recent(ctx context.Context, count int) ([]*Node, error) {
+	if gd.driveID != "" || gd.space != "" {
+		return nil, nil
+	}
+	// one page is all we want, and the order matters, so this doesn't
+	// go through listFiles or its cache
+	r, err := gd.svc.Files.List().
+		PageSize(int64(count)).
+		OrderBy("viewedByMeTime desc").
+		Fields(fileGroupFields).
+		Q(recentQuery).
+		Context(ctx).
+		Do()
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to retrieve recent files: %v", err)
+		return nil, fuse.ENODATA
+	}
+	var nodes []*Node
+	for _, f := range r.Files {
+		n, err := newNode(f.Id, f)
+		if err != nil || !gd.includeNode(n) {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
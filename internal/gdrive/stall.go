@@ -0,0 +1,115 @@
+package gdrive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultStallTimeout is how long a download may go without any bytes
+// arriving before we give up on it and try again, when the caller
+// doesn't say otherwise.
+const DefaultStallTimeout = 30 * time.Second
+
+// how many times we try again after a download stalls
+const maxStallRetries = 3
+
+var errStalled = errors.New("download stalled")
+
+// stallReader reads from body, closing it (so a Read blocked on it
+// returns) if no bytes arrive for timeout.
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	// only access via atomic
+	stalled int32
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration) *stallReader {
+	r := &stallReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.stalled, 1)
+		r.body.Close()
+	})
+	return r
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	if atomic.LoadInt32(&r.stalled) != 0 {
+		return n, errStalled
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// download copies the content get returns into f.  If no bytes arrive
+// for a while, we try again, picking up where we left off if resumable
+// (get is then asked for the content from offset on) and starting over
+// if not.
+func (gd *Gdrive) download(ctx context.Context, id string, f *os.File, resumable bool, get func(offset int64) (*http.Response, error)) error {
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		resp, err := get(offset)
+		if err != nil {
+			return err
+		}
+		if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+			// we got all of it, rather than the rest of it
+			if err = restart(f); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			offset = 0
+		}
+		var body io.ReadCloser = resp.Body
+		if gd.stallTimeout > 0 {
+			body = newStallReader(resp.Body, gd.stallTimeout)
+		}
+		n, err := copyContent(ctx, id, body, f)
+		body.Close()
+		offset += n
+		if err != errStalled || attempt == maxStallRetries {
+			return err
+		}
+		atomic.AddUint64(&connStats.Stalls, 1)
+		logging.For(ctx).Infof("Download of %s stalled after %d bytes; trying again", id, offset)
+		if !resumable {
+			if err = restart(f); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	}
+}
+
+// restart empties f, so a download can start over.
+func restart(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// rangeFrom returns the Range header value asking for the content from
+// offset on.
+func rangeFrom(offset int64) string {
+	return fmt.Sprintf("bytes=%d-", offset)
+}
@@ -0,0 +1,80 @@
+package gdrive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// stallingServer sends the first half of content and then goes quiet,
+// until the test is over.  Asked for a range, it sends the rest, unless
+// ignoreRange is set, in which case it sends everything.
+func stallingServer(content string, ignoreRange bool) (*httptest.Server, chan struct{}) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		half := len(content) / 2
+		switch {
+		case r.Header.Get("Range") == "":
+			w.Write([]byte(content[:half]))
+			w.(http.Flusher).Flush()
+			<-done
+		case ignoreRange:
+			w.Write([]byte(content))
+		default:
+			if r.Header.Get("Range") != rangeFrom(int64(half)) {
+				http.Error(w, "unexpected range "+r.Header.Get("Range"), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(content[half:]))
+		}
+	}))
+	return ts, done
+}
+
+func TestDownloadStalls(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		ts, done := stallingServer("hello world", ignoreRange)
+
+		f, err := ioutil.TempFile("", "stall_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		before := Connections()
+		gd := &Gdrive{stallTimeout: 50 * time.Millisecond}
+		err = gd.download(context.Background(), "stall_id", f, true, func(offset int64) (*http.Response, error) {
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			if err != nil {
+				return nil, err
+			}
+			if offset > 0 {
+				req.Header.Set("Range", rangeFrom(offset))
+			}
+			return http.DefaultClient.Do(req)
+		})
+		close(done)
+		ts.Close()
+		if err != nil {
+			t.Fatalf("ignoreRange=%t: %v", ignoreRange, err)
+		}
+
+		got, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello world" {
+			t.Errorf("ignoreRange=%t: downloaded %q, want %q", ignoreRange, got, "hello world")
+		}
+		if stalls := Connections().Stalls - before.Stalls; stalls != 1 {
+			t.Errorf("ignoreRange=%t: counted %d stalls, want 1", ignoreRange, stalls)
+		}
+	}
+}
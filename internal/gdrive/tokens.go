@@ -0,0 +1,134 @@
+package gdrive
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// DefaultTokenRefreshEarly is how long before an access token expires
+// we get a new one, when the caller doesn't say otherwise.  Access
+// tokens last an hour, and a long upload that starts with a token
+// about to expire would otherwise fail part way through.
+const DefaultTokenRefreshEarly = 5 * time.Minute
+
+// earlyTokenSource hands out access tokens, getting a new one when the
+// one it has is within early of expiring, or when a request told us
+// google no longer accepts it.
+type earlyTokenSource struct {
+	early time.Duration
+	// refresh gets a new access token using a refresh token
+	refresh func(refreshToken string) (*oauth2.Token, error)
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+	// set when google rejected tok
+	rejected bool
+}
+
+func newEarlyTokenSource(ctx context.Context, config *oauth2.Config, tok *oauth2.Token, early time.Duration) *earlyTokenSource {
+	return &earlyTokenSource{
+		early: early,
+		refresh: func(refreshToken string) (*oauth2.Token, error) {
+			// a token without an access token is never valid, so
+			// this source always asks google for a new one
+			return config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+		},
+		tok: tok}
+}
+
+// Token returns a token that will last at least early, if it can.
+func (ts *earlyTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !ts.rejected && ts.tok.Valid() && (ts.tok.Expiry.IsZero() || time.Until(ts.tok.Expiry) > ts.early) {
+		return ts.tok, nil
+	}
+	fresh, err := ts.refresh(ts.tok.RefreshToken)
+	if err != nil {
+		if !ts.rejected && ts.tok.Valid() {
+			// we were only refreshing early, so what we have will
+			// do for now and we'll try again next time
+			logging.Infof("Unable to refresh access token early, keeping the old one: %v", err)
+			return ts.tok, nil
+		}
+		return nil, err
+	}
+	if fresh.RefreshToken == "" {
+		fresh.RefreshToken = ts.tok.RefreshToken
+	}
+	ts.tok = fresh
+	ts.rejected = false
+	return ts.tok, nil
+}
+
+// reject says that google turned down tok, so we shouldn't hand it out
+// again.  It does nothing if we have already moved on from tok.
+func (ts *earlyTokenSource) reject(tok *oauth2.Token) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.tok.AccessToken == tok.AccessToken {
+		ts.rejected = true
+	}
+}
+
+// authTransport authorizes each request with a token from source.  If
+// google says the token is no good (e.g. it was revoked, or expired
+// while the request waited), we get a new one and try the request once
+// more, as long as we can send its body again.
+type authTransport struct {
+	source *earlyTokenSource
+	base   http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.source.Token()
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authorized(req, tok))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	t.source.reject(tok)
+	tok, err = t.source.Token()
+	if err != nil {
+		// the caller can make what it will of the first answer
+		return resp, nil
+	}
+	retry := authorized(req, tok)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	logging.Infof("Access token rejected, trying %s %s again with a new one", req.Method, req.URL.Path)
+	return t.base.RoundTrip(retry)
+}
+
+// authorized returns a copy of req, which RoundTrip mustn't change,
+// with tok in its headers.
+func authorized(req *http.Request, tok *oauth2.Token) *http.Request {
+	r := req.Clone(req.Context())
+	tok.SetAuthHeader(r)
+	return r
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,139 @@
+package gdrive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// countingRefresher hands out access tokens fresh-1, fresh-2, ... that
+// last an hour.
+type countingRefresher struct {
+	calls int
+	err   error
+}
+
+func (r *countingRefresher) refresh(refreshToken string) (*oauth2.Token, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	r.calls++
+	return &oauth2.Token{AccessToken: fmt.Sprintf("fresh-%d", r.calls), Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func testTokenSource(r *countingRefresher, expiresIn time.Duration) *earlyTokenSource {
+	return &earlyTokenSource{
+		early:   5 * time.Minute,
+		refresh: r.refresh,
+		tok:     &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(expiresIn)}}
+}
+
+func TestEarlyTokenSource(t *testing.T) {
+	r := &countingRefresher{}
+	ts := testTokenSource(r, time.Hour)
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "old" || r.calls != 0 {
+		t.Errorf("got %q after %d refreshes, expected the token we had", tok.AccessToken, r.calls)
+	}
+
+	ts = testTokenSource(r, time.Minute)
+	tok, err = ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "fresh-1" {
+		t.Errorf("got %q, expected a token refreshed before it expired", tok.AccessToken)
+	}
+	if tok.RefreshToken != "refresh" {
+		t.Errorf("got refresh token %q, expected to keep the old one", tok.RefreshToken)
+	}
+}
+
+func TestEarlyTokenSourceRefreshFails(t *testing.T) {
+	r := &countingRefresher{err: errors.New("offline")}
+	ts := testTokenSource(r, time.Minute)
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "old" {
+		t.Errorf("got %q, expected to keep using a token that hasn't expired", tok.AccessToken)
+	}
+
+	ts.reject(tok)
+	if _, err = ts.Token(); err == nil {
+		t.Error("expected an error once the old token was rejected")
+	}
+}
+
+// rejectingTransport turns down every access token but good, and
+// records the bodies it was sent.
+type rejectingTransport struct {
+	good   string
+	bodies []string
+}
+
+func (rt *rejectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+	rt.bodies = append(rt.bodies, body)
+	status := http.StatusOK
+	if req.Header.Get("Authorization") != "Bearer "+rt.good {
+		status = http.StatusUnauthorized
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestAuthTransportRetriesRejected(t *testing.T) {
+	r := &countingRefresher{}
+	rt := &rejectingTransport{good: "fresh-1"}
+	client := &http.Client{Transport: &authTransport{source: testTokenSource(r, time.Hour), base: rt}}
+
+	resp, err := client.Post("https://www.googleapis.com/upload/drive/v3/files", "text/plain", bytes.NewReader([]byte("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, expected the retry to succeed", resp.StatusCode)
+	}
+	if len(rt.bodies) != 2 || rt.bodies[1] != "content" {
+		t.Errorf("got bodies %q, expected the same body sent twice", rt.bodies)
+	}
+}
+
+func TestAuthTransportCannotResend(t *testing.T) {
+	r := &countingRefresher{}
+	rt := &rejectingTransport{good: "fresh-1"}
+	client := &http.Client{Transport: &authTransport{source: testTokenSource(r, time.Hour), base: rt}}
+
+	// a body we can't rewind, so we can't send it again
+	body := ioutil.NopCloser(strings.NewReader("content"))
+	resp, err := client.Post("https://www.googleapis.com/upload/drive/v3/files", "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d, expected the rejection", resp.StatusCode)
+	}
+	if len(rt.bodies) != 1 || r.calls != 0 {
+		t.Errorf("sent %d requests and refreshed %d times, expected no retry", len(rt.bodies), r.calls)
+	}
+}
@@ -0,0 +1,67 @@
+package gdrive
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// withTransport returns a context that makes oauth2 build its clients,
+// including the one used to refresh tokens, on top of a transport set
+// up according to opts.  If opts doesn't ask for anything special, ctx
+// is returned unchanged.
+func withTransport(ctx context.Context, opts Options) (context.Context, error) {
+	if opts.ProxyURL == "" && opts.CABundle == "" && !opts.tunesConnections() {
+		return ctx, nil
+	}
+	t, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: t}), nil
+}
+
+// tunesConnections returns true if opts asks for anything other than
+// the default connection reuse.
+func (opts Options) tunesConnections() bool {
+	return opts.IdleConnTimeout != 0 || opts.MaxIdleConnsPerHost != 0 || opts.DisableKeepAlives
+}
+
+func newTransport(opts Options) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	t.DisableKeepAlives = opts.DisableKeepAlives
+	if opts.ProxyURL != "" {
+		u, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse proxy url %q: %v", opts.ProxyURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("Proxy url %q must start with http:// or https://", opts.ProxyURL)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if opts.CABundle != "" {
+		pem, err := ioutil.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read ca bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in ca bundle %s", opts.CABundle)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return t, nil
+}
@@ -0,0 +1,84 @@
+package gdrive
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestWithTransportDefault(t *testing.T) {
+	ctx := context.Background()
+	got, err := withTransport(ctx, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != ctx {
+		t.Error("expected the context to be unchanged when no proxy or ca bundle is set")
+	}
+}
+
+func TestWithTransportProxy(t *testing.T) {
+	ctx, err := withTransport(context.Background(), Options{ProxyURL: "http://proxy.example.com:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	if !ok {
+		t.Fatal("expected an http client in the context")
+	}
+	req, _ := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files", nil)
+	u, err := client.Transport.(*http.Transport).Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "http://proxy.example.com:3128" {
+		t.Errorf("got proxy %q", u)
+	}
+}
+
+func TestWithTransportBadSettings(t *testing.T) {
+	for _, opts := range []Options{
+		{ProxyURL: "socks5://proxy.example.com"},
+		{ProxyURL: "http://%zz"},
+		{CABundle: "/does/not/exist.pem"},
+	} {
+		if _, err := withTransport(context.Background(), opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestPoolTransportPerProxy(t *testing.T) {
+	p, err := NewPool(Options{ProxyURL: "http://one.example.com:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := p.transport(Options{ProxyURL: "http://one.example.com:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := p.transport(Options{ProxyURL: "http://one.example.com:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one != again {
+		t.Error("expected connections through the same proxy to share a transport")
+	}
+	two, err := p.transport(Options{ProxyURL: "http://two.example.com:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files", nil)
+	u, err := two.Value(oauth2.HTTPClient).(*http.Client).Transport.(*http.Transport).Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "http://two.example.com:3128" {
+		t.Errorf("got proxy %q", u)
+	}
+	if _, err := p.transport(Options{CABundle: "/does/not/exist.pem"}); err == nil {
+		t.Error("expected an error for a missing ca bundle")
+	}
+}
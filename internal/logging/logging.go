@@ -0,0 +1,93 @@
+// Package logging is a thin layer over the standard log package that
+// leaves out messages below a chosen level, so that a mount left
+// running doesn't log every file system operation.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Levels, from chattiest to quietest
+const (
+	// Debug is for details of individual operations
+	Debug Level = iota
+	// Info is for things worth knowing about that happen now and then
+	Info
+	// Warn is for problems we can work around
+	Warn
+	// Error is for problems that make an operation fail
+	Error
+)
+
+// Level says how important a message is.
+type Level int32
+
+// the level below which we drop messages.  Only access via atomic.
+var minLevel = int32(Info)
+
+// ParseLevel parses the command line form of a Level.
+func ParseLevel(s string) (Level, error) {
+	for l := Debug; l <= Error; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q; expected debug, info, warn or error", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("Unknown level %d", l)
+	}
+}
+
+// SetLevel makes us drop messages below l.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&minLevel, int32(l))
+}
+
+// Enabled returns true if we log messages at level l.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&minLevel)
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	// skip logf and its caller, so that log.Lshortfile would point at
+	// the code doing the logging
+	log.Output(3, strings.ToUpper(l.String())+" "+fmt.Sprintf(format, args...))
+}
+
+// Debugf logs at Debug level, formatting like fmt.Printf.
+func Debugf(format string, args ...interface{}) {
+	logf(Debug, format, args...)
+}
+
+// Infof logs at Info level, formatting like fmt.Printf.
+func Infof(format string, args ...interface{}) {
+	logf(Info, format, args...)
+}
+
+// Warnf logs at Warn level, formatting like fmt.Printf.
+func Warnf(format string, args ...interface{}) {
+	logf(Warn, format, args...)
+}
+
+// Errorf logs at Error level, formatting like fmt.Printf.
+func Errorf(format string, args ...interface{}) {
+	logf(Error, format, args...)
+}
@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestLevels(t *testing.T) {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLevel(Info)
+	}()
+
+	SetLevel(Warn)
+	Debugf("debug %d", 1)
+	Infof("info %d", 2)
+	Warnf("warn %d", 3)
+	Errorf("error %d", 4)
+	if got, want := b.String(), "WARN warn 3\nERROR error 4\n"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{Debug, Info, Warn, Error} {
+		got, err := ParseLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%q) = %v, %v", l, got, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("expected an error parsing an unknown level")
+	}
+}
+
+func TestOps(t *testing.T) {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	ctx, cancel := context.WithCancel(WithOp(context.Background(), "0x1e"))
+	For(ctx).Infof("opened %s", "notes.txt")
+	For(context.Background()).Infof("no op")
+
+	detached := Detach(ctx)
+	life, endLife := context.WithCancel(context.Background())
+	within := DetachInto(ctx, life)
+	cancel()
+	if detached.Err() != nil {
+		t.Error("detached context was cancelled along with its operation")
+	}
+	if within.Err() != nil {
+		t.Error("context detached into another was cancelled along with its operation")
+	}
+	endLife()
+	if within.Err() == nil {
+		t.Error("context detached into another wasn't cancelled along with it")
+	}
+	if Op(within) != "0x1e" {
+		t.Errorf("context detached into another has op %q, want 0x1e", Op(within))
+	}
+	For(detached).Warnf("still %d", 1)
+
+	if got, want := b.String(), "INFO [op 0x1e] opened notes.txt\nINFO no op\nWARN [op 0x1e] still 1\n"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+type opKey struct{}
+
+// WithOp returns a context for the operation with the correlation id
+// op, e.g. "0x1e" for the fuse request with that id.  Anything logged
+// through For, including each request we make to google, is tagged
+// with it, so a slow operation can be matched to the requests it
+// caused.
+func WithOp(ctx context.Context, op string) context.Context {
+	return context.WithValue(ctx, opKey{}, op)
+}
+
+// Op returns the correlation id of ctx's operation, or "" if it isn't
+// part of one.
+func Op(ctx context.Context) string {
+	op, _ := ctx.Value(opKey{}).(string)
+	return op
+}
+
+// Detach returns a context that carries ctx's correlation id but isn't
+// cancelled along with ctx, for work that outlives the operation that
+// started it, like a download started by an open.
+func Detach(ctx context.Context) context.Context {
+	return DetachInto(ctx, context.Background())
+}
+
+// DetachInto is like Detach, except that the context it returns is
+// cancelled along with parent, for work that outlives the operation
+// that started it but not the thing it is for, like a download that
+// should stop once its file is gone.
+func DetachInto(ctx context.Context, parent context.Context) context.Context {
+	if op := Op(ctx); op != "" {
+		return WithOp(parent, op)
+	}
+	return parent
+}
+
+// Logger logs like the package level functions, with a prefix.
+type Logger struct {
+	prefix string
+}
+
+// For returns a Logger that tags messages with ctx's correlation id, if
+// it has one.
+func For(ctx context.Context) Logger {
+	if op := Op(ctx); op != "" {
+		return Logger{fmt.Sprintf("[op %s] ", op)}
+	}
+	return Logger{}
+}
+
+// Debugf logs at Debug level, formatting like fmt.Printf.
+func (l Logger) Debugf(format string, args ...interface{}) {
+	logf(Debug, l.prefix+format, args...)
+}
+
+// Infof logs at Info level, formatting like fmt.Printf.
+func (l Logger) Infof(format string, args ...interface{}) {
+	logf(Info, l.prefix+format, args...)
+}
+
+// Warnf logs at Warn level, formatting like fmt.Printf.
+func (l Logger) Warnf(format string, args ...interface{}) {
+	logf(Warn, l.prefix+format, args...)
+}
+
+// Errorf logs at Error level, formatting like fmt.Printf.
+func (l Logger) Errorf(format string, args ...interface{}) {
+	logf(Error, l.prefix+format, args...)
+}
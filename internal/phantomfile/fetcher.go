@@ -1,13 +1,20 @@
 package phantomfile
 
 import (
-	"log"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
 
 	"golang.org/x/net/context"
 )
 
+// how often a read waiting on part of a file that is still being
+// fetched in the background checks whether it has arrived
+const fetchPollInterval = 10 * time.Millisecond
+
 type downloader interface {
 	Download(context.Context, *os.File) error
 	String() string
@@ -19,26 +26,41 @@ type fetcher struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	dl     downloader
+	// set if we fetch in the background, starting right away
+	background bool
+	// closed once fetching is over, whether or not it worked
+	finishedCh chan struct{}
 
 	mu   sync.Mutex
 	file *os.File
 	done bool
 	err  error
+
+	// set once done is, so that callers can check without waiting for
+	// a download to finish.  Only access via atomic.
+	finished int32
+	// set once we are told to stop fetching because nobody wants the
+	// content any more.  Only access via atomic.
+	aborted int32
 }
 
 // newFetcher returns a new fetcher.
 func newFetcher(ctx context.Context, dl downloader, fm FetchMode, file *os.File) *fetcher {
 	ctx, cancel := context.WithCancel(ctx)
 	f := &fetcher{
-		ctx:    ctx,
-		cancel: cancel,
-		dl:     dl,
-		file:   file,
+		ctx:        ctx,
+		cancel:     cancel,
+		dl:         dl,
+		file:       file,
+		finishedCh: make(chan struct{}),
 	}
 	switch fm {
 	case NoFetch:
 		f.done = true
+		f.finished = 1
+		close(f.finishedCh)
 	case ProactiveFetch:
+		f.background = true
 		go f.fetch()
 	default:
 		// nothing more to do
@@ -54,24 +76,60 @@ func (f *fetcher) fetch() error {
 	if !f.done {
 		defer func() {
 			f.done = true
+			atomic.StoreInt32(&f.finished, 1)
+			close(f.finishedCh)
 		}()
 
 		if f.err = f.ctx.Err(); f.err == nil {
-			log.Printf("fetching content for %q...", f.dl)
+			logging.For(f.ctx).Debugf("fetching content for %q...", f.dl)
 			if f.err = f.dl.Download(f.ctx, f.file); f.err != nil {
-				log.Printf("Failed to download content for %q/%q: %v", f.dl, f.file.Name(), f.err)
+				logging.For(f.ctx).Errorf("Failed to download content for %q/%q: %v", f.dl, f.file.Name(), f.err)
+			} else {
+				trimCache()
 			}
 		}
 	}
-	if f.err == context.Canceled {
+	if f.err == context.Canceled && atomic.LoadInt32(&f.aborted) != 0 {
 		return nil
 	}
 	return f.err
 }
 
+// complete returns true once fetching is over, whether or not it
+// worked.  Unlike fetch, it never waits.
+func (f *fetcher) complete() bool {
+	return atomic.LoadInt32(&f.finished) != 0
+}
+
+// fetchTo waits until the first end bytes have been fetched, or until
+// fetching is over, so that reads near the start of a file that is
+// fetching in the background needn't wait for all of it.  If ctx is
+// done first, we give up waiting, but the fetch carries on.
+func (f *fetcher) fetchTo(ctx context.Context, end int64) error {
+	if !f.background {
+		return f.fetch()
+	}
+	for !f.complete() {
+		if fi, err := f.file.Stat(); err == nil && fi.Size() >= end {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-f.finishedCh:
+		case <-time.After(fetchPollInterval):
+		}
+	}
+	return f.fetch()
+}
+
 // Abort terminates any existing fetching process, returning after the termination is
 // complete.  Subsequent calls to Fetch will be immediately succeed.
 func (f *fetcher) abort() {
+	if !f.complete() {
+		logging.Debugf("abandoning fetch of %q", f.dl)
+	}
+	atomic.StoreInt32(&f.aborted, 1)
 	f.cancel()
 	f.fetch()
 }
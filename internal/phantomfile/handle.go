@@ -2,8 +2,10 @@ package phantomfile
 
 import (
 	"fmt"
-	"log"
 	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
 
 	"golang.org/x/net/context"
 
@@ -21,15 +23,26 @@ type handle struct {
 	of       *openFile
 	am       AccessMode
 	released uint32 // only access via atomic
+
+	// the process that opened us, or zero if we opened ourselves
+	pid      uint32
+	opened   time.Time
+	counters handleCounters
 }
 
-func newHandle(pf *PhantomFile, am AccessMode) *handle {
-	log.Printf("handle: newHandle %q as %s", pf.of.du, am)
-	return &handle{
-		pf: pf,
-		of: pf.of,
-		am: am,
+func newHandle(pf *PhantomFile, am AccessMode, pid uint32) *handle {
+	logging.Debugf("handle: newHandle %q as %s for pid %d", pf.of.du, am, pid)
+	h := &handle{
+		pf:     pf,
+		of:     pf.of,
+		am:     am,
+		pid:    pid,
+		opened: time.Now(),
 	}
+	liveHandles.Lock()
+	liveHandles.m[h] = true
+	liveHandles.Unlock()
+	return h
 }
 
 func (h *handle) isReleased() bool {
@@ -37,13 +50,19 @@ func (h *handle) isReleased() bool {
 }
 
 func (h *handle) release() bool {
-	return atomic.CompareAndSwapUint32(&h.released, 0, 1)
+	if !atomic.CompareAndSwapUint32(&h.released, 0, 1) {
+		return false
+	}
+	liveHandles.Lock()
+	delete(liveHandles.m, h)
+	liveHandles.Unlock()
+	return true
 }
 
 func (h *handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	log.Printf("handle: flushing %q", h.of.du)
+	logging.Debugf("handle: flushing %q", h.of.du)
 	if h.isReleased() {
-		log.Printf("Attempt to flush released handle for %q, failing", h.pf.du)
+		logging.Warnf("Attempt to flush released handle for %q, failing", h.pf.du)
 		return fuse.ESTALE
 	}
 	if !h.am.isWriteable() {
@@ -54,33 +73,41 @@ func (h *handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 }
 
 func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
-	log.Printf("handle: reading %q", h.of.du)
+	logging.Debugf("handle: reading %q", h.of.du)
 	if h.isReleased() {
-		log.Printf("Attempt to read from released handle for %q, failing", h.pf.du)
+		logging.Warnf("Attempt to read from released handle for %q, failing", h.pf.du)
 		return fuse.ESTALE
 	}
 	if !h.am.isReadable() {
 		return fuse.EPERM
 	}
-	return h.of.read(ctx, req, res)
+	err := h.of.read(ctx, req, res)
+	if err == nil {
+		h.counters.countRead(len(res.Data))
+	}
+	return err
 }
 
 func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	log.Printf("handle: writing %q", h.of.du)
+	logging.Debugf("handle: writing %q", h.of.du)
 	if h.isReleased() {
-		log.Printf("Attempt to write to released handle for %q, failing", h.pf.du)
+		logging.Warnf("Attempt to write to released handle for %q, failing", h.pf.du)
 		return fuse.ESTALE
 	}
 	if !h.am.isWriteable() {
 		return fuse.EPERM
 	}
-	return h.of.write(ctx, req, resp)
+	err := h.of.write(ctx, req, resp)
+	if err == nil {
+		h.counters.countWrite(resp.Size)
+	}
+	return err
 }
 
 func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	log.Printf("handle: releasing %q", h.of.du)
+	logging.Debugf("handle: releasing %q", h.of.du)
 	if !h.release() {
-		log.Printf("Attempt to release already released handle for %q, failing", h.pf.du)
+		logging.Warnf("Attempt to release already released handle for %q, failing", h.pf.du)
 		return fuse.ESTALE
 	}
 	var flushErr error
@@ -89,11 +116,11 @@ func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	}
 	err := h.pf.release(ctx)
 	if flushErr != nil {
-		log.Printf("Handle Release flush error %q: %+v", h.pf.du, flushErr)
+		logging.Errorf("Handle Release flush error %q: %+v", h.pf.du, flushErr)
 		return flushErr
 	}
 	if err != nil {
-		log.Printf("Handle Release pf release error %q: %+v", h.pf.du, err)
+		logging.Errorf("Handle Release pf release error %q: %+v", h.pf.du, err)
 		return err
 	}
 	return nil
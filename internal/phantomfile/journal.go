@@ -0,0 +1,293 @@
+package phantomfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+)
+
+// JournalEntry records a local copy holding changes that haven't been
+// uploaded yet.  Each mnt-gdrive process keeps a journal of them in the
+// cache dir, so that if it crashes or is killed before uploading them,
+// the next run can.
+type JournalEntry struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Path is the local copy
+	Path string `json:"path"`
+	// Base is the md5 of the content in drive that the changes start
+	// from, if we know it
+	Base string `json:"base,omitempty"`
+	// Profile names the google account the file belongs to; empty
+	// means the default one
+	Profile string `json:"profile,omitempty"`
+
+	// the journal the entry is in
+	journal string
+}
+
+// uploadBaser is a DownloaderUploader that knows what its content in
+// drive was when we made our local copy, for the journal.
+type uploadBaser interface {
+	UploadBase() string
+}
+
+// profiler is a DownloaderUploader that knows which google account it
+// belongs to, for the journal.
+type profiler interface {
+	Profile() string
+}
+
+func journalPath(pid int) string {
+	return filepath.Join(CacheDir(), fmt.Sprintf("mntgd-journal-%d.json", pid))
+}
+
+// journalPid returns the pid in the name of a journal made by
+// journalPath or claimedJournalPath, which is the process it belongs
+// to.
+func journalPid(base string) (int, bool) {
+	if !strings.HasPrefix(base, "mntgd-journal-") || !strings.HasSuffix(base, ".json") {
+		return 0, false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(base, "mntgd-journal-"), ".json")
+	pid, err := strconv.Atoi(strings.SplitN(rest, "-", 2)[0])
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+// claimedJournalPath returns the name we give the journal at path,
+// which belonged to a process that is no longer running, once we claim
+// it.  It starts with our pid, so other processes leave it alone while
+// we are running, and keeps the rest of the old name, so two journals
+// we claim never get the same one.
+func claimedJournalPath(path string) string {
+	rest := strings.TrimPrefix(filepath.Base(path), "mntgd-journal-")
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("mntgd-journal-%d-%s", os.Getpid(), rest))
+}
+
+// journalEntry returns what we record in our journal about o, which
+// has a temp file because something wrote to it.
+func (o *openFile) journalEntry() JournalEntry {
+	e := JournalEntry{ID: o.du.ID(), Name: o.du.Name()}
+	if f := o.getTmpFile(); f != nil {
+		e.Path = f.Name()
+	}
+	if b, ok := o.du.(uploadBaser); ok {
+		e.Base = b.UploadBase()
+	}
+	if p, ok := o.du.(profiler); ok {
+		e.Profile = p.Profile()
+	}
+	return e
+}
+
+// writeJournalLocked records everything in dirtyFiles in our journal,
+// replacing what was there, or removes the journal if there is
+// nothing.  Must be called with dirtyFiles held.
+func writeJournalLocked() {
+	path := journalPath(os.Getpid())
+	if len(dirtyFiles.m) == 0 && len(dirtyFiles.left) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logging.Errorf("Unable to remove journal %s: %v", path, err)
+		}
+		return
+	}
+	entries := append(make([]JournalEntry, 0, len(dirtyFiles.m)+len(dirtyFiles.left)), dirtyFiles.left...)
+	for _, e := range dirtyFiles.m {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	if err := writeJournal(path, entries); err != nil {
+		logging.Errorf("Unable to write journal %s: %v", path, err)
+	}
+}
+
+// writeJournal replaces the journal at path with entries, in a way that
+// leaves either the old journal or the new one behind if we crash part
+// way through.
+func writeJournal(path string, entries []JournalEntry) error {
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].journal = path
+	}
+	return entries, nil
+}
+
+// journals returns the journals in the cache dir, whether or not the
+// processes they belong to are still running.
+func journals() ([]string, error) {
+	return filepath.Glob(filepath.Join(CacheDir(), "mntgd-journal-*.json"))
+}
+
+// deadJournals returns the journals of mnt-gdrive processes that are no
+// longer running.
+func deadJournals() ([]string, error) {
+	names, err := journals()
+	if err != nil {
+		return nil, err
+	}
+	var dead []string
+	for _, name := range names {
+		if pid, ok := journalPid(filepath.Base(name)); ok && !processRunning(pid) {
+			dead = append(dead, name)
+		}
+	}
+	return dead, nil
+}
+
+// Unfinished returns the changes that mnt-gdrive processes that are no
+// longer running didn't get to upload, as their journals record.  It
+// only reads the journals, so it is safe to call while another process
+// is uploading them; to upload them yourself, use ClaimUnfinished.
+func Unfinished() ([]JournalEntry, error) {
+	names, err := deadJournals()
+	if err != nil {
+		return nil, err
+	}
+	var unfinished []JournalEntry
+	for _, name := range names {
+		entries, err := readJournal(name)
+		if err != nil {
+			logging.Warnf("Unable to read journal %s: %v", name, err)
+			continue
+		}
+		for _, e := range entries {
+			if _, err := os.Stat(e.Path); err == nil {
+				unfinished = append(unfinished, e)
+			}
+		}
+	}
+	return unfinished, nil
+}
+
+// ClaimUnfinished makes the journals of mnt-gdrive processes that are
+// no longer running ours, so that no other process uploads the same
+// changes, and returns what they record.  A journal another process
+// claims first is left to it.  We leave out, and forget, changes whose
+// local copies are gone.  Once a change has been uploaded, pass it to
+// Finish; the rest stay in a journal of ours, for a later run to claim
+// once we are gone.
+func ClaimUnfinished() ([]JournalEntry, error) {
+	names, err := deadJournals()
+	if err != nil {
+		return nil, err
+	}
+	var unfinished []JournalEntry
+	for _, name := range names {
+		claimed := claimedJournalPath(name)
+		// only one process can rename it
+		if err := os.Rename(name, claimed); err != nil {
+			if !os.IsNotExist(err) {
+				logging.Warnf("Unable to claim journal %s: %v", name, err)
+			}
+			continue
+		}
+		entries, err := readJournal(claimed)
+		if err != nil {
+			logging.Warnf("Unable to read journal %s: %v", claimed, err)
+			continue
+		}
+		var kept []JournalEntry
+		for _, e := range entries {
+			if _, err := os.Stat(e.Path); err != nil {
+				logging.Warnf("Changes to %s (%s) left behind by an earlier run are gone: %v", e.Name, e.ID, err)
+				continue
+			}
+			kept = append(kept, e)
+		}
+		switch {
+		case len(kept) == 0:
+			os.Remove(claimed)
+			continue
+		case len(kept) < len(entries):
+			if err := writeJournal(claimed, kept); err != nil {
+				logging.Warnf("Unable to update journal %s: %v", claimed, err)
+			}
+		}
+		unfinished = append(unfinished, kept...)
+	}
+	return unfinished, nil
+}
+
+// Finish removes e, which has been uploaded, and its local copy.
+func Finish(e JournalEntry) error {
+	if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries, err := readJournal(e.journal)
+	if err != nil {
+		return err
+	}
+	var kept []JournalEntry
+	for _, other := range entries {
+		if other.Path != e.Path {
+			kept = append(kept, other)
+		}
+	}
+	if len(kept) == 0 {
+		return os.Remove(e.journal)
+	}
+	return writeJournal(e.journal, kept)
+}
+
+// unfinishedPaths returns the local copies that any journal records,
+// including ones that running processes have claimed, which we must
+// keep until they have been uploaded.  Local copies in the journals of
+// running processes are in use anyway.
+func unfinishedPaths() map[string]bool {
+	paths := map[string]bool{}
+	names, err := journals()
+	if err != nil {
+		logging.Warnf("Unable to read journals: %v", err)
+	}
+	for _, name := range names {
+		entries, err := readJournal(name)
+		if err != nil {
+			logging.Warnf("Unable to read journal %s: %v", name, err)
+			continue
+		}
+		for _, e := range entries {
+			paths[e.Path] = true
+		}
+	}
+	return paths
+}
@@ -4,79 +4,210 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
 
 	"bazil.org/fuse"
 	"golang.org/x/net/context"
 )
 
+// dirtyFiles holds every openFile with changes we haven't uploaded yet,
+// and what our journal says about each.
+var dirtyFiles = struct {
+	sync.Mutex
+	m map[*openFile]JournalEntry
+	// changes we gave up on uploading, e.g. because we were unmounted
+	// before a retry got them to drive, which we leave in the journal
+	// for the next run
+	left []JournalEntry
+}{m: map[*openFile]JournalEntry{}}
+
+// FlushAll uploads the changes of every open file that has any,
+// waiting for uploads that are already underway.  It returns the first
+// error it runs into, after trying every file.
+func FlushAll(ctx context.Context) error {
+	dirtyFiles.Lock()
+	var files []*openFile
+	for o := range dirtyFiles.m {
+		files = append(files, o)
+	}
+	dirtyFiles.Unlock()
+
+	var firstErr error
+	for _, o := range files {
+		if err := o.flush(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", o.du, err)
+		}
+	}
+	return firstErr
+}
+
+// DirtyCount returns how many files have changes we haven't uploaded
+// yet, including those waiting for a retry and those we left for the
+// next run.
+func DirtyCount() int {
+	dirtyFiles.Lock()
+	defer dirtyFiles.Unlock()
+	return len(dirtyFiles.m) + len(dirtyFiles.left)
+}
+
+// how much of a file's name we put in the name of its temp file
+const maxTempNameLen = 64
+
 type openFile struct {
 	du DownloaderUploader
 
 	fetcher *fetcher
+	created time.Time
+
+	// guards tmpFile.  When we are not fetching anything, we don't
+	// create the temp file until something needs to write to it, and
+	// until then we behave like an empty file.
+	tmpMu   sync.Mutex
 	tmpFile *os.File
 
+	// held while changing tmpFile's content, by writes and truncates,
+	// and while uploading it, so an upload sends the file as it was
+	// between changes, never partway through one, and changes apply in
+	// the order they take it.  Take it before dirtyMu.
+	writeMu sync.Mutex
+
 	dirtyMu sync.Mutex
 	dirty   bool
 }
 
-func newOpenFile(du DownloaderUploader, fm FetchMode) (fr *openFile, err error) {
-	tmpFile, err := ioutil.TempFile("", fmt.Sprintf("mntgd-%s-%s-", du.ID(), du.Name()))
-	if err != nil {
-		log.Printf("Error creating temp file for %s: %v", du, err)
-		return nil, fuse.EIO
-	}
-
+// newOpenFile returns a new openFile for du, fetching its content as
+// fm says.  The fetch outlives ctx, the request that opens the file,
+// but not life.
+func newOpenFile(ctx context.Context, life context.Context, du DownloaderUploader, fm FetchMode) (fr *openFile, err error) {
 	fr = &openFile{
 		du:      du,
-		fetcher: newFetcher(context.Background(), du, fm, tmpFile),
-		tmpFile: tmpFile}
-	log.Printf("openFile: creating %q with fetchMode of %s", du, fm)
+		created: time.Now()}
+	if fm != NoFetch {
+		if f := takePrefetched(du.ID()); f != nil {
+			logging.Debugf("openFile: using prefetched content for %q", du)
+			fr.tmpFile = f
+			fm = NoFetch
+		}
+	}
+	if fm != NoFetch {
+		if _, err = fr.ensureTmpFile(); err != nil {
+			return nil, err
+		}
+	}
+	// the fetch may well outlive the open that started it
+	fr.fetcher = newFetcher(logging.DetachInto(ctx, life), du, fm, fr.tmpFile)
+	logging.For(ctx).Debugf("openFile: creating %q with fetchMode of %s", du, fm)
 
 	return fr, nil
 }
 
+// ensureTmpFile returns our temp file, creating it if we don't yet have one.
+func (o *openFile) ensureTmpFile() (*os.File, error) {
+	o.tmpMu.Lock()
+	defer o.tmpMu.Unlock()
+	if o.tmpFile == nil {
+		tmpFile, err := newTempFile(o.du)
+		if err != nil {
+			return nil, err
+		}
+		o.tmpFile = tmpFile
+	}
+	return o.tmpFile, nil
+}
+
+// newTempFile creates a temp file to hold the content of du.  The
+// name starts with our pid, so that RemoveOrphans can tell which files
+// were left behind by a process that is gone.
+func newTempFile(du DownloaderUploader) (*os.File, error) {
+	// the name is only there to help people looking at the temp dir,
+	// so we don't let a long one push us past NAME_MAX, or a slash in
+	// it send us to another dir
+	name := strings.ReplaceAll(du.Name(), "/", "_")
+	if len(name) > maxTempNameLen {
+		name = name[:maxTempNameLen]
+	}
+	tmpFile, err := ioutil.TempFile(tempDir, fmt.Sprintf("mntgd-%d-%s-%s-", os.Getpid(), du.ID(), name))
+	if err != nil {
+		logging.Errorf("Error creating temp file for %s: %v", du, err)
+		return nil, fuse.EIO
+	}
+	return tmpFile, nil
+}
+
+// getTmpFile returns our temp file, or nil if we haven't needed one yet.
+func (o *openFile) getTmpFile() *os.File {
+	o.tmpMu.Lock()
+	defer o.tmpMu.Unlock()
+	return o.tmpFile
+}
+
 func (o *openFile) String() string {
-	return o.tmpFile.Name()
+	if tmpFile := o.getTmpFile(); tmpFile != nil {
+		return tmpFile.Name()
+	}
+	return fmt.Sprintf("<empty %s>", o.du)
 }
 
 func (o *openFile) read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
-	if err := o.fetcher.fetch(); err != nil {
+	if err := o.fetcher.fetchTo(ctx, req.Offset+int64(req.Size)); err != nil {
+		if err == ctx.Err() {
+			return fuse.EINTR
+		}
 		return fuse.EIO
 	}
 
-	if o.tmpFile == nil {
-		return fuse.EIO
+	tmpFile := o.getTmpFile()
+	if tmpFile == nil {
+		// nothing has been written yet, so we are empty
+		res.Data = []byte{}
+		return nil
 	}
 	b := make([]byte, req.Size)
-	n, err := o.tmpFile.ReadAt(b, req.Offset)
+	n, err := tmpFile.ReadAt(b, req.Offset)
 	if err != nil && err != io.EOF {
-		log.Printf("Error reading from temp file: %v", err)
+		logging.Errorf("Error reading from temp file: %v", err)
 		return fuse.EIO
 	}
 	res.Data = b[:n]
 	return nil
 }
 
-func (o *openFile) stat() (os.FileInfo, error) {
-	if err := o.fetcher.fetch(); err != nil {
-		return nil, fuse.EIO
+func (o *openFile) stat() (size int64, modTime time.Time, err error) {
+	if err = o.fetcher.fetch(); err != nil {
+		return 0, modTime, fuse.EIO
+	}
+	tmpFile := o.getTmpFile()
+	if tmpFile == nil {
+		return 0, o.created, nil
+	}
+	fi, err := tmpFile.Stat()
+	if err != nil {
+		return 0, modTime, err
 	}
-	return o.tmpFile.Stat()
+	return fi.Size(), fi.ModTime(), nil
 }
 
 func (o *openFile) write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	if err := o.fetcher.fetch(); err != nil {
-		log.Printf("Write fetcher error for %q: %v", o.du, err)
+		logging.Errorf("Write fetcher error for %q: %v", o.du, err)
 		return fuse.EIO
 	}
 
-	var err error
-	resp.Size, err = o.tmpFile.WriteAt(req.Data, req.Offset)
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+	tmpFile, err := o.ensureTmpFile()
 	if err != nil {
-		log.Printf("Error writing %q for write to %q: %v", o.du, req.Offset, err)
+		return err
+	}
+	resp.Size, err = tmpFile.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		logging.Errorf("Error writing %q for write to %q: %v", o.du, req.Offset, err)
 		return fuse.EIO
 	}
 
@@ -86,44 +217,150 @@ func (o *openFile) write(ctx context.Context, req *fuse.WriteRequest, resp *fuse
 }
 
 func (o *openFile) release(ctx context.Context) error {
-	log.Printf("openFile: releasing %q", o.du)
+	logging.Debugf("openFile: releasing %q", o.du)
 	o.fetcher.abort()
+	openCopies.Lock()
+	delete(openCopies.m, o)
+	openCopies.Unlock()
+
+	// Taking the lock also waits out a FlushAll that is uploading us.
+	o.dirtyMu.Lock()
+	dirty := o.dirty
+	if dirty {
+		o.leave()
+	}
+	o.dirtyMu.Unlock()
 
-	name := o.tmpFile.Name()
-	if err := o.tmpFile.Close(); err != nil {
-		log.Printf("Error closing %s: %v", name, err)
+	tmpFile := o.getTmpFile()
+	if tmpFile == nil {
+		return nil
+	}
+	name := tmpFile.Name()
+	if err := tmpFile.Close(); err != nil {
+		logging.Errorf("Error closing %s: %v", name, err)
 		return err
 	}
+	if dirty {
+		logging.Errorf("Giving up on uploading changes to %s for now; they are in %s, and the next run will upload them", o.du, name)
+		return nil
+	}
 	if err := os.Remove(name); err != nil {
-		log.Printf("Error removing %s: %v", name, err)
+		logging.Errorf("Error removing %s: %v", name, err)
 		return err
 	}
 	return nil
 }
 
 func (o *openFile) truncate(size int64) error {
-	err := o.tmpFile.Truncate(size)
+	// Truncating must be ordered after any fetch, or the fetch could
+	// write old content past the point we truncated to.  If we are
+	// truncating away everything, there is no point in finishing the
+	// fetch.
+	if size == 0 {
+		o.fetcher.abort()
+	} else if err := o.fetcher.fetch(); err != nil {
+		logging.Errorf("Truncate fetcher error for %q: %v", o.du, err)
+		return fuse.EIO
+	}
+
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+	tmpFile, err := o.ensureTmpFile()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Truncate(size)
 	o.markDirty()
 	return err
 }
 
 func (o *openFile) flush(ctx context.Context) error {
+	o.dirtyMu.Lock()
+	dirty := o.dirty
+	o.dirtyMu.Unlock()
+	if !dirty {
+		logging.Debugf("openFile: declining to flush %q because it is not dirty", o.du)
+		return nil
+	}
+
+	// We wait for our turn without holding dirtyMu, so writes can carry
+	// on meanwhile.  Flushes that queue up behind us find everything
+	// uploaded, their changes included, and have nothing left to do.
+	done, err := takeUploadTurn(ctx, o.du.ID())
+	if err != nil {
+		return err
+	}
+	defer done()
+	// Writes that come along now wait for the upload; they would have
+	// had to wait to mark us dirty again anyway.
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
 	o.dirtyMu.Lock()
 	defer o.dirtyMu.Unlock()
 	if !o.dirty {
-		log.Printf("openFile: declining to flush %q because it is not dirty", o.du)
+		logging.Debugf("openFile: declining to flush %q because it was uploaded while we waited", o.du)
 		return nil
 	}
-	err := o.du.Upload(ctx, o.tmpFile)
+	tmpFile := o.getTmpFile()
+	// Get our copy onto disk before we upload it.  Otherwise, if we
+	// crash after the upload was acknowledged, the bytes we sent might
+	// not be the bytes we would find locally afterwards.
+	if err := tmpFile.Sync(); err != nil {
+		logging.Errorf("openFile: error syncing %q before flush: %v", o.du, err)
+		return fuse.EIO
+	}
+	err = o.du.Upload(ctx, tmpFile)
 	if err == nil {
-		o.dirty = false
+		o.setDirty(false)
+	} else {
+		atomic.AddUint64(&uploadFailures, 1)
 	}
-	log.Printf("openFile: flush of %q returning %v", o.du, err)
+	logging.Debugf("openFile: flush of %q returning %v", o.du, err)
 	return err
 }
 
 func (o *openFile) markDirty() {
 	o.dirtyMu.Lock()
-	o.dirty = true
+	o.setDirty(true)
 	o.dirtyMu.Unlock()
 }
+
+// isDirty says whether o has changes we haven't uploaded yet.
+func (o *openFile) isDirty() bool {
+	o.dirtyMu.Lock()
+	defer o.dirtyMu.Unlock()
+	return o.dirty
+}
+
+// leave moves what our journal says about o, which we are letting go
+// of with its changes not uploaded, to the entries we leave for the
+// next run.  Must be called with dirtyMu held.
+func (o *openFile) leave() {
+	o.dirty = false
+	dirtyFiles.Lock()
+	defer dirtyFiles.Unlock()
+	dirtyFiles.left = append(dirtyFiles.left, dirtyFiles.m[o])
+	delete(dirtyFiles.m, o)
+	writeJournalLocked()
+}
+
+// setDirty must be called with dirtyMu held.
+func (o *openFile) setDirty(dirty bool) {
+	was := o.dirty
+	o.dirty = dirty
+	if was == dirty {
+		return
+	}
+	var e JournalEntry
+	if dirty {
+		e = o.journalEntry()
+	}
+	dirtyFiles.Lock()
+	defer dirtyFiles.Unlock()
+	if dirty {
+		dirtyFiles.m[o] = e
+	} else {
+		delete(dirtyFiles.m, o)
+	}
+	writeJournalLocked()
+}
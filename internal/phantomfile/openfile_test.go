@@ -0,0 +1,965 @@
+package phantomfile
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+type fakeDU struct {
+	uploadErr error
+	uploaded  []string
+
+	// what Download writes
+	content   string
+	downloads int32
+}
+
+func (f *fakeDU) ID() string     { return "id" }
+func (f *fakeDU) Name() string   { return "name" }
+func (f *fakeDU) String() string { return "fake" }
+
+func (f *fakeDU) Download(ctx context.Context, file *os.File) error {
+	atomic.AddInt32(&f.downloads, 1)
+	_, err := file.WriteString(f.content)
+	return err
+}
+
+func (f *fakeDU) Upload(ctx context.Context, file *os.File) error {
+	if f.uploadErr != nil {
+		return f.uploadErr
+	}
+	// read through a fresh descriptor, the way a separate process
+	// would see it
+	b, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	f.uploaded = append(f.uploaded, string(b))
+	return nil
+}
+
+func TestFlushMarksCleanOnlyAfterUpload(t *testing.T) {
+	du := &fakeDU{uploadErr: errors.New("boom")}
+	of, err := newOpenFile(context.Background(), context.Background(), du, NoFetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.release(context.Background())
+
+	ctx := context.Background()
+	if err = of.write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = of.flush(ctx); err == nil {
+		t.Fatal("expected flush to fail when upload fails")
+	}
+
+	// still dirty, so the next flush tries again
+	du.uploadErr = nil
+	if err = of.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(du.uploaded) != 1 || du.uploaded[0] != "hello" {
+		t.Fatalf("uploaded %q, want [hello]", du.uploaded)
+	}
+
+	// now clean, so nothing more is uploaded
+	if err = of.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(du.uploaded) != 1 {
+		t.Fatalf("uploaded %d times, want 1", len(du.uploaded))
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	ctx := context.Background()
+	var dus []*fakeDU
+	for i := 0; i < 2; i++ {
+		du := &fakeDU{}
+		of, err := newOpenFile(context.Background(), context.Background(), du, NoFetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer of.release(ctx)
+		if err = of.write(ctx, &fuse.WriteRequest{Data: []byte("hi")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		dus = append(dus, du)
+	}
+	dus[0].uploadErr = errors.New("boom")
+
+	if err := FlushAll(ctx); err == nil {
+		t.Fatal("expected FlushAll to report the failed upload")
+	}
+	if len(dus[1].uploaded) != 1 {
+		t.Errorf("expected the second file to be uploaded in spite of the first failing")
+	}
+
+	dus[0].uploadErr = nil
+	if err := FlushAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(dus[0].uploaded) != 1 || len(dus[1].uploaded) != 1 {
+		t.Errorf("expected each file uploaded once, got %d and %d", len(dus[0].uploaded), len(dus[1].uploaded))
+	}
+}
+
+func TestPhantomFileFlush(t *testing.T) {
+	ctx := context.Background()
+	du := &fakeDU{}
+	pf := NewPhantomFile(context.Background(), du)
+
+	// not open, so nothing to do
+	if err := pf.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := pf.Open(context.Background(), ReadWrite, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Release(ctx, &fuse.ReleaseRequest{})
+	if err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = pf.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(du.uploaded) != 1 || du.uploaded[0] != "hello" {
+		t.Fatalf("uploaded %q, want [hello]", du.uploaded)
+	}
+}
+
+func TestPhantomFileClose(t *testing.T) {
+	ctx := context.Background()
+	du := &fakeDU{}
+	pf := NewPhantomFile(context.Background(), du)
+
+	h, err := pf.Open(ctx, ReadWrite, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	name := h.of.getTmpFile().Name()
+
+	// the handle is still open, but we close anyway
+	if err = pf.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(du.uploaded) != 1 || du.uploaded[0] != "hello" {
+		t.Fatalf("uploaded %q, want [hello]", du.uploaded)
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", name, err)
+	}
+	if DirtyCount() != 0 {
+		t.Errorf("got %d dirty files, want 0", DirtyCount())
+	}
+
+	// releasing the handle afterwards is harmless
+	if err = h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(du.uploaded) != 1 {
+		t.Errorf("uploaded %d times, want 1", len(du.uploaded))
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	du := &fakeDU{content: "hello"}
+	pf := NewPhantomFile(context.Background(), du)
+	defer Forget(du.ID())
+
+	pf.Prefetch("", 5)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prefetches.Lock()
+		p := prefetches.m[du.ID()]
+		ready := p != nil && p.file != nil
+		prefetches.Unlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("prefetch never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h, err := pf.Open(context.Background(), ReadOnly, ProactiveFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Release(ctx, &fuse.ReleaseRequest{})
+	res := &fuse.ReadResponse{}
+	if err = h.Read(ctx, &fuse.ReadRequest{Size: 16}, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Data) != "hello" {
+		t.Errorf("read %q, want hello", res.Data)
+	}
+	if n := atomic.LoadInt32(&du.downloads); n != 1 {
+		t.Errorf("downloaded %d times, want 1", n)
+	}
+}
+
+func TestOpenEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "open-empty-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+	// local copies, leaving out the journal
+	tempFiles := func() int {
+		names, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("mntgd-%d-*", os.Getpid())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names)
+	}
+
+	ctx := context.Background()
+	// a download would bring this in, so we can tell if one happens
+	du := &fakeDU{content: "hello"}
+	pf := NewPhantomFile(context.Background(), du)
+
+	ro, err := pf.Open(ctx, ReadOnly, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := pf.Open(ctx, ReadWrite, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*handle{ro, rw} {
+		res := &fuse.ReadResponse{}
+		if err = h.Read(ctx, &fuse.ReadRequest{Size: 16}, res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Data) != 0 {
+			t.Errorf("read %q, want nothing", res.Data)
+		}
+	}
+	if size, _, ok := pf.StatIfLocal(); !ok || size != 0 {
+		t.Errorf("got local size %d (ok=%t), want 0", size, ok)
+	}
+	if n := tempFiles(); n != 0 {
+		t.Errorf("got %d temp files before any write, want 0", n)
+	}
+
+	if err = rw.Write(ctx, &fuse.WriteRequest{Data: []byte("bye")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := tempFiles(); n != 1 {
+		t.Errorf("got %d temp files after a write, want 1", n)
+	}
+	res := &fuse.ReadResponse{}
+	if err = ro.Read(ctx, &fuse.ReadRequest{Size: 16}, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Data) != "bye" {
+		t.Errorf("read %q after the write, want bye", res.Data)
+	}
+
+	for _, h := range []*handle{ro, rw} {
+		if err = h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(du.uploaded) != 1 || du.uploaded[0] != "bye" {
+		t.Errorf("uploaded %q, want [bye]", du.uploaded)
+	}
+	if n := atomic.LoadInt32(&du.downloads); n != 0 {
+		t.Errorf("downloaded %d times, want 0", n)
+	}
+}
+
+func TestMakeRoom(t *testing.T) {
+	SetCacheQuota("photos", 10)
+	defer delete(cacheQuotas, "photos")
+
+	f, err := ioutil.TempFile("", "mntgd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	prefetches.m["old"] = &prefetched{cancel: func() {}, group: "photos", size: 6, file: f, fetched: time.Now()}
+	defer delete(prefetches.m, "old")
+
+	if !makeRoom("documents", 100) {
+		t.Error("expected room in a group without a quota")
+	}
+	if makeRoom("photos", 11) {
+		t.Error("expected no room for more than the whole quota")
+	}
+	if !makeRoom("photos", 4) {
+		t.Error("expected room alongside what we have")
+	}
+	if _, ok := prefetches.m["old"]; !ok {
+		t.Fatal("discarded a file when there was room for both")
+	}
+	if !makeRoom("photos", 6) {
+		t.Error("expected room after discarding the old file")
+	}
+	if _, ok := prefetches.m["old"]; ok {
+		t.Error("expected the old file to be discarded")
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the old file to be removed, got %v", err)
+	}
+}
+
+// photoDU is in the photos cache group.
+type photoDU struct {
+	fakeDU
+}
+
+func (f *photoDU) CacheGroup() string { return "photos" }
+
+func TestMakeRoomCountsOpenFiles(t *testing.T) {
+	SetCacheQuota("photos", 10)
+	defer delete(cacheQuotas, "photos")
+	ctx := context.Background()
+
+	pf := NewPhantomFile(ctx, &photoDU{fakeDU{content: "sixsix"}})
+	h, err := pf.Open(ctx, ReadOnly, ProactiveFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.of.fetcher.fetch(); err != nil {
+		t.Fatal(err)
+	}
+
+	prefetches.Lock()
+	room := makeRoom("photos", 5)
+	prefetches.Unlock()
+	if room {
+		t.Error("expected the open file to count against the quota")
+	}
+
+	if err = h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	prefetches.Lock()
+	room = makeRoom("photos", 5)
+	prefetches.Unlock()
+	if !room {
+		t.Error("expected room once the file was released")
+	}
+}
+
+func TestFitCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fit-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+	SetCacheSize(10)
+	defer SetCacheSize(0)
+
+	f, err := newTempFile(&fakeDU{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString("sixsix"); err != nil {
+		t.Fatal(err)
+	}
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	prefetches.m["old"] = &prefetched{cancel: func() {}, size: 6, file: f, fetched: time.Now()}
+	defer delete(prefetches.m, "old")
+
+	if fitCache(11) {
+		t.Error("expected no room for more than the whole cache")
+	}
+	if !fitCache(4) {
+		t.Error("expected room alongside what we have")
+	}
+	if _, ok := prefetches.m["old"]; !ok {
+		t.Fatal("discarded a file when there was room for both")
+	}
+	if !fitCache(5) {
+		t.Error("expected room after discarding the old file")
+	}
+	if _, ok := prefetches.m["old"]; ok {
+		t.Error("expected the old file to be discarded")
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the old file to be removed, got %v", err)
+	}
+}
+
+func TestCacheUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-usage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+
+	for name, size := range map[string]int{"mntgd-1-a-b-1": 100, "mntgd-2-c-d-2": 23, "mntgd-setup-3": 500, "unrelated": 1000} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	used, err := CacheUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 123 {
+		t.Errorf("got %d bytes used, want 123", used)
+	}
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remove-orphans-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+
+	// a process that is certainly gone
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := fmt.Sprintf("mntgd-%d-id-name-1", cmd.Process.Pid)
+	mine := fmt.Sprintf("mntgd-%d-id-name-2", os.Getpid())
+	for name, size := range map[string]int{dead: 10, mine: 20, "mntgd-setup-3": 30, "unrelated": 40} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := CacheFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse := map[string]bool{}
+	for _, f := range files {
+		inUse[filepath.Base(f.Path)] = f.InUse
+	}
+	if want := map[string]bool{dead: false, mine: true}; !reflect.DeepEqual(inUse, want) {
+		t.Errorf("got cache files %v, want %v", inUse, want)
+	}
+
+	removed, freed, err := RemoveOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || freed != 10 {
+		t.Errorf("removed %d files and freed %d bytes, want 1 and 10", removed, freed)
+	}
+	for _, name := range []string{mine, "mntgd-setup-3", "unrelated"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, dead)); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", dead, err)
+	}
+}
+
+// slowDU writes half of its content, then waits to be told to write
+// the rest.
+type slowDU struct {
+	fakeDU
+	halfway chan struct{}
+	proceed chan struct{}
+}
+
+func (f *slowDU) Download(ctx context.Context, file *os.File) error {
+	half := len(f.content) / 2
+	if _, err := file.WriteString(f.content[:half]); err != nil {
+		return err
+	}
+	close(f.halfway)
+	select {
+	case <-f.proceed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, err := file.WriteString(f.content[half:])
+	return err
+}
+
+func TestStatDuringDownload(t *testing.T) {
+	ctx := context.Background()
+	du := &slowDU{fakeDU: fakeDU{content: "0123456789"}, halfway: make(chan struct{}), proceed: make(chan struct{})}
+	pf := NewPhantomFile(context.Background(), du)
+
+	h, err := pf.Open(ctx, ReadOnly, ProactiveFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Release(ctx, &fuse.ReleaseRequest{})
+
+	<-du.halfway
+	if size, _, ok := pf.StatIfLocal(); ok {
+		t.Errorf("got local size %d partway through the download, want none", size)
+	}
+
+	close(du.proceed)
+	if err = h.Read(ctx, &fuse.ReadRequest{Size: 10}, &fuse.ReadResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	size, _, ok := pf.StatIfLocal()
+	if !ok || size != 10 {
+		t.Errorf("got local size %d (ok=%t) after the download, want 10", size, ok)
+	}
+}
+
+func TestReadDuringDownload(t *testing.T) {
+	ctx := context.Background()
+	du := &slowDU{fakeDU: fakeDU{content: "0123456789"}, halfway: make(chan struct{}), proceed: make(chan struct{})}
+	pf := NewPhantomFile(context.Background(), du)
+
+	h, err := pf.Open(ctx, ReadOnly, ProactiveFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what has arrived can be read before the rest does
+	<-du.halfway
+	res := &fuse.ReadResponse{}
+	if err = h.Read(ctx, &fuse.ReadRequest{Size: 4}, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Data) != "0123" {
+		t.Errorf("read %q partway through the download, want %q", res.Data, "0123")
+	}
+
+	// a read of what hasn't arrived waits, until it gives up
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	err = h.Read(waitCtx, &fuse.ReadRequest{Offset: 4, Size: 4}, &fuse.ReadResponse{})
+	cancel()
+	if err != fuse.EINTR {
+		t.Errorf("got %v reading what hadn't arrived, want EINTR", err)
+	}
+
+	// releasing the last handle stops the download, rather than
+	// waiting for it
+	released := make(chan error, 1)
+	go func() { released <- h.Release(ctx, &fuse.ReleaseRequest{}) }()
+	select {
+	case err = <-released:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("release waited for the download to finish")
+	}
+}
+
+func TestFetchEndsWithLife(t *testing.T) {
+	ctx := context.Background()
+	life, endLife := context.WithCancel(ctx)
+	du := &slowDU{fakeDU: fakeDU{content: "0123456789"}, halfway: make(chan struct{}), proceed: make(chan struct{})}
+	pf := NewPhantomFile(life, du)
+
+	h, err := pf.Open(ctx, ReadOnly, ProactiveFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Release(ctx, &fuse.ReleaseRequest{})
+
+	<-du.halfway
+	endLife()
+	if err = h.Read(ctx, &fuse.ReadRequest{Offset: 4, Size: 4}, &fuse.ReadResponse{}); err != fuse.EIO {
+		t.Errorf("got %v reading past what was fetched before the file went away, want EIO", err)
+	}
+}
+
+func init() {
+	// most tests upload the same file over and over, and don't want to
+	// wait between uploads
+	SetUploadSpacing(0)
+}
+
+func TestUploadSpacing(t *testing.T) {
+	const spacing = 200 * time.Millisecond
+	SetUploadSpacing(spacing)
+	defer SetUploadSpacing(0)
+
+	du := &fakeDU{}
+	of, err := newOpenFile(context.Background(), context.Background(), du, NoFetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.release(context.Background())
+
+	ctx := context.Background()
+	if err = of.write(ctx, &fuse.WriteRequest{Data: []byte("a")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = of.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := time.Now()
+
+	// several flushes queue up behind the spacing, and the first one
+	// through uploads for all of them
+	if err = of.write(ctx, &fuse.WriteRequest{Data: []byte("b")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- of.flush(ctx) }()
+	}
+	for i := 0; i < 3; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(first); elapsed < spacing {
+		t.Errorf("uploaded again after %s, want at least %s", elapsed, spacing)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(du.uploaded, want) {
+		t.Errorf("uploaded %q, want %q", du.uploaded, want)
+	}
+}
+
+func TestUploadTurnCancel(t *testing.T) {
+	SetUploadSpacing(time.Hour)
+	defer SetUploadSpacing(0)
+
+	done, err := takeUploadTurn(context.Background(), "cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = takeUploadTurn(ctx, "cancel"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// other files don't wait on it
+	done, err = takeUploadTurn(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+}
+
+// baseDU knows what its content in drive was.
+type baseDU struct {
+	fakeDU
+}
+
+func (f *baseDU) UploadBase() string { return "base md5" }
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+
+	ctx := context.Background()
+	du := &baseDU{}
+	of, err := newOpenFile(ctx, ctx, du, NoFetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.release(ctx)
+	if err = of.write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readJournal(journalPath(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalEntry{{ID: "id", Name: "name", Path: of.getTmpFile().Name(), Base: "base md5", journal: journalPath(os.Getpid())}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got journal %+v, want %+v", entries, want)
+	}
+	// we are still running, so nothing of ours is unfinished
+	if unfinished, err := Unfinished(); err != nil || len(unfinished) != 0 {
+		t.Errorf("got unfinished %+v, %v, want none", unfinished, err)
+	}
+
+	if err = of.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(journalPath(os.Getpid())); !os.IsNotExist(err) {
+		t.Errorf("expected the journal to be removed once everything was uploaded, got %v", err)
+	}
+}
+
+func TestUnfinished(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unfinished-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+
+	// a process that is certainly gone, and crashed with changes it
+	// hadn't uploaded
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	changed := filepath.Join(dir, fmt.Sprintf("mntgd-%d-id-name-1", pid))
+	clean := filepath.Join(dir, fmt.Sprintf("mntgd-%d-id2-name2-2", pid))
+	for _, name := range []string{changed, clean} {
+		if err := ioutil.WriteFile(name, []byte("changes"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal := journalPath(pid)
+	gone := JournalEntry{ID: "id3", Name: "name3", Path: filepath.Join(dir, "gone")}
+	if err := writeJournal(journal, []JournalEntry{{ID: "id", Name: "name", Path: changed}, gone}); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, _, err := RemoveOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want only the one without changes", removed)
+	}
+
+	unfinished, err := Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalEntry{{ID: "id", Name: "name", Path: changed, journal: journal}}
+	if !reflect.DeepEqual(unfinished, want) {
+		t.Fatalf("got unfinished %+v, want %+v", unfinished, want)
+	}
+	// looking doesn't change anything
+	if entries, err := readJournal(journal); err != nil || len(entries) != 2 {
+		t.Fatalf("got journal %+v, %v, want both entries still there", entries, err)
+	}
+
+	claimed := claimedJournalPath(journal)
+	unfinished, err = ClaimUnfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []JournalEntry{{ID: "id", Name: "name", Path: changed, journal: claimed}}
+	if !reflect.DeepEqual(unfinished, want) {
+		t.Fatalf("got claimed %+v, want %+v", unfinished, want)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be renamed, got %v", journal, err)
+	}
+	// we are still running, so nobody else gets to claim them, or
+	// removes the local copy
+	if again, err := ClaimUnfinished(); err != nil || len(again) != 0 {
+		t.Errorf("got claimed %+v, %v, want none", again, err)
+	}
+	if removed, _, err := RemoveOrphans(); err != nil || removed != 0 {
+		t.Errorf("removed %d files (%v), want none", removed, err)
+	}
+
+	if err := Finish(unfinished[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{changed, claimed} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
+
+// flakyDU fails its first fails uploads.
+type flakyDU struct {
+	fakeDU
+	fails int32
+}
+
+func (f *flakyDU) Upload(ctx context.Context, file *os.File) error {
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return errors.New("boom")
+	}
+	return f.fakeDU.Upload(ctx, file)
+}
+
+func TestRetryUpload(t *testing.T) {
+	old := firstUploadRetry
+	firstUploadRetry = time.Millisecond
+	defer func() { firstUploadRetry = old }()
+
+	ctx := context.Background()
+	du := &flakyDU{fails: 3}
+	pf := NewPhantomFile(context.Background(), du)
+	h, err := pf.Open(ctx, ReadWrite, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	name := h.of.getTmpFile().Name()
+	failures := UploadFailures()
+	if err = h.Release(ctx, &fuse.ReleaseRequest{}); err == nil {
+		t.Fatal("expected the release to report the failed upload")
+	}
+	if _, err = os.Stat(name); err != nil {
+		t.Fatalf("expected our copy to be kept for a retry, got %v", err)
+	}
+
+	for start := time.Now(); pf.IsOpen(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("gave up waiting for the retry")
+		}
+	}
+	if len(du.uploaded) != 1 || du.uploaded[0] != "hello" {
+		t.Fatalf("uploaded %q, want [hello]", du.uploaded)
+	}
+	if got := UploadFailures() - failures; got != 3 {
+		t.Errorf("counted %d failures, want 3", got)
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed once uploaded, got %v", name, err)
+	}
+	if DirtyCount() != 0 || RetryingCount() != 0 {
+		t.Errorf("got %d dirty and %d retrying, want none", DirtyCount(), RetryingCount())
+	}
+}
+
+func TestRetryUploadLeftForNextRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := tempDir
+	SetTempDir(dir)
+	defer SetTempDir(old)
+	defer func() { dirtyFiles.left = nil }()
+
+	ctx := context.Background()
+	life, unmount := context.WithCancel(ctx)
+	du := &flakyDU{fails: 1000}
+	pf := NewPhantomFile(life, du)
+	h, err := pf.Open(ctx, ReadWrite, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	name := h.of.getTmpFile().Name()
+	h.Release(ctx, &fuse.ReleaseRequest{})
+
+	unmount()
+	for start := time.Now(); pf.IsOpen(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("gave up waiting for the retries to stop")
+		}
+	}
+	if _, err = os.Stat(name); err != nil {
+		t.Fatalf("expected our copy to be left for the next run, got %v", err)
+	}
+	entries, err := readJournal(journalPath(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != name {
+		t.Errorf("got journal %+v, want an entry for %s", entries, name)
+	}
+	if DirtyCount() != 1 {
+		t.Errorf("got %d dirty files, want 1", DirtyCount())
+	}
+}
+
+// pausingDU waits partway through each upload until told to go on.
+type pausingDU struct {
+	fakeDU
+	uploading chan struct{}
+	proceed   chan struct{}
+}
+
+func (f *pausingDU) Upload(ctx context.Context, file *os.File) error {
+	f.uploading <- struct{}{}
+	<-f.proceed
+	return f.fakeDU.Upload(ctx, file)
+}
+
+func TestChangesWaitForUpload(t *testing.T) {
+	ctx := context.Background()
+	du := &pausingDU{uploading: make(chan struct{}), proceed: make(chan struct{})}
+	pf := NewPhantomFile(context.Background(), du)
+	h, err := pf.Open(ctx, ReadWrite, NoFetch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- h.Flush(ctx, &fuse.FlushRequest{}) }()
+	<-du.uploading
+
+	// a truncate and a write, as from an O_TRUNC open elsewhere, wait
+	// until the upload is over rather than changing what it sends
+	changed := make(chan error, 1)
+	go func() {
+		if err := pf.Truncate(ctx, 0); err != nil {
+			changed <- err
+			return
+		}
+		changed <- h.Write(ctx, &fuse.WriteRequest{Data: []byte("bye")}, &fuse.WriteResponse{})
+	}()
+	select {
+	case err = <-changed:
+		t.Fatalf("changed the file partway through an upload (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	du.proceed <- struct{}{}
+	if err = <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if err = <-changed; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { du.proceed <- struct{}{} }()
+	go func() { <-du.uploading }()
+	if err = h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hello", "bye"}; !reflect.DeepEqual(du.uploaded, want) {
+		t.Errorf("uploaded %q, want %q", du.uploaded, want)
+	}
+}
@@ -0,0 +1,88 @@
+package phantomfile
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultUploadSpacing is how long we leave, by default, between the
+// end of one upload of a file and the start of the next.  Drive turns
+// down (with a 403) new revisions of a file that come too quickly, which
+// build systems that rewrite their outputs over and over run into.
+const DefaultUploadSpacing = time.Second
+
+// uploadTurns keeps uploads of each file one at a time, and spaced out,
+// by file id.
+var uploadTurns = struct {
+	sync.Mutex
+	spacing time.Duration
+	m       map[string]*uploadTurn
+}{spacing: DefaultUploadSpacing, m: map[string]*uploadTurn{}}
+
+type uploadTurn struct {
+	// held by whoever is uploading the file
+	mu sync.Mutex
+	// when the last upload of the file finished
+	last time.Time
+	// how many are uploading or waiting to; guarded by uploadTurns
+	users int
+}
+
+// SetUploadSpacing sets the least time we leave between the end of one
+// upload of a file and the start of the next.  Zero only keeps them
+// from overlapping.
+func SetUploadSpacing(d time.Duration) {
+	uploadTurns.Lock()
+	uploadTurns.spacing = d
+	uploadTurns.Unlock()
+}
+
+// takeUploadTurn waits until nobody else is uploading id and the
+// upload spacing has passed since the last upload of id finished.
+// Callers must call done once their upload is over, whether or not it
+// worked.
+func takeUploadTurn(ctx context.Context, id string) (done func(), err error) {
+	uploadTurns.Lock()
+	spacing := uploadTurns.spacing
+	// forget files whose spacing is up, so we don't keep one of these
+	// for every file ever uploaded
+	for other, t := range uploadTurns.m {
+		if t.users == 0 && time.Since(t.last) >= spacing {
+			delete(uploadTurns.m, other)
+		}
+	}
+	t, ok := uploadTurns.m[id]
+	if !ok {
+		t = &uploadTurn{}
+		uploadTurns.m[id] = t
+	}
+	t.users++
+	uploadTurns.Unlock()
+
+	release := func() {
+		uploadTurns.Lock()
+		t.users--
+		uploadTurns.Unlock()
+	}
+
+	t.mu.Lock()
+	if wait := spacing - time.Since(t.last); wait > 0 {
+		logging.For(ctx).Debugf("Waiting %s before uploading %s again", wait, id)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			t.mu.Unlock()
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		t.last = time.Now()
+		t.mu.Unlock()
+		release()
+	}, nil
+}
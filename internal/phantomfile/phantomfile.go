@@ -2,17 +2,146 @@ package phantomfile
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
 	"bazil.org/fuse"
 
 	"golang.org/x/net/context"
 )
 
+// tempDir is where we create local copies of file content.  Empty
+// means the system temp dir.
+var tempDir string
+
+// SetTempDir sets the directory where we create local copies of file
+// content.  It must be called before any files are opened.
+func SetTempDir(dir string) {
+	tempDir = dir
+}
+
+// CacheDir returns the directory where we create local copies of file
+// content.
+func CacheDir() string {
+	if tempDir == "" {
+		return os.TempDir()
+	}
+	return tempDir
+}
+
+// CacheFile is a local copy of file content in the cache dir.
+type CacheFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Pid is the process that made the copy
+	Pid int
+	// InUse is true when that process is still running, in which case
+	// the copy may be open or hold changes that haven't been uploaded
+	InUse bool
+}
+
+// CacheFiles returns every local copy of file content in the cache
+// dir, whether it belongs to us, to another running mnt-gdrive or to
+// one that is gone.
+func CacheFiles() ([]CacheFile, error) {
+	names, err := filepath.Glob(filepath.Join(CacheDir(), "mntgd-*"))
+	if err != nil {
+		return nil, err
+	}
+	var files []CacheFile
+	for _, name := range names {
+		pid, ok := tempFilePid(filepath.Base(name))
+		if !ok {
+			// not something we made
+			continue
+		}
+		fi, err := os.Lstat(name)
+		if err != nil || !fi.Mode().IsRegular() {
+			// released while we were looking
+			continue
+		}
+		files = append(files, CacheFile{
+			Path:    name,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Pid:     pid,
+			InUse:   processRunning(pid)})
+	}
+	return files, nil
+}
+
+// CacheUsage returns how many bytes our local copies of file content
+// take up right now.
+func CacheUsage() (int64, error) {
+	files, err := CacheFiles()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	return total, nil
+}
+
+// RemoveOrphans removes local copies of file content left behind by
+// an mnt-gdrive process that is no longer running, e.g. one that
+// crashed or was killed.  We never read those copies again, so all
+// they do is take up space.  Copies that belong to a running process,
+// including this one, are left alone, as are copies with changes its
+// journal says it didn't upload, and anything we didn't create.
+// It returns how many files it removed and how many bytes that freed.
+func RemoveOrphans() (removed int, freed int64, err error) {
+	files, err := CacheFiles()
+	if err != nil {
+		return 0, 0, err
+	}
+	unfinished := unfinishedPaths()
+	for _, f := range files {
+		if f.InUse || unfinished[f.Path] {
+			continue
+		}
+		if err := os.Remove(f.Path); err != nil {
+			logging.Warnf("Unable to remove orphaned %s: %v", f.Path, err)
+			continue
+		}
+		removed++
+		freed += f.Size
+	}
+	return removed, freed, nil
+}
+
+// tempFilePid returns the pid at the start of a temp file name made by
+// newTempFile.
+func tempFilePid(base string) (int, bool) {
+	parts := strings.SplitN(base, "-", 3)
+	if len(parts) != 3 || parts[0] != "mntgd" {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(parts[1])
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+func processRunning(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	// EPERM means it is there but belongs to someone else
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
 // DownloaderUploader is something we know how to download and upload
 type DownloaderUploader interface {
 	Download(context.Context, *os.File) error
@@ -25,55 +154,104 @@ type DownloaderUploader interface {
 // PhantomFile handles file-related requests for gdrive files that
 // sometimes have a local presence on the file system (e.g. while
 // open) and sometimes don't.
+//
+// All handles open at the same time share a single local copy of the
+// content.  Writes and truncates through any handle wait for the
+// initial fetch to finish and then operate on that shared copy, so
+// bytes written through one handle are visible to reads through every
+// other handle right away, before anything is flushed.  Reads only
+// wait for the part they want, so a program that reads the start of a
+// file and closes it (as file managers do, for previews) isn't held up
+// by the rest, which we stop fetching once the last handle is released.
 type PhantomFile struct {
-	du          DownloaderUploader
+	du DownloaderUploader
+	// done once fetching the file's content is pointless, e.g. because
+	// it is gone from drive or we are unmounting
+	life        context.Context
 	mu          sync.Mutex
 	handleCount uint32
 	of          *openFile
+	// set while retryUploads is keeping of, which nothing has open, to
+	// get its changes to drive
+	retrying bool
+}
+
+// NewPhantomFile creates a PhantomFile.  Fetches of its content
+// outlive the requests that start them, but are cancelled once life is
+// done.
+func NewPhantomFile(life context.Context, du DownloaderUploader) *PhantomFile {
+	return &PhantomFile{du: du, life: life}
 }
 
-// NewPhantomFile creates a PhantomFile
-func NewPhantomFile(du DownloaderUploader) *PhantomFile {
-	return &PhantomFile{du: du}
+// Open opens the associated file on behalf of the process with pid.
+func (pf *PhantomFile) Open(ctx context.Context, am AccessMode, fm FetchMode, pid uint32) (*handle, error) {
+	h, _, err := pf.open(ctx, am, fm, pid)
+	return h, err
 }
 
-// Open opens the associated file
-func (pf *PhantomFile) Open(am AccessMode, fm FetchMode) (*handle, error) {
+// open is Open, also saying whether the file was open already.
+func (pf *PhantomFile) open(ctx context.Context, am AccessMode, fm FetchMode, pid uint32) (h *handle, wasOpen bool, err error) {
+	// finding the group may take locks of the file's own, so we do it
+	// before taking ours
+	group, grouped := cacheGroupOf(pf.du)
 	pf.mu.Lock()
 	defer pf.mu.Unlock()
+	wasOpen = pf.handleCount > 0
 	if pf.of == nil {
-		of, err := newOpenFile(pf.du, fm)
+		of, err := newOpenFile(ctx, pf.life, pf.du, fm)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		pf.of = of
+		if grouped {
+			countCopy(of, group)
+		}
 	}
 
 	pf.handleCount++
-	return newHandle(pf, am), nil
+	return newHandle(pf, am, pid), wasOpen, nil
 }
 
-// StatIfLocal runs a stat on the associated file if local.  Otherwise it returns cached stat values.
+// StatIfLocal runs a stat on the associated file if we have all of its
+// content locally.  Otherwise ok is false and the caller should use
+// what drive told it.
 func (pf *PhantomFile) StatIfLocal() (size int64, modTime time.Time, ok bool) {
 	pf.mu.Lock()
 	defer pf.mu.Unlock()
 	defer func() {
-		log.Printf("StatIfLocal: of nil=%t, size=%d, modTime=%q, ok=%t",
+		logging.Debugf("StatIfLocal: of nil=%t, size=%d, modTime=%q, ok=%t",
 			pf.of == nil, size, modTime, ok)
 	}()
 	if pf.of == nil {
 		return size, modTime, false
 	}
-	fi, err := pf.of.stat()
+	if !pf.of.fetcher.complete() {
+		// the local copy is still growing, so it would make the file
+		// look like it was shrinking; stick with what drive says until
+		// we have all of it
+		return size, modTime, false
+	}
+	size, modTime, err := pf.of.stat()
 	if err != nil {
-		log.Printf("StatIfLocal for %q failed: %v", pf.of, err)
+		logging.Errorf("StatIfLocal for %q failed: %v", pf.of, err)
 		return size, modTime, false
 	}
 
-	return fi.Size(), fi.ModTime(), true
+	return size, modTime, true
 }
 
-// Truncate truncates the associated file.
+// IsOpen returns true if the associated file has a local copy because
+// it is open, whether or not we have all of its content yet.
+func (pf *PhantomFile) IsOpen() bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	return pf.of != nil
+}
+
+// Truncate truncates the associated file.  If it is open, the change
+// is uploaded with the rest, when it is closed or flushed, so a program
+// that truncates and then writes doesn't leave a short revision behind
+// in drive.  Otherwise it is uploaded right away.
 func (pf *PhantomFile) Truncate(ctx context.Context, size int64) error {
 	var fm FetchMode
 	if size == 0 {
@@ -81,10 +259,20 @@ func (pf *PhantomFile) Truncate(ctx context.Context, size int64) error {
 	} else {
 		fm = ProactiveFetch
 	}
-	h, err := pf.Open(WriteOnly, fm)
+	h, wasOpen, err := pf.open(ctx, WriteOnly, fm, 0)
 	if err != nil {
 		return err
 	}
+	if wasOpen {
+		// Releasing h normally would upload, so we just let go of it.
+		// If everyone else closed meanwhile, that keeps the changed
+		// copy and uploads it in the background.
+		defer func() {
+			h.release()
+			pf.release(ctx)
+		}()
+		return h.of.truncate(size)
+	}
 	defer h.Release(ctx, &fuse.ReleaseRequest{})
 	if err = h.of.truncate(size); err != nil {
 		return err
@@ -93,13 +281,70 @@ func (pf *PhantomFile) Truncate(ctx context.Context, size int64) error {
 	return h.Flush(ctx, &fuse.FlushRequest{})
 }
 
+// Flush uploads any changes to the associated file that haven't been
+// uploaded yet, waiting for an upload that is already underway.  It
+// does nothing if the file isn't open.
+func (pf *PhantomFile) Flush(ctx context.Context) error {
+	pf.mu.Lock()
+	of := pf.of
+	pf.mu.Unlock()
+	if of == nil {
+		return nil
+	}
+	return of.flush(ctx)
+}
+
+// Prefetch starts downloading the content of the associated file,
+// which we expect to be size bytes, in the background, so that it is
+// ready if someone opens it soon.  It counts against the cache quota
+// of group, if there is one.  It does nothing if the file is already
+// open.
+func (pf *PhantomFile) Prefetch(group string, size int64) {
+	pf.mu.Lock()
+	open := pf.of != nil
+	pf.mu.Unlock()
+	if !open {
+		prefetch(pf.life, pf.du, group, size)
+	}
+}
+
+// Close uploads any changes to the associated file and lets go of its
+// local copy, and of any prefetched one, whether or not handles to it
+// are still open.  It is for when the kernel has gone away, so nothing
+// is going to release them.  Handles left open fail from then on.
+func (pf *PhantomFile) Close(ctx context.Context) error {
+	Forget(pf.du.ID())
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.of == nil {
+		return nil
+	}
+	err := pf.of.flush(ctx)
+	if rerr := pf.of.release(ctx); err == nil {
+		err = rerr
+	}
+	pf.of = nil
+	pf.handleCount = 0
+	return err
+}
+
 func (pf *PhantomFile) release(ctx context.Context) error {
 	pf.mu.Lock()
 	defer pf.mu.Unlock()
+	if pf.handleCount == 0 {
+		// we were closed with this handle still open
+		return nil
+	}
 	pf.handleCount--
 	if pf.handleCount > 0 {
 		return nil
 	}
+	if pf.of.isDirty() {
+		// the upload failed, so we hang on to our copy, which opens
+		// share meanwhile, until a retry gets it to drive
+		pf.queueRetryLocked()
+		return nil
+	}
 	err := pf.of.release(ctx)
 	pf.of = nil
 	return err
@@ -0,0 +1,316 @@
+package phantomfile
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// how many files we download ahead of time at once, so that
+// prefetching doesn't crowd out files people are waiting on
+const maxConcurrentPrefetches = 2
+
+// how many prefetched files we hold on to, waiting for someone to
+// open them
+const maxPrefetched = 8
+
+// how long we hold on to a prefetched file that nobody opens
+const prefetchedTTL = 5 * time.Minute
+
+var prefetchSlots = make(chan struct{}, maxConcurrentPrefetches)
+
+// prefetches holds files that are downloaded, or being downloaded,
+// ahead of time, by id.
+var prefetches = struct {
+	sync.Mutex
+	m map[string]*prefetched
+}{m: map[string]*prefetched{}}
+
+// cacheQuotas limits how many bytes of local copies we hold for each
+// group, so that one big folder doesn't crowd out the others.  Groups
+// without an entry have no limit of their own.  We stay under them by
+// throwing away prefetched files; copies that are open stay.
+var cacheQuotas = map[string]int64{}
+
+// SetCacheQuota limits how many bytes of local copies we hold for files
+// in group.  It must be called before anything is opened.
+func SetCacheQuota(group string, limit int64) {
+	cacheQuotas[group] = limit
+}
+
+// cacheGrouper is a DownloaderUploader whose local copies count against
+// the cache quota of a group.
+type cacheGrouper interface {
+	CacheGroup() string
+}
+
+// openCopies holds the group of every openFile that counts against a
+// cache quota.
+var openCopies = struct {
+	sync.Mutex
+	m map[*openFile]string
+}{m: map[*openFile]string{}}
+
+// cacheGroupOf returns the group whose cache quota the local copies of
+// du count against, if there is one.
+func cacheGroupOf(du DownloaderUploader) (string, bool) {
+	cg, ok := du.(cacheGrouper)
+	if !ok || len(cacheQuotas) == 0 {
+		return "", false
+	}
+	group := cg.CacheGroup()
+	_, ok = cacheQuotas[group]
+	return group, ok
+}
+
+// countCopy makes o count against the cache quota of group until it is
+// released.
+func countCopy(o *openFile, group string) {
+	openCopies.Lock()
+	defer openCopies.Unlock()
+	openCopies.m[o] = group
+}
+
+// openSize returns how many bytes the local copies of open files in
+// group take up.
+func openSize(group string) int64 {
+	openCopies.Lock()
+	defer openCopies.Unlock()
+	var total int64
+	for o, g := range openCopies.m {
+		if g != group {
+			continue
+		}
+		if f := o.getTmpFile(); f != nil {
+			if fi, err := f.Stat(); err == nil {
+				total += fi.Size()
+			}
+		}
+	}
+	return total
+}
+
+// cacheLimit is how many bytes we try to keep our local copies under,
+// in all, or zero for no limit.  We stay under it by throwing away
+// prefetched files; copies that are open, or hold changes, stay.
+var cacheLimit int64
+
+// SetCacheSize limits how many bytes our local copies may take up in
+// the cache dir.  It must be called before anything is opened.
+func SetCacheSize(limit int64) {
+	cacheLimit = limit
+}
+
+type prefetched struct {
+	cancel context.CancelFunc
+	group  string
+	// how big we expect the content to be
+	size int64
+	// set once the download has finished successfully
+	file    *os.File
+	fetched time.Time
+}
+
+// discard gets rid of the prefetched content.  Must be called with the
+// prefetches lock held, after removing p from the map.
+func (p *prefetched) discard() {
+	p.cancel()
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+	}
+}
+
+// prefetch downloads the content of du, which we expect to be size
+// bytes, in the background, unless we already have it or are holding
+// on to as many files as we care to.  The download stops if life is
+// done first.
+func prefetch(life context.Context, du DownloaderUploader, group string, size int64) {
+	id := du.ID()
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	if _, ok := prefetches.m[id]; ok {
+		return
+	}
+	expirePrefetched()
+	if len(prefetches.m) >= maxPrefetched || !makeRoom(group, size) || !fitCache(size) {
+		return
+	}
+	ctx, cancel := context.WithCancel(life)
+	p := &prefetched{cancel: cancel, group: group, size: size}
+	prefetches.m[id] = p
+
+	go func() {
+		select {
+		case prefetchSlots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-prefetchSlots }()
+
+		f, err := newTempFile(du)
+		if err == nil {
+			logging.Debugf("prefetching content for %q...", du)
+			if err = du.Download(ctx, f); err != nil {
+				logging.Warnf("Failed to prefetch content for %q: %v", du, err)
+			}
+		}
+
+		prefetches.Lock()
+		defer prefetches.Unlock()
+		if err == nil && prefetches.m[id] == p {
+			p.file = f
+			p.fetched = time.Now()
+			return
+		}
+		if prefetches.m[id] == p {
+			delete(prefetches.m, id)
+		}
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+}
+
+// expirePrefetched drops prefetched files that have waited too long.
+// Must be called with the prefetches lock held.
+func expirePrefetched() {
+	for id, p := range prefetches.m {
+		if p.file != nil && time.Since(p.fetched) > prefetchedTTL {
+			delete(prefetches.m, id)
+			p.discard()
+		}
+	}
+}
+
+// makeRoom returns true if we can hold size more bytes for group
+// without going over its quota, discarding the files in the group that
+// have waited longest if that is what it takes.  Must be called with
+// the prefetches lock held.
+func makeRoom(group string, size int64) bool {
+	limit, ok := cacheQuotas[group]
+	if !ok {
+		return true
+	}
+	if size > limit {
+		return false
+	}
+	open := openSize(group)
+	for {
+		used := open
+		var oldestID string
+		var oldest *prefetched
+		for id, p := range prefetches.m {
+			if p.group != group {
+				continue
+			}
+			used += p.size
+			if p.file != nil && (oldest == nil || p.fetched.Before(oldest.fetched)) {
+				oldestID, oldest = id, p
+			}
+		}
+		if used+size <= limit {
+			return true
+		}
+		if oldest == nil {
+			// everything else in the group is open, or still
+			// downloading
+			return false
+		}
+		delete(prefetches.m, oldestID)
+		oldest.discard()
+	}
+}
+
+// fitCache returns true if our local copies have room for size more
+// bytes without going over cacheLimit, discarding the prefetched files
+// that have waited longest if that is what it takes.  Must be called
+// with the prefetches lock held.
+func fitCache(size int64) bool {
+	if cacheLimit <= 0 {
+		return true
+	}
+	if size > cacheLimit {
+		return false
+	}
+	used, err := CacheUsage()
+	if err != nil {
+		logging.Warnf("Unable to tell how much of the cache is used: %v", err)
+		return true
+	}
+	for _, p := range prefetches.m {
+		if p.file == nil {
+			// still downloading, so it will take up more
+			used += p.size
+		}
+	}
+	for used+size > cacheLimit {
+		var oldestID string
+		var oldest *prefetched
+		for id, p := range prefetches.m {
+			if p.file != nil && (oldest == nil || p.fetched.Before(oldest.fetched)) {
+				oldestID, oldest = id, p
+			}
+		}
+		if oldest == nil {
+			// what is left is open, or holds changes
+			return false
+		}
+		delete(prefetches.m, oldestID)
+		oldest.discard()
+		used -= oldest.size
+	}
+	return true
+}
+
+// trimCache discards prefetched files until our local copies fit in
+// their groups' quotas, and under cacheLimit, again, e.g. after we
+// download a file someone opened.
+func trimCache() {
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	for group := range cacheQuotas {
+		makeRoom(group, 0)
+	}
+	fitCache(0)
+}
+
+// takePrefetched returns the prefetched content for id, if we have
+// finished downloading it, and forgets about it.  The caller owns the
+// file from then on.
+func takePrefetched(id string) *os.File {
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	expirePrefetched()
+	p, ok := prefetches.m[id]
+	if !ok || p.file == nil {
+		return nil
+	}
+	delete(prefetches.m, id)
+	return p.file
+}
+
+// Prefetched returns true if we have finished prefetching the content
+// for id, and it is waiting for someone to open it.
+func Prefetched(id string) bool {
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	p, ok := prefetches.m[id]
+	return ok && p.file != nil
+}
+
+// Forget drops any prefetched content for id, e.g. because the file
+// has changed since we fetched it.
+func Forget(id string) {
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	if p, ok := prefetches.m[id]; ok {
+		delete(prefetches.m, id)
+		p.discard()
+	}
+}
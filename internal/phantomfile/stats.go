@@ -0,0 +1,78 @@
+package phantomfile
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveHandles holds every handle that hasn't been released yet.
+var liveHandles = struct {
+	sync.Mutex
+	m map[*handle]bool
+}{m: map[*handle]bool{}}
+
+// HandleStats describes one open handle and what has been done with it.
+type HandleStats struct {
+	File   DownloaderUploader
+	Mode   AccessMode
+	Pid    uint32
+	Opened time.Time
+
+	Reads        uint64
+	BytesRead    uint64
+	Writes       uint64
+	BytesWritten uint64
+}
+
+// OpenHandles returns the stats of every handle that is open right
+// now, ordered by pid and then by when they were opened.
+func OpenHandles() []HandleStats {
+	liveHandles.Lock()
+	var result []HandleStats
+	for h := range liveHandles.m {
+		result = append(result, h.stats())
+	}
+	liveHandles.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Pid != result[j].Pid {
+			return result[i].Pid < result[j].Pid
+		}
+		return result[i].Opened.Before(result[j].Opened)
+	})
+	return result
+}
+
+// handleCounters tracks the reads and writes done through one handle.
+// Only access via atomic.
+type handleCounters struct {
+	reads        uint64
+	bytesRead    uint64
+	writes       uint64
+	bytesWritten uint64
+}
+
+func (c *handleCounters) countRead(n int) {
+	atomic.AddUint64(&c.reads, 1)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+}
+
+func (c *handleCounters) countWrite(n int) {
+	atomic.AddUint64(&c.writes, 1)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+}
+
+func (h *handle) stats() HandleStats {
+	return HandleStats{
+		File:         h.pf.du,
+		Mode:         h.am,
+		Pid:          h.pid,
+		Opened:       h.opened,
+		Reads:        atomic.LoadUint64(&h.counters.reads),
+		BytesRead:    atomic.LoadUint64(&h.counters.bytesRead),
+		Writes:       atomic.LoadUint64(&h.counters.writes),
+		BytesWritten: atomic.LoadUint64(&h.counters.bytesWritten),
+	}
+}
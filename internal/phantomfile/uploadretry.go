@@ -0,0 +1,93 @@
+package phantomfile
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+)
+
+// How long we wait before trying a failed upload again, the first time
+// and at most.  The wait doubles with each try.  These are variables so
+// tests can shorten them.
+var (
+	firstUploadRetry = 5 * time.Second
+	maxUploadRetry   = 10 * time.Minute
+)
+
+// after this many failed tries in a row, we complain louder
+const persistentUploadFailures = 5
+
+// only access via atomic
+var (
+	// uploads that failed, whether or not a retry worked later
+	uploadFailures uint64
+	// files nothing has open whose changes we are trying to upload again
+	retryingUploads int32
+)
+
+// UploadFailures returns how many uploads have failed so far.
+func UploadFailures() uint64 {
+	return atomic.LoadUint64(&uploadFailures)
+}
+
+// RetryingCount returns how many closed files have changes we are
+// still trying to upload.
+func RetryingCount() int {
+	return int(atomic.LoadInt32(&retryingUploads))
+}
+
+// queueRetryLocked starts trying to upload our changes again in the
+// background, unless we already are.  Must be called with pf.mu held.
+func (pf *PhantomFile) queueRetryLocked() {
+	if pf.retrying {
+		return
+	}
+	pf.retrying = true
+	atomic.AddInt32(&retryingUploads, 1)
+	logging.Warnf("Unable to upload changes to %s, will keep trying", pf.du)
+	go pf.retryUploads(pf.of)
+}
+
+// retryUploads tries to upload of's changes, backing off more each
+// time, until one works or our life is over.  Then, if nothing has
+// opened the file again meanwhile, it lets go of of, which leaves any
+// changes it still has for the next run.
+func (pf *PhantomFile) retryUploads(of *openFile) {
+	defer atomic.AddInt32(&retryingUploads, -1)
+	wait := firstUploadRetry
+	for tries := 1; ; tries++ {
+		timer := time.NewTimer(wait)
+		select {
+		case <-pf.life.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if pf.life.Err() != nil {
+			break
+		}
+		err := of.flush(pf.life)
+		if err == nil {
+			logging.Infof("Uploaded changes to %s on retry %d", pf.du, tries)
+			break
+		}
+		if tries%persistentUploadFailures == 0 {
+			logging.Errorf("Still unable to upload changes to %s after %d retries: %v", pf.du, tries, err)
+		} else {
+			logging.Warnf("Retry %d of upload of %s failed: %v", tries, pf.du, err)
+		}
+		if wait *= 2; wait > maxUploadRetry {
+			wait = maxUploadRetry
+		}
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.retrying = false
+	if pf.of != of || pf.handleCount > 0 {
+		// opened again, so whoever closes it last takes over
+		return
+	}
+	of.release(pf.life)
+	pf.of = nil
+}
@@ -0,0 +1,36 @@
+// Package sdnotify tells systemd about our state, for units with
+// Type=notify.
+package sdnotify
+
+import (
+	"net"
+	"os"
+)
+
+// States we report
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+)
+
+// Notify sends state to systemd.  It returns false, with no error, if
+// we weren't started by systemd with a notify socket.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// a leading @ means an abstract socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
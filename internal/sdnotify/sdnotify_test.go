@@ -0,0 +1,43 @@
+package sdnotify
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", path)
+	sent, err := Notify(Ready)
+	if err != nil || !sent {
+		t.Fatalf("Notify = %t, %v", sent, err)
+	}
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != Ready {
+		t.Errorf("got %q, want %q", got, Ready)
+	}
+
+	os.Setenv("NOTIFY_SOCKET", "")
+	if sent, err = Notify(Ready); sent || err != nil {
+		t.Errorf("without a socket, Notify = %t, %v", sent, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+)
+
+// callJob sends req to the mount at mountpoint and prints the job it
+// started.
+func callJob(mountpoint string, req control.Request) error {
+	sockPath, err := control.SocketPath(mountpoint)
+	if err != nil {
+		return err
+	}
+	var reply control.JobReply
+	err = control.CallRequest(sockPath, req, func(dec *json.Decoder) error {
+		return dec.Decode(&reply)
+	})
+	switch {
+	case err != nil:
+		return err
+	case reply.Error != "":
+		return errors.New(reply.Error)
+	case reply.Job != nil:
+		fmt.Printf("started job %s, see %s/.mntgdrive/jobs/%s\n", reply.Job.ID, mountpoint, reply.Job.ID)
+	}
+	return nil
+}
+
+var jobsCommand = cli.Command{
+	Name:      "jobs",
+	Usage:     "list the jobs of a running mount, or cancel one",
+	ArgsUsage: "MOUNTPOINT",
+	Action:    jobs,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "cancel",
+			Usage: "Cancel the job with this id.",
+		},
+	},
+}
+
+func jobs(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("You must specify a single argument which is the mount point of a running mount.", 1)
+	}
+	mountpoint := ctx.Args().First()
+	if id := ctx.String("cancel"); id != "" {
+		if err := callJob(mountpoint, control.Request{Op: control.OpCancel, Args: []string{id}}); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to cancel job %s: %v", id, err), 1)
+		}
+		return nil
+	}
+
+	sockPath, err := control.SocketPath(mountpoint)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var sts []control.JobStatus
+	err = control.Call(sockPath, control.OpJobs, func(dec *json.Decoder) error {
+		return dec.Decode(&sts)
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, st := range sts {
+		progress := fmt.Sprintf("%d", st.Done)
+		if st.Total > 0 {
+			progress = fmt.Sprintf("%d/%d", st.Done, st.Total)
+		}
+		line := fmt.Sprintf("%-4s %-10s %-9s %-9s %v", st.ID, st.Op, st.State, progress, st.Args)
+		if st.Error != "" {
+			line += " " + st.Error
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
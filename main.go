@@ -1,56 +1,32 @@
-// Hellofs implements a simple "hello world" file system.
+// mnt-gdrive mounts google drive as a fuse file system.  See the
+// mntgdrive package for the file system itself.
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
-	"strings"
-	"sync"
 	"syscall"
-	"time"
 
 	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
 	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
-	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
-
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
-	_ "bazil.org/fuse/fs/fstestutil"
-	"golang.org/x/net/context"
-)
-
-const (
-	// Not sure if something in the kernel or fuse might get upset by a zero value, so we
-	// skip past it.
-	reservedIdx = iota
-
-	// Group of special fixed indices for 'magic' files that aren't part of gdrive and a
-	// therefore outside of our normal allocation mechanism.
-	dumpIdx
-
-	// Where we start allocating indices for gdrive files
-	firstDynamicIdx
-)
-
-const (
-	modeReadOnly  os.FileMode = 0555
-	modeReadWrite os.FileMode = 0777
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/sdnotify"
+	"github.com/ginabythebay/mnt-gdrive/mntgdrive"
 )
 
-// TODO(gina) make this configurable
-const changeFetchSleep = time.Duration(5) * time.Second
-
-// The handle that the kernel expects to use when identifying files and directories.  The
-// kernel often calls this inode.  But it also uses inode but since inode is also used to
-// refer to the struct that many filesystems use, that seems confusing.
-type index uint64
+// defaults are what we mount with when the command line and config
+// file don't say otherwise.
+var defaults = mntgdrive.DefaultOptions()
 
 func main() {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		stacktrace := make([]byte, 8192)
 		for range sigChan {
@@ -64,796 +40,332 @@ func main() {
 	app.Name = "mnt-gdrive"
 	app.Usage = "mount a google drive as a fuse filesystem"
 	app.Action = mount
-	app.Flags = []cli.Flag{
+	app.Flags = append([]cli.Flag{
 		cli.BoolFlag{
 			Name:  "w, writeable",
 			Usage: "Mounts drive using writeable mode"},
+		cli.BoolFlag{
+			Name:  "strict-writeable",
+			Usage: "with --writeable, fail rather than mount read-only when we are only authorized to read"},
+		cli.StringFlag{
+			Name:  "root-folder-id",
+			Usage: "id of the drive folder to mount as the root, instead of My Drive"},
+		cli.StringFlag{
+			Name:  "root-folder",
+			Usage: "path, within My Drive (or the shared drive), of the folder to mount as the root, e.g. Projects/2016"},
+		cli.StringFlag{
+			Name:  "others-files",
+			Value: "hide",
+			Usage: "what to do with files owned by other people that are in your folders: hide, readonly, or editable (if they let you)"},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "where to keep local copies of files, overriding the config file (default: the system temp dir)"},
+		cli.BoolFlag{
+			Name:  "mount-trash",
+			Usage: "present what is in the trash, by the day it was trashed and where it used to be, instead of the drive"},
+		cli.BoolFlag{
+			Name:  "spaces",
+			Usage: "put My Drive, what is shared with you, shared drives, the trash and recent files side by side, as mydrive, shared-with-me, shared-drives, trash and recent"},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "mount writeable, but only log the changes programs make (creates, renames, trashes, uploads) instead of making them in drive"},
+		cli.BoolFlag{
+			Name:  "export-zip",
+			Usage: "put the zip export of each google docs file next to it, as <name>.zip, e.g. for backups"},
+		cli.BoolFlag{
+			Name:  "gdoc-stubs",
+			Usage: "show google docs files as .gdoc (or .gsheet etc) stubs that open them in a browser, instead of exporting them"},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "hide files and folders with names matching this pattern, e.g. *.iso, or node_modules/ for just folders (may be repeated; adds to the config file's)"},
+		cli.BoolFlag{
+			Name:  "allow-other",
+			Usage: "let users other than you see the mount (needs user_allow_other in /etc/fuse.conf)"},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "with --allow-other, add a line to this file saying who read what each time someone closes a file they read"},
+		cli.BoolFlag{
+			Name:  "strict-posix",
+			Usage: "act like a posix filesystem wherever we can (O_EXCL, rename over existing files, sorted listings, posix errors), e.g. for test suites"},
+		cli.StringFlag{
+			Name:  "volume-name",
+			Value: defaults.VolumeName,
+			Usage: "name of the mount in Finder and in the list of mounted file systems; {email} and {root} stand for the account and the folder or drive mounted"},
+		cli.StringFlag{
+			Name:  "volume-icon",
+			Usage: ".icns file for Finder to show as the mount's icon"},
+		cli.IntFlag{
+			Name:  "prefetch",
+			Value: defaults.Prefetch,
+			Usage: "when a program opens the files in a folder one after another, download this many of the following files ahead of time; 0 turns that off"},
+		cli.DurationFlag{
+			Name:  "metadata-delay",
+			Usage: "hold on to renames and moves, and send them to drive in batches this often; 0 sends each one right away"},
+		cli.DurationFlag{
+			Name:  "interactive-retry-budget",
+			Value: defaults.InteractiveRetryBudget,
+			Usage: "how long a file system operation keeps trying again after transient errors from google before it fails; 0 fails right away"},
+		cli.IntFlag{
+			Name:  "remount-retries",
+			Usage: "how many times in a row to try mounting again if we lose our mount, other than by umount; 0 means never"},
+		cli.DurationFlag{
+			Name:  "remount-backoff",
+			Value: defaults.RemountBackoff,
+			Usage: "how long to wait before the first try at mounting again; doubles with each try"},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "least important messages to log: debug (every file system request), info, warn or error"},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "file to append log messages to, instead of stderr (with --daemon, instead of the file next to the control socket)"},
+		cli.BoolFlag{
+			Name:  "daemon",
+			Usage: "run in the background once the drive is mounted"},
+		cli.StringFlag{
+			Name:  "pidfile",
+			Usage: "with --daemon, where to write the process id (default: next to the control socket)"},
+		cli.DurationFlag{
+			Name:  "refresh-after",
+			Value: defaults.RefreshAfter,
+			Usage: "when we haven't heard from the change feed for this long, re-fetch the metadata of files as they are statted; 0 turns that off"},
+		cli.DurationFlag{
+			Name:  "upload-spacing",
+			Value: defaults.UploadSpacing,
+			Usage: "the least time to leave between uploads of the same file; saves made meanwhile go up together in the next one"},
+	}, driveFlags...)
+	app.Commands = []cli.Command{
+		cacheCommand,
+		doctorCommand,
+		connectionsCommand,
+		quotaCommand,
+		setupCommand,
+		jobsCommand,
+		resyncCommand,
+		statusCommand,
+		umountCommand,
+		versionCommand,
+		watchCommand,
 	}
 	app.Run(os.Args)
 }
 
+// driveFlags control how we talk to google drive.  They are shared by
+// every command that does.
+var driveFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "profile",
+		Usage: "name of the google account to use, each authorized separately with 'mnt-gdrive setup --profile'; empty is the default account"},
+	cli.StringFlag{
+		Name:  "scope",
+		Usage: "how much of your drive to ask for: full, or file for only the files mnt-gdrive created (default: what setup chose)"},
+	cli.StringFlag{
+		Name:  "proxy",
+		Usage: "http or https proxy url to use for all google drive traffic, overriding the environment"},
+	cli.StringFlag{
+		Name:  "ca-bundle",
+		Usage: "file of PEM encoded certificates to trust instead of the system roots"},
+	cli.StringFlag{
+		Name:  "shared-drive-id",
+		Usage: "id of a shared drive to use instead of My Drive"},
+	cli.DurationFlag{
+		Name:  "idle-conn-timeout",
+		Usage: "how long to keep idle connections to google for reuse (default 90s)"},
+	cli.IntFlag{
+		Name:  "max-idle-conns-per-host",
+		Usage: "how many idle connections to each google host to keep for reuse (default 2)"},
+	cli.BoolFlag{
+		Name:  "no-keep-alives",
+		Usage: "use a new connection for every request to google"},
+	cli.BoolFlag{
+		Name:  "app-data",
+		Usage: "also ask for access to the hidden app data folder, and show it as .appdata at the top of the mount"},
+	cli.DurationFlag{
+		Name:  "list-cache-ttl",
+		Value: gdrive.DefaultListCacheTTL,
+		Usage: "how long to reuse the results of listing a folder; 0 turns that off"},
+	cli.BoolFlag{
+		Name:  "convert-uploads",
+		Usage: "make .docx, .xlsx and .pptx files created in the mount into google docs, sheets and slides"},
+	cli.DurationFlag{
+		Name:  "stall-timeout",
+		Value: gdrive.DefaultStallTimeout,
+		Usage: "how long a download may go without any bytes arriving before we try again; 0 waits forever"},
+	cli.DurationFlag{
+		Name:  "token-refresh-early",
+		Value: gdrive.DefaultTokenRefreshEarly,
+		Usage: "how long before an access token expires to get a new one"},
+	cli.DurationFlag{
+		Name:  "retry-budget",
+		Value: gdrive.DefaultRetryBudget,
+		Usage: "how long background work (the change feed, jobs, uploads at unmount) keeps trying again after transient errors from google; 0 never tries again"},
+	cli.Float64Flag{
+		Name:  "requests-per-second",
+		Usage: "most requests a second to send to google, across every mount and account; 0 for no limit (default: what the config file says)"},
+}
+
+func driveOptions(ctx *cli.Context, readonly bool) (gdrive.Options, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return gdrive.Options{}, err
+	}
+	scope := ctx.String("scope")
+	if scope == "" {
+		scope = cfg.Scope
+	}
+	scopeMode := gdrive.FullScope
+	if scope != "" {
+		if scopeMode, err = gdrive.ParseScopeMode(scope); err != nil {
+			return gdrive.Options{}, err
+		}
+	}
+	rate := ctx.Float64("requests-per-second")
+	if !ctx.IsSet("requests-per-second") {
+		rate = cfg.RequestsPerSecond
+	}
+	if rate < 0 {
+		return gdrive.Options{}, errors.New("requests per second can't be negative")
+	}
+	if err := gdrive.CheckProfile(ctx.String("profile")); err != nil {
+		return gdrive.Options{}, err
+	}
+	return gdrive.Options{
+		Readonly:            readonly,
+		Scope:               scopeMode,
+		Profile:             ctx.String("profile"),
+		RequestsPerSecond:   rate,
+		ProxyURL:            ctx.String("proxy"),
+		CABundle:            ctx.String("ca-bundle"),
+		SharedDriveID:       ctx.String("shared-drive-id"),
+		IdleConnTimeout:     ctx.Duration("idle-conn-timeout"),
+		MaxIdleConnsPerHost: ctx.Int("max-idle-conns-per-host"),
+		DisableKeepAlives:   ctx.Bool("no-keep-alives"),
+		ListCacheTTL:        ctx.Duration("list-cache-ttl"),
+		ConvertUploads:      ctx.Bool("convert-uploads"),
+		StallTimeout:        ctx.Duration("stall-timeout"),
+		TokenRefreshEarly:   ctx.Duration("token-refresh-early"),
+		RetryBudget:         ctx.Duration("retry-budget"),
+		AppData:             ctx.Bool("app-data")}, nil
+}
+
+// mount is the command line front end to Mount.
 func mount(ctx *cli.Context) {
 	args := ctx.Args()
-	switch {
-	case len(args) == 0:
-		log.Fatal("You must specify a single argument which is path to the directory to use as a mount point.")
-	case len(args) > 1:
+	if len(args) > 1 {
 		log.Fatal("Too many arguments specified. You must specify a single argument which is path to the directory to use as a mount point.")
 	}
 
-	mountpoint := args.First()
-	readonly := !ctx.Bool("writeable")
-
-	gd, err := gdrive.GetService(readonly)
+	level, err := logging.ParseLevel(ctx.String("log-level"))
 	if err != nil {
 		log.Fatal(err)
 	}
+	logging.SetLevel(level)
 
-	mountOptions := []fuse.MountOption{
-		fuse.FSName("mntgdrive"),
-		fuse.Subtype("mntgrdrivefs"),
-		fuse.LocalVolume(),
-		fuse.VolumeName("GDrive"),
-	}
-	if readonly {
-		mountOptions = append(mountOptions, fuse.ReadOnly())
-	}
-	c, err := fuse.Mount(mountpoint, mountOptions...)
+	opts, err := mntgdrive.ConfigOptions()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer c.Close()
-
-	log.Print("Entering Serve")
-
-	config := fs.Config{
-		Debug: func(msg interface{}) {
-			log.Print(msg)
-		},
-		WithContext: func(ctx context.Context, req fuse.Request) context.Context {
-			return ctx
-		},
-	}
-
-	server := fs.New(c, &config)
-	system := newSystem(gd, server, readonly)
-
-	go system.watchForChanges()
-	err = server.Serve(system)
-	if err != nil {
+	if len(args) == 1 {
+		if ctx.IsSet("root-folder-id") && ctx.IsSet("root-folder") {
+			log.Fatal("Specify at most one of --root-folder-id and --root-folder.")
+		}
+		opts.Mounts = []config.Mount{{
+			Mountpoint:    args.First(),
+			RootFolder:    ctx.String("root-folder"),
+			RootFolderID:  ctx.String("root-folder-id"),
+			SharedDriveID: ctx.String("shared-drive-id")}}
+	} else if len(opts.Mounts) == 0 {
+		log.Fatal("You must specify a single argument which is path to the directory to use as a mount point, or list mounts in the config file.")
+	} else if ctx.IsSet("shared-drive-id") {
+		// each mount in the config file says which shared drive it is
+		log.Fatal("--shared-drive-id only goes with a mount point argument; give mounts in the config file a sharedDriveId instead.")
+	}
+	opts.Writeable = ctx.Bool("writeable")
+	opts.StrictWriteable = ctx.Bool("strict-writeable")
+	opts.Trash = ctx.Bool("mount-trash")
+	opts.Spaces = ctx.Bool("spaces")
+	opts.ExportZip = ctx.Bool("export-zip")
+	opts.Stubs = ctx.Bool("gdoc-stubs")
+	opts.StrictPOSIX = ctx.Bool("strict-posix")
+	opts.AllowOther = ctx.Bool("allow-other")
+	if ctx.IsSet("audit-log") {
+		opts.AuditLog = config.ExpandHome(ctx.String("audit-log"))
+	}
+	opts.Excludes = append(opts.Excludes, ctx.StringSlice("exclude")...)
+	opts.DryRun = ctx.Bool("dry-run")
+	if ctx.IsSet("cache-dir") {
+		opts.CacheDir = config.ExpandHome(ctx.String("cache-dir"))
+	}
+	if opts.Drive, err = driveOptions(ctx, !opts.Writeable); err != nil {
 		log.Fatal(err)
 	}
-
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
+	if opts.Drive.Others, err = gdrive.ParseOthersMode(ctx.String("others-files")); err != nil {
 		log.Fatal(err)
 	}
-}
-
-var _ fs.FS = &system{}
-
-// FS implements the hello world file system.
-type system struct {
-	gd     gdrive.DriveLike
-	server *fs.Server
-
-	readonly bool
-
-	// guards all of the fields below
-	mu sync.Mutex
-
-	nextInode index
-
-	serverStart time.Time
-	updateTime  time.Time
-
-	// maps from google drive id to node
-	idMap map[string]*node
-	// maps from inode number to node
-	inodeMap map[index]*node
-
-	initDumpOnce sync.Once
-	dumpNode     *dumpNodeType
-}
-
-func newSystem(gd gdrive.DriveLike, server *fs.Server, readonly bool) *system {
-	return &system{
-		gd:          gd,
-		server:      server,
-		readonly:    readonly,
-		nextInode:   firstDynamicIdx,
-		serverStart: time.Now(),
-		updateTime:  time.Now(),
-		idMap:       make(map[string]*node),
-		inodeMap:    make(map[index]*node)}
-
-}
-
-func (s *system) Root() (fs.Node, error) {
-	g, err := s.gd.FetchNode("root")
-	if err != nil {
-		log.Print("Error fetching root: ", err)
-		return nil, fuse.ENODATA
+	opts.VolumeName = ctx.String("volume-name")
+	opts.VolumeIcon = ctx.String("volume-icon")
+	opts.Prefetch = ctx.Int("prefetch")
+	opts.MetadataDelay = ctx.Duration("metadata-delay")
+	opts.RefreshAfter = ctx.Duration("refresh-after")
+	opts.UploadSpacing = ctx.Duration("upload-spacing")
+	opts.InteractiveRetryBudget = ctx.Duration("interactive-retry-budget")
+	opts.RemountRetries = ctx.Int("remount-retries")
+	opts.RemountBackoff = ctx.Duration("remount-backoff")
+	if err = opts.Validate(); err != nil {
+		log.Fatal(err)
 	}
 
-	root := s.getOrMakeNode(g)
-
-	return root, nil
-}
-
-func (s *system) watchForChanges() {
-	// TODO(gina) provide a way to cancel this via context?
-
-	// TODO(gina) Better to select on a channel that we send ticks to.
-	// Then when something updates the filesystem from our side, we
-	// can run this right away to see the result.
-
-	// TODO(gina) track the last time we fetched changes without an error, use that to
-	// determine staleness elsewhere, to .e.g. shutdown the system if this seems borken
-	log.Println("entering watchForChanges")
-	defer log.Println("exiting watchForChanges")
-	for {
-		time.Sleep(changeFetchSleep)
-
-		cs, err := s.gd.ProcessChanges(s.processChange)
+	var pidfile, logfile string
+	if ctx.Bool("daemon") {
+		// we only have one pidfile and log, which live next to the
+		// first mount's control socket
+		sockPath, err := control.SocketPath(opts.Mounts[0].Mountpoint)
 		if err != nil {
-			if cs.FetchedChanges() {
-				log.Fatalf("Aborting due to failure to fetch changes partway through change processing.  We don't support idempotent operations so cannot continue: %v", err)
-			} else {
-				log.Printf("Failed to fetch changes.  Will try again later: %v", err)
-			}
-		} else {
-			if cs.FetchedChanges() {
-				log.Print(cs.String())
-			}
+			log.Fatal(err)
 		}
-	}
-}
-
-func (s *system) processChange(c *gdrive.Change, cs *gdrive.ChangeStats) {
-	trash := c.Removed || c.Node.Trashed
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	n, nodeExists := s.idMap[c.ID]
-
-	switch {
-	case trash:
-		if nodeExists {
-			s.removeNode(n)
-			n.server.InvalidateNodeData(n)
-			log.Printf("Removed %s", c.ID)
-			cs.Changed++
+		pidfile, logfile = daemonPaths(sockPath)
+		if ctx.IsSet("pidfile") {
+			pidfile = ctx.String("pidfile")
 		}
-	case nodeExists && !c.Node.IncludeNode():
-		// This can happen if a file got renamed to contain a slash, or if it was owned
-		// by the user but is now not
-		s.removeNode(n)
-		n.server.InvalidateNodeData(n)
-		log.Printf("Removed %s", c.ID)
-		cs.Changed++
-	case nodeExists:
-		// TODO(gina) this is more aggressive than needed.  If only
-		// metadata changed, we don't need to invalidate the content
-		// entry
-		if !n.dir {
-			n.server.InvalidateNodeData(n)
+		if ctx.IsSet("log-file") {
+			logfile = ctx.String("log-file")
 		}
-		n.update(c.Node)
-		cs.Changed++
-	default:
-		// We want to create this new node if there is at least one of
-		// our parents has children
-		var haveReadyParent bool
-		for _, pid := range c.Node.ParentIDs {
-			if p, ok := s.idMap[pid]; ok && p.haveChildren() {
-				haveReadyParent = true
-				break
+		if !isDaemonChild() {
+			if err := daemonize(logfile); err != nil {
+				log.Fatal(err)
 			}
-		}
-		if haveReadyParent {
-			s.insertNode(c.Node)
-			log.Printf("Created %s because a parent needed to know about it", c.ID)
-			cs.Changed++
-		} else {
-			cs.Ignored++
-			log.Printf("Ignoring unkown id %s", c.ID)
-		}
-	}
-}
-
-// assumes we already have the system lock
-func (s *system) removeNode(n *node) {
-	delete(s.idMap, n.id)
-	delete(s.inodeMap, n.idx)
-	s.updateTime = time.Now()
-
-	// TODO(gina) figure out how to tell the kernel to invalidate the entry
-
-	for _, p := range n.parents {
-		// TODO(gina) figure out how to tell the kernel to invalidate the directory (parent) containing our node (the kernel cache of it)
-		p.cmu.Lock()
-		if _, ok := p.children[n.id]; ok {
-			delete(p.children, n.id)
-		} else {
-			log.Fatalf("Inconsistent data: node %+v listed parent %+v, but that parent does not know about the node", n, p)
-		}
-		p.cmu.Unlock()
-	}
-}
-
-// Assumes we have the system lock already
-func (s *system) getNodeIfExists(id string) *node {
-	n, _ := s.idMap[id]
-	return n
-}
-
-// TODO(gina) I think it would make sense to have this instead return a tuple of
-// (*node, idx) where if *node is nil, then the idx will be the value to assign to a new node.
-func (s *system) getOrMakeNode(g *gdrive.Node) *node {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	n, ok := s.idMap[g.ID]
-	if !ok {
-		n = s.insertNode(g)
-	} else {
-		n.update(g)
-	}
-	s.updateTime = time.Now()
-
-	return n
-}
-
-// Assumes the system lock is already held
-func (s *system) insertNode(g *gdrive.Node) *node {
-	s.nextInode++
-	inode := s.nextInode
-	pm := map[string]*node{}
-	for _, id := range g.ParentIDs {
-		if p, ok := s.idMap[id]; ok {
-			pm[id] = p
-		}
-	}
-	n := newNode(s, inode, g, pm)
-	for _, p := range pm {
-		if p.haveChildren() {
-			p.mu.Lock()
-			p.children[n.id] = n
-			p.mu.Unlock()
+			return
 		}
 	}
-	s.inodeMap[inode] = n
-	s.idMap[g.ID] = n
-	return n
-}
-
-var _ fs.NodeCreater = (*node)(nil)
-var _ fs.NodeGetattrer = (*node)(nil)
-var _ fs.NodeMkdirer = (*node)(nil)
-var _ fs.NodeOpener = (*node)(nil)
-var _ fs.NodeRemover = (*node)(nil)
-var _ fs.NodeRenamer = (*node)(nil)
-
-type node struct {
-	*system
-	// These are things we expect to be immutable for a node
-	idx index
-	id  string
-	pf  *phantomfile.PhantomFile
-
-	//
-	// These can change while a node exists
-	//
 
-	// directly retrieved metadata
-
-	// guards this access to this group
-	mu      sync.Mutex
-	name    string
-	ctime   time.Time
-	mtime   time.Time
-	size    uint64
-	version int64
-	dir     bool
-	parents map[string]*node
-
-	// guards children
-	cmu sync.Mutex
-	// if nil, we don't yet have children information
-	children map[string]*node
-}
-
-func newNode(s *system, idx index, g *gdrive.Node, parents map[string]*node) *node {
-	n := &node{
-		system:  s,
-		idx:     idx,
-		id:      g.ID,
-		name:    g.Name,
-		ctime:   g.Ctime,
-		mtime:   g.Mtime,
-		size:    g.Size,
-		version: g.Version,
-		dir:     g.Dir(),
-		parents: parents}
-	n.pf = phantomfile.NewPhantomFile(n)
-	return n
-}
-
-type printableNode struct {
-	name    string
-	dir     bool
-	idx     index
-	id      string
-	ctime   time.Time
-	mtime   time.Time
-	size    uint64
-	version int64
-}
-
-const indent = 2
-
-func (n *node) dump(b *bytes.Buffer, level int) {
-	margin := strings.Repeat(" ", level*indent)
-	b.WriteString(margin)
-
-	n.mu.Lock()
-	p := printableNode{n.name, n.dir, n.idx, n.id, n.ctime, n.mtime, n.size, n.version}
-	n.mu.Unlock()
-	b.WriteString(fmt.Sprintf("%#v\n", p))
-	if p.dir {
-		if n.haveChildren() {
-			// we build a separate list of children so we don't have to acquire locks all
-			// the way down, which could lead to deadlock if an update comes in that
-			// expects locking upward.
-			//
-			// TODO(gina) rework locking order to go downward(?)
-			var children []*node
-			n.cmu.Lock()
-			for _, c := range n.children {
-				children = append(children, c)
-			}
-			n.cmu.Unlock()
-			for _, c := range children {
-				c.dump(b, level+1)
-			}
-		} else {
-			margin = strings.Repeat(" ", (level+1)*indent)
-			b.WriteString(fmt.Sprintf("%s<unknown children>\n", margin))
+	if ctx.IsSet("log-file") && !isDaemonChild() {
+		// a daemon's stderr already goes to the log file
+		f, err := os.OpenFile(ctx.String("log-file"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Unable to open log file: %v", err)
 		}
+		defer f.Close()
+		log.SetOutput(f)
 	}
-}
-
-// Assumes we already have the system lock
-func (n *node) update(g *gdrive.Node) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.name = g.Name
-	n.ctime = g.Ctime
-	n.mtime = g.Mtime
-	n.size = g.Size
-	n.version = g.Version
-	n.dir = g.Dir()
 
-	newParentSet := map[string]bool{}
-	for _, id := range g.ParentIDs {
-		newParentSet[id] = true
-	}
-
-	// loop through existing parents looking for ones no longer present and tell them to
-	// remove us
-	for _, ep := range n.parents {
-		if _, ok := newParentSet[ep.id]; !ok {
-			log.Printf("Update %q, removing %q as a parent", n.id, ep.id)
-			ep.removeChild(n.id)
-			delete(n.parents, ep.id)
+	if pidfile != "" {
+		if err = ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			log.Fatalf("Unable to write pidfile: %v", err)
 		}
+		defer os.Remove(pidfile)
 	}
 
-	// loop through new parents, looking for ones that aren't yet present and tell them
-	// to add us
-	for np := range newParentSet {
-		if _, ok := n.parents[np]; !ok {
-			if p := n.getNodeIfExists(np); p != nil {
-				log.Printf("Update %q, adding %q as a parent", n.id, np)
-				p.addChild(n)
-				n.parents[np] = p
+	opts.Ready = func(err error) {
+		daemonReady(err)
+		if err == nil {
+			if _, err := sdnotify.Notify(sdnotify.Ready); err != nil {
+				logging.Warnf("Unable to tell systemd we are ready: %v", err)
 			}
 		}
 	}
-	n.updateTime = time.Now()
-}
-
-func (n *node) addChild(c *node) {
-	n.cmu.Lock()
-	defer n.cmu.Unlock()
-	n.children[c.id] = c
-	n.updateTime = time.Now()
-}
-
-func (n *node) removeChild(id string) {
-	n.cmu.Lock()
-	defer n.cmu.Unlock()
-	delete(n.children, id)
-	n.updateTime = time.Now()
-}
-
-func (n *node) Getattr(ctx context.Context, eq *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
-	err := n.Attr(ctx, &resp.Attr)
-	log.Printf("in my Getattr, n=%s, size=%d", n, resp.Attr.Size)
-	return err
-}
-
-func (n *node) Attr(ctx context.Context, a *fuse.Attr) error {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	a.Inode = uint64(n.idx)
-	a.Size = n.size
-	a.Ctime = n.ctime
-	a.Crtime = n.ctime
-	a.Mtime = n.mtime
-
-	size, modTime, ok := n.pf.StatIfLocal()
-	if ok {
-		a.Size = uint64(size)
-		a.Mtime = modTime
-	}
-
-	mode := modeReadWrite
-	if n.readonly {
-		mode = modeReadOnly
-	}
-
-	if n.dir {
-		a.Mode = os.ModeDir | mode
-	} else {
-		a.Mode = mode
-	}
-
-	return nil
-}
-
-func (n *node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fuseNode fs.Node, err error) {
-	defer func() {
-		log.Printf("main: Mkdir produced %s, %+v", fuseNode, err)
-	}()
-	if n.readonly {
-		return nil, fuse.ENOTSUP
-	}
-	if !n.dir {
-		return nil, fuse.ENOTSUP
-	}
-	if err = n.loadChildrenIfEmpty(ctx); err != nil {
-		log.Printf("Failed to load children of %q: %+v", n.id, err)
-		return nil, err
-	}
-	g, err := n.gd.CreateNode(n.id, req.Name, true)
-	if err != nil {
-		log.Printf("Failed to create node %q: %v", req.Name, err)
-		return nil, err
-	}
-	n.system.mu.Lock()
-	defer n.system.mu.Unlock()
-	created := n.insertNode(g)
-
-	return created, nil
-}
-
-func (n *node) haveChildren() bool {
-	n.cmu.Lock()
-	loaded := n.children != nil
-	n.cmu.Unlock()
-	return loaded
-}
-
-func (n *node) findChild(name string) (*node, error) {
-	if !n.haveChildren() {
-		panic(fmt.Sprintf("findChild on %q called for %q before loadChildrenIfEmpty was called.  Unable to continue.", n.id, name))
-	}
-
-	n.cmu.Lock()
-	defer n.cmu.Unlock()
-	for _, c := range n.children {
-		if c.name == name {
-			return c, nil
-		}
-	}
-	return nil, fuse.ENOENT
-}
-
-func (n *node) loadChildrenIfEmpty(ctx context.Context) error {
-	if n.haveChildren() {
-		return nil
-	}
-
-	gs, err := n.gd.FetchChildren(ctx, n.id)
-	if err != nil {
-		return err
-	}
-
-	var children []*node
-	for _, g := range gs {
-		// Note inside this loop we are aquiring and releasing a lock over and over.  I don't know if that is bad yet.
-		c := n.getOrMakeNode(g)
-		c.addParent(n)
-		children = append(children, c)
-	}
-
-	childMap := map[string]*node{}
-	for _, c := range children {
-		childMap[c.id] = c
-	}
-
-	n.cmu.Lock()
-	n.children = childMap
-	n.cmu.Unlock()
-
-	n.mu.Lock()
-	n.updateTime = time.Now()
-	n.mu.Unlock()
-
-	return nil
-}
-
-func (n *node) addParent(p *node) {
-	n.mu.Lock()
-	n.parents[p.id] = p
-	n.updateTime = time.Now()
-	n.mu.Unlock()
-}
-
-func (n *node) ReadDirAll(ctx context.Context) (ds []fuse.Dirent, err error) {
-	if err = n.loadChildrenIfEmpty(ctx); err != nil {
-		return nil, err
-	}
-
-	n.cmu.Lock()
-	defer n.cmu.Unlock()
-	for _, c := range n.children {
-		var dt fuse.DirentType
-		if c.dir {
-			dt = fuse.DT_Dir
-		} else {
-			dt = fuse.DT_File
-		}
-
-		ds = append(ds, fuse.Dirent{uint64(c.idx), dt, c.name})
-	}
-
-	log.Printf("ReadDirAll returning %d children", len(ds))
-	return ds, nil
-}
-
-func (n *node) Lookup(ctx context.Context, name string) (ret fs.Node, err error) {
-	if err := n.loadChildrenIfEmpty(ctx); err != nil {
-		return nil, err
-	}
-
-	if n.id == "root" && name == ".dump" {
-		n.initDumpOnce.Do(func() {
-			n.dumpNode = &dumpNodeType{n}
-		})
-		return n.dumpNode, nil
-	}
-
-	return n.findChild(name)
-}
-
-func (n *node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fuseNode fs.Node, h fs.Handle, err error) {
-	defer func() {
-		log.Printf("main: Create produced %s, %s, %#v", fuseNode, h, err)
-	}()
-	if n.readonly {
-		return nil, nil, fuse.ENOTSUP
-	}
-	if !n.dir {
-		return nil, nil, fuse.ENOTSUP
-	}
-	if err = n.loadChildrenIfEmpty(ctx); err != nil {
-		log.Printf("Failed to load children of %q: %v", n.id, err)
-		return nil, nil, err
-	}
-	dir := req.Mode&os.ModeDir != 0
-	g, err := n.gd.CreateNode(n.id, req.Name, dir)
-	if err != nil {
-		log.Printf("Failed to create node %q: %v", req.Name, err)
-		return nil, nil, err
-	}
-	n.system.mu.Lock()
-	defer n.system.mu.Unlock()
-	created := n.insertNode(g)
-
-	resp.Node = fuse.NodeID(created.idx)
-	created.Attr(ctx, &resp.Attr)
-
-	handle, err := created.pf.Open(phantomfile.WriteOnly, phantomfile.NoFetch)
-	if err != nil {
-		log.Printf("Failed to open file for node %q: %v", created.id, err)
-		return nil, nil, err
-	}
-	return created, handle, nil
-}
-
-func xlateAccessMode(flags fuse.OpenFlags) phantomfile.AccessMode {
-	switch {
-	case flags.IsReadOnly():
-		return phantomfile.ReadOnly
-	case flags.IsWriteOnly():
-		return phantomfile.WriteOnly
-	default:
-		return phantomfile.ReadWrite
-	}
-}
-
-func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (handle fs.Handle, err error) {
-	if n.dir {
-		// send the caller to ReadDirAll
-		return n, nil
-	}
-	if req.Flags&fuse.OpenExclusive != 0 {
-		// Google drive doesn't support this concept (it is fine
-		// having two files with the same name in the same folder), so
-		// we don't either.
-		log.Print("Open failing due to unsupported exclusive flag")
-		return nil, fuse.ENOTSUP
-	}
-
-	am := xlateAccessMode(req.Flags)
-
-	if am != phantomfile.ReadOnly && n.readonly {
-		log.Print("Open: failing due to writeable request of readonly filesystem")
-		return nil, fuse.EPERM
-	}
-
-	defer func() {
-		if handle != nil && err != nil {
-			h := handle.(fs.HandleReleaser)
-			h.Release(ctx, &fuse.ReleaseRequest{})
-		}
-	}()
-
-	switch {
-	case am == phantomfile.ReadOnly:
-		res.Flags |= fuse.OpenKeepCache
-		return n.pf.Open(am, phantomfile.ProactiveFetch)
-	case req.Flags&fuse.OpenTruncate != 0:
-		handle, err = n.pf.Open(am, phantomfile.NoFetch)
-		if err != nil {
-			err = n.pf.Truncate(ctx, 0)
-		}
-		return handle, err
-	case am == phantomfile.ReadWrite:
-		return n.pf.Open(am, phantomfile.ProactiveFetch)
-	default:
-		log.Printf("Denying open due to unsupported flags for %q, am=%d, flags=%s", n.name, am, req.Flags)
-		return nil, fuse.Errno(syscall.EACCES)
-	}
-}
-
-func (n *node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-	if n.readonly {
-		log.Print("Rename: failing because readonly")
-		return fuse.ENOTSUP
-	}
-	if !n.dir {
-		log.Print("Rename: failing because not a directory")
-		return fuse.ENOTSUP
-	}
-	if err := n.loadChildrenIfEmpty(ctx); err != nil {
-		log.Printf("Rename: load failed %v", err)
-		return fuse.EIO
-	}
-
-	child, err := n.findChild(req.OldName)
-	if child == nil {
-		log.Printf("Rename: failed because unable to find %q in %q", req.OldName, n.id)
-		return fuse.ENOENT
-	}
-
-	var oldParentID string
-	var newParentID string
-	if newDir != nil {
-		newParent, ok := newDir.(*node)
-		if !ok {
-			log.Printf("*node newDir node isn't a *node, is a %T; can't handle.  returning EIO.", newDir)
-			return fuse.EIO
-		}
-		oldParentID = n.id
-		newParentID = newParent.id
-		if oldParentID == newParentID {
-			oldParentID = ""
-			newParentID = ""
-		}
-	}
-	log.Printf("Renaming %q with newName %q.  oldParentID=%q and newParentID=%q", child.id, req.NewName, oldParentID, newParentID)
-	gnode, err := n.system.gd.Rename(ctx, child.id, req.NewName, oldParentID, newParentID)
+	err = mntgdrive.Mount(opts)
+	sdnotify.Notify(sdnotify.Stopping)
 	if err != nil {
-		return err
-	}
-	n.system.mu.Lock()
-	defer n.system.mu.Unlock()
-	child.update(gnode)
-	return nil
-}
-
-func (n *node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if n.readonly {
-		log.Print("Rename: failing because readonly")
-		return fuse.ENOTSUP
-	}
-	if !n.dir {
-		log.Print("Rename: failing because not a directory")
-		return fuse.ENOTSUP
-	}
-	if err := n.loadChildrenIfEmpty(ctx); err != nil {
-		log.Printf("Rename: load failed %v", err)
-		return fuse.EIO
-	}
-
-	child, err := n.findChild(req.Name)
-	if child == nil {
-		log.Printf("Remove: failed because unable to find %q in %q", req.Name, n.id)
-		return fuse.ENOENT
-	}
-
-	err = n.system.gd.Trash(ctx, child.id)
-	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	n.system.mu.Lock()
-	defer n.system.mu.Unlock()
-	n.system.removeNode(child)
-	return nil
-}
-
-var _ phantomfile.DownloaderUploader = (*node)(nil)
-
-func (n *node) Download(ctx context.Context, f *os.File) error {
-	return n.gd.Download(ctx, n.id, f)
-}
-
-func (n *node) Upload(ctx context.Context, f *os.File) error {
-	return n.gd.Upload(ctx, n.id, f)
-}
-
-func (n *node) ID() string {
-	return n.id
-}
-
-func (n *node) Name() string {
-	return n.name
-}
-
-func (n *node) String() string {
-	return fmt.Sprintf("%s/%s", n.id,
-		n.name)
-}
-
-type dumpNodeType struct {
-	root *node
-}
-
-func (d *dumpNodeType) text() string {
-	var b bytes.Buffer
-	d.root.dump(&b, 0)
-	return b.String()
-}
-
-func (d *dumpNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = dumpIdx
-	a.Size = uint64(len(d.text()))
-	a.Mode = modeReadOnly
-
-	d.root.mu.Lock()
-	a.Ctime = d.root.serverStart
-	a.Crtime = d.root.serverStart
-	a.Mtime = d.root.updateTime
-	d.root.mu.Unlock()
-
-	return nil
-}
-
-func (d *dumpNodeType) ReadAll(ctx context.Context) (result []byte, err error) {
-	return []byte(d.text()), nil
 }
@@ -0,0 +1,27 @@
+package mntgdrive
+
+const appDataName = ".appdata"
+
+// appDataRoot returns the top of the hidden app data folder, which we
+// present as .appdata at the top of the mount.  It is a subsystem of
+// its own, since drive lists and tracks changes to it separately from
+// the drive.
+func (s *system) appDataRoot() (*node, error) {
+	s.mu.Lock()
+	sub := s.appDataSystem
+	s.mu.Unlock()
+	if sub == nil {
+		gd, err := s.gd.ForAppData()
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		if s.appDataSystem == nil {
+			s.appDataSystem = s.newSubsystem(gd, "appDataFolder")
+			s.appDataSystem.mountPrefix = appDataName
+		}
+		sub = s.appDataSystem
+		s.mu.Unlock()
+	}
+	return sub.rootNode()
+}
@@ -0,0 +1,115 @@
+package mntgdrive
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// auditLog records who read what through a mount that other users may
+// see (allow_other), so whoever runs a shared host can find out.  Each
+// time someone closes a file they opened for reading we add a line to
+// it, a JSON auditRecord.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// auditRecord says that the user with Uid (running the process with
+// Pid) opened the file at Path (relative to the mount) and read Bytes
+// of it before closing it at Time.
+type auditRecord struct {
+	Time  time.Time `json:"time"`
+	Uid   uint32    `json:"uid"`
+	Pid   uint32    `json:"pid"`
+	Path  string    `json:"path"`
+	ID    string    `json:"id"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// openAuditLog opens the file called name, creating it if need be, to
+// add records to the end of it.  Only we may read it.
+func openAuditLog(name string) (*auditLog, *os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &auditLog{w: f}, f, nil
+}
+
+func (a *auditLog) record(r auditRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		logging.Errorf("Unable to encode audit record %+v: %v", r, err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		logging.Errorf("Unable to write audit record %+v: %v", r, err)
+	}
+}
+
+// fileHandle is what node.Open returns for files.
+type fileHandle interface {
+	fs.HandleFlusher
+	fs.HandleReader
+	fs.HandleWriter
+	fs.HandleReleaser
+}
+
+// auditedHandle counts what is read through a handle, and tells the
+// audit log about it when it is released.
+type auditedHandle struct {
+	fileHandle
+	audit *auditLog
+	id    string
+	// where the file is, relative to the top of the mount
+	path     func() string
+	uid, pid uint32
+	bytes    uint64 // only access via atomic
+	once     sync.Once
+}
+
+// audited returns h, which the process that made req opened for
+// reading, recording what is read through it if we keep an audit log.
+// id is the file in drive, and path says where it is in the mount when
+// h is released.
+func (s *system) audited(h fs.Handle, req *fuse.OpenRequest, id string, path func() string) fs.Handle {
+	fh, ok := h.(fileHandle)
+	if s.audit == nil || !ok {
+		return h
+	}
+	return &auditedHandle{fileHandle: fh, audit: s.audit, id: id, path: path, uid: req.Uid, pid: req.Pid}
+}
+
+func (h *auditedHandle) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
+	err := h.fileHandle.Read(ctx, req, res)
+	if err == nil {
+		atomic.AddUint64(&h.bytes, uint64(len(res.Data)))
+	}
+	return err
+}
+
+func (h *auditedHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	err := h.fileHandle.Release(ctx, req)
+	h.once.Do(func() {
+		h.audit.record(auditRecord{
+			Time:  time.Now(),
+			Uid:   h.uid,
+			Pid:   h.pid,
+			Path:  "/" + h.path(),
+			ID:    h.id,
+			Bytes: atomic.LoadUint64(&h.bytes)})
+	})
+	return err
+}
@@ -0,0 +1,491 @@
+package mntgdrive
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const batchName = "batch"
+
+// batchResultName is the file that says, in JSON, what the last batch
+// did (or has done so far) to each file.
+const batchResultName = "batch.json"
+
+// how many files a batch changes between progress log messages
+const batchProgressEvery = 100
+
+// the most we take in a single batch
+const maxBatchSize = 1 << 20
+
+var _ fs.NodeOpener = (*batchNodeType)(nil)
+var _ fs.HandleWriter = (*batchHandle)(nil)
+var _ fs.HandleFlusher = (*batchHandle)(nil)
+var _ fs.HandleReadAller = (*batchHandle)(nil)
+var _ fs.NodeOpener = (*batchResultNodeType)(nil)
+var _ fs.HandleReadAller = (*batchResultNodeType)(nil)
+
+// batchOp is one thing for a batch to do to a file or folder.  Target,
+// and Value for a move, are paths from the top of the mount if they
+// start with a slash and drive ids otherwise.
+type batchOp struct {
+	Op     string `json:"op"`
+	Target string `json:"target"`
+	Value  string `json:"value"`
+}
+
+var batchOps = map[string]bool{"rename": true, "move": true, "star": true, "describe": true}
+
+// parseBatch reads the ops in b, which is either a JSON array of
+// objects with op, target and value fields, or CSV with those three
+// columns and an optional header row.
+func parseBatch(b []byte) ([]batchOp, error) {
+	b = bytes.TrimSpace(b)
+	var ops []batchOp
+	if bytes.HasPrefix(b, []byte("[")) {
+		if err := json.Unmarshal(b, &ops); err != nil {
+			return nil, err
+		}
+	} else {
+		r := csv.NewReader(bytes.NewReader(b))
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		r.Comment = '#'
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, rec := range records {
+			if i == 0 && strings.EqualFold(rec[0], "op") {
+				continue
+			}
+			if len(rec) < 2 || len(rec) > 3 {
+				return nil, fmt.Errorf("op %d: want op,target[,value], got %q", len(ops)+1, strings.Join(rec, ","))
+			}
+			op := batchOp{Op: rec[0], Target: rec[1]}
+			if len(rec) == 3 {
+				op.Value = rec[2]
+			}
+			ops = append(ops, op)
+		}
+	}
+	for i, op := range ops {
+		if !batchOps[op.Op] {
+			return nil, fmt.Errorf("op %d: unknown op %q", i+1, op.Op)
+		}
+		if op.Target == "" {
+			return nil, fmt.Errorf("op %d: no target", i+1)
+		}
+	}
+	return ops, nil
+}
+
+// batchNodeType is the .mntgdrive/batch magic file.  Writing ops to it
+// (see parseBatch) makes them all, or none of them if any don't make
+// sense, combining the ones for the same file into a single call to
+// drive.  Reading it says what the last batch did, or how far along
+// the one running is.
+type batchNodeType struct {
+	root *node
+
+	// held while a batch runs, so they run one at a time
+	mu sync.Mutex
+
+	// guards the fields below, which change as a batch runs
+	rmu sync.Mutex
+	// what the last batch did, and when
+	report  string
+	updated time.Time
+	result  batchResult
+}
+
+// batchResult is what a batch did, or has done so far, to each file it
+// changes, for programs to read from batch.json.  When some changes
+// fail, it says exactly which files were changed and which weren't.
+type batchResult struct {
+	Running bool `json:"running"`
+	// how many files the batch changes
+	Total  int            `json:"total"`
+	Done   []batchOutcome `json:"done"`
+	Failed []batchOutcome `json:"failed"`
+	// why the batch was turned down, if it was, in which case nothing
+	// was changed
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+type batchOutcome struct {
+	ID string `json:"id"`
+	// how the batch named the file
+	Target string `json:"target"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchEdit is everything a batch does to one node.
+type batchEdit struct {
+	n *node
+	// how the batch first named n
+	target string
+	e      gdrive.Edit
+	// what we are doing, for the report
+	what []string
+}
+
+func (b *batchNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = batchIdx
+	a.Mode = modeReadWrite
+	if b.root.readonly {
+		a.Mode = modeReadOnly
+	}
+	b.rmu.Lock()
+	a.Size = uint64(len(b.report))
+	a.Mtime = b.updated
+	b.rmu.Unlock()
+
+	b.root.system.mu.Lock()
+	a.Ctime = b.root.serverStart
+	a.Crtime = b.root.serverStart
+	b.root.system.mu.Unlock()
+	if a.Mtime.IsZero() {
+		a.Mtime = a.Ctime
+	}
+	return nil
+}
+
+func (b *batchNodeType) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() && b.root.readonly {
+		logging.For(ctx).Debugf("Open: failing due to writeable request of batch in a readonly filesystem")
+		return nil, fuse.EPERM
+	}
+	// the report changes with every batch
+	res.Flags |= fuse.OpenDirectIO
+	return &batchHandle{b: b}, nil
+}
+
+// resolve returns the node that target, a path from root (the top of
+// the mount) or a drive id, names.
+func (root *node) resolve(ctx context.Context, target string) (*node, error) {
+	if !strings.HasPrefix(target, "/") {
+		return root.nodeByID(ctx, target)
+	}
+	n := root
+	for _, name := range strings.Split(target, "/") {
+		if name == "" {
+			continue
+		}
+		if !n.dir {
+			return nil, fuse.ENOENT
+		}
+		if err := n.loadChildrenIfEmpty(ctx); err != nil {
+			return nil, err
+		}
+		c, err := n.findChild(name)
+		if err != nil {
+			return nil, err
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// plan works out the edit to make to each node that ops touch, in the
+// order they first touch them, along with any problems with ops.
+func (b *batchNodeType) plan(ctx context.Context, ops []batchOp) (edits []*batchEdit, problems []string) {
+	byID := map[string]*batchEdit{}
+	for i, op := range ops {
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("op %d (%s %s): %s", i+1, op.Op, op.Target, fmt.Sprintf(format, args...)))
+		}
+		n, err := b.root.resolve(ctx, op.Target)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		if b.root.isRoot(n) {
+			problem("can't change the top of the mount")
+			continue
+		}
+		if !n.isWriteable() {
+			problem("we may not change it")
+			continue
+		}
+		be, ok := byID[n.id]
+		if !ok {
+			be = &batchEdit{n: n, target: op.Target}
+		}
+
+		switch op.Op {
+		case "rename":
+			if op.Value == "" || strings.Contains(op.Value, "/") {
+				problem("need a new name, without slashes")
+				continue
+			}
+			if !n.isRenameable() {
+				problem("we may not rename it")
+				continue
+			}
+			be.e.Name = driveName(op.Value)
+		case "move":
+			dest, err := b.root.resolve(ctx, op.Value)
+			if err != nil {
+				problem("%s: %v", op.Value, err)
+				continue
+			}
+			if !dest.dir || !dest.isWriteable() || !dest.isAddable() {
+				problem("we may not move things into %s", op.Value)
+				continue
+			}
+			if be.e.OldParentID == "" {
+				n.mu.Lock()
+				for id := range n.parents {
+					be.e.OldParentID = id
+					break
+				}
+				n.mu.Unlock()
+				if be.e.OldParentID == "" {
+					problem("can't find the folder it is in now")
+					continue
+				}
+			}
+			be.e.NewParentID = dest.id
+			if be.e.OldParentID == be.e.NewParentID {
+				be.e.OldParentID = ""
+				be.e.NewParentID = ""
+			}
+		case "star":
+			starred := true
+			if op.Value != "" {
+				if starred, err = strconv.ParseBool(op.Value); err != nil {
+					problem("%q is neither true nor false", op.Value)
+					continue
+				}
+			}
+			be.e.Starred = &starred
+		case "describe":
+			description := op.Value
+			be.e.Description = &description
+		}
+		be.what = append(be.what, fmt.Sprintf("%s %q", op.Op, op.Value))
+		if !ok {
+			byID[n.id] = be
+			edits = append(edits, be)
+		}
+	}
+	return edits, problems
+}
+
+// run makes the ops in buf, reporting what happened in b.report and
+// b.result.
+func (b *batchNodeType) run(ctx context.Context, buf []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ops, err := parseBatch(buf)
+	if err != nil {
+		b.finish(fmt.Sprintf("rejected, nothing was changed: %v\n", err), batchResult{Rejected: []string{err.Error()}})
+		return fuse.Errno(syscall.EINVAL)
+	}
+	edits, problems := b.plan(ctx, ops)
+	if len(problems) != 0 {
+		b.finish("rejected, nothing was changed:\n"+strings.Join(problems, "\n")+"\n", batchResult{Rejected: problems})
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	logging.Infof("Running a batch of %d op(s) on %d file(s)", len(ops), len(edits))
+	b.rmu.Lock()
+	b.updated = time.Now()
+	b.result = batchResult{Running: true, Total: len(edits)}
+	b.rmu.Unlock()
+
+	s := b.root.system
+	var report bytes.Buffer
+	var failed int
+	var stale []staleEntry
+	// running it as a job shows how far along it is in the jobs folder,
+	// and lets it be cancelled
+	j := s.jobs.Start(s.watching, batchName, []string{fmt.Sprintf("%d file(s)", len(edits))}, func(ctx context.Context, j *control.Job) error {
+		for i, be := range edits {
+			if i > 0 && i%batchProgressEvery == 0 {
+				logging.Infof("Batch has changed %d of %d file(s), %d failed", i-failed, len(edits), failed)
+			}
+			j.Progress(int64(i), int64(len(edits)))
+			outcome := batchOutcome{ID: be.n.id, Target: be.target}
+			if be.e.Empty() {
+				fmt.Fprintf(&report, "ok %s: nothing to do\n", be.target)
+				b.record(outcome)
+				continue
+			}
+			s.mu.Lock()
+			before := be.n.entriesOf()
+			s.mu.Unlock()
+			// once cancelled, we leave the rest alone
+			var g *gdrive.Node
+			err := ctx.Err()
+			if err == nil {
+				g, err = s.gd.Edit(ctx, be.n.id, be.e)
+			}
+			if err != nil {
+				logging.Errorf("Unable to edit %s as a batch says to: %v", be.n.id, err)
+				fmt.Fprintf(&report, "failed %s: %v\n", be.target, err)
+				failed++
+				outcome.Error = err.Error()
+				b.record(outcome)
+				continue
+			}
+			s.mu.Lock()
+			be.n.update(g)
+			if after := be.n.entriesOf(); !sameEntries(before, after) {
+				stale = append(stale, append(before, after...)...)
+			}
+			s.mu.Unlock()
+			fmt.Fprintf(&report, "ok %s: %s\n", be.target, strings.Join(be.what, ", "))
+			b.record(outcome)
+		}
+		j.Progress(int64(len(edits)), int64(len(edits)))
+		if failed != 0 {
+			return fmt.Errorf("%d of %d file(s) failed; see %s", failed, len(edits), batchResultName)
+		}
+		return nil
+	})
+	<-j.Finished()
+	s.invalidateEntries(stale)
+	fmt.Fprintf(&report, "%d file(s) changed, %d failed\n", len(edits)-failed, failed)
+	if failed != 0 {
+		fmt.Fprintf(&report, "see %s for which ones\n", batchResultName)
+	}
+	b.rmu.Lock()
+	result := b.result
+	b.rmu.Unlock()
+	result.Running = false
+	b.finish(report.String(), result)
+	if failed != 0 {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// record notes what happened to one of the files the running batch
+// changes.
+func (b *batchNodeType) record(o batchOutcome) {
+	b.rmu.Lock()
+	defer b.rmu.Unlock()
+	if o.Error == "" {
+		b.result.Done = append(b.result.Done, o)
+	} else {
+		b.result.Failed = append(b.result.Failed, o)
+	}
+}
+
+// finish sets what we say about the batch that just ended.
+func (b *batchNodeType) finish(report string, result batchResult) {
+	b.rmu.Lock()
+	defer b.rmu.Unlock()
+	b.updated = time.Now()
+	b.report = report
+	b.result = result
+}
+
+// progress returns what we say about the last batch, or how far along
+// the running one is.
+func (b *batchNodeType) progress() string {
+	b.rmu.Lock()
+	defer b.rmu.Unlock()
+	if r := b.result; r.Running {
+		return fmt.Sprintf("running: %d of %d file(s) done, %d failed\n", len(r.Done), r.Total, len(r.Failed))
+	}
+	return b.report
+}
+
+// batchHandle collects what is written to the batch file, running it
+// when the file is closed.
+type batchHandle struct {
+	b *batchNodeType
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (h *batchHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	end := req.Offset + int64(len(req.Data))
+	if end > maxBatchSize {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	if end > int64(len(h.buf)) {
+		h.buf = append(h.buf, make([]byte, end-int64(len(h.buf)))...)
+	}
+	copy(h.buf[req.Offset:], req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (h *batchHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	buf := h.buf
+	h.buf = nil
+	h.mu.Unlock()
+	if buf == nil {
+		return nil
+	}
+	return h.b.run(ctx, buf)
+}
+
+func (h *batchHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return []byte(h.b.progress()), nil
+}
+
+// batchResultNodeType is the .mntgdrive/batch.json magic file, which
+// holds the batchResult of the last batch, or of the one running.
+type batchResultNodeType struct {
+	b *batchNodeType
+}
+
+func (r *batchResultNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = batchResultIdx
+	a.Mode = modeReadOnly
+	r.b.rmu.Lock()
+	a.Mtime = r.b.updated
+	r.b.rmu.Unlock()
+
+	r.b.root.system.mu.Lock()
+	a.Ctime = r.b.root.serverStart
+	a.Crtime = r.b.root.serverStart
+	r.b.root.system.mu.Unlock()
+	if a.Mtime.IsZero() {
+		a.Mtime = a.Ctime
+	}
+	return nil
+}
+
+func (r *batchResultNodeType) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	// we don't know how big it is until we read it
+	res.Flags |= fuse.OpenDirectIO
+	return r, nil
+}
+
+func (r *batchResultNodeType) ReadAll(ctx context.Context) ([]byte, error) {
+	r.b.rmu.Lock()
+	defer r.b.rmu.Unlock()
+	b, err := json.MarshalIndent(r.b.result, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
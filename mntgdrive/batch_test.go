@@ -0,0 +1,43 @@
+package mntgdrive
+
+import (
+	"testing"
+)
+
+func TestParseBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []batchOp
+		wantErr bool
+	}{
+		{"csv",
+			"op,target,value\nrename,/file one,file 1\n# a comment\nstar, file_one_id\n",
+			[]batchOp{{"rename", "/file one", "file 1"}, {"star", "file_one_id", ""}},
+			false},
+		{"csv without header",
+			"describe,/dir two,\"scans, mostly\"\n",
+			[]batchOp{{"describe", "/dir two", "scans, mostly"}},
+			false},
+		{"json",
+			` [{"op": "move", "target": "/file one", "value": "/dir one"}]`,
+			[]batchOp{{"move", "/file one", "/dir one"}},
+			false},
+		{"empty", "\n", nil, false},
+		{"unknown op", "delete,/file one\n", nil, true},
+		{"no target", `[{"op": "star"}]`, nil, true},
+		{"too many columns", "rename,/file one,a,b\n", nil, true},
+		{"bad json", `[{"op": "star",]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBatch([]byte(tt.in))
+			if tt.wantErr {
+				assert(t, err != nil, "expected an error, got %v", got)
+				return
+			}
+			ok(t, err)
+			equals(t, tt.want, got)
+		})
+	}
+}
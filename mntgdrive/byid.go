@@ -0,0 +1,70 @@
+package mntgdrive
+
+import (
+	"os"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const byIDName = "by-id"
+
+var _ fs.HandleReadDirAller = (*byIDDirType)(nil)
+var _ fs.NodeStringLookuper = (*byIDDirType)(nil)
+
+// byIDDirType is the .mntgdrive/by-id folder.  Looking up a drive id
+// in it finds that file or folder wherever it is below our root, so
+// scripts that have an id, or a link with one in it, can get at it
+// without working out its path.  It lists nothing, since that would
+// mean everything, and nothing can be created in it.
+type byIDDirType struct {
+	root *node
+}
+
+// nodeByID returns the node with id, asking drive about it if we
+// haven't loaded it.
+func (s *system) nodeByID(ctx context.Context, id string) (*node, error) {
+	s.mu.Lock()
+	n := s.getNodeIfExists(id)
+	s.mu.Unlock()
+	if n != nil {
+		return n, nil
+	}
+	g, err := s.gd.FetchNode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.getOrMakeNode(g), nil
+}
+
+func (d *byIDDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = byIDIdx
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *byIDDirType) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	// we only hand out what is below our root, even when we are
+	// asked for something elsewhere in the drive
+	if _, err := d.root.pathOf(ctx, name); err != nil {
+		logging.For(ctx).Debugf("by-id: %q isn't below our root: %v", name, err)
+		return nil, fuse.ENOENT
+	}
+	n, err := d.root.nodeByID(ctx, name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return n, nil
+}
+
+func (d *byIDDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return nil, nil
+}
@@ -0,0 +1,53 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+)
+
+// we refuse to start if the cache dir has less free space than this,
+// since even small files would soon fail to open
+const minCacheFreeMB = 100
+
+// CheckCacheDir makes sure we can keep local copies of files in dir
+// (the system temp dir if dir is empty), creating it if needed.  It
+// complains if there is less than sizeMB free there, and fails if there
+// is hardly any.
+func CheckCacheDir(dir string, sizeMB int64) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := checkWriteableDir(dir); err != nil {
+		return fmt.Errorf("Unable to use cache dir %s: %v", dir, err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("Unable to check free space in cache dir %s: %v", dir, err)
+	}
+	freeMB := int64(st.Bavail) * int64(st.Bsize) >> 20
+	if freeMB < minCacheFreeMB {
+		return fmt.Errorf("Cache dir %s only has %dMB free; we need at least %dMB", dir, freeMB, minCacheFreeMB)
+	}
+	if sizeMB > 0 && freeMB < sizeMB {
+		logging.Warnf("Cache dir %s only has %dMB free, less than the %dMB the cache may use", dir, freeMB, sizeMB)
+	}
+	return nil
+}
+
+// checkWriteableDir creates dir if needed and makes sure we can create
+// files in it.
+func checkWriteableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "mntgd-setup-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,26 @@
+package mntgdrive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckCacheDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mntgd-cachedir-")
+	ok(t, err)
+	defer os.RemoveAll(tmp)
+
+	// made if needed
+	dir := filepath.Join(tmp, "cache")
+	ok(t, CheckCacheDir(dir, 0))
+	fi, err := os.Stat(dir)
+	ok(t, err)
+	assert(t, fi.IsDir(), "expected %s to be a dir", dir)
+
+	// a file where the dir should be
+	file := filepath.Join(tmp, "file")
+	ok(t, ioutil.WriteFile(file, nil, 0600))
+	assert(t, CheckCacheDir(file, 0) != nil, "expected an error using a file as the cache dir")
+}
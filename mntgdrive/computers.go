@@ -0,0 +1,143 @@
+package mntgdrive
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const computersName = ".computers"
+
+var _ fs.HandleReadDirAller = (*computersDirType)(nil)
+var _ fs.NodeStringLookuper = (*computersDirType)(nil)
+
+// computersDirType is the .computers folder at the top of a mount.  It
+// has a folder for each computer that backs up to the drive, named
+// after the computer, like the web UI's Computers section.  Each is
+// the top of its own read-only system, so backups can be looked
+// through and copied out, but never changed by accident.
+type computersDirType struct {
+	root *node
+
+	mu sync.Mutex
+	// the computers as of when we last listed them, by local name; nil
+	// if we haven't yet
+	byName map[string]*system
+}
+
+// computerSystem returns the system for the computer whose backups are
+// in g, making it if this is the first we have heard of it.  Its
+// changes come through our part of the change feed, so it shares our
+// connection to drive.
+func (s *system) computerSystem(g *gdrive.Node) *system {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.computerSystems[g.ID]
+	if !ok {
+		sub = s.newSubsystem(s.gd, g.ID)
+		sub.readonly = true
+		sub.sharesChanges = true
+		s.computerSystems[g.ID] = sub
+	}
+	return sub
+}
+
+// sharingSubsystems returns the subsystems that hear about changes
+// through us.
+func (s *system) sharingSubsystems() []*system {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subs []*system
+	for _, sub := range s.computerSystems {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// keepComputers forgets the systems for computers that aren't in ids,
+// e.g. because their backups were deleted.
+func (s *system) keepComputers(ids map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sub := range s.computerSystems {
+		if !ids[id] {
+			logging.Infof("Forgetting computer %s, which no longer backs up to the drive", id)
+			sub.stopWatching()
+			delete(s.computerSystems, id)
+		}
+	}
+}
+
+// list returns the computers by local name, asking drive for them if
+// fresh is true or if we haven't yet.
+func (d *computersDirType) list(ctx context.Context, fresh bool) (map[string]*system, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byName != nil && !fresh {
+		return d.byName, nil
+	}
+	computers, err := d.root.gd.Computers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*system{}
+	ids := map[string]bool{}
+	for _, g := range computers {
+		sub := d.root.computerSystem(g)
+		sub.setMountPrefix(path.Join(computersName, localName(g.Name)))
+		byName[localName(g.Name)] = sub
+		ids[g.ID] = true
+	}
+	d.root.keepComputers(ids)
+	d.byName = byName
+	return byName, nil
+}
+
+func (d *computersDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = computersIdx
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *computersDirType) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	byName, err := d.list(ctx, false)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list computers: %v", err)
+		return nil, fuse.EIO
+	}
+	sub, ok := byName[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return sub.rootNode()
+}
+
+func (d *computersDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	byName, err := d.list(ctx, true)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list computers: %v", err)
+		return nil, fuse.EIO
+	}
+	var ds []fuse.Dirent
+	for name, sub := range byName {
+		root, err := sub.rootNode()
+		if err != nil {
+			logging.For(ctx).Errorf("Unable to fetch the top of computer %s: %v", name, err)
+			continue
+		}
+		ds = append(ds, fuse.Dirent{Inode: uint64(root.idx), Type: fuse.DT_Dir, Name: name})
+	}
+	return ds, nil
+}
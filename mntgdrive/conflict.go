@@ -0,0 +1,184 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// conflictError is what checking a file before uploading changes to it
+// finds when its content changed in drive after we made our local copy
+// of it.  We upload our changes as a conflict copy instead, so we
+// don't overwrite someone else's edits.  If there is nowhere to put
+// one, the upload fails with it, which programs see as ESTALE, from
+// close, rather than the EIO other failed uploads give them.
+type conflictError struct {
+	id string
+	// the md5 of the content our copy started from, and of what
+	// drive has now
+	base, remote string
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("%s changed in drive while we had it open (md5 %s, was %s)", e.id, e.remote, e.base)
+}
+
+func (e *conflictError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ESTALE)
+}
+
+// noteUploadBase remembers what drive has for n as what any changes we
+// upload to it are based on, unless we already have a local copy,
+// which has what drive had when we made it.  Our metadata may be
+// behind drive, so once a download fills the local copy, what it got
+// is the base instead; see downloaded.  A prefetched copy noted its
+// base when it was downloaded.
+func (n *node) noteUploadBase() {
+	if pf := n.madeContent(); pf != nil && pf.IsOpen() {
+		return
+	}
+	prefetched := phantomfile.Prefetched(n.id)
+	n.mu.Lock()
+	if !prefetched {
+		n.uploadBase = n.md5
+	}
+	n.conflictCopy = nil
+	n.mu.Unlock()
+}
+
+// downloaded notes that f has what drive has for n now, which changes
+// to a local copy made from it are based on.
+func (n *node) downloaded(f *os.File) {
+	sum, err := gdrive.FileMD5(f)
+	if err != nil {
+		logging.Warnf("Unable to checksum what we downloaded for %s: %v", n, err)
+		return
+	}
+	n.mu.Lock()
+	n.uploadBase = sum
+	n.mu.Unlock()
+}
+
+// UploadBase returns the md5 of what drive had when we made our local
+// copy of n, for the upload journal.
+func (n *node) UploadBase() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.uploadBase
+}
+
+// checkUploadBase asks drive whether n's content is still what our
+// local copy started from, returning a *conflictError if it isn't.
+// We only compare content, so renaming or starring the file elsewhere
+// doesn't count.
+func (n *node) checkUploadBase(ctx context.Context) error {
+	n.mu.Lock()
+	refreshed := n.openRefresh
+	n.mu.Unlock()
+	if refreshed != nil {
+		select {
+		case <-refreshed.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	n.mu.Lock()
+	base := n.uploadBase
+	n.mu.Unlock()
+	if base == "" {
+		// we don't know what it started from, e.g. because drive
+		// doesn't checksum it
+		return nil
+	}
+	g, err := n.gd.FetchNode(ctx, n.id)
+	if err != nil {
+		return err
+	}
+	if g.MD5 != base {
+		return &conflictError{n.id, base, g.MD5}
+	}
+	return nil
+}
+
+// uploaded notes that drive now has the content of f for n, so later
+// changes are based on that.
+func (n *node) uploaded(f *os.File) {
+	sum, err := gdrive.FileMD5(f)
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	if err != nil {
+		logging.Warnf("Unable to checksum what we uploaded for %s: %v", n, err)
+		sum = ""
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err == nil {
+		// so that the change drive tells us about doesn't look like
+		// new content
+		n.md5 = sum
+		n.size = uint64(fi.Size())
+	}
+	n.uploadBase = sum
+	// we just made a new revision
+	n.revs = nil
+}
+
+// conflictCopyName returns the name we give a copy of our changes to
+// the file called name, made at t, when we can't upload them over it.
+// Like dropbox, we keep any extension at the end, so the copy opens
+// with the same program.
+func conflictCopyName(name string, t time.Time) string {
+	ext := path.Ext(name)
+	if ext == name {
+		// a dotfile, with no extension
+		ext = ""
+	}
+	return fmt.Sprintf("%s (conflicted copy %s)%s", strings.TrimSuffix(name, ext), t.Format("2006-01-02 150405"), ext)
+}
+
+// uploadConflictCopy uploads f, our changes to n, to a new file next to
+// n rather than over it, because of conflict.  Later uploads from the
+// same local copy go to the new file as well.
+func (n *node) uploadConflictCopy(ctx context.Context, f *os.File, conflict *conflictError) error {
+	n.mu.Lock()
+	name := n.name
+	var parentID string
+	for id := range n.parents {
+		if parentID == "" || id < parentID {
+			parentID = id
+		}
+	}
+	n.mu.Unlock()
+	if parentID == "" {
+		logging.Warnf("Not uploading changes to %s, which has no folder to put a conflict copy in: %v", n, conflict)
+		return conflict
+	}
+	g, err := n.gd.CreateNode(ctx, parentID, conflictCopyName(name, time.Now()), false)
+	if err != nil {
+		logging.Errorf("Unable to create a conflict copy of %s: %v", n, err)
+		return err
+	}
+	n.system.mu.Lock()
+	cp := n.insertNode(g)
+	stale := cp.entriesOf()
+	n.system.mu.Unlock()
+	n.invalidateEntries(stale)
+	logging.Warnf("%v, so uploading our changes to %s instead", conflict, cp)
+
+	n.mu.Lock()
+	n.conflictCopy = cp
+	n.mu.Unlock()
+	return cp.Upload(ctx, f)
+}
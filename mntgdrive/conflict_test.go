@@ -0,0 +1,14 @@
+package mntgdrive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConflictCopyName(t *testing.T) {
+	at := time.Date(2016, 5, 1, 13, 4, 5, 0, time.UTC)
+	equals(t, "report (conflicted copy 2016-05-01 130405).txt", conflictCopyName("report.txt", at))
+	equals(t, "archive.tar (conflicted copy 2016-05-01 130405).gz", conflictCopyName("archive.tar.gz", at))
+	equals(t, "notes (conflicted copy 2016-05-01 130405)", conflictCopyName("notes", at))
+	equals(t, ".bashrc (conflicted copy 2016-05-01 130405)", conflictCopyName(".bashrc", at))
+}
@@ -0,0 +1,67 @@
+package mntgdrive
+
+import (
+	"os"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const ctlDirName = ".mntgdrive"
+
+var _ fs.HandleReadDirAller = (*ctlDirType)(nil)
+var _ fs.NodeStringLookuper = (*ctlDirType)(nil)
+
+// ctlDirType is the .mntgdrive folder at the top of a regular mount.
+// It holds magic files for controlling the mount, as opposed to the
+// ones at the top, like .dump, that just tell you about it.
+type ctlDirType struct {
+	root        *node
+	batch       *batchNodeType
+	batchResult *batchResultNodeType
+	byID        *byIDDirType
+	jobs        *jobsDirType
+	whoami      *whoamiNodeType
+	config      *configNodeType
+}
+
+func (d *ctlDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = ctlDirIdx
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *ctlDirType) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	switch name {
+	case batchName:
+		return d.batch, nil
+	case batchResultName:
+		return d.batchResult, nil
+	case byIDName:
+		return d.byID, nil
+	case jobsName:
+		return d.jobs, nil
+	case whoamiName:
+		return d.whoami, nil
+	case configName:
+		return d.config, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *ctlDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Inode: batchIdx, Type: fuse.DT_File, Name: batchName},
+		{Inode: batchResultIdx, Type: fuse.DT_File, Name: batchResultName},
+		{Inode: byIDIdx, Type: fuse.DT_Dir, Name: byIDName},
+		{Inode: jobsIdx, Type: fuse.DT_Dir, Name: jobsName},
+		{Inode: whoamiIdx, Type: fuse.DT_File, Name: whoamiName},
+		{Inode: configIdx, Type: fuse.DT_File, Name: configName},
+	}, nil
+}
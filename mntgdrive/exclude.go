@@ -0,0 +1,45 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+)
+
+// checkExcludes returns an error if any of patterns isn't one we
+// understand.  Each is a glob (as for path.Match) that names are matched
+// against, optionally ending in a slash to only match folders.
+func checkExcludes(patterns []string) error {
+	for _, p := range patterns {
+		glob := strings.TrimSuffix(p, "/")
+		if glob == "" || strings.Contains(glob, "/") {
+			return fmt.Errorf("exclude pattern %q: want a name pattern like *.iso or node_modules/", p)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("exclude pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// excluded returns true if we hide g, and everything below it, because
+// of one of our exclude patterns.
+func (s *system) excluded(g *gdrive.Node) bool {
+	for _, p := range s.excludes {
+		glob := strings.TrimSuffix(p, "/")
+		if glob != p && !g.Dir() {
+			continue
+		}
+		if ok, _ := path.Match(glob, g.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// presented returns true if we show g.
+func (s *system) presented(g *gdrive.Node) bool {
+	return g.IncludeNode(s.others) && !s.excluded(g)
+}
@@ -0,0 +1,30 @@
+package mntgdrive
+
+import (
+	"testing"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/fakedrive"
+)
+
+func TestExcluded(t *testing.T) {
+	s := &system{excludes: []string{"*.iso", "node_modules/"}}
+	for _, tc := range []struct {
+		name string
+		dir  bool
+		want bool
+	}{
+		{"disk.iso", false, true},
+		{"disk.iso.txt", false, false},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"my_modules", true, false},
+	} {
+		g := fakedrive.MakeTextFile("id", tc.name, "root")
+		if tc.dir {
+			g = fakedrive.MakeDir("id", tc.name, "root")
+		}
+		if got := s.excluded(g); got != tc.want {
+			t.Errorf("excluded(%q, dir=%t) = %t, want %t", tc.name, tc.dir, got, tc.want)
+		}
+	}
+}
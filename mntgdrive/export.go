@@ -0,0 +1,141 @@
+package mntgdrive
+
+import (
+	"os"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// what we add to the name of a google docs file for its zip export
+const zipExportSuffix = ".zip"
+
+const zipMimeType = "application/zip"
+
+var _ fs.NodeOpener = (*exportNode)(nil)
+
+// exportNode is a read-only file holding a google docs file (or
+// similar), exported as a zip archive.  When we are asked to, each file
+// that drive can export that way gets one, next to it, named after it
+// with .zip on the end.  Google docs files have no content of their
+// own, so this is how backup tools get at what is in them.
+type exportNode struct {
+	*system
+	idx index
+	of  *node
+	pf  *phantomfile.PhantomFile
+}
+
+// lookupExport returns the node for name, if it names the zip export of
+// one of n's children.
+func (n *node) lookupExport(name string) (*exportNode, error) {
+	if !n.exportZip || !strings.HasSuffix(name, zipExportSuffix) {
+		return nil, fuse.ENOENT
+	}
+	name = strings.TrimSuffix(name, zipExportSuffix)
+	var found *node
+	var lc *lazyChild
+	n.cmu.Lock()
+	for _, c := range n.children {
+		if localName(c.name) == name {
+			found = c
+			break
+		}
+	}
+	if found == nil {
+		for _, l := range n.lazy {
+			if localName(l.g.Name) == name {
+				lc = l
+				break
+			}
+		}
+	}
+	n.cmu.Unlock()
+	switch {
+	case lc != nil:
+		// made takes the system lock, which we can't take while
+		// holding cmu
+		found = n.made(lc)
+	case found == nil:
+		return nil, fuse.ENOENT
+	}
+	return found.export()
+}
+
+// export returns the zip export of n, if drive can export it that way.
+// We hand out the same node each time, so the kernel sees a stable
+// inode.
+func (n *node) export() (*exportNode, error) {
+	n.mu.Lock()
+	mimeType := n.mimeType
+	n.mu.Unlock()
+	if !gdrive.ZipExportable(mimeType) {
+		return nil, fuse.ENOENT
+	}
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	e, ok := n.exportNodes[n.id]
+	if !ok {
+		n.nextInode++
+		e = &exportNode{system: n.system, idx: n.nextInode, of: n}
+		e.pf = phantomfile.NewPhantomFile(n.lifetime(), e)
+		n.exportNodes[n.id] = e
+	}
+	return e, nil
+}
+
+func (e *exportNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(e.idx)
+	e.of.mu.Lock()
+	a.Mtime = e.of.mtime
+	a.Ctime = e.of.ctime
+	a.Crtime = e.of.ctime
+	e.of.mu.Unlock()
+	// we don't know how big the export is until we have made it
+	if size, _, ok := e.pf.StatIfLocal(); ok {
+		a.Size = uint64(size)
+	}
+	a.Mode = modeReadOnly
+	return nil
+}
+
+func (e *exportNode) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if xlateAccessMode(req.Flags) != phantomfile.ReadOnly {
+		return nil, fuse.EPERM
+	}
+	// the size we reported may well have been zero, so the kernel
+	// can't go by it
+	res.Flags |= fuse.OpenDirectIO
+	h, err := e.pf.Open(ctx, phantomfile.ReadOnly, phantomfile.ProactiveFetch, processOf(req.Pid))
+	if err != nil {
+		return nil, err
+	}
+	return e.observed(e.audited(h, req, e.of.id, func() string { return e.of.mountPath() + zipExportSuffix })), nil
+}
+
+func (e *exportNode) Download(ctx context.Context, f *os.File) error {
+	return e.gd.Export(ctx, e.of.id, zipMimeType, f)
+}
+
+func (e *exportNode) Upload(ctx context.Context, f *os.File) error {
+	return fuse.EPERM
+}
+
+func (e *exportNode) ID() string {
+	return e.of.id
+}
+
+func (e *exportNode) Name() string {
+	e.of.mu.Lock()
+	defer e.of.mu.Unlock()
+	return e.of.name + zipExportSuffix
+}
+
+func (e *exportNode) String() string {
+	return e.of.String() + zipExportSuffix
+}
@@ -0,0 +1,98 @@
+package mntgdrive
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// Transfer directions, as passed to Hooks.OnTransfer
+const (
+	Download = "download"
+	Upload   = "upload"
+)
+
+// Hooks lets a program that mounts a drive through us (see Options)
+// attach its own telemetry.  Methods may be called from many
+// goroutines at once and shouldn't block, since file system requests
+// wait on them.
+type Hooks interface {
+	// OnOperation is called when we finish answering a file system
+	// request, e.g. "Open" or "Rename", with how long it took and the
+	// error we returned, if any.
+	OnOperation(op string, took time.Duration, err error)
+	// OnTransfer is called when we finish downloading or uploading the
+	// content of the file with id.
+	OnTransfer(direction string, id string, bytes int64, took time.Duration, err error)
+	// OnChangeApplied is called for each change from drive's change
+	// feed that changes what we show.
+	OnChangeApplied(id string, removed bool)
+	// OnError is called when something fails that no program is
+	// waiting on, e.g. fetching changes.
+	OnError(what string, err error)
+}
+
+// NoHooks is the Hooks we use when nobody asks for any.  It does
+// nothing.
+type NoHooks struct{}
+
+func (NoHooks) OnOperation(op string, took time.Duration, err error)                               {}
+func (NoHooks) OnTransfer(direction string, id string, bytes int64, took time.Duration, err error) {}
+func (NoHooks) OnChangeApplied(id string, removed bool)                                            {}
+func (NoHooks) OnError(what string, err error)                                                     {}
+
+// observe tells our hooks about op, which started at start, once it is
+// done.  Use it as
+//
+//	defer s.observe("Rename", time.Now(), &err)
+func (s *system) observe(op string, start time.Time, err *error) {
+	s.hooks.OnOperation(op, time.Since(start), *err)
+}
+
+// transfer moves the content of the file with id in direction, using
+// do, and tells our hooks about it.
+func (s *system) transfer(direction string, id string, f *os.File, do func() error) error {
+	start := time.Now()
+	err := do()
+	var size int64
+	if fi, serr := f.Stat(); serr == nil {
+		size = fi.Size()
+	}
+	s.hooks.OnTransfer(direction, id, size, time.Since(start), err)
+	return err
+}
+
+// observedHandle tells our hooks about each read, write and flush
+// through a file handle.
+type observedHandle struct {
+	fileHandle
+	s *system
+}
+
+// observed returns h, telling our hooks about what is done with it if
+// anybody is listening.
+func (s *system) observed(h fs.Handle) fs.Handle {
+	fh, ok := h.(fileHandle)
+	if _, none := s.hooks.(NoHooks); none || !ok {
+		return h
+	}
+	return &observedHandle{fileHandle: fh, s: s}
+}
+
+func (h *observedHandle) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) (err error) {
+	defer h.s.observe("Read", time.Now(), &err)
+	return h.fileHandle.Read(ctx, req, res)
+}
+
+func (h *observedHandle) Write(ctx context.Context, req *fuse.WriteRequest, res *fuse.WriteResponse) (err error) {
+	defer h.s.observe("Write", time.Now(), &err)
+	return h.fileHandle.Write(ctx, req, res)
+}
+
+func (h *observedHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer h.s.observe("Flush", time.Now(), &err)
+	return h.fileHandle.Flush(ctx, req)
+}
@@ -0,0 +1,161 @@
+package mntgdrive
+
+import (
+	"testing"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/fakedrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// recordingInvalidator remembers the ids of the nodes it was asked to
+// invalidate, in order, those it only invalidated the attributes of,
+// and the entries, as parent id/name.
+type recordingInvalidator struct {
+	ids     []string
+	attrs   []string
+	entries []string
+}
+
+func (r *recordingInvalidator) InvalidateNodeData(n fs.Node) error {
+	r.ids = append(r.ids, n.(*node).id)
+	return nil
+}
+
+func (r *recordingInvalidator) InvalidateNodeAttr(n fs.Node) error {
+	r.attrs = append(r.attrs, n.(*node).id)
+	return nil
+}
+
+func (r *recordingInvalidator) InvalidateEntry(parent fs.Node, name string) error {
+	r.entries = append(r.entries, parent.(*node).id+"/"+name)
+	return nil
+}
+
+// loadedSystem returns a system with the root and its children
+// already loaded and looked up, along with what it invalidates.
+func loadedSystem(t *testing.T) (*system, *recordingInvalidator) {
+	rec := &recordingInvalidator{}
+	s := newSystem(fakedrive.NewDrive(allNodes()), rec, false)
+	root, err := s.Root()
+	ok(t, err)
+	lookUpAll(t, root.(*node))
+	dirTwo, ok2 := s.idMap["dir_two_id"]
+	assert(t, ok2, "dir two not loaded")
+	lookUpAll(t, dirTwo)
+	return s, rec
+}
+
+// lookUpAll lists n and makes nodes for everything in it, as though
+// the kernel had looked each one up.
+func lookUpAll(t *testing.T, n *node) {
+	ok(t, n.loadChildrenIfEmpty(context.Background()))
+	n.cmu.Lock()
+	var lazy []*lazyChild
+	for _, lc := range n.lazy {
+		lazy = append(lazy, lc)
+	}
+	n.cmu.Unlock()
+	for _, lc := range lazy {
+		n.made(lc)
+	}
+}
+
+func TestInvalidations(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func() *gdrive.Change
+		want        []string
+		wantEntries []string
+	}{
+		{"file removed",
+			func() *gdrive.Change { return &gdrive.Change{ID: "file_one_id", Removed: true} },
+			[]string{"file_one_id"},
+			[]string{"root/file one"}},
+		{"file trashed",
+			func() *gdrive.Change {
+				g := fakedrive.MakeTextFile("file_one_id", "file one", "root")
+				g.Trashed = true
+				return &gdrive.Change{ID: g.ID, Node: g}
+			},
+			[]string{"file_one_id"},
+			[]string{"root/file one"}},
+		{"file renamed to a name with a slash",
+			func() *gdrive.Change {
+				return &gdrive.Change{ID: "file_one_id", Node: fakedrive.MakeTextFile("file_one_id", "one/two", "root")}
+			},
+			nil,
+			[]string{"root/file one", "root/one\u2215two"}},
+		{"file updated",
+			func() *gdrive.Change {
+				return &gdrive.Change{ID: "file_two_id", Node: fakedrive.MakeTextFile("file_two_id", "file 2", "dir_two_id")}
+			},
+			nil,
+			[]string{"dir_two_id/file two", "dir_two_id/file 2"}},
+		{"file content changed",
+			func() *gdrive.Change {
+				g := fakedrive.MakeTextFile("file_two_id", "file two", "dir_two_id")
+				g.MD5 = "new md5"
+				return &gdrive.Change{ID: g.ID, Node: g}
+			},
+			[]string{"file_two_id"},
+			nil},
+		{"folder updated",
+			func() *gdrive.Change {
+				return &gdrive.Change{ID: "dir_two_id", Node: fakedrive.MakeDir("dir_two_id", "dir 2", "root")}
+			},
+			nil,
+			[]string{"root/dir two", "root/dir 2"}},
+		{"folder removed",
+			func() *gdrive.Change { return &gdrive.Change{ID: "dir_one_id", Removed: true} },
+			[]string{"dir_one_id"},
+			[]string{"root/dir one"}},
+		{"root removed",
+			func() *gdrive.Change { return &gdrive.Change{ID: "root", Removed: true} },
+			nil,
+			nil},
+		{"new file",
+			func() *gdrive.Change {
+				return &gdrive.Change{ID: "new_id", Node: fakedrive.MakeTextFile("new_id", "new", "root")}
+			},
+			nil,
+			[]string{"root/new"}},
+		{"unknown file",
+			func() *gdrive.Change { return &gdrive.Change{ID: "unknown_id", Removed: true} },
+			nil,
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, rec := loadedSystem(t)
+			var cs gdrive.ChangeStats
+			s.processChange(tt.change(), &cs)
+			equals(t, tt.want, rec.ids)
+			equals(t, tt.wantEntries, rec.entries)
+		})
+	}
+}
+
+func TestMetadataChangeKeepsData(t *testing.T) {
+	s, rec := loadedSystem(t)
+	g := fakedrive.MakeTextFile("file_two_id", "file two", "dir_two_id")
+	g.Starred = true
+	g.Version++
+	var cs gdrive.ChangeStats
+	s.processChange(&gdrive.Change{ID: g.ID, Node: g}, &cs)
+	equals(t, []string(nil), rec.ids)
+	equals(t, []string{"file_two_id"}, rec.attrs)
+	equals(t, uint32(1), cs.Changed)
+
+	// google docs files have no checksum, so a new version may be new
+	// content
+	rec.attrs = nil
+	doc := fakedrive.MakeTextFile("file_two_id", "file two", "dir_two_id")
+	doc.MD5 = ""
+	doc.Version = g.Version + 1
+	s.processChange(&gdrive.Change{ID: doc.ID, Node: doc}, &cs)
+	equals(t, []string{"file_two_id"}, rec.ids)
+	equals(t, []string(nil), rec.attrs)
+}
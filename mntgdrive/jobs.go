@@ -0,0 +1,119 @@
+package mntgdrive
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const jobsName = "jobs"
+
+var _ fs.HandleReadDirAller = (*jobsDirType)(nil)
+var _ fs.NodeStringLookuper = (*jobsDirType)(nil)
+var _ fs.HandleReadAller = (*jobFileType)(nil)
+
+// jobsDirType is the .mntgdrive/jobs folder.  It holds a file for each
+// job the mount is running or finished recently, named by the job's
+// id, which says how far the job has got.
+type jobsDirType struct {
+	root *node
+}
+
+func (d *jobsDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = jobsIdx
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *jobsDirType) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	j, ok := d.root.jobs.Get(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return &jobFileType{j: j}, nil
+}
+
+func (d *jobsDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var dirs []fuse.Dirent
+	for _, st := range d.root.jobs.List() {
+		dirs = append(dirs, fuse.Dirent{Type: fuse.DT_File, Name: st.ID})
+	}
+	return dirs, nil
+}
+
+// jobFileType is the file in .mntgdrive/jobs for one job.  Reading it
+// gets the job's control.JobStatus as json.
+type jobFileType struct {
+	j *control.Job
+}
+
+func (f *jobFileType) Attr(ctx context.Context, a *fuse.Attr) error {
+	st := f.j.Status()
+	a.Mode = modeReadOnly
+	a.Size = uint64(len(jobContent(st)))
+	a.Ctime = st.Started
+	a.Crtime = st.Started
+	a.Mtime = time.Now()
+	return nil
+}
+
+func (f *jobFileType) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	// the status changes while the job runs
+	res.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+func (f *jobFileType) ReadAll(ctx context.Context) ([]byte, error) {
+	return jobContent(f.j.Status()), nil
+}
+
+func jobContent(st control.JobStatus) []byte {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		// a JobStatus always encodes
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// handleJobs registers the control socket handlers for starting,
+// listing and cancelling jobs.
+func (s *system) handleJobs(ctl *control.Server) {
+	ctl.Handle(control.OpJobs, func(req control.Request, enc *json.Encoder) error {
+		return enc.Encode(s.jobs.List())
+	})
+	ctl.Handle(control.OpCancel, func(req control.Request, enc *json.Encoder) error {
+		var reply control.JobReply
+		if len(req.Args) != 1 {
+			reply.Error = "cancel takes a single job id"
+		} else if err := s.jobs.Cancel(req.Args[0]); err != nil {
+			reply.Error = err.Error()
+		}
+		return enc.Encode(reply)
+	})
+	ctl.Handle(control.OpResync, func(req control.Request, enc *json.Encoder) error {
+		var reply control.JobReply
+		j, err := s.startResync(req.Args)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			st := j.Status()
+			reply.Job = &st
+		}
+		return enc.Encode(reply)
+	})
+}
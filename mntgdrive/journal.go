@@ -0,0 +1,79 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"golang.org/x/net/context"
+)
+
+// replayJournals uploads the changes that earlier runs didn't get to
+// before they crashed or were killed, as their journals record.  As
+// when a running mount uploads, we don't overwrite a file that changed
+// in drive since the changes were made; they go up as a conflict copy
+// instead.  Changes we can't upload stay in the journal for next time.
+// Each change goes up through the account that made it, from gds, by
+// profile, so it is credited to the right person; if that account
+// isn't mounted writeable this time, the change waits for a run where
+// it is.
+func replayJournals(ctx context.Context, gds map[string]gdrive.DriveLike) {
+	entries, err := phantomfile.ClaimUnfinished()
+	if err != nil {
+		logging.Warnf("Unable to read the journals of earlier runs: %v", err)
+		return
+	}
+	for _, e := range entries {
+		gd, ok := gds[e.Profile]
+		if !ok {
+			logging.Warnf("Not uploading changes to %s (%s) left behind by an earlier run, as its account (%q) isn't mounted writeable, will try again next time", e.Name, e.ID, e.Profile)
+			continue
+		}
+		if err := replayEntry(ctx, gd, e); err != nil {
+			logging.Errorf("Unable to upload changes to %s (%s) left behind by an earlier run, will try again next time: %v", e.Name, e.ID, err)
+			continue
+		}
+		if err := phantomfile.Finish(e); err != nil {
+			logging.Warnf("Unable to remove %s from its journal: %v", e.Path, err)
+		}
+	}
+}
+
+// Profile returns the name of the google account n belongs to, for the
+// upload journal; empty means the default one.
+func (n *node) Profile() string {
+	return n.profile
+}
+
+func replayEntry(ctx context.Context, gd gdrive.DriveLike, e phantomfile.JournalEntry) error {
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	g, err := gd.FetchNode(ctx, e.ID)
+	if err != nil {
+		return err
+	}
+	id := e.ID
+	if g.Trashed || (e.Base != "" && g.MD5 != e.Base) {
+		if len(g.ParentIDs) == 0 {
+			return fmt.Errorf("%s changed in drive and has no folder to put a conflict copy in", e.ID)
+		}
+		cp, err := gd.CreateNode(ctx, g.ParentIDs[0], conflictCopyName(g.Name, time.Now()), false)
+		if err != nil {
+			return err
+		}
+		logging.Warnf("%s (%s) changed in drive since an earlier run changed it, so uploading those changes to %s", e.Name, e.ID, cp.Name)
+		id = cp.ID
+	}
+	if err = gd.Upload(ctx, id, f); err != nil {
+		return err
+	}
+	logging.Infof("Uploaded changes to %s (%s) left behind by an earlier run", e.Name, e.ID)
+	return nil
+}
@@ -0,0 +1,101 @@
+package mntgdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/fakedrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"golang.org/x/net/context"
+)
+
+func TestReplayJournals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mntgd-replay-")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	old := phantomfile.CacheDir()
+	phantomfile.SetTempDir(dir)
+	defer phantomfile.SetTempDir(old)
+
+	nodes := allNodes()
+	fake := fakedrive.NewDrive(nodes)
+
+	// a run that crashed with changes to both files, one of which was
+	// changed in drive since
+	cmd := exec.Command("true")
+	ok(t, cmd.Run())
+	pid := cmd.Process.Pid
+	var entries []phantomfile.JournalEntry
+	for i, g := range []struct{ id, name, base string }{
+		{"file_one_id", "file one", nodes[3].MD5},
+		{"file_two_id", "file two", "an older md5"},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("mntgd-%d-%s-%d", pid, g.id, i))
+		ok(t, ioutil.WriteFile(path, []byte("crashed with "+g.id), 0600))
+		entries = append(entries, phantomfile.JournalEntry{ID: g.id, Name: g.name, Path: path, Base: g.base})
+	}
+	b, err := json.Marshal(entries)
+	ok(t, err)
+	ok(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("mntgd-journal-%d.json", pid)), b, 0600))
+
+	// another account, which has the same files shared with it, mustn't
+	// upload changes the default account made
+	shared := fakedrive.NewDrive(allNodes())
+	replayJournals(context.Background(), map[string]gdrive.DriveLike{"": fake, "shared": shared})
+
+	equals(t, "content for file_one_id", downloadString(t, shared, "file_one_id"))
+	equals(t, "crashed with file_one_id", downloadString(t, fake, "file_one_id"))
+	equals(t, "content for file_two_id", downloadString(t, fake, "file_two_id"))
+	children, err := fake.FetchChildren(context.Background(), "dir_two_id")
+	ok(t, err)
+	var copies int
+	for _, c := range children {
+		if strings.HasPrefix(c.Name, "file two (conflicted copy ") {
+			copies++
+			equals(t, "crashed with file_two_id", downloadString(t, fake, c.ID))
+		}
+	}
+	equals(t, 1, copies)
+
+	left, err := ioutil.ReadDir(dir)
+	ok(t, err)
+	equals(t, 0, len(left))
+}
+
+func TestReplayJournalsWaitsForItsAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mntgd-replay-")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	old := phantomfile.CacheDir()
+	phantomfile.SetTempDir(dir)
+	defer phantomfile.SetTempDir(old)
+
+	cmd := exec.Command("true")
+	ok(t, cmd.Run())
+	pid := cmd.Process.Pid
+	path := filepath.Join(dir, fmt.Sprintf("mntgd-%d-file_one_id-1", pid))
+	ok(t, ioutil.WriteFile(path, []byte("crashed with file_one_id"), 0600))
+	b, err := json.Marshal([]phantomfile.JournalEntry{{ID: "file_one_id", Name: "file one", Path: path, Profile: "work"}})
+	ok(t, err)
+	ok(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("mntgd-journal-%d.json", pid)), b, 0600))
+
+	fake := fakedrive.NewDrive(allNodes())
+	replayJournals(context.Background(), map[string]gdrive.DriveLike{"": fake})
+
+	equals(t, "content for file_one_id", downloadString(t, fake, "file_one_id"))
+	// the change is still there, in a journal we claimed, for a run
+	// that mounts the account
+	_, err = os.Stat(path)
+	ok(t, err)
+	journals, err := filepath.Glob(filepath.Join(dir, "mntgd-journal-*.json"))
+	ok(t, err)
+	equals(t, 1, len(journals))
+}
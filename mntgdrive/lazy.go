@@ -0,0 +1,127 @@
+package mntgdrive
+
+import (
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+
+	"bazil.org/fuse"
+)
+
+// lazyChild is something we have listed in a folder but haven't made a
+// node for yet.  In a big folder most children are only ever listed, so
+// we keep what drive told us about each, which the listing cache holds
+// anyway, and make the node when someone looks it up.  The inode
+// number is picked when it is listed, so it stays the same once the
+// node is made.
+type lazyChild struct {
+	g   *gdrive.Node
+	idx index
+}
+
+// listedChild returns the lazyChild for g, which we are listing in a
+// folder, making one if no other folder has listed it.  Assumes we have
+// the system lock.
+func (s *system) listedChild(g *gdrive.Node) *lazyChild {
+	lc, ok := s.lazyChildren[g.ID]
+	if !ok {
+		s.nextInode++
+		lc = &lazyChild{g: g, idx: s.nextInode}
+		s.lazyChildren[g.ID] = lc
+		return lc
+	}
+	old := lc.g
+	lc.g = g
+	// the folders that listed it before may now show it by another
+	// name
+	s.forgetNamesIn(old.ParentIDs)
+	return lc
+}
+
+// forgetNamesIn throws away the names the folders with ids worked out
+// for their children.  Assumes we have the system lock.
+func (s *system) forgetNamesIn(ids []string) {
+	for _, id := range ids {
+		if p, ok := s.idMap[id]; ok {
+			p.cmu.Lock()
+			p.forgetNames()
+			p.cmu.Unlock()
+		}
+	}
+}
+
+// makeLazy makes the node for lc, as g says it is now, taking it out of
+// the folders that listed it and putting the node in its parents
+// instead.  Assumes we have the system lock.
+func (s *system) makeLazy(lc *lazyChild, g *gdrive.Node) *node {
+	delete(s.lazyChildren, lc.g.ID)
+	for _, id := range lc.g.ParentIDs {
+		if p, ok := s.idMap[id]; ok {
+			p.cmu.Lock()
+			delete(p.lazy, lc.g.ID)
+			p.forgetNames()
+			p.cmu.Unlock()
+		}
+	}
+	return s.insertNodeAt(lc.idx, g)
+}
+
+// made returns the node for lc, which n listed, making it if need be.
+func (n *node) made(lc *lazyChild) *node {
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	if c, ok := n.idMap[lc.g.ID]; ok {
+		return c
+	}
+	return n.makeLazy(lc, lc.g)
+}
+
+// lazyIDs returns the ids of n's children that we haven't made nodes
+// for, in no particular order.
+func (n *node) lazyIDs() []string {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	ids := make([]string, 0, len(n.lazy))
+	for id := range n.lazy {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// dropLazy forgets the children n listed but we never made nodes for,
+// now that n is going away, unless another folder still lists them.
+// Assumes we have the system lock.
+func (s *system) dropLazy(n *node) {
+	n.cmu.Lock()
+	lazy := n.lazy
+	n.lazy = nil
+	n.forgetNames()
+	n.cmu.Unlock()
+	for id, lc := range lazy {
+		listed := false
+		for _, pid := range lc.g.ParentIDs {
+			if p, ok := s.idMap[pid]; ok && p != n {
+				p.cmu.Lock()
+				_, listed = p.lazy[id]
+				p.cmu.Unlock()
+			}
+			if listed {
+				break
+			}
+		}
+		if !listed {
+			delete(s.lazyChildren, id)
+		}
+	}
+}
+
+// direntType returns the type we list something as, given whether it
+// is a folder and what it points at if it is a shortcut.
+func direntType(dir bool, target string) fuse.DirentType {
+	switch {
+	case dir:
+		return fuse.DT_Dir
+	case target != "":
+		return fuse.DT_Link
+	default:
+		return fuse.DT_File
+	}
+}
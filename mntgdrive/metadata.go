@@ -0,0 +1,200 @@
+package mntgdrive
+
+import (
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// pendingRename is a rename (or move) that we have already made
+// locally but haven't sent to drive yet.
+type pendingRename struct {
+	newName string
+	// both empty unless the node is moving to a different folder
+	oldParentID string
+	newParentID string
+	// the ids of what the rename replaced, which we trash once drive
+	// has the rename, so that a rename drive turns down loses nothing
+	replaced []string
+}
+
+// queueRename renames child locally right away and remembers to tell
+// drive about it the next time we send metadata.  Several renames of
+// the same node between sends become one.  If the rename replaces
+// something, which may be nil, that goes away locally now and is
+// trashed once we send the rename.
+func (s *system) queueRename(child *node, newName string, oldParentID string, newParentID string, replaced *node) {
+	s.pendingMu.Lock()
+	p, ok := s.pendingRenames[child.id]
+	if !ok {
+		p = &pendingRename{oldParentID: oldParentID, newParentID: newParentID}
+		s.pendingRenames[child.id] = p
+	} else if newParentID != "" {
+		if p.newParentID == "" {
+			p.oldParentID = oldParentID
+		}
+		p.newParentID = newParentID
+		if p.oldParentID == p.newParentID {
+			// it is back where it started
+			p.oldParentID = ""
+			p.newParentID = ""
+		}
+	}
+	p.newName = newName
+	if replaced != nil {
+		p.replaced = append(p.replaced, replaced.id)
+		// whatever it was waiting to replace goes along with it
+		if rp, ok := s.pendingRenames[replaced.id]; ok {
+			p.replaced = append(p.replaced, rp.replaced...)
+			delete(s.pendingRenames, replaced.id)
+		}
+	}
+	s.pendingMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if replaced != nil {
+		s.removeNode(replaced)
+	}
+	child.mu.Lock()
+	child.name = newName
+	if newParentID != "" {
+		var ids []string
+		for id := range child.parents {
+			if id != oldParentID {
+				ids = append(ids, id)
+			}
+		}
+		child.setParents(append(ids, newParentID))
+	}
+	child.updateTime = time.Now()
+	parents := child.parentList()
+	child.mu.Unlock()
+	forgetNamesOf(parents)
+}
+
+// dropPendingRename forgets any rename of id we haven't sent, e.g.
+// because it has been trashed.  It returns the ids of what the rename
+// replaced, which the caller should trash as well.
+func (s *system) dropPendingRename(id string) []string {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	var replaced []string
+	if p, ok := s.pendingRenames[id]; ok {
+		replaced = p.replaced
+		delete(s.pendingRenames, id)
+	}
+	return replaced
+}
+
+// replacedByPending returns true if a rename we haven't sent yet
+// replaced id, which we trash once it is sent.
+func (s *system) replacedByPending(id string) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for _, p := range s.pendingRenames {
+		for _, r := range p.replaced {
+			if r == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trashReplaced trashes what a rename that drive now has replaced.
+func (s *system) trashReplaced(ctx context.Context, replaced []string) {
+	for _, id := range replaced {
+		if err := s.gd.Trash(ctx, id); err != nil {
+			logging.Errorf("Unable to trash %s, which a rename replaced: %v", id, err)
+			s.hooks.OnError("delayed trash", err)
+		}
+	}
+}
+
+// withPendingRename returns g as it will be once drive knows about our
+// pending rename of it, if we have one, so that news from drive about
+// other changes doesn't undo the rename locally.
+func (s *system) withPendingRename(g *gdrive.Node) *gdrive.Node {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	p, ok := s.pendingRenames[g.ID]
+	if !ok {
+		return g
+	}
+	renamed := *g
+	renamed.Name = p.newName
+	if p.newParentID != "" {
+		renamed.ParentIDs = nil
+		for _, id := range g.ParentIDs {
+			if id != p.oldParentID && id != p.newParentID {
+				renamed.ParentIDs = append(renamed.ParentIDs, id)
+			}
+		}
+		renamed.ParentIDs = append(renamed.ParentIDs, p.newParentID)
+	}
+	return &renamed
+}
+
+// sendMetadata sends every pending rename to drive, and then trashes
+// what each replaced.  If drive turns one down, we go back to showing
+// what drive has, including what the rename would have replaced.
+func (s *system) sendMetadata(ctx context.Context) {
+	s.pendingMu.Lock()
+	pending := s.pendingRenames
+	s.pendingRenames = map[string]*pendingRename{}
+	s.pendingMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	logging.Infof("Sending %d delayed rename(s)", len(pending))
+	for id, p := range pending {
+		g, err := s.gd.Rename(ctx, id, p.newName, p.oldParentID, p.newParentID)
+		if err != nil {
+			logging.Errorf("Unable to rename %s to %q: %v", id, p.newName, err)
+			s.hooks.OnError("delayed rename", err)
+			s.restoreReplaced(ctx, p.replaced)
+			if g, err = s.gd.FetchNode(ctx, id); err != nil {
+				logging.Errorf("Unable to fetch %s after failing to rename it: %v", id, err)
+				continue
+			}
+		} else {
+			s.trashReplaced(ctx, p.replaced)
+		}
+		s.mu.Lock()
+		if n, ok := s.idMap[id]; ok {
+			n.update(s.withPendingRename(g))
+		}
+		s.mu.Unlock()
+	}
+}
+
+// restoreReplaced shows again what a rename that drive turned down would
+// have replaced.
+func (s *system) restoreReplaced(ctx context.Context, replaced []string) {
+	for _, id := range replaced {
+		g, err := s.gd.FetchNode(ctx, id)
+		if err != nil {
+			logging.Errorf("Unable to fetch %s, which a failed rename would have replaced: %v", id, err)
+			continue
+		}
+		s.getOrMakeNode(g)
+	}
+}
+
+// sendMetadataPeriodically sends pending metadata changes every
+// metadataDelay, until we stop watching for changes.
+func (s *system) sendMetadataPeriodically() {
+	for {
+		select {
+		case <-s.watching.Done():
+			return
+		case <-time.After(s.metadataDelay):
+			s.sendMetadata(context.Background())
+		}
+	}
+}
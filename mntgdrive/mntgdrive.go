@@ -0,0 +1,2612 @@
+// Package mntgdrive serves google drive as a fuse file system.  Mount,
+// given Options, mounts it; the mnt-gdrive command is a front end that
+// fills in Options from its flags and the config file.
+package mntgdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	_ "bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Not sure if something in the kernel or fuse might get upset by a zero value, so we
+	// skip past it.
+	reservedIdx = iota
+
+	// Group of special fixed indices for 'magic' files that aren't part of gdrive and a
+	// therefore outside of our normal allocation mechanism.
+	dumpIdx
+	openFilesIdx
+	volumeIconIdx
+	trashViewIdx
+	ctlDirIdx
+	batchIdx
+	sharedDrivesIdx
+	byIDIdx
+	computersIdx
+	batchResultIdx
+	spacesIdx
+	sharedWithMeIdx
+	recentIdx
+	jobsIdx
+	whoamiIdx
+	configIdx
+
+	// Where we start allocating indices for gdrive files
+	firstDynamicIdx
+)
+
+const (
+	modeReadOnly  os.FileMode = 0555
+	modeReadWrite os.FileMode = 0777
+)
+
+// TODO(gina) make this configurable
+const changeFetchSleep = time.Duration(5) * time.Second
+
+const defaultRefreshAfter = time.Minute
+
+const defaultPrefetch = 3
+
+// the longest we wait between tries at mounting again
+const maxRemountBackoff = time.Minute
+
+// The handle that the kernel expects to use when identifying files and directories.  The
+// kernel often calls this inode.  But it also uses inode but since inode is also used to
+// refer to the struct that many filesystems use, that seems confusing.
+type index uint64
+
+// listenForControl sets up our control socket for the mount at
+// mountpoint.  We carry on without one if that doesn't work.
+func (s *system) listenForControl(mountpoint string) {
+	sockPath, err := control.SocketPath(mountpoint)
+	if err != nil {
+		logging.Warnf("Unable to determine control socket path, continuing without it: %v", err)
+		return
+	}
+	ctl, err := control.Listen(sockPath)
+	if err != nil {
+		logging.Warnf("Unable to create control socket, continuing without it: %v", err)
+		return
+	}
+	s.ctl = ctl
+	ctl.HandleAction(control.OpUmount, func() error {
+		if err := s.flushAll(context.Background()); err != nil {
+			return fmt.Errorf("not unmounting, unable to upload changes to %v", err)
+		}
+		s.stopWatching()
+		s.sendMetadata(context.Background())
+		return fuse.Unmount(mountpoint)
+	})
+	ctl.Handle(control.OpConnections, func(req control.Request, enc *json.Encoder) error {
+		return enc.Encode(gdrive.Connections())
+	})
+	ctl.Handle(control.OpStatus, func(req control.Request, enc *json.Encoder) error {
+		return enc.Encode(s.status())
+	})
+	s.handleJobs(ctl)
+	go ctl.Serve()
+}
+
+// readyGroup tells whoever started us that we are ready once every
+// mount is, or that we failed as soon as one of them does.
+type readyGroup struct {
+	// notify, if set, is told as well
+	notify func(error)
+
+	mu      sync.Mutex
+	waiting int
+	done    bool
+	err     error
+}
+
+func (g *readyGroup) ready(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return
+	}
+	if err == nil {
+		g.waiting--
+		if g.waiting > 0 {
+			return
+		}
+	}
+	g.done = true
+	g.err = err
+	if g.notify != nil {
+		g.notify(err)
+	}
+}
+
+// succeeded returns true if every mount has been ready at some point.
+func (g *readyGroup) succeeded() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done && g.err == nil
+}
+
+// run serves the mount at mountpoint until we are asked to stop,
+// mounting it again up to retries times in a row if it goes away on
+// its own.  ready gets called once the first mount is ready, or
+// failed.
+func (s *system) run(mountpoint string, mountOptions []fuse.MountOption, retries int, firstBackoff time.Duration, ready func(error)) (err error) {
+	defer s.shutdown()
+	backoff := firstBackoff
+	for attempt := 0; ; attempt++ {
+		started := time.Now()
+		var mounted bool
+		if attempt == 0 {
+			mounted, err = s.serve(mountpoint, mountOptions, ready)
+		} else {
+			mounted, err = s.serve(mountpoint, mountOptions, nil)
+		}
+		if !mounted && attempt == 0 {
+			ready(err)
+			return err
+		}
+		if s.watching.Err() != nil {
+			// we were asked to shut down
+			if f := s.failed(); f != nil {
+				return f
+			}
+			return err
+		}
+		if time.Since(started) > maxRemountBackoff {
+			// we were up for a good while, so this is a new problem
+			attempt = 0
+			backoff = firstBackoff
+		}
+		if attempt >= retries {
+			return err
+		}
+		logging.Warnf("Lost our mount of %s (%v), remounting in %s", mountpoint, err, backoff)
+		if err := s.flushAll(context.Background()); err != nil {
+			logging.Warnf("Unable to upload changes while remounting: %v", err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRemountBackoff {
+			backoff = maxRemountBackoff
+		}
+		// clear away what is left of the old mount, if anything
+		fuse.Unmount(mountpoint)
+	}
+}
+
+// serve mounts our file system at mountpoint and serves it until it
+// gets unmounted or the connection to the kernel fails.  mounted is
+// false if we never got as far as mounting.  If ready is set, we call
+// it once the kernel has told us how mounting went.
+func (s *system) serve(mountpoint string, mountOptions []fuse.MountOption, ready func(error)) (mounted bool, err error) {
+	c, err := fuse.Mount(mountpoint, mountOptions...)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	logging.Infof("Entering Serve")
+
+	config := fs.Config{
+		// tag everything an operation does with the id the kernel
+		// gave it, which is also what the fuse debug log shows, e.g.
+		// [ID=0x1e]
+		WithContext: func(ctx context.Context, req fuse.Request) context.Context {
+			ctx = logging.WithOp(ctx, fmt.Sprintf("%#x", uint64(req.Hdr().ID)))
+			return gdrive.WithRetryBudget(ctx, s.interactiveRetryBudget)
+		},
+	}
+	if logging.Enabled(logging.Debug) {
+		// this logs every request and response, so only do it when
+		// asked
+		config.Debug = func(msg interface{}) {
+			logging.Debugf("%v", msg)
+		}
+	}
+
+	server := fs.New(c, &config)
+	s.mu.Lock()
+	s.server = server
+	s.mu.Unlock()
+	// shared drives we find from now on get the new server from us
+	for _, sub := range s.subsystems() {
+		sub.mu.Lock()
+		sub.server = server
+		sub.mu.Unlock()
+	}
+
+	if ready != nil {
+		go func() {
+			<-c.Ready
+			ready(c.MountError)
+		}()
+	}
+
+	if err = server.Serve(s); err != nil {
+		return true, err
+	}
+
+	// check if the mount process has an error to report
+	<-c.Ready
+	return true, c.MountError
+}
+
+// goBackground runs f in a goroutine that shutdown waits for.  f
+// should return soon after we stop watching.
+func (s *system) goBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// shutdown cleans up after us once we are done serving: it stops what
+// we started in the background and waits for it to finish, sends
+// renames we were holding on to, uploads changes that haven't been
+// uploaded yet and removes our local copies of files.  The kernel
+// doesn't always release every handle on the way out, so we don't wait
+// for it to.  Calling it again does no harm.
+func (s *system) shutdown() {
+	s.stopWatching()
+	s.background.Wait()
+
+	ctx := context.Background()
+	s.sendMetadata(ctx)
+	s.mu.Lock()
+	var pfs []*phantomfile.PhantomFile
+	for _, n := range s.idMap {
+		if pf := n.madeContent(); pf != nil {
+			pfs = append(pfs, pf)
+		}
+	}
+	for _, e := range s.exportNodes {
+		pfs = append(pfs, e.pf)
+	}
+	for _, revs := range s.revisionNodes {
+		for _, r := range revs {
+			pfs = append(pfs, r.pf)
+		}
+	}
+	s.mu.Unlock()
+	for _, pf := range pfs {
+		if err := pf.Close(ctx); err != nil {
+			logging.Errorf("Unable to upload changes while shutting down: %v", err)
+		}
+	}
+
+	for _, sub := range s.subsystems() {
+		sub.shutdown()
+	}
+}
+
+// flushAll uploads the changes to every file of ours, and of our
+// subsystems, that has any, waiting for uploads that are already
+// underway.  Other systems in the same process are left alone.  It
+// returns the first error it runs into, after trying every file.
+func (s *system) flushAll(ctx context.Context) error {
+	s.mu.Lock()
+	nodes := make([]*node, 0, len(s.idMap))
+	for _, n := range s.idMap {
+		nodes = append(nodes, n)
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, n := range nodes {
+		pf := n.madeContent()
+		if pf == nil {
+			continue
+		}
+		if err := pf.Flush(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", n, err)
+		}
+	}
+	for _, sub := range s.subsystems() {
+		if err := sub.flushAll(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+var _ fs.FS = &system{}
+
+var _ invalidator = (*fs.Server)(nil)
+
+// invalidator tells the kernel to drop what it has cached.  Once we
+// are mounted, it is our fs.Server; tests use one that just records
+// what it was asked to do.
+type invalidator interface {
+	InvalidateNodeData(node fs.Node) error
+	InvalidateNodeAttr(node fs.Node) error
+	InvalidateEntry(parent fs.Node, name string) error
+}
+
+// staleEntry is a name in a folder that the kernel may have cached
+// wrongly, either as pointing at a node that isn't there any more or as
+// missing.
+type staleEntry struct {
+	parent *node
+	name   string
+}
+
+// entriesOf returns the names n goes by in each of its parents, in
+// order of parent id.  Assumes we have the system lock.
+func (n *node) entriesOf() []staleEntry {
+	n.mu.Lock()
+	var parents []*node
+	for _, p := range n.parents {
+		parents = append(parents, p)
+	}
+	n.mu.Unlock()
+	var entries []staleEntry
+	for _, p := range parents {
+		entries = append(entries, staleEntry{p, p.childName(n)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].parent.id < entries[j].parent.id })
+	return entries
+}
+
+func sameEntries(a, b []staleEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidateEntries tells the kernel to forget what it knows about
+// entries.  The kernel locks each parent folder while it does that, so
+// we must not hold the system lock, which a lookup in one of those
+// folders may be waiting on.
+func (s *system) invalidateEntries(entries []staleEntry) {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+	for _, e := range entries {
+		if err := server.InvalidateEntry(e.parent, e.name); err != nil && err != fuse.ErrNotCached {
+			logging.Debugf("Unable to invalidate %q in %s: %v", e.name, e.parent.id, err)
+		}
+	}
+}
+
+// FS implements the hello world file system.
+type system struct {
+	gd gdrive.DriveLike
+	// replaced each time we remount, so guarded by mu
+	server invalidator
+	// nil if we are running without a control socket
+	ctl *control.Server
+	// long running operations we do for clients; see jobs.go
+	jobs *control.Jobs
+
+	readonly bool
+	// what we do with files owned by other people
+	others gdrive.OthersMode
+	// if set, we present what is in the trash instead of the drive
+	trash bool
+	// if set, google docs files (and similar) each have a zip export
+	// next to them
+	exportZip bool
+	// what we export google docs files (and similar) as, by their mime
+	// type
+	exportFormats map[string]gdrive.ExportFormat
+	// if set, google docs files (and similar) are small stub files
+	// that link to them, rather than exports
+	stubs bool
+	// if set, we have an .appdata folder with the hidden app data
+	// folder in it
+	appData bool
+	// if set, we act like a posix filesystem wherever we can, at some
+	// cost; see posix.go
+	strictPOSIX bool
+	// if set, our root holds My Drive and the rest of the account side
+	// by side; see spaces.go
+	spaces bool
+	// if set, we record who reads what here; see audit.go
+	audit *auditLog
+
+	// done once watchForChanges should return
+	watching     context.Context
+	stopWatching context.CancelFunc
+
+	// where we are mounted; empty for shared drives and the like,
+	// which are part of their parentSystem's mount
+	mountpoint string
+	// names the google account we mount; empty means the default one
+	profile string
+
+	// guards failure
+	failMu sync.Mutex
+	// if set, why we gave up, or couldn't shut down cleanly, which run
+	// reports in place of what serving returned
+	failure error
+
+	// the google drive id of the folder we present as our root.  Either
+	// "root" (which is what google calls My Drive) or the id of some
+	// folder below it.
+	rootFolderID string
+
+	// folders, relative to our root and without leading or trailing
+	// slashes, that we don't let anyone change
+	readonlyPaths []string
+
+	// what to do with things created in particular folders, with
+	// paths in the same form as readonlyPaths
+	rules []config.Rule
+
+	// name patterns for things we hide, along with everything below
+	// them; see checkExcludes
+	excludes []string
+
+	// local uids to report as the owners of files owned by other
+	// people, by lower case email address.  Files owned by people who
+	// aren't listed look like ours.
+	owners map[string]uint32
+
+	// how many of the following files in a folder we download ahead of
+	// time when a process opens files in it one after another
+	prefetchCount int
+
+	// how long requests made for file system operations keep trying
+	// again after transient errors, so whoever is waiting finds out
+	// soon
+	interactiveRetryBudget time.Duration
+
+	// who we talk to google as, for .mntgdrive/whoami; nil for a fake
+	// drive
+	account account
+	// the settings we run with, for .mntgdrive/config; nil when not
+	// mounted by Mount
+	mountConfig *mountConfig
+
+	// if set, we hold on to renames and send them to drive this often,
+	// rather than right away
+	metadataDelay time.Duration
+	// guards pendingRenames
+	pendingMu sync.Mutex
+	// renames we haven't sent to drive yet, by node id
+	pendingRenames map[string]*pendingRename
+
+	// if set, we are a shared drive within parentSystem's
+	// .shared-drives folder
+	parentSystem *system
+	// where our root is within the mount, if we are a subsystem, e.g.
+	// ".shared-drives/Team".  Readonly paths and rules are relative to
+	// the mount, so we prefix our paths with it to match them.
+	mountPrefix string
+
+	// If the change feed hasn't succeeded for this long, we re-fetch
+	// the metadata of nodes this old when they are statted.  Zero means
+	// we never do that.
+	refreshAfter time.Duration
+
+	// goroutines we started that run until we stop watching
+	background sync.WaitGroup
+
+	// guards all of the fields below
+	mu sync.Mutex
+
+	nextInode index
+
+	// the google drive id of our root node, once it is loaded.  This
+	// is the real id, never the "root" alias.
+	rootID string
+
+	serverStart time.Time
+	updateTime  time.Time
+	// the last time we fetched changes without an error
+	changesTime time.Time
+
+	// maps from google drive id to node
+	idMap map[string]*node
+	// maps from inode number to node
+	inodeMap map[index]*node
+	// maps from google drive id to what we listed of it, for children
+	// of folders that we haven't made nodes for yet
+	lazyChildren map[string]*lazyChild
+	// maps from id, then revision id, to the node we made for that
+	// revision
+	revisionNodes map[string]map[string]*revisionNode
+	// maps from id to the node's folder in the .revisions tree
+	revisionsDirs map[string]*revisionsDirNode
+	// maps from pid to the revision that process last opened, so we
+	// can tell when it copies it over the file
+	revisionsRead map[uint32]*revisionNode
+	// maps from id to the zip export of that file
+	exportNodes map[string]*exportNode
+	// maps from folder id to the last file opened in it
+	sequences map[string]readSequence
+
+	initDumpOnce sync.Once
+	dumpNode     *dumpNodeType
+
+	initOpenFilesOnce sync.Once
+	openFilesNode     *openFilesNodeType
+
+	// if set, the .icns file we present as the volume's icon
+	volumeIcon         string
+	initVolumeIconOnce sync.Once
+	volumeIconNode     *volumeIconNodeType
+	initTrashViewOnce  sync.Once
+	trashViewNode      *trashViewType
+	initCtlDirOnce     sync.Once
+	ctlDirNode         *ctlDirType
+
+	initSharedDrivesOnce sync.Once
+	sharedDrivesNode     *sharedDrivesDirType
+	initComputersOnce    sync.Once
+	computersNode        *computersDirType
+	initSpacesOnce       sync.Once
+	spacesNode           *spacesDirType
+	// the systems for the shared drives in our .shared-drives folder,
+	// by drive id
+	sharedDriveSystems map[string]*system
+	// the systems for the computers in our .computers folder, by the
+	// id of their top folder
+	computerSystems map[string]*system
+	// if set, we hear about changes through our parent system, since
+	// they are in its part of the change feed
+	sharesChanges bool
+	// the system for our .appdata folder, once someone looks at it
+	appDataSystem *system
+	// how many subsystems we have ever made, forgotten ones included
+	subsystemsMade int
+
+	// what we tell about what we do
+	hooks Hooks
+}
+
+func newSystem(gd gdrive.DriveLike, server invalidator, readonly bool) *system {
+	watching, stopWatching := context.WithCancel(context.Background())
+	return &system{
+		gd:                 gd,
+		server:             server,
+		readonly:           readonly,
+		rootFolderID:       "root",
+		watching:           watching,
+		stopWatching:       stopWatching,
+		nextInode:          firstDynamicIdx,
+		serverStart:        time.Now(),
+		updateTime:         time.Now(),
+		changesTime:        time.Now(),
+		idMap:              make(map[string]*node),
+		inodeMap:           make(map[index]*node),
+		lazyChildren:       make(map[string]*lazyChild),
+		revisionNodes:      make(map[string]map[string]*revisionNode),
+		revisionsDirs:      make(map[string]*revisionsDirNode),
+		revisionsRead:      make(map[uint32]*revisionNode),
+		exportNodes:        make(map[string]*exportNode),
+		sequences:          make(map[string]readSequence),
+		pendingRenames:     make(map[string]*pendingRename),
+		sharedDriveSystems: make(map[string]*system),
+		computerSystems:    make(map[string]*system),
+		exportFormats:      gdrive.DefaultExportFormats(),
+		jobs:               control.NewJobs(),
+		hooks:              NoHooks{}}
+
+}
+
+func (s *system) Root() (fs.Node, error) {
+	if s.trash {
+		root, err := s.trashRoot(context.Background())
+		if err != nil {
+			logging.Errorf("Error fetching trash: %v", err)
+			return nil, fuse.ENODATA
+		}
+		return root, nil
+	}
+	if s.spaces {
+		return s.spacesRoot()
+	}
+	root, err := s.driveRoot()
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// driveRoot returns the node for the folder we present as our root,
+// or, with spaces, as mydrive.
+func (s *system) driveRoot() (*node, error) {
+	g, err := s.gd.FetchNode(context.Background(), s.rootFolderID)
+	if err != nil {
+		logging.Errorf("Error fetching root: %v", err)
+		return nil, fuse.ENODATA
+	}
+	if !g.Dir() {
+		logging.Errorf("Root %q is not a folder", s.rootFolderID)
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+
+	root := s.getOrMakeNode(g)
+	s.mu.Lock()
+	s.rootID = root.id
+	s.mu.Unlock()
+
+	return root, nil
+}
+
+func (s *system) isRoot(n *node) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n.id == s.rootID
+}
+
+func (s *system) watchForChanges() {
+	// TODO(gina) Better to select on a channel that we send ticks to.
+	// Then when something updates the filesystem from our side, we
+	// can run this right away to see the result.
+
+	// TODO(gina) track the last time we fetched changes without an error, use that to
+	// determine staleness elsewhere, to .e.g. shutdown the system if this seems borken
+	logging.Debugf("entering watchForChanges")
+	defer logging.Debugf("exiting watchForChanges")
+	for {
+		select {
+		case <-s.watching.Done():
+			return
+		case <-time.After(changeFetchSleep):
+		}
+
+		if err := s.fetchChanges(); err != nil {
+			s.fail(err)
+			return
+		}
+		for _, sub := range s.subsystems() {
+			if err := sub.fetchChanges(); err != nil {
+				s.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// fetchChanges fetches and processes the changes made since we last
+// asked.  It only returns an error if we can't carry on: drive failed
+// part way through, and we can't apply the same changes twice.
+func (s *system) fetchChanges() error {
+	if s.sharesChanges {
+		return nil
+	}
+	sharing := s.sharingSubsystems()
+	cs, err := s.gd.ProcessChanges(func(c *gdrive.Change, cs *gdrive.ChangeStats) {
+		s.processChange(c, cs)
+		for _, sub := range sharing {
+			sub.processChange(c, &gdrive.ChangeStats{})
+		}
+	})
+	if err != nil {
+		if cs.FetchedChanges() {
+			return fmt.Errorf("failed to fetch changes partway through change processing.  We don't support idempotent operations so cannot continue: %v", err)
+		}
+		logging.Warnf("Failed to fetch changes.  Will try again later: %v", err)
+		s.hooks.OnError("fetch changes", err)
+		return nil
+	}
+	s.mu.Lock()
+	s.changesTime = time.Now()
+	s.mu.Unlock()
+	if cs.FetchedChanges() {
+		logging.Infof("%s", cs.String())
+	}
+	return nil
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM and then shuts us down
+// as cleanly as it can: it stops looking for changes, uploads whatever
+// hasn't been uploaded yet and unmounts.  Serve returns once the
+// unmount happens.
+func (s *system) shutdownOnSignal(mountpoint string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	var sig os.Signal
+	select {
+	case sig = <-sigs:
+	case <-s.watching.Done():
+		// we are already on our way out
+		return
+	}
+	logging.Infof("Got %s, shutting down", sig)
+
+	s.stopWatching()
+	if err := s.flushAll(context.Background()); err != nil {
+		logging.Errorf("Unable to upload all changes before shutting down: %v", err)
+	}
+	s.sendMetadata(context.Background())
+	if err := unmountOrDetach(mountpoint); err != nil {
+		// other mounts may still be uploading their changes, so we
+		// leave it to run to report
+		logging.Errorf("%v", err)
+		s.setFailure(err)
+	}
+}
+
+// unmountOrDetach unmounts mountpoint.  If something still has files
+// open, we detach it anyway, rather than leave the mountpoint stuck
+// once we are gone.
+func unmountOrDetach(mountpoint string) error {
+	err := fuse.Unmount(mountpoint)
+	if err == nil {
+		return nil
+	}
+	logging.Warnf("Unable to unmount %s, detaching it instead: %v", mountpoint, err)
+	if out, err := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to detach %s: %v: %s", mountpoint, err, out)
+	}
+	return nil
+}
+
+// fail gives up on the mount s is part of because of err, which run
+// then reports: we stop watching for changes and unmount.  Other
+// mounts in the process carry on.  It doesn't take the system lock, so
+// it is safe to call while holding it.
+func (s *system) fail(err error) {
+	top := s
+	for top.parentSystem != nil {
+		top = top.parentSystem
+	}
+	logging.Errorf("Giving up on %s: %v", top.mountpoint, err)
+	top.setFailure(err)
+	top.stopWatching()
+	if top.mountpoint == "" {
+		return
+	}
+	// the kernel may want answers from us before it lets go, so we
+	// can't wait for it here
+	go func() {
+		if err := unmountOrDetach(top.mountpoint); err != nil {
+			logging.Errorf("%v", err)
+		}
+	}()
+}
+
+// setFailure records err as why we gave up, or couldn't shut down
+// cleanly, unless we already have a reason.
+func (s *system) setFailure(err error) {
+	s.failMu.Lock()
+	defer s.failMu.Unlock()
+	if s.failure == nil {
+		s.failure = err
+	}
+}
+
+// failed returns what setFailure recorded, if anything.
+func (s *system) failed() error {
+	s.failMu.Lock()
+	defer s.failMu.Unlock()
+	return s.failure
+}
+
+func (s *system) processChange(c *gdrive.Change, cs *gdrive.ChangeStats) {
+	trash := c.Removed || c.Node.Trashed
+	// The kernel keeps names it has looked up for a while, so after a
+	// remote rename or removal it can still find things under their
+	// old names.  We answer lookups of missing names with ENOENT, which
+	// the kernel doesn't keep, but we invalidate new names as well in
+	// case it does.  That happens once we let go of the system lock.
+	var stale []staleEntry
+	changed := cs.Changed
+	defer func() {
+		s.invalidateEntries(stale)
+		if cs.Changed != changed {
+			s.hooks.OnChangeApplied(c.ID, trash)
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, nodeExists := s.idMap[c.ID]
+	if lc, ok := s.lazyChildren[c.ID]; ok && !nodeExists {
+		// we only listed it, so make the node to apply the change to
+		n, nodeExists = s.makeLazy(lc, lc.g), true
+	}
+
+	switch {
+	case nodeExists && n.id == s.rootID && (trash || !s.presented(c.Node)):
+		// We have nowhere to go if our root goes away, so we keep
+		// presenting what we have
+		logging.Infof("Ignoring removal of our root %s", c.ID)
+		cs.Ignored++
+	case trash:
+		if nodeExists {
+			s.publish(control.EventRemoved, n)
+			stale = n.entriesOf()
+			s.removeNode(n)
+			n.server.InvalidateNodeData(n)
+			logging.Infof("Removed %s", c.ID)
+			cs.Changed++
+		}
+	case nodeExists && !s.presented(c.Node):
+		// This can happen if a file got renamed to something we exclude, or if it was
+		// owned by the user but is now not (and we are hiding files owned by others)
+		s.publish(control.EventRemoved, n)
+		stale = n.entriesOf()
+		s.removeNode(n)
+		n.server.InvalidateNodeData(n)
+		logging.Infof("Removed %s", c.ID)
+		cs.Changed++
+	case nodeExists:
+		contentChanged := !n.dir && n.contentChanged(c.Node)
+		before := n.entriesOf()
+		n.update(s.withPendingRename(c.Node))
+		if after := n.entriesOf(); !sameEntries(before, after) {
+			stale = append(before, after...)
+		}
+		switch {
+		case contentChanged:
+			n.server.InvalidateNodeData(n)
+			phantomfile.Forget(n.id)
+		case !n.dir:
+			// Only metadata changed.  Programs may have the file
+			// mapped, and throwing its pages away would make them
+			// read it all again for nothing.
+			n.server.InvalidateNodeAttr(n)
+		}
+		s.publish(control.EventUpdated, n)
+		cs.Changed++
+	case !s.presented(c.Node):
+		cs.Ignored++
+		logging.Debugf("Ignoring %s, which we don't present", c.ID)
+	case s.replacedByPending(c.ID):
+		cs.Ignored++
+		logging.Debugf("Ignoring %s, which a rename we haven't sent replaced", c.ID)
+	default:
+		// We want to create this new node if there is at least one of
+		// our parents has children
+		var haveReadyParent bool
+		for _, pid := range c.Node.ParentIDs {
+			if p, ok := s.idMap[pid]; ok && p.haveChildren() {
+				haveReadyParent = true
+				break
+			}
+		}
+		if haveReadyParent {
+			n = s.insertNode(c.Node)
+			stale = n.entriesOf()
+			s.publish(control.EventCreated, n)
+			logging.Debugf("Created %s because a parent needed to know about it", c.ID)
+			cs.Changed++
+		} else {
+			cs.Ignored++
+			logging.Debugf("Ignoring unkown id %s", c.ID)
+		}
+	}
+}
+
+// publish tells anyone watching the control socket about a change we
+// applied to n.  Assumes we already have the system lock.
+func (s *system) publish(eventType string, n *node) {
+	if s.ctl == nil {
+		return
+	}
+	n.mu.Lock()
+	name := n.name
+	n.mu.Unlock()
+	s.ctl.Publish(control.Event{
+		Time: time.Now(),
+		Type: eventType,
+		ID:   n.id,
+		Name: name,
+		Path: n.path()})
+}
+
+// assumes we already have the system lock
+func (s *system) removeNode(n *node) {
+	n.endLifetime()
+	delete(s.idMap, n.id)
+	delete(s.inodeMap, n.idx)
+	s.updateTime = time.Now()
+	s.dropLazy(n)
+	s.dropRevisions(n)
+
+	for _, p := range n.parents {
+		p.cmu.Lock()
+		if _, ok := p.children[n.id]; ok {
+			delete(p.children, n.id)
+			p.forgetNames()
+		} else {
+			s.fail(fmt.Errorf("Inconsistent data: node %+v listed parent %+v, but that parent does not know about the node", n, p))
+		}
+		p.cmu.Unlock()
+	}
+}
+
+// Assumes we have the system lock already
+func (s *system) getNodeIfExists(id string) *node {
+	n, _ := s.idMap[id]
+	return n
+}
+
+// TODO(gina) I think it would make sense to have this instead return a tuple of
+// (*node, idx) where if *node is nil, then the idx will be the value to assign to a new node.
+func (s *system) getOrMakeNode(g *gdrive.Node) *node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.idMap[g.ID]
+	if !ok {
+		n = s.insertNode(g)
+	} else {
+		n.update(g)
+	}
+	s.updateTime = time.Now()
+
+	return n
+}
+
+// Assumes the system lock is already held
+func (s *system) insertNode(g *gdrive.Node) *node {
+	if lc, ok := s.lazyChildren[g.ID]; ok {
+		return s.makeLazy(lc, g)
+	}
+	s.nextInode++
+	return s.insertNodeAt(s.nextInode, g)
+}
+
+// insertNodeAt makes the node for g, with inode, and puts it in those
+// of its parents that have listed their children.  Assumes the system
+// lock is already held.
+func (s *system) insertNodeAt(inode index, g *gdrive.Node) *node {
+	pm := map[string]*node{}
+	for _, id := range g.ParentIDs {
+		if p, ok := s.idMap[id]; ok {
+			pm[id] = p
+		}
+	}
+	n := newNode(s, inode, g, pm)
+	for _, p := range pm {
+		p.cmu.Lock()
+		delete(p.lazy, n.id)
+		if p.children != nil {
+			p.children[n.id] = n
+		}
+		p.forgetNames()
+		p.cmu.Unlock()
+	}
+	s.inodeMap[inode] = n
+	s.idMap[g.ID] = n
+	return n
+}
+
+var _ fs.NodeCreater = (*node)(nil)
+var _ fs.NodeFsyncer = (*node)(nil)
+var _ fs.NodeGetattrer = (*node)(nil)
+var _ fs.NodeMkdirer = (*node)(nil)
+var _ fs.NodeOpener = (*node)(nil)
+var _ fs.NodeRemover = (*node)(nil)
+var _ fs.NodeRenamer = (*node)(nil)
+var _ fs.NodeSetattrer = (*node)(nil)
+
+type node struct {
+	*system
+	// These are things we expect to be immutable for a node
+	idx index
+	id  string
+
+	// guards pf, life and forgotten.  We make pf and life the first
+	// time something needs them, via content and lifetime: most nodes
+	// in a big listing are never opened, and they are much of what a
+	// node costs.
+	pfMu sync.Mutex
+	pf   *phantomfile.PhantomFile
+	// done once we forget about the node or stop watching, so that
+	// work on its behalf that outlives requests (fetching its content,
+	// say) stops too
+	life      context.Context
+	endLife   context.CancelFunc
+	forgotten bool
+
+	//
+	// These can change while a node exists
+	//
+
+	// directly retrieved metadata
+
+	// guards this access to this group
+	mu       sync.Mutex
+	name     string
+	ctime    time.Time
+	mtime    time.Time
+	size     uint64
+	md5      string
+	version  int64
+	dir      bool
+	mimeType string
+	// the id of what the node points at, if it is a shortcut
+	target string
+	// opens the node in a browser
+	webViewLink string
+	// whether we have starred the node, and its description
+	starred     bool
+	description string
+	// whether nobody may change the node's content, and whether we
+	// may change that
+	locked   bool
+	lockable bool
+	// what drive keeps for us with the node, including extended
+	// attributes that programs set
+	appProperties map[string]string
+	// false for files owned by someone else
+	mine bool
+	// the email address of whoever owns the node in drive, if known
+	owner string
+	// false if we shouldn't let anyone change the node, even when the
+	// system is writeable
+	writeable bool
+	// false if we shouldn't let anyone rename or trash the node, as
+	// for writeable
+	renameable bool
+	trashable  bool
+	// false if we shouldn't let anyone create things in the node, or
+	// move things into it, even when they may otherwise change it
+	addable bool
+	parents map[string]*node
+	// when we last got the metadata above from google drive
+	fetched time.Time
+	// if set, the drive folder we move the node to once its content
+	// has been uploaded, as a rule says to
+	pendingMove string
+	// if set, the revision of the node that is being copied over it,
+	// which we restore rather than upload if that is all that is
+	// written
+	restoreFrom *gdrive.Revision
+	// the revisions drive had when the node was at revsVersion, so
+	// looking up several of them asks drive once
+	revs        []*gdrive.Revision
+	revsVersion int64
+	// the md5 of what drive had when we made our local copy, which it
+	// should still have when we upload changes, or empty if we don't
+	// know
+	uploadBase string
+	// if set, where we upload changes from our local copy to, because
+	// n changed in drive after we made it
+	conflictCopy *node
+
+	// non-zero while a background refresh is running.  Only access via
+	// atomic.
+	refreshing int32
+	// if set, done once the metadata fetch the last open started is
+	// over
+	openRefresh context.Context
+
+	// guards children, lazy, listed, names, named, sorted and position
+	cmu sync.Mutex
+	// if nil, we don't yet have children information
+	children map[string]*node
+	// the rest of our children, which we haven't made nodes for yet,
+	// by id
+	lazy map[string]*lazyChild
+	// when we got children from drive
+	listed time.Time
+	// the names childNames worked out, by id, and the ids, by name.
+	// Working them out costs a pass over every child, so we keep them
+	// until a child is added, removed or renamed; nil until then.
+	names map[string]string
+	named map[string]string
+	// bumped each time we forget names, so childNames can tell if a
+	// child changed while it was working them out
+	namesGen uint64
+	// our children in name order, and where each id is in it, which
+	// we keep the same way; see sortedChildren
+	sorted   []sibling
+	position map[string]int
+}
+
+func newNode(s *system, idx index, g *gdrive.Node, parents map[string]*node) *node {
+	n := &node{
+		system:        s,
+		idx:           idx,
+		id:            g.ID,
+		name:          g.Name,
+		ctime:         g.Ctime,
+		mtime:         g.Mtime,
+		size:          g.Size,
+		md5:           g.MD5,
+		version:       g.Version,
+		dir:           g.Dir(),
+		mimeType:      g.MimeType,
+		target:        shortcutTarget(g),
+		webViewLink:   g.WebViewLink,
+		starred:       g.Starred,
+		description:   g.Description,
+		locked:        g.Locked,
+		lockable:      g.CanLock,
+		appProperties: g.AppProperties,
+		mine:          g.Mine(),
+		owner:         g.OwnerEmail,
+		writeable:     g.Writeable(s.others),
+		renameable:    g.Renameable(s.others),
+		trashable:     g.Trashable(s.others),
+		addable:       g.Addable(s.others),
+		parents:       parents,
+		fetched:       time.Now()}
+	return n
+}
+
+// content returns n's phantom file, making it if nothing has needed
+// it before.
+func (n *node) content() *phantomfile.PhantomFile {
+	n.pfMu.Lock()
+	defer n.pfMu.Unlock()
+	if n.pf == nil {
+		n.pf = phantomfile.NewPhantomFile(n.lifetimeLocked(), n)
+	}
+	return n.pf
+}
+
+// madeContent returns n's phantom file, or nil if nothing has needed
+// it yet, in which case we have no local copy of n's content.
+func (n *node) madeContent() *phantomfile.PhantomFile {
+	n.pfMu.Lock()
+	defer n.pfMu.Unlock()
+	return n.pf
+}
+
+// lifetime returns a context that is done once we forget about n or
+// stop watching.
+func (n *node) lifetime() context.Context {
+	n.pfMu.Lock()
+	defer n.pfMu.Unlock()
+	return n.lifetimeLocked()
+}
+
+// Assumes n.pfMu is already held
+func (n *node) lifetimeLocked() context.Context {
+	if n.life == nil {
+		n.life, n.endLife = context.WithCancel(n.watching)
+		if n.forgotten {
+			n.endLife()
+		}
+	}
+	return n.life
+}
+
+// endLifetime ends n's lifetime, including any made later.
+func (n *node) endLifetime() {
+	n.pfMu.Lock()
+	defer n.pfMu.Unlock()
+	n.forgotten = true
+	if n.endLife != nil {
+		n.endLife()
+	}
+}
+
+type printableNode struct {
+	name    string
+	dir     bool
+	idx     index
+	id      string
+	ctime   time.Time
+	mtime   time.Time
+	size    uint64
+	version int64
+}
+
+// dumpSnapshot is an immutable copy of a node and everything below
+// it, so a dump can be rendered without holding any locks.
+type dumpSnapshot struct {
+	printableNode
+	known    bool // whether we have loaded children for a directory
+	children []*dumpSnapshot
+}
+
+const indent = 2
+
+// dump writes n and everything below it to b.  The tree is copied
+// under the system lock so that no change can be applied part way
+// through and the output reflects a single moment in time.
+func (n *node) dump(b *bytes.Buffer, level int) {
+	n.system.mu.Lock()
+	snap := n.snapshotLocked()
+	n.system.mu.Unlock()
+	snap.write(b, level)
+}
+
+// Assumes we already have the system lock
+func (n *node) snapshotLocked() *dumpSnapshot {
+	n.mu.Lock()
+	snap := &dumpSnapshot{printableNode: printableNode{n.name, n.dir, n.idx, n.id, n.ctime, n.mtime, n.size, n.version}}
+	n.mu.Unlock()
+	if !snap.dir {
+		return snap
+	}
+
+	var children []*node
+	n.cmu.Lock()
+	snap.known = n.children != nil
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	// we don't make nodes just to dump them
+	for _, lc := range n.lazy {
+		g := lc.g
+		snap.children = append(snap.children, &dumpSnapshot{printableNode: printableNode{g.Name, g.Dir(), lc.idx, g.ID, g.Ctime, g.Mtime, g.Size, g.Version}})
+	}
+	n.cmu.Unlock()
+	for _, c := range children {
+		snap.children = append(snap.children, c.snapshotLocked())
+	}
+	sort.Slice(snap.children, func(i, j int) bool {
+		return snap.children[i].name < snap.children[j].name
+	})
+	return snap
+}
+
+func (snap *dumpSnapshot) write(b *bytes.Buffer, level int) {
+	margin := strings.Repeat(" ", level*indent)
+	b.WriteString(fmt.Sprintf("%s%#v\n", margin, snap.printableNode))
+	if !snap.dir {
+		return
+	}
+	if !snap.known {
+		margin = strings.Repeat(" ", (level+1)*indent)
+		b.WriteString(fmt.Sprintf("%s<unknown children>\n", margin))
+		return
+	}
+	for _, c := range snap.children {
+		c.write(b, level+1)
+	}
+}
+
+// Assumes we already have the system lock
+func (n *node) update(g *gdrive.Node) {
+	n.mu.Lock()
+	renamed := n.name != g.Name || n.mimeType != g.MimeType || !n.ctime.Equal(g.Ctime)
+	n.name = g.Name
+	n.ctime = g.Ctime
+	n.mtime = g.Mtime
+	n.size = g.Size
+	n.md5 = g.MD5
+	n.version = g.Version
+	n.dir = g.Dir()
+	n.mimeType = g.MimeType
+	n.target = shortcutTarget(g)
+	n.webViewLink = g.WebViewLink
+	n.starred = g.Starred
+	n.description = g.Description
+	n.locked = g.Locked
+	n.lockable = g.CanLock
+	n.appProperties = g.AppProperties
+	n.mine = g.Mine()
+	n.owner = g.OwnerEmail
+	n.writeable = g.Writeable(n.others)
+	n.renameable = g.Renameable(n.others)
+	n.trashable = g.Trashable(n.others)
+	n.addable = g.Addable(n.others)
+	n.fetched = time.Now()
+	n.setParents(g.ParentIDs)
+	parents := n.parentList()
+	n.mu.Unlock()
+	if renamed {
+		forgetNamesOf(parents)
+	}
+}
+
+// setParents makes n a child of the parents with ids (the ones we know
+// about) and of no others.  Assumes we already have the system lock
+// and n.mu.
+func (n *node) setParents(ids []string) {
+	newParentSet := map[string]bool{}
+	for _, id := range ids {
+		newParentSet[id] = true
+	}
+
+	// loop through existing parents looking for ones no longer present and tell them to
+	// remove us
+	for _, ep := range n.parents {
+		if _, ok := newParentSet[ep.id]; !ok {
+			logging.Debugf("Update %q, removing %q as a parent", n.id, ep.id)
+			ep.removeChild(n.id)
+			delete(n.parents, ep.id)
+		}
+	}
+
+	// loop through new parents, looking for ones that aren't yet present and tell them
+	// to add us
+	for np := range newParentSet {
+		if _, ok := n.parents[np]; !ok {
+			if p := n.getNodeIfExists(np); p != nil {
+				logging.Debugf("Update %q, adding %q as a parent", n.id, np)
+				p.addChild(n)
+				n.parents[np] = p
+			}
+		}
+	}
+	n.updateTime = time.Now()
+}
+
+func (n *node) addChild(c *node) {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	if n.children == nil {
+		// we'll pick c up when we load the rest
+		return
+	}
+	n.children[c.id] = c
+	n.forgetNames()
+	n.updateTime = time.Now()
+}
+
+func (n *node) removeChild(id string) {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	delete(n.children, id)
+	n.forgetNames()
+	n.updateTime = time.Now()
+}
+
+// parentList returns n's parents.  Assumes we have n's lock.
+func (n *node) parentList() []*node {
+	parents := make([]*node, 0, len(n.parents))
+	for _, p := range n.parents {
+		parents = append(parents, p)
+	}
+	return parents
+}
+
+// forgetNamesOf tells parents that the name one of their children is
+// shown by may have changed, so they work out their children's names
+// again.  Call it once the child has its new name, so none of them
+// works them out from the old one, and not while holding the child's
+// lock.
+func forgetNamesOf(parents []*node) {
+	for _, p := range parents {
+		p.cmu.Lock()
+		p.forgetNames()
+		p.cmu.Unlock()
+	}
+}
+
+// forgetNames throws away the names, and the order, we worked out for
+// n's children, now that one of them has changed.  Assumes we have the
+// children lock.
+func (n *node) forgetNames() {
+	n.namesGen++
+	n.names = nil
+	n.named = nil
+	n.sorted = nil
+	n.position = nil
+}
+
+func (n *node) Getattr(ctx context.Context, eq *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	n.refreshIfStale(ctx)
+	err := n.Attr(ctx, &resp.Attr)
+	logging.Debugf("in my Getattr, n=%s, size=%d", n, resp.Attr.Size)
+	return err
+}
+
+// refreshIfStale starts fetching n's metadata again in the background
+// if the change feed hasn't been keeping it up to date.  It never
+// waits for the fetch; whoever is asking gets what we have now, and
+// later requests see the result.
+func (n *node) refreshIfStale(ctx context.Context) {
+	if !n.metadataStale() || !atomic.CompareAndSwapInt32(&n.refreshing, 0, 1) {
+		return
+	}
+
+	// the refresh carries on after the getattr that asked for it
+	ctx = logging.Detach(ctx)
+	n.goBackground(func() {
+		defer atomic.StoreInt32(&n.refreshing, 0)
+		g, err := n.gd.FetchNode(ctx, n.id)
+		if err != nil {
+			logging.Warnf("Unable to refresh stale metadata for %s: %v", n, err)
+			n.hooks.OnError("refresh metadata", err)
+			return
+		}
+		n.mu.Lock()
+		changed := g.Version != n.version
+		n.fetched = time.Now()
+		n.mu.Unlock()
+		if changed {
+			logging.Debugf("Refreshed stale metadata for %s", n)
+			n.processChange(&gdrive.Change{ID: n.id, Node: g}, &gdrive.ChangeStats{})
+		}
+	})
+}
+
+// metadataStale returns true if the change feed hasn't been keeping n's
+// metadata up to date and we fetched it too long ago to trust.
+func (n *node) metadataStale() bool {
+	if n.refreshAfter <= 0 {
+		return false
+	}
+	n.system.mu.Lock()
+	lagging := time.Since(n.changesTime) > n.refreshAfter
+	n.system.mu.Unlock()
+	if !lagging {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Since(n.fetched) > n.refreshAfter
+}
+
+// refreshForOpen fetches n's metadata again, if it is stale and n has
+// no local copy yet, alongside the download that opening n starts
+// rather than before it, so the open waits for one round trip instead
+// of two.  The download gets what drive has now, so what the fetch
+// finds becomes our upload base, unless the download has already noted
+// what it got, and checkUploadBase waits for it.  It returns a channel
+// that is closed once the fetch is over, or nil if there is nothing to
+// fetch.
+func (n *node) refreshForOpen(ctx context.Context) <-chan struct{} {
+	if pf := n.madeContent(); (pf != nil && pf.IsOpen()) || !n.metadataStale() {
+		return nil
+	}
+	refreshed, done := context.WithCancel(context.Background())
+	n.mu.Lock()
+	n.openRefresh = refreshed
+	base := n.uploadBase
+	n.mu.Unlock()
+
+	ctx = logging.Detach(ctx)
+	n.goBackground(func() {
+		defer done()
+		g, err := n.gd.FetchNode(ctx, n.id)
+		if err != nil {
+			logging.Warnf("Unable to refresh stale metadata for %s on open: %v", n, err)
+			return
+		}
+		n.mu.Lock()
+		changed := g.Version != n.version
+		n.fetched = time.Now()
+		if n.uploadBase == base {
+			n.uploadBase = g.MD5
+		}
+		n.mu.Unlock()
+		if changed {
+			logging.Debugf("Refreshed stale metadata for %s on open", n)
+			n.processChange(&gdrive.Change{ID: n.id, Node: g}, &gdrive.ChangeStats{})
+		}
+	})
+	return refreshed.Done()
+}
+
+func (n *node) Attr(ctx context.Context, a *fuse.Attr) error {
+	protected := n.inReadonlyPath()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	a.Inode = uint64(n.idx)
+	a.Size = n.size
+	if _, ok := n.exportFormat(); ok && n.stubs {
+		// we know what the stub will hold without fetching anything
+		a.Size = uint64(len(n.stubContent()))
+	}
+	a.Ctime = n.ctime
+	a.Crtime = n.ctime
+	a.Mtime = n.mtime
+	if uid, ok := n.ownerUidLocked(); ok {
+		a.Uid = uid
+	}
+
+	if pf := n.madeContent(); pf != nil {
+		if size, modTime, ok := pf.StatIfLocal(); ok {
+			a.Size = uint64(size)
+			a.Mtime = modTime
+		}
+	}
+
+	_, exported := n.exportFormat()
+	mode := modeReadWrite
+	if n.readonly || !n.writeable || protected || (n.dir && !n.addable) || exported {
+		mode = modeReadOnly
+	}
+
+	switch {
+	case n.dir:
+		a.Mode = os.ModeDir | mode
+	case n.target != "":
+		// the kernel follows symlinks itself, and ignores their mode
+		a.Mode = os.ModeSymlink | modeReadWrite
+	default:
+		a.Mode = mode
+	}
+
+	return nil
+}
+
+// isWriteable returns false if drive won't let us change n (e.g. it
+// belongs to someone else) or if it is in one of our readonly paths.
+// It doesn't consider whether the whole system is readonly.
+func (n *node) isWriteable() bool {
+	n.mu.Lock()
+	writeable := n.writeable
+	n.mu.Unlock()
+	return writeable && !n.inReadonlyPath()
+}
+
+// isRenameable is like isWriteable, for renaming n.
+func (n *node) isRenameable() bool {
+	n.mu.Lock()
+	renameable := n.renameable
+	n.mu.Unlock()
+	return renameable && !n.inReadonlyPath()
+}
+
+// isLockable is like isWriteable, for locking or unlocking n.  Only
+// files can be locked.
+func (n *node) isLockable() bool {
+	n.mu.Lock()
+	lockable := n.lockable && !n.dir
+	n.mu.Unlock()
+	return lockable && !n.inReadonlyPath()
+}
+
+// isTrashable is like isWriteable, for moving n to the trash.
+func (n *node) isTrashable() bool {
+	n.mu.Lock()
+	trashable := n.trashable
+	n.mu.Unlock()
+	return trashable && !n.inReadonlyPath()
+}
+
+// isAddable returns false if drive won't let us create things in n, or
+// move things into it.  Drive may allow that in folders we may not
+// otherwise change, and not allow it in ones we may, so callers check
+// isWriteable as well.
+func (n *node) isAddable() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.addable
+}
+
+// inReadonlyPath returns true if n is one of our readonly paths or is
+// somewhere below one, by any of the paths it has.
+func (n *node) inReadonlyPath() bool {
+	if len(n.readonlyPaths) == 0 {
+		return false
+	}
+	n.system.mu.Lock()
+	ps := n.mountPaths()
+	n.system.mu.Unlock()
+	for _, p := range ps {
+		if underAny(p, n.readonlyPaths) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fuseNode fs.Node, err error) {
+	defer n.observe("Mkdir", time.Now(), &err)
+	defer func() {
+		logging.For(ctx).Debugf("main: Mkdir produced %s, %+v", fuseNode, err)
+	}()
+	if n.readonly {
+		return nil, n.readonlyErr()
+	}
+	if !n.isWriteable() {
+		return nil, fuse.EPERM
+	}
+	if !n.dir {
+		return nil, n.notDirErr()
+	}
+	if !n.isAddable() {
+		logging.For(ctx).Debugf("Mkdir: failing because drive won't let us add to %q", n.id)
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	if err = n.loadChildrenIfEmpty(ctx); err != nil {
+		logging.For(ctx).Errorf("Failed to load children of %q: %+v", n.id, err)
+		return nil, err
+	}
+	if err = n.checkNameFree(req.Name); err != nil {
+		return nil, err
+	}
+	g, err := n.gd.CreateNode(ctx, n.id, driveName(req.Name), true)
+	if err != nil {
+		logging.For(ctx).Errorf("Failed to create node %q: %v", req.Name, err)
+		return nil, err
+	}
+	n.system.mu.Lock()
+	created := n.insertNode(g)
+	r := ruleFor(created.mountPath(), n.rules)
+	n.system.mu.Unlock()
+	if r != nil {
+		created.applyRule(ctx, r)
+	}
+	n.touched()
+
+	return created, nil
+}
+
+// contentChanged returns true if g, new metadata for n, says n's
+// content is different from what we have.  Drive doesn't checksum
+// google docs files (and similar), so for those any new version may be
+// new content.
+func (n *node) contentChanged(g *gdrive.Node) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.md5 == "" || g.MD5 == "" {
+		return n.version != g.Version
+	}
+	return n.md5 != g.MD5 || n.size != g.Size
+}
+
+func (n *node) haveChildren() bool {
+	n.cmu.Lock()
+	loaded := n.children != nil
+	n.cmu.Unlock()
+	return loaded
+}
+
+func (n *node) findChild(name string) (*node, error) {
+	if !n.haveChildren() {
+		panic(fmt.Sprintf("findChild on %q called for %q before loadChildrenIfEmpty was called.  Unable to continue.", n.id, name))
+	}
+
+	n.cmu.Lock()
+	var found *node
+	var lc *lazyChild
+	if id, ok := n.childNamed(name); ok {
+		found, lc = n.children[id], n.lazy[id]
+	}
+	n.cmu.Unlock()
+	switch {
+	case found != nil:
+		return found, nil
+	case lc != nil:
+		// made takes the system lock, which we can't take while
+		// holding cmu
+		return n.made(lc), nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// childNames returns the name we present each of n's children by, by
+// id, whether or not we have made nodes for them, working them out
+// again if a child has changed since we last did.  Callers mustn't
+// change what it returns.  Assumes we have the children lock.
+//
+// Working them out means reading each child's name under its own lock,
+// which we can't take while holding the children lock, so we let go of
+// it meanwhile.  Callers mustn't count on anything they read from n
+// before calling it.
+func (n *node) childNames() map[string]string {
+	for n.names == nil {
+		gen := n.namesGen
+		entries := make([]nameEntry, 0, len(n.children)+len(n.lazy))
+		children := make([]*node, 0, len(n.children))
+		for _, c := range n.children {
+			children = append(children, c)
+		}
+		for id, lc := range n.lazy {
+			entries = append(entries, nameEntry{id, n.system.shownName(lc.g.Name, lc.g.MimeType), lc.g.Ctime})
+		}
+		n.cmu.Unlock()
+		for _, c := range children {
+			c.mu.Lock()
+			entries = append(entries, nameEntry{c.id, c.shownName(), c.ctime})
+			c.mu.Unlock()
+		}
+		n.cmu.Lock()
+		if n.namesGen != gen {
+			// a child changed while we were reading them
+			continue
+		}
+		n.names = workOutChildNames(entries)
+		n.named = make(map[string]string, len(n.names))
+		for id, name := range n.names {
+			n.named[name] = id
+		}
+	}
+	return n.names
+}
+
+// nameEntry is what workOutChildNames needs to know about a child.
+type nameEntry struct {
+	id    string
+	name  string // as shownName gives it
+	ctime time.Time
+}
+
+// childNamed returns the id of n's child shown as name, if there is
+// one.  Assumes we have the children lock.
+func (n *node) childNamed(name string) (string, bool) {
+	n.childNames()
+	id, ok := n.named[name]
+	return id, ok
+}
+
+// workOutChildNames returns the name we present each of the children in
+// entries by, by id.  Where several would be shown by the same name,
+// the oldest (or, if they were created together, the one with the
+// lowest id) keeps it and the rest are disambiguated, so they come out
+// the same way every time.
+func workOutChildNames(entries []nameEntry) map[string]string {
+	type entry struct {
+		id    string
+		ctime time.Time
+	}
+	count := len(entries)
+	names := make(map[string]string, count)
+	first := make(map[string]entry, count)
+	// only names used more than once, which few are, so big folders
+	// don't cost a slice per child
+	byName := map[string][]entry{}
+	add := func(e entry, name string) {
+		names[e.id] = name
+		f, ok := first[name]
+		switch {
+		case !ok:
+			first[name] = e
+		case len(byName[name]) == 0:
+			byName[name] = []entry{f, e}
+		default:
+			byName[name] = append(byName[name], e)
+		}
+	}
+	for _, e := range entries {
+		add(entry{e.id, e.ctime}, e.name)
+	}
+	if len(byName) == 0 {
+		return names
+	}
+
+	// a generated name may be another child's real name, or another
+	// generated one, so we check each against every name in use, and
+	// go through the clashes in order so they come out the same way
+	// every time
+	taken := make(map[string]bool, len(first))
+	clashes := make([]string, 0, len(byName))
+	for name := range first {
+		taken[name] = true
+	}
+	for name := range byName {
+		clashes = append(clashes, name)
+	}
+	sort.Strings(clashes)
+	for _, name := range clashes {
+		same := byName[name]
+		sort.Slice(same, func(i, j int) bool {
+			if !same[i].ctime.Equal(same[j].ctime) {
+				return same[i].ctime.Before(same[j].ctime)
+			}
+			return same[i].id < same[j].id
+		})
+		for _, e := range same[1:] {
+			u := uniqueName(name, e.id, taken)
+			taken[u] = true
+			names[e.id] = u
+		}
+	}
+	return names
+}
+
+// childName returns the name we present c by in n.  Working it out
+// takes c's lock, so callers mustn't hold it.
+func (n *node) childName(c *node) string {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	if name, ok := n.childNames()[c.id]; ok {
+		return name
+	}
+	// n hasn't loaded its children yet, so there is nothing to tell c
+	// apart from
+	return c.shownName()
+}
+
+func (n *node) loadChildrenIfEmpty(ctx context.Context) error {
+	if n.haveChildren() {
+		return nil
+	}
+
+	gs, err := n.gd.FetchChildren(ctx, n.id)
+	if err != nil {
+		return err
+	}
+
+	// We only make nodes for children we already know; the rest wait
+	// until someone looks them up.  See lazyChild.
+	childMap := map[string]*node{}
+	lazy := make(map[string]*lazyChild, len(gs))
+	n.system.mu.Lock()
+	if n.haveChildren() {
+		// someone else listed n while we were fetching
+		n.system.mu.Unlock()
+		return nil
+	}
+	for _, g := range gs {
+		if n.excluded(g) {
+			continue
+		}
+		if c, ok := n.idMap[g.ID]; ok {
+			c.update(g)
+			c.addParent(n)
+			childMap[c.id] = c
+			continue
+		}
+		lazy[g.ID] = n.listedChild(g)
+	}
+	n.cmu.Lock()
+	n.children = childMap
+	n.lazy = lazy
+	n.listed = time.Now()
+	n.forgetNames()
+	n.cmu.Unlock()
+	n.system.mu.Unlock()
+
+	n.mu.Lock()
+	n.updateTime = time.Now()
+	n.mu.Unlock()
+
+	return nil
+}
+
+func (n *node) addParent(p *node) {
+	n.mu.Lock()
+	n.parents[p.id] = p
+	n.updateTime = time.Now()
+	n.mu.Unlock()
+}
+
+func (n *node) ReadDirAll(ctx context.Context) (ds []fuse.Dirent, err error) {
+	defer n.observe("ReadDirAll", time.Now(), &err)
+	if err = n.loadChildrenIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+
+	// only needed for zip exports, so big folders don't cost a second
+	// slice the size of the listing otherwise
+	var children []*node
+	var lazy []*lazyChild
+	n.cmu.Lock()
+	names := n.childNames()
+	ds = make([]fuse.Dirent, 0, len(names))
+	for _, c := range n.children {
+		ds = append(ds, fuse.Dirent{Inode: uint64(c.idx), Type: direntType(c.dir, c.target), Name: names[c.id]})
+		if n.exportZip {
+			children = append(children, c)
+		}
+	}
+	for id, lc := range n.lazy {
+		ds = append(ds, fuse.Dirent{Inode: uint64(lc.idx), Type: direntType(lc.g.Dir(), shortcutTarget(lc.g)), Name: names[id]})
+		if n.exportZip {
+			lazy = append(lazy, lc)
+		}
+	}
+	n.cmu.Unlock()
+
+	if n.exportZip {
+		// export and made take the system lock, which we can't take
+		// while holding cmu
+		for _, lc := range lazy {
+			children = append(children, n.made(lc))
+		}
+		for _, c := range children {
+			if e, err := c.export(); err == nil {
+				ds = append(ds, fuse.Dirent{Inode: uint64(e.idx), Type: fuse.DT_File, Name: localName(c.name) + zipExportSuffix})
+			}
+		}
+	}
+
+	n.sortDirents(ds)
+	logging.For(ctx).Debugf("ReadDirAll returning %d children", len(ds))
+	return ds, nil
+}
+
+func (n *node) Lookup(ctx context.Context, name string) (ret fs.Node, err error) {
+	defer n.observe("Lookup", time.Now(), &err)
+	if err := n.loadChildrenIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+
+	if name == ".dump" && n.isRoot(n) {
+		n.initDumpOnce.Do(func() {
+			n.dumpNode = &dumpNodeType{n}
+		})
+		return n.dumpNode, nil
+	}
+
+	if name == openFilesName && n.isRoot(n) {
+		n.initOpenFilesOnce.Do(func() {
+			n.openFilesNode = &openFilesNodeType{n}
+		})
+		return n.openFilesNode, nil
+	}
+
+	if name == volumeIconName && n.volumeIcon != "" && n.isRoot(n) {
+		n.initVolumeIconOnce.Do(func() {
+			n.volumeIconNode = &volumeIconNodeType{n}
+		})
+		return n.volumeIconNode, nil
+	}
+
+	if name == trashViewName && n.isRoot(n) {
+		return n.trashView(), nil
+	}
+
+	if name == ctlDirName && n.isRoot(n) {
+		n.initCtlDirOnce.Do(func() {
+			batch := &batchNodeType{root: n}
+			n.ctlDirNode = &ctlDirType{root: n, batch: batch, batchResult: &batchResultNodeType{batch}, byID: &byIDDirType{root: n}, jobs: &jobsDirType{root: n},
+				whoami: &whoamiNodeType{root: n}, config: &configNodeType{root: n}}
+		})
+		return n.ctlDirNode, nil
+	}
+
+	if name == revisionsName && n.isRoot(n) {
+		return n.revisionsDir(), nil
+	}
+
+	if name == appDataName && n.appData && n.parentSystem == nil && n.isRoot(n) {
+		root, err := n.appDataRoot()
+		if err != nil {
+			logging.For(ctx).Errorf("Unable to open the app data folder: %v", err)
+			return nil, fuse.EIO
+		}
+		return root, nil
+	}
+
+	if name == computersName && n.parentSystem == nil && n.isRoot(n) {
+		n.initComputersOnce.Do(func() {
+			n.computersNode = &computersDirType{root: n}
+		})
+		return n.computersNode, nil
+	}
+
+	if name == sharedDrivesName && n.parentSystem == nil && n.isRoot(n) {
+		return n.sharedDrivesDir(), nil
+	}
+
+	c, err := n.findChild(name)
+	if err == fuse.ENOENT {
+		// maybe it names an old revision of one of our children
+		if r, rerr := n.lookupRevision(ctx, name); rerr == nil {
+			return r, nil
+		}
+		if e, eerr := n.lookupExport(name); eerr == nil {
+			return e, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (n *node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fuseNode fs.Node, h fs.Handle, err error) {
+	defer n.observe("Create", time.Now(), &err)
+	defer func() {
+		logging.For(ctx).Debugf("main: Create produced %s, %s, %#v", fuseNode, h, err)
+	}()
+	if n.readonly {
+		return nil, nil, n.readonlyErr()
+	}
+	if !n.isWriteable() {
+		return nil, nil, fuse.EPERM
+	}
+	if !n.dir {
+		return nil, nil, n.notDirErr()
+	}
+	if !n.isAddable() {
+		logging.For(ctx).Debugf("Create: failing because drive won't let us add to %q", n.id)
+		return nil, nil, fuse.Errno(syscall.EACCES)
+	}
+	if err = n.loadChildrenIfEmpty(ctx); err != nil {
+		logging.For(ctx).Errorf("Failed to load children of %q: %v", n.id, err)
+		return nil, nil, err
+	}
+	if req.Flags&fuse.OpenExclusive != 0 {
+		if err = n.checkNameFree(req.Name); err != nil {
+			return nil, nil, err
+		}
+	}
+	dir := req.Mode&os.ModeDir != 0
+	g, err := n.gd.CreateNode(ctx, n.id, driveName(req.Name), dir)
+	if err != nil {
+		logging.For(ctx).Errorf("Failed to create node %q: %v", req.Name, err)
+		return nil, nil, err
+	}
+	n.system.mu.Lock()
+	created := n.insertNode(g)
+	r := ruleFor(created.mountPath(), n.rules)
+	n.system.mu.Unlock()
+	if r != nil {
+		created.applyRule(ctx, r)
+	}
+	n.touched()
+
+	resp.Node = fuse.NodeID(created.idx)
+	created.Attr(ctx, &resp.Attr)
+
+	handle, err := created.content().Open(ctx, phantomfile.WriteOnly, phantomfile.NoFetch, processOf(req.Pid))
+	if err != nil {
+		logging.For(ctx).Errorf("Failed to open file for node %q: %v", created.id, err)
+		return nil, nil, err
+	}
+	return created, n.observed(handle), nil
+}
+
+func xlateAccessMode(flags fuse.OpenFlags) phantomfile.AccessMode {
+	switch {
+	case flags.IsReadOnly():
+		return phantomfile.ReadOnly
+	case flags.IsWriteOnly():
+		return phantomfile.WriteOnly
+	default:
+		return phantomfile.ReadWrite
+	}
+}
+
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (handle fs.Handle, err error) {
+	defer n.observe("Open", time.Now(), &err)
+	if n.dir {
+		// send the caller to ReadDirAll
+		return n, nil
+	}
+	defer func() {
+		if err == nil && !req.Flags.IsWriteOnly() {
+			handle = n.system.audited(handle, req, n.id, n.mountPath)
+		}
+		if err == nil {
+			handle = n.system.observed(handle)
+		}
+	}()
+	if req.Flags&fuse.OpenExclusive != 0 && !n.strictPOSIX {
+		// Google drive doesn't support this concept (it is fine
+		// having two files with the same name in the same folder), so
+		// we don't either.  When strict, Create already made sure the
+		// name was free.
+		logging.For(ctx).Debugf("Open failing due to unsupported exclusive flag")
+		return nil, fuse.ENOTSUP
+	}
+
+	am := xlateAccessMode(req.Flags)
+
+	if am != phantomfile.ReadOnly && n.readonly {
+		logging.For(ctx).Debugf("Open: failing due to writeable request of readonly filesystem")
+		return nil, fuse.EPERM
+	}
+	if am != phantomfile.ReadOnly && !n.isWriteable() {
+		logging.For(ctx).Debugf("Open: failing due to writeable request of %q, which we may not change", n.id)
+		return nil, fuse.EPERM
+	}
+	exported := n.exported()
+	if am != phantomfile.ReadOnly && exported {
+		logging.For(ctx).Debugf("Open: failing due to writeable request of %q, which we only see exported", n.id)
+		return nil, fuse.EPERM
+	}
+
+	defer func() {
+		if handle != nil && err != nil {
+			h := handle.(fs.HandleReleaser)
+			h.Release(ctx, &fuse.ReleaseRequest{})
+		}
+	}()
+
+	n.noteUploadBase()
+	refreshed := n.refreshForOpen(ctx)
+
+	// Zero-byte files have nothing to fetch, so we skip straight to
+	// an empty file rather than asking gdrive for no content.  Google
+	// docs files always claim zero bytes, but have an export to fetch.
+	// If we are refreshing stale metadata, the file may not be empty
+	// any more, so we wait to find out first.
+	n.mu.Lock()
+	empty := n.size == 0 && !exported
+	n.mu.Unlock()
+	if empty && refreshed != nil {
+		select {
+		case <-refreshed:
+		case <-ctx.Done():
+			return nil, fuse.EINTR
+		}
+		n.mu.Lock()
+		empty = n.size == 0
+		n.mu.Unlock()
+	}
+	fm := phantomfile.ProactiveFetch
+	if empty {
+		fm = phantomfile.NoFetch
+	}
+
+	switch {
+	case am == phantomfile.ReadOnly && exported:
+		// we don't know how big the export is until we have it, so
+		// the kernel mustn't trust the size we report
+		res.Flags |= fuse.OpenDirectIO
+		return n.content().Open(ctx, am, fm, processOf(req.Pid))
+	case am == phantomfile.ReadOnly:
+		if n.audit == nil {
+			// with an audit log, every read has to reach us so we
+			// can count it
+			res.Flags |= fuse.OpenKeepCache
+		}
+		pid := processOf(req.Pid)
+		handle, err = n.content().Open(ctx, am, fm, pid)
+		if err == nil {
+			n.prefetchSiblings(pid)
+		}
+		return handle, err
+	case req.Flags&fuse.OpenTruncate != 0:
+		pid := processOf(req.Pid)
+		n.noticeRestore(ctx, pid)
+		handle, err = n.content().Open(ctx, am, phantomfile.NoFetch, pid)
+		if err == nil {
+			err = n.content().Truncate(ctx, 0)
+		}
+		return handle, err
+	default:
+		// Without O_TRUNC the rest of the file stays, so we fetch it
+		// as for reading and writing.  On linux that includes opens
+		// with O_TRUNC: our fuse library doesn't ask for atomic
+		// O_TRUNC, so the kernel opens the file without it and then
+		// sends a Setattr to size 0.  The file is open by then, so
+		// the truncation stops the fetch and goes up with the writes
+		// that follow, when the file is closed or synced.
+		pid := processOf(req.Pid)
+		n.noticeRestore(ctx, pid)
+		return n.content().Open(ctx, am, fm, pid)
+	}
+}
+
+// Fsync uploads any changes to n that haven't been uploaded yet and
+// returns how that went, so fsync(2) means the changes are in drive.
+// Our fuse library asks the node rather than the handle, which comes
+// to the same thing, since every handle shares one local copy.
+// Folders have nothing to upload.
+func (n *node) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	defer n.observe("Fsync", time.Now(), &err)
+	if n.dir {
+		return nil
+	}
+	if err = n.content().Flush(ctx); err != nil {
+		logging.For(ctx).Errorf("Fsync: unable to upload changes to %q: %v", n.id, err)
+	}
+	return err
+}
+
+// Setattr changes n's size, as truncate(1), ftruncate(2) and editors
+// that shrink files ask us to.  Like a write, that goes up when n is
+// closed or synced if it is open, and right away if not.  The rest is
+// ours to decide: drive keeps no modes or owners, and times follow what
+// we upload.
+func (n *node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer n.observe("Setattr", time.Now(), &err)
+	if !req.Valid.Size() {
+		return nil
+	}
+	switch {
+	case n.dir:
+		return fuse.Errno(syscall.EISDIR)
+	case n.readonly:
+		logging.For(ctx).Debugf("Setattr: failing due to size change on readonly filesystem")
+		return n.readonlyErr()
+	case !n.isWriteable():
+		logging.For(ctx).Debugf("Setattr: failing due to size change of %q, which we may not change", n.id)
+		return fuse.EPERM
+	case n.exported():
+		logging.For(ctx).Debugf("Setattr: failing due to size change of %q, which we only see exported", n.id)
+		return fuse.EPERM
+	}
+
+	n.noteUploadBase()
+	if err = n.content().Truncate(ctx, int64(req.Size)); err != nil {
+		logging.For(ctx).Errorf("Setattr: unable to change the size of %q to %d: %v", n.id, req.Size, err)
+	}
+	return err
+}
+
+func (n *node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	defer n.observe("Rename", time.Now(), &err)
+	if n.readonly {
+		logging.For(ctx).Debugf("Rename: failing because readonly")
+		return n.readonlyErr()
+	}
+	if !n.dir {
+		logging.For(ctx).Debugf("Rename: failing because not a directory")
+		return n.notDirErr()
+	}
+	if err := n.loadChildrenIfEmpty(ctx); err != nil {
+		logging.For(ctx).Errorf("Rename: load failed %v", err)
+		return fuse.EIO
+	}
+
+	child, err := n.findChild(req.OldName)
+	if child == nil {
+		logging.For(ctx).Debugf("Rename: failed because unable to find %q in %q", req.OldName, n.id)
+		return fuse.ENOENT
+	}
+	if !n.isWriteable() || !child.isRenameable() {
+		logging.For(ctx).Debugf("Rename: failing because we may not rename %q in %q", req.OldName, n.id)
+		return fuse.EPERM
+	}
+
+	var oldParentID string
+	var newParentID string
+	target := n
+	if newDir != nil {
+		newParent, ok := newDir.(*node)
+		if !ok {
+			logging.For(ctx).Errorf("*node newDir node isn't a *node, is a %T; can't handle.  returning EIO.", newDir)
+			return fuse.EIO
+		}
+		if newParent.system != n.system {
+			// one of us is in a different shared drive, which we
+			// leave to the caller to copy into
+			logging.For(ctx).Debugf("Rename: failing because %q is in a different drive", newParent.id)
+			return fuse.Errno(syscall.EXDEV)
+		}
+		if !newParent.isWriteable() {
+			logging.For(ctx).Debugf("Rename: failing because we may not change %q", newParent.id)
+			return fuse.EPERM
+		}
+		target = newParent
+		oldParentID = n.id
+		newParentID = newParent.id
+		if oldParentID == newParentID {
+			oldParentID = ""
+			newParentID = ""
+		} else if !newParent.isAddable() {
+			logging.For(ctx).Debugf("Rename: failing because drive won't let us add to %q", newParent.id)
+			return fuse.Errno(syscall.EACCES)
+		}
+	}
+	// before anything else, so a rename we refuse changes nothing
+	// locally or in drive
+	if n.renameTouchesReadonly(target, req.OldName, req.NewName) {
+		logging.For(ctx).Debugf("Rename: failing because %q to %q crosses a readonly path", req.OldName, req.NewName)
+		return fuse.EPERM
+	}
+	replaced, err := target.replacedBy(ctx, child.id, child.dir, req.NewName)
+	if err != nil {
+		logging.For(ctx).Debugf("Rename: failing because we can't replace %q in %q: %v", req.NewName, target.id, err)
+		return err
+	}
+	if !child.dir {
+		// Editors often save by writing a temp file and renaming it
+		// over the original, without an fsync in between.  Get the
+		// content up before the name, so the name never points at
+		// stale content.
+		if err := child.content().Flush(ctx); err != nil {
+			logging.For(ctx).Errorf("Rename: failing because unable to upload changes to %q: %v", child.id, err)
+			return fuse.EIO
+		}
+	}
+	newName := driveName(req.NewName)
+	shown := n.childName(child)
+	child.mu.Lock()
+	if req.NewName == shown {
+		// Just moving it.  We keep the whole name, rather than
+		// renaming it to the shortened one we present locally.
+		newName = child.name
+	} else if f, ok := child.exportFormat(); ok {
+		// drive doesn't know about the extension we add
+		newName = strings.TrimSuffix(newName, f.Extension)
+	}
+	child.mu.Unlock()
+	if n.metadataDelay > 0 {
+		logging.For(ctx).Debugf("Queueing rename of %q with newName %q.  oldParentID=%q and newParentID=%q", child.id, newName, oldParentID, newParentID)
+		n.system.queueRename(child, newName, oldParentID, newParentID, replaced)
+		replaced = nil
+	} else {
+		logging.For(ctx).Debugf("Renaming %q with newName %q.  oldParentID=%q and newParentID=%q", child.id, newName, oldParentID, newParentID)
+		gnode, err := n.system.gd.Rename(ctx, child.id, newName, oldParentID, newParentID)
+		if err != nil {
+			return err
+		}
+		n.system.mu.Lock()
+		child.update(gnode)
+		n.system.mu.Unlock()
+	}
+	if replaced != nil {
+		// posix rename replaces the target in one step.  We can't, so
+		// we trash it once the new name is in place.  A queued rename
+		// does that when it is sent.
+		if err := n.trashChild(ctx, replaced); err != nil {
+			logging.For(ctx).Errorf("Rename: unable to trash %q, which %q replaced: %v", replaced.id, child.id, err)
+			return err
+		}
+	}
+	n.touched()
+	if target != n {
+		target.touched()
+	}
+	return nil
+}
+
+func (n *node) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer n.observe("Remove", time.Now(), &err)
+	if n.readonly {
+		logging.For(ctx).Debugf("Rename: failing because readonly")
+		return n.readonlyErr()
+	}
+	if !n.dir {
+		logging.For(ctx).Debugf("Rename: failing because not a directory")
+		return n.notDirErr()
+	}
+	if err := n.loadChildrenIfEmpty(ctx); err != nil {
+		logging.For(ctx).Errorf("Rename: load failed %v", err)
+		return fuse.EIO
+	}
+
+	child, err := n.findChild(req.Name)
+	if child == nil {
+		logging.For(ctx).Debugf("Remove: failed because unable to find %q in %q", req.Name, n.id)
+		return fuse.ENOENT
+	}
+	if !n.isWriteable() || !child.isTrashable() {
+		logging.For(ctx).Debugf("Remove: failing because we may not trash %q in %q", req.Name, n.id)
+		return fuse.EPERM
+	}
+	if err := n.checkRemove(ctx, child, req.Dir); err != nil {
+		logging.For(ctx).Debugf("Remove: failing for %q in %q: %v", req.Name, n.id, err)
+		return err
+	}
+
+	if err := n.trashChild(ctx, child); err != nil {
+		return err
+	}
+	n.touched()
+	return nil
+}
+
+// trashChild moves child to the trash and forgets about it.
+func (n *node) trashChild(ctx context.Context, child *node) error {
+	if err := n.system.gd.Trash(ctx, child.id); err != nil {
+		return err
+	}
+	n.system.trashReplaced(ctx, n.system.dropPendingRename(child.id))
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	n.system.removeNode(child)
+	return nil
+}
+
+var _ phantomfile.DownloaderUploader = (*node)(nil)
+
+func (n *node) Download(ctx context.Context, f *os.File) error {
+	n.mu.Lock()
+	format, export := n.exportFormat()
+	var stub []byte
+	if export && n.stubs {
+		stub = n.stubContent()
+	}
+	n.mu.Unlock()
+	if stub != nil {
+		_, err := f.Write(stub)
+		return err
+	}
+	return n.transfer(Download, n.id, f, func() error {
+		if export {
+			return n.gd.Export(ctx, n.id, format.MimeType, f)
+		}
+		if err := n.gd.Download(ctx, n.id, f); err != nil {
+			return err
+		}
+		n.downloaded(f)
+		return nil
+	})
+}
+
+// exported returns true if n is a google docs file (or similar), which
+// we show exported to another format.  We can't upload changes to
+// those.
+func (n *node) exported() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.exportFormat()
+	return ok
+}
+
+// exportFormat returns what we export n as, if it is a google docs file
+// (or similar).  Assumes we have the node lock.
+func (n *node) exportFormat() (gdrive.ExportFormat, bool) {
+	return n.system.exportFormat(n.mimeType)
+}
+
+// exportFormat returns what we export google docs files (and similar)
+// with mimeType as.  Stubs have no mime type to ask drive for, just an
+// extension.
+func (s *system) exportFormat(mimeType string) (gdrive.ExportFormat, bool) {
+	if s.stubs {
+		ext, ok := stubExtension(mimeType)
+		return gdrive.ExportFormat{Extension: ext}, ok
+	}
+	f, ok := s.exportFormats[mimeType]
+	return f, ok
+}
+
+// shownName returns the name we present n by locally.  Assumes we have
+// the node lock.
+func (n *node) shownName() string {
+	return n.system.shownName(n.name, n.mimeType)
+}
+
+// shownName returns the name we present a file drive calls name, with
+// mimeType, by locally.  That has the extension of its export format,
+// if it has one, and is shortened if need be.
+func (s *system) shownName(name string, mimeType string) string {
+	if f, ok := s.exportFormat(mimeType); ok {
+		name += f.Extension
+	}
+	return localName(name)
+}
+
+func (n *node) Upload(ctx context.Context, f *os.File) error {
+	// anything we prefetched is out of date now
+	phantomfile.Forget(n.id)
+	n.mu.Lock()
+	cp := n.conflictCopy
+	n.mu.Unlock()
+	if cp != nil {
+		return cp.Upload(ctx, f)
+	}
+	if err := n.checkUploadBase(ctx); err != nil {
+		if conflict, ok := err.(*conflictError); ok {
+			return n.uploadConflictCopy(ctx, f, conflict)
+		}
+		return err
+	}
+	n.mu.Lock()
+	rev := n.restoreFrom
+	n.restoreFrom = nil
+	n.mu.Unlock()
+	if rev != nil {
+		// only restore if the copy went through untouched
+		match, err := gdrive.MatchesRevision(f, rev)
+		if err != nil {
+			return err
+		}
+		if !match {
+			rev = nil
+		}
+	}
+	err := n.transfer(Upload, n.id, f, func() error {
+		if rev != nil {
+			return gdrive.RestoreRevision(ctx, n.gd, n.id, rev.ID)
+		}
+		return n.gd.Upload(ctx, n.id, f)
+	})
+	if err != nil {
+		return err
+	}
+	n.uploaded(f)
+	n.mu.Lock()
+	folderID := n.pendingMove
+	n.pendingMove = ""
+	n.mu.Unlock()
+	if folderID != "" {
+		n.moveTo(ctx, folderID)
+	}
+	return nil
+}
+
+func (n *node) ID() string {
+	return n.id
+}
+
+func (n *node) Name() string {
+	return n.name
+}
+
+// path returns the path of n relative to the root, following the
+// first parent we know about at each level, or "" if we can't connect
+// n to the root.  Assumes we already have the system lock.
+func (n *node) path() string {
+	var names []string
+	// guard against cycles, which drive allows
+	seen := map[string]bool{}
+	for c := n; c.id != n.rootID; {
+		if seen[c.id] {
+			return ""
+		}
+		seen[c.id] = true
+		c.mu.Lock()
+		var parent *node
+		for _, p := range c.parents {
+			parent = p
+			break
+		}
+		c.mu.Unlock()
+		if parent == nil {
+			return ""
+		}
+		names = append(names, parent.childName(c))
+		c = parent
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/")
+}
+
+// maxPaths is the most paths paths returns, so a node in many folders
+// that are each in many folders doesn't cost us unbounded work.
+const maxPaths = 64
+
+// paths returns the paths to n from our root, one for each chain of
+// parents, since drive lets a node be in several folders.  Chains that
+// loop back on themselves or don't reach our root are left out.
+// Assumes we already have the system lock.
+func (n *node) paths() []string {
+	var found []string
+	var walk func(c *node, names []string, seen map[string]bool)
+	walk = func(c *node, names []string, seen map[string]bool) {
+		if c.id == n.rootID {
+			p := make([]string, len(names))
+			for i, name := range names {
+				p[len(names)-1-i] = name
+			}
+			found = append(found, strings.Join(p, "/"))
+			return
+		}
+		if seen[c.id] || len(found) == maxPaths {
+			return
+		}
+		seen[c.id] = true
+		defer delete(seen, c.id)
+		c.mu.Lock()
+		parents := make([]*node, 0, len(c.parents))
+		for _, p := range c.parents {
+			parents = append(parents, p)
+		}
+		c.mu.Unlock()
+		for _, p := range parents {
+			walk(p, append(names, p.childName(c)), seen)
+		}
+	}
+	walk(n, nil, map[string]bool{})
+	return found
+}
+
+func (n *node) String() string {
+	return fmt.Sprintf("%s/%s", n.id,
+		n.name)
+}
+
+type dumpNodeType struct {
+	root *node
+}
+
+func (d *dumpNodeType) text() string {
+	var b bytes.Buffer
+	d.root.dump(&b, 0)
+	return b.String()
+}
+
+func (d *dumpNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = dumpIdx
+	a.Size = uint64(len(d.text()))
+	a.Mode = modeReadOnly
+
+	d.root.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.updateTime
+	d.root.mu.Unlock()
+
+	return nil
+}
+
+func (d *dumpNodeType) ReadAll(ctx context.Context) (result []byte, err error) {
+	return []byte(d.text()), nil
+}
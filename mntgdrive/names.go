@@ -0,0 +1,115 @@
+package mntgdrive
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNameLen is the longest file name most local file systems, and
+// most programs, can cope with (NAME_MAX).  Drive has no such limit.
+const maxNameLen = 255
+
+// longest extension we keep when shortening a name
+const maxKeptExtLen = 16
+
+// slashEscape is what we show in place of each slash in a drive name,
+// which can't have one locally.  It is DIVISION SLASH, which looks
+// much the same.
+const slashEscape = "\u2215"
+
+// localName returns the name we present locally for a file that drive
+// calls driveName.  Slashes become slashEscape.  Names that fit are
+// otherwise unchanged.  Longer names are cut
+// short and given a suffix derived from the whole name, so that two
+// long names that start the same way still come out different, and
+// the same drive name always comes out the same way.  We keep the
+// extension, if it is short, so programs still know what kind of file
+// it is.
+//
+// We find our way back from a shortened name by comparing it with the
+// local names of a directory's children, so there is no need to decode
+// it.
+func localName(driveName string) string {
+	driveName = strings.ReplaceAll(driveName, "/", slashEscape)
+	if len(driveName) <= maxNameLen {
+		return driveName
+	}
+	ext := path.Ext(driveName)
+	if len(ext) > maxKeptExtLen || !utf8.ValidString(ext) {
+		ext = ""
+	}
+	sum := sha1.Sum([]byte(driveName))
+	suffix := fmt.Sprintf("~%x", sum[:5]) + ext
+
+	prefix := driveName[:maxNameLen-len(suffix)]
+	// don't leave half a character at the end
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + suffix
+}
+
+// driveName returns the name we give drive for a file created or
+// renamed locally as name, turning slashEscape back into slashes.
+func driveName(name string) string {
+	return strings.ReplaceAll(name, slashEscape, "/")
+}
+
+// shortestTag is how many bytes of an id's hash we put in the tag
+// disambiguate adds, unless that clashes with another name.
+const shortestTag = 2
+
+// disambiguate returns the name we present a file with id by when
+// another file in the same folder is also shown as name.  Drive is fine
+// with that, but we need every name in a folder to be different.  We
+// add a tag derived from the id before the extension, e.g.
+// "report (a1b2).txt", so the same file always gets the same name.  The
+// tag holds tagLen bytes of the id's hash; callers ask for more if the
+// short one clashes with another name in the folder.
+func disambiguate(name string, id string, tagLen int) string {
+	sum := sha1.Sum([]byte(id))
+	if tagLen > len(sum) {
+		tagLen = len(sum)
+	}
+	return withTag(name, fmt.Sprintf(" (%x)", sum[:tagLen]))
+}
+
+// withTag returns name with tag added before its extension, shortening
+// the rest if need be.
+func withTag(name string, tag string) string {
+	ext := path.Ext(name)
+	if len(ext) > maxKeptExtLen || !utf8.ValidString(ext) {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	if over := len(stem) + len(tag) + len(ext) - maxNameLen; over > 0 {
+		stem = stem[:len(stem)-over]
+		// don't leave half a character at the end
+		for len(stem) > 0 && !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+	}
+	return stem + tag + ext
+}
+
+// uniqueName returns the name we present a file with id by, in place of
+// name, which another file in the folder already has.  It is the
+// shortest disambiguated name not in taken, so it only depends on the
+// names already taken, not on the order we come to them in.  We should
+// never run out of hash, but if we do, we count.
+func uniqueName(name string, id string, taken map[string]bool) string {
+	for tagLen := shortestTag; tagLen <= sha1.Size; tagLen++ {
+		if u := disambiguate(name, id, tagLen); !taken[u] {
+			return u
+		}
+	}
+	full := disambiguate(name, id, sha1.Size)
+	for i := 2; ; i++ {
+		if u := withTag(full, fmt.Sprintf(" (%d)", i)); !taken[u] {
+			return u
+		}
+	}
+}
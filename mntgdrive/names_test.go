@@ -0,0 +1,161 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/fakedrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+func TestLocalName(t *testing.T) {
+	equals(t, "short.txt", localName("short.txt"))
+
+	exact := strings.Repeat("a", maxNameLen)
+	equals(t, exact, localName(exact))
+
+	long := strings.Repeat("a", 300) + ".pdf"
+	got := localName(long)
+	assert(t, len(got) <= maxNameLen, "%q is %d bytes long", got, len(got))
+	assert(t, strings.HasSuffix(got, ".pdf"), "%q lost its extension", got)
+	equals(t, got, localName(long))
+
+	// names that differ only past the cut still come out different
+	other := strings.Repeat("a", 300) + "b.pdf"
+	assert(t, localName(other) != got, "%q and %q collide", long, other)
+
+	// we don't split multi-byte characters
+	wide := strings.Repeat("é", 200)
+	got = localName(wide)
+	assert(t, len(got) <= maxNameLen, "%q is %d bytes long", got, len(got))
+	assert(t, utf8.ValidString(got), "%q is not valid utf8", got)
+
+	equals(t, "a\u2215b", localName("a/b"))
+	equals(t, "a/b", driveName(localName("a/b")))
+}
+
+func TestDisambiguate(t *testing.T) {
+	got := disambiguate("report.txt", "id_one", shortestTag)
+	assert(t, strings.HasPrefix(got, "report ("), "%q lost its name", got)
+	assert(t, strings.HasSuffix(got, ").txt"), "%q lost its extension", got)
+	equals(t, got, disambiguate("report.txt", "id_one", shortestTag))
+	assert(t, got != disambiguate("report.txt", "id_two", shortestTag), "%q came out the same for both ids", got)
+
+	long := strings.Repeat("é", 127) + ".txt"
+	got = disambiguate(long, "id_one", shortestTag)
+	assert(t, len(got) <= maxNameLen, "%q is %d bytes long", got, len(got))
+	assert(t, utf8.ValidString(got), "%q is not valid utf8", got)
+}
+
+func TestChildNamesNeverClash(t *testing.T) {
+	const dups = 500
+	start := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	n := &node{system: &system{}, children: map[string]*node{}, lazy: map[string]*lazyChild{}}
+	for i := 0; i < dups; i++ {
+		id := fmt.Sprintf("untitled_%d_id", i)
+		n.lazy[id] = &lazyChild{g: &gdrive.Node{ID: id, Name: "Untitled document", Ctime: start.Add(time.Duration(i) * time.Second)}}
+	}
+	// a real file that has the name the second duplicate would get
+	lookalike := disambiguate("Untitled document", "untitled_1_id", shortestTag)
+	n.lazy["lookalike_id"] = &lazyChild{g: &gdrive.Node{ID: "lookalike_id", Name: lookalike, Ctime: start}}
+
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	names := n.childNames()
+	equals(t, dups+1, len(names))
+	equals(t, "Untitled document", names["untitled_0_id"])
+	equals(t, lookalike, names["lookalike_id"])
+	ids := map[string]string{}
+	for id, name := range names {
+		if other, ok := ids[name]; ok {
+			t.Fatalf("%s and %s are both shown as %q", id, other, name)
+		}
+		ids[name] = id
+	}
+
+	// the same every time, whatever order we come to them in
+	for i := 0; i < 5; i++ {
+		n.forgetNames()
+		equals(t, names, n.childNames())
+	}
+}
+
+func TestLookupDuringRemoteRename(t *testing.T) {
+	s, _ := loadedSystem(t)
+	root := s.idMap["root"]
+	ctx := context.Background()
+
+	// lookups that work out the names again while the change feed is
+	// renaming
+	looking, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for looking.Err() == nil {
+				root.Lookup(ctx, "file one")
+			}
+		}()
+	}
+	defer func() {
+		stop()
+		wg.Wait()
+	}()
+
+	old := "file one"
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("file %d", i)
+		g := fakedrive.MakeTextFile("file_one_id", name, "root")
+		var cs gdrive.ChangeStats
+		s.processChange(&gdrive.Change{ID: g.ID, Node: g}, &cs)
+		_, err := root.Lookup(ctx, name)
+		ok(t, err)
+		_, err = root.Lookup(ctx, old)
+		equals(t, fuse.ENOENT, err)
+		old = name
+	}
+}
+
+func TestTrashDirAdd(t *testing.T) {
+	d := &trashDir{children: map[string]fs.Node{}}
+	equals(t, "a.txt", d.add("a.txt", "id_one", &trashFile{}))
+	equals(t, disambiguate("a.txt", "id_two", shortestTag), d.add("a.txt", "id_two", &trashFile{}))
+	// built from the name it asked for, not the one the last clash got
+	equals(t, disambiguate("a.txt", "id_three", shortestTag), d.add("a.txt", "id_three", &trashFile{}))
+	equals(t, 3, len(d.children))
+
+	// folders with the same name are kept apart too, each with what
+	// was in it
+	s := newSystem(nil, nil, true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	top := s.newTrashDir()
+	one := fakedrive.MakeDir("one_id", "photos", "root")
+	two := fakedrive.MakeDir("two_id", "photos", "root")
+	childrenOf := map[string][]*gdrive.Node{
+		"one_id": {fakedrive.MakeTextFile("a_id", "a", "one_id")},
+		"two_id": {fakedrive.MakeTextFile("b_id", "b", "two_id")},
+	}
+	seen := map[string]bool{}
+	top.addTrashed(one, childrenOf, seen)
+	top.addTrashed(two, childrenOf, seen)
+	equals(t, 2, len(top.children))
+	first := top.children["photos"].(*trashDir)
+	second := top.children[disambiguate("photos", "two_id", shortestTag)].(*trashDir)
+	equals(t, one, first.g)
+	equals(t, two, second.g)
+	equals(t, first, top.subdir("photos", "one_id"))
+	_, ok := first.children["a"]
+	assert(t, ok && len(first.children) == 1, "first photos has %v", first.children)
+	_, ok = second.children["b"]
+	assert(t, ok && len(second.children) == 1, "second photos has %v", second.children)
+}
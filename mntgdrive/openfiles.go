@@ -0,0 +1,121 @@
+package mntgdrive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+const openFilesName = ".open-files"
+
+// openFilesNodeType is a magic file at the root that lists every open
+// handle, grouped by the process that opened it, along with how much
+// each has read and written.  It makes it easy to find out which
+// program is hammering the mount.
+type openFilesNodeType struct {
+	root *node
+}
+
+// processOf returns the process that the thread with id tid belongs
+// to.  The kernel tells us which thread made each request, but for a
+// multi-threaded program it is the process that people know about.
+func processOf(tid uint32) uint32 {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return tid
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "Tgid:") {
+			continue
+		}
+		if pid, err := strconv.ParseUint(strings.TrimSpace(line[len("Tgid:"):]), 10, 32); err == nil {
+			return uint32(pid)
+		}
+	}
+	return tid
+}
+
+// processName returns the command name of pid, or "?" if we can't
+// find it (e.g. it has exited).
+func processName(pid uint32) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (o *openFilesNodeType) text() string {
+	var b bytes.Buffer
+	handles := phantomfile.OpenHandles()
+
+	// handles are sorted by pid, so each process is a run of them
+	for i := 0; i < len(handles); {
+		pid := handles[i].Pid
+		j := i
+		var total phantomfile.HandleStats
+		for ; j < len(handles) && handles[j].Pid == pid; j++ {
+			total.Reads += handles[j].Reads
+			total.BytesRead += handles[j].BytesRead
+			total.Writes += handles[j].Writes
+			total.BytesWritten += handles[j].BytesWritten
+		}
+		name := "mnt-gdrive"
+		if pid != 0 {
+			name = processName(pid)
+		}
+		fmt.Fprintf(&b, "pid %d (%s): %d handle(s), %s\n", pid, name, j-i, ioSummary(total))
+		for _, h := range handles[i:j] {
+			fmt.Fprintf(&b, "  %s %s, open %s, %s\n", o.describe(h.File), h.Mode,
+				time.Since(h.Opened).Truncate(time.Second), ioSummary(h))
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// describe returns the path of the file f, if we can find it.
+func (o *openFilesNodeType) describe(f phantomfile.DownloaderUploader) string {
+	n, ok := f.(*node)
+	if !ok {
+		return f.String()
+	}
+	o.root.system.mu.Lock()
+	p := n.path()
+	o.root.system.mu.Unlock()
+	if p == "" {
+		return n.String()
+	}
+	return p
+}
+
+func ioSummary(h phantomfile.HandleStats) string {
+	return fmt.Sprintf("%d reads (%d bytes), %d writes (%d bytes)",
+		h.Reads, h.BytesRead, h.Writes, h.BytesWritten)
+}
+
+func (o *openFilesNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = openFilesIdx
+	a.Size = uint64(len(o.text()))
+	a.Mode = modeReadOnly
+
+	o.root.system.mu.Lock()
+	a.Ctime = o.root.serverStart
+	a.Crtime = o.root.serverStart
+	o.root.system.mu.Unlock()
+	a.Mtime = time.Now()
+
+	return nil
+}
+
+func (o *openFilesNodeType) ReadAll(ctx context.Context) (result []byte, err error) {
+	return []byte(o.text()), nil
+}
@@ -0,0 +1,555 @@
+package mntgdrive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// These are what Options is made of.  They live in internal packages,
+// so this is how programs outside this module name them.
+type (
+	// MountPoint says what to mount where.
+	MountPoint = config.Mount
+	// ExportFormat says what to export a kind of google docs file as.
+	ExportFormat = config.ExportFormat
+	// Rule says what to do with what is created in a folder.
+	Rule = config.Rule
+	// DriveOptions say how we talk to google.
+	DriveOptions = gdrive.Options
+)
+
+// Options says what Mount mounts and how.  Start from DefaultOptions,
+// which matches what we do when nothing is said on the command line or
+// in the config file.
+type Options struct {
+	// Mounts are what to mount where.  They share one pool of
+	// connections to google, and one limit on how fast we send
+	// requests, even when they are for different accounts.
+	Mounts []config.Mount
+	// Writeable lets programs change what is mounted.
+	Writeable bool
+	// StrictWriteable makes a writeable mount fail, rather than fall
+	// back to read-only, when we are only authorized to read.
+	StrictWriteable bool
+	// Trash mounts the trash, read-only, instead of the drive.
+	Trash bool
+	// DryRun mounts writeable, but only logs the changes programs make
+	// instead of sending them to google, which never sees them.
+	DryRun bool
+	// ExportFormats say what to export each kind of google docs file
+	// (and similar) as, overriding the defaults.
+	ExportFormats map[string]config.ExportFormat
+	// Stubs presents google docs files (and similar) as small stub
+	// files that link to them, like Drive File Stream does, instead of
+	// exporting them.
+	Stubs bool
+	// ExportZip puts the zip export of each google docs file (and
+	// similar) next to it, as "<name>.zip".
+	ExportZip bool
+	// StrictPOSIX makes us act like a posix filesystem wherever we
+	// can, e.g. for test suites, at some cost in requests to google.
+	StrictPOSIX bool
+	// Spaces puts My Drive, what is shared with us, shared drives, the
+	// trash and recent files side by side at the top of the mount.
+	Spaces bool
+	// AllowOther lets users other than the one who mounted see the
+	// mount.  The system has to allow that (user_allow_other in
+	// /etc/fuse.conf).
+	AllowOther bool
+	// AuditLog, if set, is a file we add a line to each time someone
+	// closes a file they read, saying who they were and how much they
+	// read.  It needs AllowOther, since otherwise it is always us.
+	AuditLog string
+
+	// Drive says how we talk to google.  Readonly follows Writeable,
+	// SharedDriveID comes from each mount and so does Profile, for
+	// mounts that have one.
+	Drive gdrive.Options
+	// Service, if set, is used for every mount instead of connecting
+	// to google, e.g. to mount a fake drive.
+	Service gdrive.DriveLike
+
+	// CacheDir is where we keep local copies of file content.  Empty
+	// means the system temp dir.
+	CacheDir string
+	// CacheSizeMB is how much space we try to stay under in CacheDir.
+	// Zero means no limit.
+	CacheSizeMB int64
+	// CacheQuotasMB limits how much of the cache each top-level folder
+	// may use.  Open files count against it, but only files downloaded
+	// ahead of time are thrown away to stay under it.
+	CacheQuotasMB map[string]int64
+
+	// ReadonlyPaths are folders, relative to the top of each mount,
+	// that we never change.
+	ReadonlyPaths []string
+	// Rules say what to do with files and folders created in
+	// particular places.
+	Rules []config.Rule
+	// Excludes are name patterns for files and folders we hide, along
+	// with everything below them.  See checkExcludes.
+	Excludes []string
+	// Owners maps the email addresses of people who own files we show
+	// to the local uids we report as those files' owners.
+	Owners map[string]uint32
+
+	// VolumeName and VolumeIcon apply to mounts that don't have their
+	// own.
+	VolumeName string
+	VolumeIcon string
+
+	// Prefetch is how many files to download ahead of a program that
+	// opens the files in a folder one after another.  Zero turns that
+	// off.
+	Prefetch int
+	// MetadataDelay, if set, is how often we send renames and moves to
+	// drive in a batch.  Zero sends each one right away.
+	MetadataDelay time.Duration
+	// RefreshAfter is how long we go without hearing from the change
+	// feed before re-fetching metadata as files are statted.  Zero
+	// turns that off.
+	RefreshAfter time.Duration
+	// UploadSpacing is the least time we leave between uploads of the
+	// same file, so drive doesn't turn down revisions that come too
+	// quickly.
+	UploadSpacing time.Duration
+	// InteractiveRetryBudget is how long requests made for file system
+	// operations keep trying again after transient errors.  Other
+	// requests use Drive.RetryBudget.
+	InteractiveRetryBudget time.Duration
+
+	// RemountRetries is how many times in a row we mount again if a
+	// mount goes away on its own.  RemountBackoff is how long we wait
+	// before the first try; it doubles with each one after that.
+	RemountRetries int
+	RemountBackoff time.Duration
+
+	// Hooks, if set, hears about what each mount does.
+	Hooks Hooks
+
+	// Ready, if set, is called once every mount is ready, or with an
+	// error as soon as one fails.
+	Ready func(error)
+}
+
+// DefaultOptions returns the options we use when nothing else is said.
+// Callers need to fill in Mounts.
+func DefaultOptions() Options {
+	return Options{
+		Drive:                  gdrive.Options{ListCacheTTL: gdrive.DefaultListCacheTTL, StallTimeout: gdrive.DefaultStallTimeout, TokenRefreshEarly: gdrive.DefaultTokenRefreshEarly, RetryBudget: gdrive.DefaultRetryBudget},
+		VolumeName:             defaultVolumeName,
+		Prefetch:               defaultPrefetch,
+		RefreshAfter:           defaultRefreshAfter,
+		UploadSpacing:          phantomfile.DefaultUploadSpacing,
+		InteractiveRetryBudget: gdrive.DefaultInteractiveRetryBudget,
+		RemountBackoff:         time.Second}
+}
+
+// Validate checks that opts make sense together.  Mount does too.
+func (opts *Options) Validate() error {
+	if len(opts.Mounts) == 0 {
+		return errors.New("nothing to mount")
+	}
+	if opts.Trash && (opts.Writeable || opts.DryRun) {
+		return errors.New("the trash is always mounted read-only")
+	}
+	if opts.Trash && opts.Spaces {
+		return errors.New("mount the trash or every space, not both")
+	}
+	if opts.AuditLog != "" && !opts.AllowOther {
+		return errors.New("an audit log only makes sense when other users can see the mount")
+	}
+	for kind, f := range opts.ExportFormats {
+		if kind == "" || strings.Contains(kind, "/") {
+			return fmt.Errorf("export format for %q: kinds are like document or spreadsheet", kind)
+		}
+		if f.MimeType == "" {
+			return fmt.Errorf("export format for %s: mimeType is required", kind)
+		}
+		if strings.Contains(f.Extension, "/") {
+			return fmt.Errorf("export format for %s: extension %q can't contain a slash", kind, f.Extension)
+		}
+	}
+	if err := checkExcludes(opts.Excludes); err != nil {
+		return err
+	}
+	for _, m := range opts.Mounts {
+		if m.Mountpoint == "" {
+			return errors.New("every mount needs a mount point")
+		}
+		if err := gdrive.CheckProfile(m.Profile); err != nil {
+			return fmt.Errorf("mount of %s: %v", m.Mountpoint, err)
+		}
+		if m.RootFolderID != "" && m.RootFolder != "" {
+			return fmt.Errorf("mount of %s: specify at most one of rootFolderId and rootFolder", m.Mountpoint)
+		}
+		if opts.Spaces && (m.RootFolderID != "" || m.RootFolder != "" || m.SharedDriveID != "") {
+			return fmt.Errorf("mount of %s: spaces mount the whole account, so can't have a root folder or shared drive", m.Mountpoint)
+		}
+	}
+	switch {
+	case opts.Prefetch < 0:
+		return errors.New("prefetch can't be negative")
+	case opts.MetadataDelay < 0, opts.RefreshAfter < 0, opts.UploadSpacing < 0, opts.RemountBackoff < 0:
+		return errors.New("delays can't be negative")
+	case opts.RemountRetries < 0:
+		return errors.New("remount retries can't be negative")
+	case opts.InteractiveRetryBudget < 0, opts.Drive.RetryBudget < 0:
+		return errors.New("retry budgets can't be negative")
+	}
+	return nil
+}
+
+// Mount mounts everything opts asks for and serves it until it is all
+// unmounted.
+func Mount(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	askedReadonly := !opts.Writeable && !opts.DryRun
+	// a dry run never changes anything, so reading is all it needs
+	opts.Drive.Readonly = !opts.Writeable
+
+	if err := CheckCacheDir(opts.CacheDir, opts.CacheSizeMB); err != nil {
+		return err
+	}
+	phantomfile.SetTempDir(opts.CacheDir)
+	if removed, freed, err := phantomfile.RemoveOrphans(); err != nil {
+		logging.Warnf("Unable to look for orphaned local copies: %v", err)
+	} else if removed > 0 {
+		logging.Infof("Removed %d local copies (%dMB) left behind by an earlier run", removed, freed>>20)
+	}
+	phantomfile.SetCacheSize(opts.CacheSizeMB << 20)
+	for folder, mb := range opts.CacheQuotasMB {
+		phantomfile.SetCacheQuota(strings.Trim(folder, "/"), mb<<20)
+	}
+	phantomfile.SetUploadSpacing(opts.UploadSpacing)
+
+	var audit *auditLog
+	if opts.AuditLog != "" {
+		var f *os.File
+		var err error
+		if audit, f, err = openAuditLog(opts.AuditLog); err != nil {
+			return fmt.Errorf("Unable to open audit log: %v", err)
+		}
+		defer f.Close()
+	}
+
+	var pool *gdrive.Pool
+	if opts.Service == nil {
+		var err error
+		if pool, err = gdrive.NewPool(opts.Drive); err != nil {
+			return err
+		}
+	}
+	accounts := map[accountKey]*mountAccount{}
+
+	systems := make([]*system, len(opts.Mounts))
+	mountOptions := make([][]fuse.MountOption, len(opts.Mounts))
+	for i, m := range opts.Mounts {
+		gd := opts.Service
+		var acct *mountAccount
+		readonly := askedReadonly
+		if gd == nil {
+			mopts := mountDriveOptions(m, opts.Drive)
+			key := accountKey{mopts.Profile, mopts.ProxyURL, mopts.CABundle}
+			acct = accounts[key]
+			if acct == nil {
+				var err error
+				if acct, err = connectAccount(pool, mopts, opts); err != nil {
+					return err
+				}
+				accounts[key] = acct
+			}
+			readonly = readonly || acct.readonly
+			mopts.SharedDriveID = m.SharedDriveID
+			var err error
+			if gd, err = acct.conn.Service(mopts); err != nil {
+				return err
+			}
+		}
+		if opts.DryRun {
+			gd = gdrive.NewDryRun(gd)
+		}
+
+		// The root folder of a shared drive has the same id as the drive
+		rootFolderID := "root"
+		if m.SharedDriveID != "" {
+			rootFolderID = m.SharedDriveID
+		}
+		switch {
+		case m.RootFolderID != "":
+			rootFolderID = m.RootFolderID
+		case m.RootFolder != "":
+			var err error
+			rootFolderID, err = gdrive.FindFolder(context.Background(), gd, rootFolderID, m.RootFolder)
+			if err != nil {
+				return fmt.Errorf("Unable to find root folder %q: %v", m.RootFolder, err)
+			}
+		}
+
+		name := volumeName(m, opts.VolumeName)
+		var email string
+		if acct != nil && strings.Contains(name, "{email}") {
+			var err error
+			if email, err = acct.email(); err != nil {
+				return fmt.Errorf("Unable to find the account's email address for the volume name: %v", err)
+			}
+		}
+		if strings.Contains(name, "{root}") {
+			root := "My Drive"
+			if rootFolderID != "root" {
+				g, err := gd.FetchNode(context.Background(), rootFolderID)
+				if err != nil {
+					return fmt.Errorf("Unable to find the name of %s for the volume name: %v", rootFolderID, err)
+				}
+				root = g.Name
+			}
+			name = expandVolumeName(name, email, root)
+		} else {
+			name = expandVolumeName(name, email, "")
+		}
+		mountOptions[i] = []fuse.MountOption{
+			fuse.FSName("mntgdrive:" + name),
+			fuse.Subtype("mntgrdrivefs"),
+			fuse.LocalVolume(),
+			fuse.VolumeName(name),
+		}
+		if readonly {
+			mountOptions[i] = append(mountOptions[i], fuse.ReadOnly())
+		}
+		if opts.AllowOther {
+			mountOptions[i] = append(mountOptions[i], fuse.AllowOther())
+		}
+		icon, err := volumeIcon(m, opts.VolumeIcon)
+		if err != nil {
+			return err
+		}
+
+		system := newSystem(gd, nil, readonly)
+		system.rootFolderID = rootFolderID
+		system.refreshAfter = opts.RefreshAfter
+		system.others = opts.Drive.Others
+		system.readonlyPaths = cleanPaths(opts.ReadonlyPaths)
+		system.rules = cleanRules(opts.Rules)
+		system.excludes = opts.Excludes
+		system.owners = ownerUids(opts.Owners)
+		system.trash = opts.Trash
+		system.exportZip = opts.ExportZip
+		system.exportFormats = exportFormats(opts.ExportFormats)
+		system.stubs = opts.Stubs
+		system.strictPOSIX = opts.StrictPOSIX
+		system.spaces = opts.Spaces
+		system.audit = audit
+		system.appData = opts.Drive.AppData
+		system.prefetchCount = opts.Prefetch
+		system.interactiveRetryBudget = opts.InteractiveRetryBudget
+		if acct != nil {
+			system.account = acct.conn
+		}
+		system.mountConfig = newMountConfig(opts, m, rootFolderID, name, readonly)
+		system.metadataDelay = opts.MetadataDelay
+		system.volumeIcon = icon
+		if opts.Hooks != nil {
+			system.hooks = opts.Hooks
+		}
+		system.mountpoint = m.Mountpoint
+		system.profile = profileOf(m, opts.Drive)
+		system.listenForControl(m.Mountpoint)
+		if system.ctl != nil {
+			defer system.ctl.Close()
+		}
+		systems[i] = system
+	}
+
+	if !opts.DryRun {
+		// each change goes up through the account that made it
+		gds := map[string]gdrive.DriveLike{}
+		for _, sys := range systems {
+			if _, ok := gds[sys.profile]; !ok && !sys.readonly {
+				gds[sys.profile] = sys.gd
+			}
+		}
+		if len(gds) > 0 {
+			replayJournals(context.Background(), gds)
+		}
+	}
+
+	ready := &readyGroup{waiting: len(systems), notify: opts.Ready}
+	errs := make([]error, len(systems))
+	var wg sync.WaitGroup
+	for i, sys := range systems {
+		// the closures below each need their own
+		sys := sys
+		mountpoint := opts.Mounts[i].Mountpoint
+		if !opts.Trash {
+			sys.goBackground(sys.watchForChanges)
+		}
+		if sys.metadataDelay > 0 {
+			sys.goBackground(sys.sendMetadataPeriodically)
+		}
+		sys.goBackground(func() { sys.shutdownOnSignal(mountpoint) })
+		wg.Add(1)
+		go func(i int, sys *system) {
+			defer wg.Done()
+			errs[i] = sys.run(mountpoint, mountOptions[i], opts.RemountRetries, opts.RemountBackoff, ready.ready)
+			if errs[i] != nil && !ready.succeeded() {
+				// we aren't going to be of any use, so say so, and
+				// don't leave the other mounts behind
+				ready.ready(errs[i])
+				for j, other := range systems {
+					other.stopWatching()
+					fuse.Unmount(opts.Mounts[j].Mountpoint)
+				}
+			}
+		}(i, sys)
+	}
+	wg.Wait()
+	for _, sys := range systems {
+		sys.stopWatching()
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("Mount of %s: %v", opts.Mounts[i].Mountpoint, err)
+		}
+	}
+	return nil
+}
+
+// mountAccount is a google account that one or more mounts use.
+type mountAccount struct {
+	conn *gdrive.Connection
+	// set when we were asked to mount writeable but the account is
+	// only authorized to read
+	readonly bool
+
+	emailOnce sync.Once
+	address   string
+	emailErr  error
+}
+
+// profileOf returns the profile of the account m mounts, which is the
+// one drive names unless m names its own.
+func profileOf(m config.Mount, drive gdrive.Options) string {
+	if m.Profile != "" {
+		return m.Profile
+	}
+	return drive.Profile
+}
+
+// mountDriveOptions returns drive with what m says about the account
+// and how to reach google in place of what drive says.
+func mountDriveOptions(m config.Mount, drive gdrive.Options) gdrive.Options {
+	drive.Profile = profileOf(m, drive)
+	if m.Proxy != "" {
+		drive.ProxyURL = m.Proxy
+	}
+	if m.CABundle != "" {
+		drive.CABundle = m.CABundle
+	}
+	return drive
+}
+
+// accountKey says which mounts can share a connection: those using the
+// same account in the same way.
+type accountKey struct {
+	profile  string
+	proxyURL string
+	caBundle string
+}
+
+// connectAccount connects to the account drive names, in pool, and
+// checks that it can make changes if opts asks for that.
+func connectAccount(pool *gdrive.Pool, drive gdrive.Options, opts Options) (*mountAccount, error) {
+	conn, err := pool.Connect(drive)
+	if err != nil {
+		return nil, err
+	}
+	acct := &mountAccount{conn: conn}
+	if opts.Writeable && !opts.DryRun {
+		canWrite, err := conn.CanWrite(context.Background())
+		if acct.readonly, err = fallBackToReadonly(canWrite, err, opts.StrictWriteable); err != nil {
+			return nil, err
+		}
+	}
+	return acct, nil
+}
+
+// email returns the account's email address, asking google the first
+// time.
+func (a *mountAccount) email() (string, error) {
+	a.emailOnce.Do(func() {
+		a.address, a.emailErr = a.conn.UserEmail(context.Background())
+	})
+	return a.address, a.emailErr
+}
+
+// fallBackToReadonly decides whether a writeable mount has to be
+// read-only after all, given whether we are authorized to make changes
+// (or why we couldn't find out).  When strict, we fail instead.
+func fallBackToReadonly(canWrite bool, checkErr error, strict bool) (bool, error) {
+	switch {
+	case checkErr != nil:
+		logging.Warnf("Unable to check that we are authorized to make changes, mounting writeable anyway: %v", checkErr)
+		return false, nil
+	case canWrite:
+		return false, nil
+	case strict:
+		return true, errors.New("Asked for a writeable mount, but we are only authorized to read.  Run 'mnt-gdrive setup' and say yes to writeable mode.")
+	default:
+		logging.Warnf("*** Asked for a writeable mount, but we are only authorized to read, so mounting READ-ONLY.  Run 'mnt-gdrive setup' and say yes to writeable mode to fix that. ***")
+		return true, nil
+	}
+}
+
+// ConfigOptions returns the default options, adjusted by what the
+// config file says.
+func ConfigOptions() (Options, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return Options{}, err
+	}
+	return optionsFromConfig(cfg), nil
+}
+
+// optionsFromConfig returns the default options, adjusted by what cfg
+// says.
+func optionsFromConfig(cfg *config.Config) Options {
+	opts := DefaultOptions()
+	opts.Mounts = cfg.Mounts
+	opts.CacheDir = cfg.CacheDir
+	opts.CacheSizeMB = cfg.CacheSizeMB
+	opts.CacheQuotasMB = cfg.CacheQuotasMB
+	opts.ReadonlyPaths = cfg.ReadonlyPaths
+	opts.Rules = cfg.Rules
+	opts.Excludes = cfg.Excludes
+	opts.Owners = cfg.Owners
+	opts.ExportFormats = cfg.ExportFormats
+	return opts
+}
+
+// exportFormats returns the default export formats, with those in
+// overrides, which are by kind, taking their place.
+func exportFormats(overrides map[string]config.ExportFormat) map[string]gdrive.ExportFormat {
+	formats := gdrive.DefaultExportFormats()
+	for kind, f := range overrides {
+		ext := f.Extension
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		formats[gdrive.GoogleMimeType(kind)] = gdrive.ExportFormat{MimeType: f.MimeType, Extension: ext}
+	}
+	return formats
+}
@@ -0,0 +1,202 @@
+package mntgdrive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/fakedrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+
+	"bazil.org/fuse"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		adjust func(*Options)
+		valid  bool
+	}{
+		{"defaults", func(o *Options) {}, true},
+		{"nothing to mount", func(o *Options) { o.Mounts = nil }, false},
+		{"no mount point", func(o *Options) { o.Mounts[0].Mountpoint = "" }, false},
+		{"two roots", func(o *Options) {
+			o.Mounts[0].RootFolder = "Projects"
+			o.Mounts[0].RootFolderID = "0B..."
+		}, false},
+		{"writeable trash", func(o *Options) {
+			o.Trash = true
+			o.Writeable = true
+		}, false},
+		{"dry run of the trash", func(o *Options) {
+			o.Trash = true
+			o.DryRun = true
+		}, false},
+		{"spaces", func(o *Options) { o.Spaces = true }, true},
+		{"spaces and the trash", func(o *Options) {
+			o.Spaces = true
+			o.Trash = true
+		}, false},
+		{"spaces of a shared drive", func(o *Options) {
+			o.Spaces = true
+			o.Mounts[0].SharedDriveID = "0A..."
+		}, false},
+		{"audit log", func(o *Options) {
+			o.AllowOther = true
+			o.AuditLog = "/var/log/mnt-gdrive-audit"
+		}, true},
+		{"audit log without allow other", func(o *Options) { o.AuditLog = "/var/log/mnt-gdrive-audit" }, false},
+		{"negative prefetch", func(o *Options) { o.Prefetch = -1 }, false},
+		{"negative delay", func(o *Options) { o.MetadataDelay = -time.Second }, false},
+		{"export format", func(o *Options) {
+			o.ExportFormats = map[string]config.ExportFormat{"document": {MimeType: "application/vnd.oasis.opendocument.text", Extension: ".odt"}}
+		}, true},
+		{"export format without a mime type", func(o *Options) {
+			o.ExportFormats = map[string]config.ExportFormat{"document": {Extension: ".odt"}}
+		}, false},
+		{"export format for a mime type", func(o *Options) {
+			o.ExportFormats = map[string]config.ExportFormat{"application/vnd.google-apps.document": {MimeType: "text/plain"}}
+		}, false},
+		{"excludes", func(o *Options) { o.Excludes = []string{"*.iso", "node_modules/"} }, true},
+		{"exclude with a path", func(o *Options) { o.Excludes = []string{"a/b"} }, false},
+		{"bad exclude", func(o *Options) { o.Excludes = []string{"[a"} }, false},
+	}
+	for _, tc := range tests {
+		opts := DefaultOptions()
+		opts.Mounts = []config.Mount{{Mountpoint: "/tmp/mnt"}}
+		tc.adjust(&opts)
+		err := opts.Validate()
+		assert(t, (err == nil) == tc.valid, "%s: got %v", tc.name, err)
+	}
+}
+
+func TestMount(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mntgd-mount-")
+	ok(t, err)
+	defer os.RemoveAll(tmp)
+	mountpoint := filepath.Join(tmp, "mnt")
+	ok(t, os.Mkdir(mountpoint, 0700))
+
+	ready := make(chan error, 1)
+	opts := DefaultOptions()
+	opts.Mounts = []config.Mount{{Mountpoint: mountpoint}}
+	opts.Service = fakedrive.NewDrive(allNodes())
+	opts.CacheDir = tmp
+	opts.Ready = func(err error) { ready <- err }
+	done := make(chan error, 1)
+	go func() { done <- Mount(opts) }()
+
+	select {
+	case err = <-ready:
+		ok(t, err)
+	case err = <-done:
+		t.Fatalf("Mount returned %v before it was ready", err)
+	}
+	fi, err := os.Stat(filepath.Join(mountpoint, "dir two", "file two"))
+	ok(t, err)
+	assert(t, fi.Mode().IsRegular(), "file two is %v", fi.Mode())
+
+	ok(t, fuse.Unmount(mountpoint))
+	ok(t, <-done)
+}
+
+func TestMountsShutDownOnSignal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mntgd-mount-")
+	ok(t, err)
+	defer os.RemoveAll(tmp)
+	var mountpoints []string
+	for _, name := range []string{"one", "two"} {
+		mountpoint := filepath.Join(tmp, name)
+		ok(t, os.Mkdir(mountpoint, 0700))
+		mountpoints = append(mountpoints, mountpoint)
+	}
+
+	// uploads fail at first, so the changes below wait for a retry,
+	// and only get to drive sooner if each mount flushes its own
+	// files when told to stop
+	fake := &failingUploadDrive{Drive: fakedrive.NewDrive(allNodes()), failing: 1}
+	ready := make(chan error, 1)
+	opts := DefaultOptions()
+	opts.Mounts = []config.Mount{{Mountpoint: mountpoints[0]}, {Mountpoint: mountpoints[1]}}
+	opts.Service = fake
+	opts.CacheDir = tmp
+	opts.Writeable = true
+	opts.Ready = func(err error) { ready <- err }
+	// a system that never hears the signal takes its unmount for a
+	// lost mount, and waits to mount again instead of returning
+	opts.RemountRetries = 1
+	opts.RemountBackoff = time.Minute
+	done := make(chan error, 1)
+	go func() { done <- Mount(opts) }()
+
+	select {
+	case err = <-ready:
+		ok(t, err)
+	case err = <-done:
+		t.Fatalf("Mount returned %v before it was ready", err)
+	}
+
+	for i, name := range []string{"file one", "dir two/file two"} {
+		err := ioutil.WriteFile(filepath.Join(mountpoints[i], name), []byte("CONTENT"), 0)
+		assert(t, err != nil, "expected the upload of %s to fail", name)
+	}
+	atomic.StoreInt32(&fake.failing, 0)
+
+	ok(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	// well before the first retry
+	deadline := time.Now().Add(3 * time.Second)
+	for _, id := range []string{"file_one_id", "file_two_id"} {
+		for downloadString(t, fake.Drive, id) != "CONTENT" {
+			assert(t, time.Now().Before(deadline), "%s wasn't uploaded on the way out", id)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	select {
+	case err = <-done:
+		ok(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Mount never returned")
+	}
+	for _, mountpoint := range mountpoints {
+		mounted, err := ioutil.ReadFile("/proc/self/mounts")
+		ok(t, err)
+		assert(t, !strings.Contains(string(mounted), " "+mountpoint+" "), "%s is still mounted", mountpoint)
+	}
+}
+
+func TestFallBackToReadonly(t *testing.T) {
+	readonly, err := fallBackToReadonly(true, nil, true)
+	ok(t, err)
+	assert(t, !readonly, "read-only although we may write")
+
+	readonly, err = fallBackToReadonly(false, nil, false)
+	ok(t, err)
+	assert(t, readonly, "writeable although we may only read")
+
+	_, err = fallBackToReadonly(false, nil, true)
+	assert(t, err != nil, "expected strict mode to fail")
+
+	readonly, err = fallBackToReadonly(false, errors.New("no network"), true)
+	ok(t, err)
+	assert(t, !readonly, "read-only although we couldn't check")
+}
+
+func TestMountDriveOptions(t *testing.T) {
+	drive := gdrive.Options{Profile: "work", ProxyURL: "http://proxy.example.com:3128", CABundle: "/etc/work.pem"}
+
+	got := mountDriveOptions(config.Mount{Mountpoint: "/mnt/work"}, drive)
+	equals(t, drive, got)
+
+	got = mountDriveOptions(config.Mount{Mountpoint: "/mnt/home", Profile: "home", Proxy: "http://home.example.com:8080", CABundle: "/etc/home.pem"}, drive)
+	equals(t, "home", got.Profile)
+	equals(t, "http://home.example.com:8080", got.ProxyURL)
+	equals(t, "/etc/home.pem", got.CABundle)
+}
@@ -0,0 +1,27 @@
+package mntgdrive
+
+import "strings"
+
+// ownerUids returns owners, which maps google account email addresses
+// to local uids, keyed by lower case address, as google ignores case.
+func ownerUids(owners map[string]uint32) map[string]uint32 {
+	if len(owners) == 0 {
+		return nil
+	}
+	uids := make(map[string]uint32, len(owners))
+	for email, uid := range owners {
+		uids[strings.ToLower(email)] = uid
+	}
+	return uids
+}
+
+// ownerUidLocked returns the local uid of whoever owns n in drive, if
+// it isn't us and the config file says who they are here.  Assumes we
+// have n.mu.
+func (n *node) ownerUidLocked() (uint32, bool) {
+	if n.mine || n.owner == "" {
+		return 0, false
+	}
+	uid, ok := n.owners[strings.ToLower(n.owner)]
+	return uid, ok
+}
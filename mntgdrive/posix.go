@@ -0,0 +1,131 @@
+package mntgdrive
+
+import (
+	"sort"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// With --strict-posix we pretend drive behaves like a posix
+// filesystem, at some cost, so test suites that expect one pass:
+//
+//   - creating with O_EXCL, or making a folder, fails with EEXIST when
+//     the name is taken, rather than making a second file by that name
+//   - rename replaces whatever had the new name, moving it to the trash
+//   - folders list in name order
+//   - errors are the ones posix gives, e.g. EROFS rather than ENOTSUP
+//   - folders' modified times change when what is in them does
+//
+// Locks need nothing from us; the kernel keeps them itself when we
+// don't handle them.
+
+// readonlyErr is what we fail changes to a readonly filesystem with.
+func (s *system) readonlyErr() error {
+	if s.strictPOSIX {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return fuse.ENOTSUP
+}
+
+// notDirErr is what we fail asking a file to do what only folders can
+// with.
+func (s *system) notDirErr() error {
+	if s.strictPOSIX {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	return fuse.ENOTSUP
+}
+
+// checkNameFree fails with EEXIST if n already has a child called name
+// and we are being strict.  Assumes loadChildrenIfEmpty was called.
+func (n *node) checkNameFree(name string) error {
+	if !n.strictPOSIX {
+		return nil
+	}
+	if c, _ := n.findChild(name); c != nil {
+		return fuse.EEXIST
+	}
+	return nil
+}
+
+// checkRemove fails if posix wouldn't let us remove child with
+// rmdir (when dir is set) or unlink.
+func (n *node) checkRemove(ctx context.Context, child *node, dir bool) error {
+	if !n.strictPOSIX {
+		return nil
+	}
+	switch {
+	case dir && !child.dir:
+		return fuse.Errno(syscall.ENOTDIR)
+	case !dir && child.dir:
+		return fuse.Errno(syscall.EISDIR)
+	case dir:
+		return checkEmpty(ctx, child)
+	}
+	return nil
+}
+
+// replacedBy returns what moving the file or folder (as dir says) with
+// id to newName in n would replace, if anything, or fails the way posix
+// rename would.  We only replace when being strict.
+func (n *node) replacedBy(ctx context.Context, id string, dir bool, newName string) (*node, error) {
+	if !n.strictPOSIX {
+		return nil, nil
+	}
+	if err := n.loadChildrenIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+	old, _ := n.findChild(newName)
+	if old == nil || old.id == id {
+		return nil, nil
+	}
+	if !old.isTrashable() {
+		return nil, fuse.EPERM
+	}
+	switch {
+	case dir && !old.dir:
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	case !dir && old.dir:
+		return nil, fuse.Errno(syscall.EISDIR)
+	case old.dir:
+		if err := checkEmpty(ctx, old); err != nil {
+			return nil, err
+		}
+	}
+	return old, nil
+}
+
+func checkEmpty(ctx context.Context, dir *node) error {
+	if err := dir.loadChildrenIfEmpty(ctx); err != nil {
+		return err
+	}
+	dir.cmu.Lock()
+	defer dir.cmu.Unlock()
+	if len(dir.children)+len(dir.lazy) != 0 {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+	return nil
+}
+
+// touched notes that what is in n changed.  Drive doesn't change the
+// modified time of folders when that happens, so when being strict we
+// do it locally.
+func (n *node) touched() {
+	if !n.strictPOSIX {
+		return
+	}
+	n.mu.Lock()
+	n.mtime = time.Now()
+	n.mu.Unlock()
+}
+
+// sortDirents puts ds in name order when being strict, so listings are
+// the same from one read to the next.
+func (s *system) sortDirents(ds []fuse.Dirent) {
+	if s.strictPOSIX {
+		sort.Slice(ds, func(i, j int) bool { return ds[i].Name < ds[j].Name })
+	}
+}
@@ -0,0 +1,148 @@
+package mntgdrive
+
+import (
+	"sort"
+	"strings"
+)
+
+// we don't prefetch files bigger than this; they take long enough that
+// getting a head start isn't worth tying up the connection
+const maxPrefetchSize = 64 << 20
+
+// readSequence is the last file a process opened in a folder.
+type readSequence struct {
+	pid uint32
+	id  string
+}
+
+// prefetchSiblings is called when pid opens n for reading.  If the
+// last file pid opened in the same folder was the one just before n,
+// the process is probably working through the folder in order (e.g. a
+// music player or photo viewer), so we start downloading the next few
+// files.
+func (n *node) prefetchSiblings(pid uint32) {
+	if n.prefetchCount <= 0 {
+		return
+	}
+	n.mu.Lock()
+	var parent *node
+	for _, p := range n.parents {
+		parent = p
+		break
+	}
+	n.mu.Unlock()
+	if parent == nil {
+		return
+	}
+
+	// most opens aren't part of a sequence, so we check that before
+	// looking for n among its siblings
+	n.system.mu.Lock()
+	last, ok := n.sequences[parent.id]
+	n.sequences[parent.id] = readSequence{pid, n.id}
+	n.system.mu.Unlock()
+	if !ok || last.pid != pid {
+		return
+	}
+
+	parent.cmu.Lock()
+	siblings, position := parent.sortedChildren()
+	parent.cmu.Unlock()
+	i, ok := position[n.id]
+	j, lastOK := position[last.id]
+	if !ok || !lastOK || j >= i {
+		return
+	}
+	// we can't take a child's lock while holding cmu
+	for _, s := range siblings[j+1 : i] {
+		if !s.dir() {
+			return
+		}
+	}
+
+	group := n.CacheGroup()
+	count := 0
+	for _, s := range siblings[i+1:] {
+		if count == n.prefetchCount {
+			break
+		}
+		if s.dir() {
+			continue
+		}
+		size := s.size()
+		if size == 0 || size > maxPrefetchSize {
+			continue
+		}
+		c := s.n
+		if c == nil {
+			c = parent.made(s.lc)
+		}
+		c.content().Prefetch(group, int64(size))
+		count++
+	}
+}
+
+// CacheGroup returns the top-level folder n is in, whose cache quota
+// its local copies count against, or "" if it is at the top.
+func (n *node) CacheGroup() string {
+	n.system.mu.Lock()
+	p := n.path()
+	n.system.mu.Unlock()
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// sibling is a child of a folder we are prefetching from.  Exactly one
+// of n and lc is set, depending on whether we had made its node when
+// we put the folder in order.
+type sibling struct {
+	id   string
+	name string
+	n    *node
+	lc   *lazyChild
+}
+
+func (s sibling) dir() bool {
+	if s.n == nil {
+		return s.lc.g.Dir()
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	return s.n.dir
+}
+
+func (s sibling) size() uint64 {
+	if s.n == nil {
+		return s.lc.g.Size
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	return s.n.size
+}
+
+// sortedChildren returns n's children, files and folders, in the order
+// ls would list them, and where each id is in that order.  Putting
+// them in order costs a sort of every child, so we keep the result
+// until a child changes.  Callers mustn't change what it returns.
+// Assumes we have the children lock.
+func (n *node) sortedChildren() ([]sibling, map[string]int) {
+	if n.sorted == nil {
+		names := n.childNames()
+		sorted := make([]sibling, 0, len(names))
+		for id, c := range n.children {
+			sorted = append(sorted, sibling{id: id, name: names[id], n: c})
+		}
+		for id, lc := range n.lazy {
+			sorted = append(sorted, sibling{id: id, name: names[id], lc: lc})
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+		position := make(map[string]int, len(sorted))
+		for i, s := range sorted {
+			position[s.id] = i
+		}
+		n.sorted, n.position = sorted, position
+	}
+	return n.sorted, n.position
+}
@@ -0,0 +1,105 @@
+package mntgdrive
+
+import (
+	"path"
+	"strings"
+)
+
+// cleanPaths puts paths from the config file into the form that
+// node.path returns: relative, with no leading or trailing slashes.
+// Paths that refer to the root itself are dropped; use a readonly
+// mount for that.
+func cleanPaths(paths []string) []string {
+	var cleaned []string
+	for _, p := range paths {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if p != "" {
+			cleaned = append(cleaned, p)
+		}
+	}
+	return cleaned
+}
+
+// overlapsAny returns true if p is one of dirs, is below one of them or
+// has one of them below it.  Moving p, or moving something to p, then
+// changes what is in a readonly path.
+func overlapsAny(p string, dirs []string) bool {
+	if p == "" {
+		return false
+	}
+	for _, d := range dirs {
+		if p == d || strings.HasPrefix(p, d+"/") || strings.HasPrefix(d, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// underAny returns true if p is one of dirs or is below one of them.
+func underAny(p string, dirs []string) bool {
+	if p == "" {
+		return false
+	}
+	for _, d := range dirs {
+		if p == d || strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mountPath is like path, but relative to the top of the mount rather
+// than of our system, which is different for subsystems.  Assumes we
+// already have the system lock.
+func (n *node) mountPath() string {
+	return n.inMount(n.path())
+}
+
+// mountPaths is like paths, as mountPath is like path.  Assumes we
+// already have the system lock.
+func (n *node) mountPaths() []string {
+	ps := n.paths()
+	for i, p := range ps {
+		ps[i] = n.inMount(p)
+	}
+	return ps
+}
+
+// inMount turns p, relative to the top of our system, into a path
+// relative to the top of the mount.
+func (n *node) inMount(p string) string {
+	if n.mountPrefix == "" {
+		return p
+	}
+	return path.Join(n.mountPrefix, p)
+}
+
+// renameTouchesReadonly returns true if renaming oldName in n to
+// newName in target would move something into, out of or within one of
+// our readonly paths, or move one of them.  We check the paths at both
+// ends, as well as the nodes, because the new name may itself be a
+// readonly path, and a folder being moved may hold one.  Folders in
+// several places are checked at each of them.
+func (n *node) renameTouchesReadonly(target *node, oldName, newName string) bool {
+	if len(n.readonlyPaths) == 0 {
+		return false
+	}
+	return n.nameTouchesReadonly(oldName) || target.nameTouchesReadonly(newName)
+}
+
+// nameTouchesReadonly returns true if name in n, by any of n's paths,
+// is in one of our readonly paths or holds one.
+func (n *node) nameTouchesReadonly(name string) bool {
+	if len(n.readonlyPaths) == 0 {
+		return false
+	}
+	n.system.mu.Lock()
+	ps := n.mountPaths()
+	n.system.mu.Unlock()
+	for _, p := range ps {
+		if overlapsAny(path.Join(p, name), n.readonlyPaths) {
+			return true
+		}
+	}
+	return false
+}
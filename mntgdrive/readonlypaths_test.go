@@ -0,0 +1,50 @@
+package mntgdrive
+
+import (
+	"testing"
+)
+
+func TestCleanPaths(t *testing.T) {
+	equals(t, []string{"Shared plans", "a/b"}, cleanPaths([]string{"/Shared plans/", "a//b/.", "/", ""}))
+	equals(t, []string(nil), cleanPaths(nil))
+}
+
+func TestUnderAny(t *testing.T) {
+	dirs := []string{"Shared plans", "a/b"}
+	for _, tc := range []struct {
+		p    string
+		want bool
+	}{
+		{"Shared plans", true},
+		{"Shared plans/notes.txt", true},
+		{"Shared plans again", false},
+		{"a", false},
+		{"a/b/c/d", true},
+		{"", false},
+	} {
+		if got := underAny(tc.p, dirs); got != tc.want {
+			t.Errorf("underAny(%q) = %t, want %t", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestOverlapsAny(t *testing.T) {
+	dirs := []string{"Shared plans", "a/b"}
+	for _, tc := range []struct {
+		p    string
+		want bool
+	}{
+		{"Shared plans", true},
+		{"Shared plans/notes.txt", true},
+		{"Shared plans again", false},
+		{"a", true},
+		{"a/c", false},
+		{"ab", false},
+		{"a/b/c/d", true},
+		{"", false},
+	} {
+		if got := overlapsAny(tc.p, dirs); got != tc.want {
+			t.Errorf("overlapsAny(%q) = %t, want %t", tc.p, got, tc.want)
+		}
+	}
+}
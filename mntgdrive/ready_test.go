@@ -0,0 +1,35 @@
+package mntgdrive
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadyGroup(t *testing.T) {
+	g := &readyGroup{waiting: 2}
+	g.ready(nil)
+	assert(t, !g.succeeded(), "ready after only one of two mounts")
+	g.ready(nil)
+	assert(t, g.succeeded(), "not ready after both mounts")
+
+	g = &readyGroup{waiting: 2}
+	g.ready(errors.New("boom"))
+	g.ready(nil)
+	g.ready(nil)
+	assert(t, !g.succeeded(), "ready in spite of a failed mount")
+}
+
+func TestFailStopsOnlyItsMount(t *testing.T) {
+	top := newSystem(nil, nil, false)
+	other := newSystem(nil, nil, false)
+	top.mu.Lock()
+	sub := top.newSubsystem(nil, "shared_drive_id")
+	top.mu.Unlock()
+
+	sub.fail(errors.New("boom"))
+	sub.fail(errors.New("later"))
+	assert(t, top.watching.Err() != nil, "mount still watching after its shared drive failed")
+	equals(t, "boom", top.failed().Error())
+	assert(t, other.watching.Err() == nil, "another mount stopped as well")
+	assert(t, other.failed() == nil, "another mount failed as well")
+}
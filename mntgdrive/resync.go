@@ -0,0 +1,132 @@
+package mntgdrive
+
+import (
+	"fmt"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// startResync starts a job that resyncs the folder at the path in
+// args, from the top of the mount, or the whole mount if there isn't
+// one.
+func (s *system) startResync(args []string) (*control.Job, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("resync takes at most one path")
+	}
+	root, err := s.rootNode()
+	if err != nil {
+		return nil, err
+	}
+	top := root
+	if len(args) == 1 {
+		if top, err = root.resolve(context.Background(), "/"+args[0]); err != nil {
+			return nil, fmt.Errorf("unable to find %s: %v", args[0], err)
+		}
+	}
+	return s.jobs.Start(s.watching, control.OpResync, args, func(ctx context.Context, j *control.Job) error {
+		return s.resync(ctx, j, top)
+	}), nil
+}
+
+// resync lists every folder below top that we have listed before
+// again, applying whatever it finds as though it came from the change
+// feed.  That catches us up on anything the feed missed.  Folders we
+// have never listed are left alone; we will list them when someone
+// looks.
+func (s *system) resync(ctx context.Context, j *control.Job, top *node) error {
+	var cs gdrive.ChangeStats
+	var done int64
+	todo := []*node{top}
+	for len(todo) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := todo[0]
+		todo = todo[1:]
+		if n.dir && n.haveChildren() {
+			if err := s.resyncFolder(ctx, n, &cs); err != nil {
+				return err
+			}
+			for _, c := range n.childList() {
+				if c.dir {
+					todo = append(todo, c)
+				}
+			}
+		}
+		done++
+		j.Progress(done, done+int64(len(todo)))
+	}
+	logging.Infof("Resynced %s: %s", top, cs.String())
+	return nil
+}
+
+// resyncFolder lists n again, applying anything that changed.
+func (s *system) resyncFolder(ctx context.Context, n *node, cs *gdrive.ChangeStats) error {
+	gs, err := s.gd.FetchChildren(ctx, n.id)
+	if err != nil {
+		return err
+	}
+	listed := map[string]bool{}
+	for _, g := range gs {
+		listed[g.ID] = true
+		s.resyncNode(g, cs)
+	}
+	// whatever we have that drive no longer lists has moved or gone
+	var ids []string
+	for _, c := range n.childList() {
+		ids = append(ids, c.id)
+	}
+	ids = append(ids, n.lazyIDs()...)
+	for _, id := range ids {
+		if listed[id] {
+			continue
+		}
+		g, err := s.gd.FetchNode(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			logging.Warnf("Resync unable to find out what happened to %s in %s: %v", id, n, err)
+			continue
+		}
+		s.resyncNode(g, cs)
+	}
+	return nil
+}
+
+// resyncNode applies g unless we already have that version of it, so
+// we don't throw away cached content that is still good.
+func (s *system) resyncNode(g *gdrive.Node, cs *gdrive.ChangeStats) {
+	s.mu.Lock()
+	n := s.getNodeIfExists(g.ID)
+	lc, lazy := s.lazyChildren[g.ID]
+	same := lazy && lc.g.Version == g.Version && !g.Trashed
+	s.mu.Unlock()
+	if same {
+		return
+	}
+	if n != nil {
+		n.mu.Lock()
+		same := n.version == g.Version && !g.Trashed
+		n.mu.Unlock()
+		if same {
+			return
+		}
+	}
+	s.processChange(&gdrive.Change{ID: g.ID, Node: g}, cs)
+}
+
+// childList returns n's children, in no particular order.
+func (n *node) childList() []*node {
+	n.cmu.Lock()
+	defer n.cmu.Unlock()
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	return children
+}
@@ -0,0 +1,195 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+var _ fs.NodeOpener = (*revisionNode)(nil)
+
+// revisionNode is a read-only file holding an old revision of a file.
+// We make them on demand when someone looks up "name@selector", where
+// selector is a revision id or a time like 2016-08-20T10:00, and name
+// is a file in the same directory.
+type revisionNode struct {
+	*system
+	idx index
+	of  *node
+	rev *gdrive.Revision
+	pf  *phantomfile.PhantomFile
+}
+
+// splitRevisionName splits "name@selector" into its parts.
+func splitRevisionName(name string) (base string, selector string, ok bool) {
+	i := strings.LastIndex(name, "@")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// lookupRevision returns the node for name, if it names a revision of
+// one of n's children.
+func (n *node) lookupRevision(ctx context.Context, name string) (*revisionNode, error) {
+	base, selector, ok := splitRevisionName(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	c, err := n.findChild(base)
+	if err != nil {
+		return nil, err
+	}
+	if c.dir {
+		return nil, fuse.ENOENT
+	}
+	revs, err := c.revisions(ctx)
+	if err != nil {
+		logging.Errorf("Unable to fetch revisions of %s: %v", c, err)
+		return nil, fuse.EIO
+	}
+	rev, err := gdrive.SelectRevision(revs, selector)
+	if err != nil {
+		logging.Debugf("Lookup of %q: %v", name, err)
+		return nil, fuse.ENOENT
+	}
+
+	return c.revision(rev), nil
+}
+
+// revision returns the node for revision rev of n.  We hand out the
+// same node for the same revision, so the kernel sees a stable inode.
+func (n *node) revision(rev *gdrive.Revision) *revisionNode {
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	revs := n.revisionNodes[n.id]
+	if revs == nil {
+		revs = map[string]*revisionNode{}
+		n.revisionNodes[n.id] = revs
+	}
+	r, ok := revs[rev.ID]
+	if !ok {
+		n.nextInode++
+		r = &revisionNode{system: n.system, idx: n.nextInode, of: n, rev: rev}
+		r.pf = phantomfile.NewPhantomFile(n.lifetime(), r)
+		revs[rev.ID] = r
+	}
+	return r
+}
+
+// revisions returns the revisions drive has of n.  We keep what it
+// says until n changes.
+func (n *node) revisions(ctx context.Context) ([]*gdrive.Revision, error) {
+	n.mu.Lock()
+	version := n.version
+	if n.revs != nil && n.revsVersion == version {
+		revs := n.revs
+		n.mu.Unlock()
+		return revs, nil
+	}
+	n.mu.Unlock()
+
+	revs, err := n.gd.FetchRevisions(ctx, n.id)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	if n.version == version {
+		n.revs, n.revsVersion = revs, version
+	}
+	n.mu.Unlock()
+	return revs, nil
+}
+
+// dropRevisions forgets the nodes we made for n's revisions, and for
+// its folder in the .revisions tree, now that n is gone.  Assumes we
+// have the system lock.
+func (s *system) dropRevisions(n *node) {
+	delete(s.revisionNodes, n.id)
+	delete(s.revisionsDirs, n.id)
+	for pid, r := range s.revisionsRead {
+		if r.of == n {
+			delete(s.revisionsRead, pid)
+		}
+	}
+}
+
+// noticeRestore checks whether pid, which is opening n for writing,
+// last read one of n's revisions.  If so, it is probably copying that
+// revision over n, and if that turns out to be all it writes, we
+// restore the revision rather than upload what was written.
+func (n *node) noticeRestore(ctx context.Context, pid uint32) {
+	n.system.mu.Lock()
+	r := n.revisionsRead[pid]
+	if r == nil || r.of != n {
+		n.system.mu.Unlock()
+		return
+	}
+	delete(n.revisionsRead, pid)
+	n.system.mu.Unlock()
+
+	logging.For(ctx).Debugf("Open: %s may be copying revision %s over %s", processName(pid), r.rev.ID, n)
+	n.mu.Lock()
+	n.restoreFrom = r.rev
+	n.mu.Unlock()
+}
+
+func (r *revisionNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(r.idx)
+	a.Size = r.rev.Size
+	a.Mtime = r.rev.ModifiedTime
+	a.Ctime = r.rev.ModifiedTime
+	a.Crtime = r.rev.ModifiedTime
+	a.Mode = modeReadOnly
+	return nil
+}
+
+func (r *revisionNode) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if xlateAccessMode(req.Flags) != phantomfile.ReadOnly {
+		return nil, fuse.EPERM
+	}
+	if r.audit == nil {
+		// revisions never change, so the kernel can keep what it
+		// has read
+		res.Flags |= fuse.OpenKeepCache
+	}
+	pid := processOf(req.Pid)
+	r.system.mu.Lock()
+	r.revisionsRead[pid] = r
+	r.system.mu.Unlock()
+	h, err := r.pf.Open(ctx, phantomfile.ReadOnly, phantomfile.ProactiveFetch, pid)
+	if err != nil {
+		return nil, err
+	}
+	return r.observed(r.audited(h, req, r.of.id, func() string { return r.of.mountPath() + "@" + r.rev.ID })), nil
+}
+
+func (r *revisionNode) Download(ctx context.Context, f *os.File) error {
+	return r.gd.DownloadRevision(ctx, r.of.id, r.rev.ID, f)
+}
+
+func (r *revisionNode) Upload(ctx context.Context, f *os.File) error {
+	return fuse.EPERM
+}
+
+func (r *revisionNode) ID() string {
+	return r.of.id
+}
+
+func (r *revisionNode) Name() string {
+	r.of.mu.Lock()
+	defer r.of.mu.Unlock()
+	return fmt.Sprintf("%s@%s", r.of.name, r.rev.ID)
+}
+
+func (r *revisionNode) String() string {
+	return fmt.Sprintf("%s@%s", r.of, r.rev.ID)
+}
@@ -0,0 +1,139 @@
+package mntgdrive
+
+import (
+	"os"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const revisionsName = ".revisions"
+
+// how we name each revision in a .revisions folder
+const revisionTimeFormat = "2006-01-02T15:04:05Z"
+
+var _ fs.HandleReadDirAller = (*revisionsDirNode)(nil)
+var _ fs.NodeStringLookuper = (*revisionsDirNode)(nil)
+
+// revisionsDirNode is a folder in the .revisions tree at the top of a
+// mount, which mirrors the rest of the mount.  Where the mount has a
+// folder, the tree has a folder with the same name; where the mount
+// has a file, the tree has a folder holding each of its old revisions,
+// named after when it was made, e.g.
+// .revisions/notes/todo.txt/2016-08-20T10:00:00Z.
+type revisionsDirNode struct {
+	*system
+	idx index
+	of  *node
+}
+
+// revisionsDir returns n's folder in the .revisions tree.  We hand out
+// the same node each time, so the kernel sees a stable inode.
+func (n *node) revisionsDir() *revisionsDirNode {
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	d, ok := n.revisionsDirs[n.id]
+	if !ok {
+		n.nextInode++
+		d = &revisionsDirNode{system: n.system, idx: n.nextInode, of: n}
+		n.revisionsDirs[n.id] = d
+	}
+	return d
+}
+
+// revisionNames returns the revisions of d's file by the names we
+// give them.  If two revisions were made in the same second, the later
+// ones get their ids on the end.
+func (d *revisionsDirNode) revisionNames(ctx context.Context) (map[string]*gdrive.Revision, error) {
+	revs, err := d.of.revisions(ctx)
+	if err != nil {
+		logging.Errorf("Unable to fetch revisions of %s: %v", d.of, err)
+		return nil, fuse.EIO
+	}
+	byName := map[string]*gdrive.Revision{}
+	for _, rev := range revs {
+		name := rev.ModifiedTime.UTC().Format(revisionTimeFormat)
+		if _, ok := byName[name]; ok {
+			name += "@" + rev.ID
+		}
+		byName[name] = rev
+	}
+	return byName, nil
+}
+
+func (d *revisionsDirNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(d.idx)
+	d.of.mu.Lock()
+	a.Mtime = d.of.mtime
+	a.Ctime = d.of.ctime
+	a.Crtime = d.of.ctime
+	d.of.mu.Unlock()
+	a.Mode = os.ModeDir | modeReadOnly
+	return nil
+}
+
+func (d *revisionsDirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if !d.of.dir {
+		byName, err := d.revisionNames(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rev, ok := byName[name]
+		if !ok {
+			return nil, fuse.ENOENT
+		}
+		return d.of.revision(rev), nil
+	}
+	if err := d.of.loadChildrenIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+	c, err := d.of.findChild(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.revisionsDir(), nil
+}
+
+func (d *revisionsDirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var ds []fuse.Dirent
+	if !d.of.dir {
+		byName, err := d.revisionNames(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for name, rev := range byName {
+			ds = append(ds, fuse.Dirent{Inode: uint64(d.of.revision(rev).idx), Type: fuse.DT_File, Name: name})
+		}
+		return ds, nil
+	}
+
+	if err := d.of.loadChildrenIfEmpty(ctx); err != nil {
+		return nil, err
+	}
+	// revisionsDir takes the system lock, which we can't take while
+	// holding cmu
+	var children []*node
+	var lazy []*lazyChild
+	d.of.cmu.Lock()
+	for _, c := range d.of.children {
+		children = append(children, c)
+	}
+	for _, lc := range d.of.lazy {
+		lazy = append(lazy, lc)
+	}
+	d.of.cmu.Unlock()
+	for _, lc := range lazy {
+		children = append(children, d.of.made(lc))
+	}
+	for _, c := range children {
+		c.mu.Lock()
+		name := localName(c.name)
+		c.mu.Unlock()
+		ds = append(ds, fuse.Dirent{Inode: uint64(c.revisionsDir().idx), Type: fuse.DT_Dir, Name: name})
+	}
+	return ds, nil
+}
@@ -0,0 +1,99 @@
+package mntgdrive
+
+import (
+	"path"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"golang.org/x/net/context"
+)
+
+// cleanRules puts the paths of rules from the config file into the form
+// that node.path returns and fills in the defaults for sharing.
+func cleanRules(rules []config.Rule) []config.Rule {
+	var cleaned []config.Rule
+	for _, r := range rules {
+		r.Path = strings.Trim(path.Clean("/"+r.Path), "/")
+		var shares []config.Share
+		for _, s := range r.ShareWith {
+			if s.Type == "" {
+				s.Type = "user"
+			}
+			if s.Role == "" {
+				s.Role = "reader"
+			}
+			shares = append(shares, s)
+		}
+		r.ShareWith = shares
+		cleaned = append(cleaned, r)
+	}
+	return cleaned
+}
+
+// ruleFor returns the first rule that covers something created at p,
+// or nil if there isn't one.  A rule for the root covers everything.
+func ruleFor(p string, rules []config.Rule) *config.Rule {
+	if p == "" {
+		return nil
+	}
+	for i, r := range rules {
+		if r.Path == "" || underAny(path.Dir(p), []string{r.Path}) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// applyRule describes and shares n, which was just created, as r says
+// to.  Files that r moves elsewhere are moved once their content has
+// been uploaded; folders are moved right away.  Problems are logged
+// rather than returned, since n has been created either way.
+func (n *node) applyRule(ctx context.Context, r *config.Rule) {
+	if r.Description != "" {
+		if err := n.gd.Describe(ctx, n.id, r.Description); err != nil {
+			logging.Errorf("Unable to describe %q as rule for %q says to: %v", n.id, r.Path, err)
+		}
+	}
+	for _, s := range r.ShareWith {
+		if err := n.gd.Share(ctx, n.id, s.Type, s.Email, s.Role); err != nil {
+			logging.Errorf("Unable to share %q with %s as rule for %q says to: %v", n.id, s.Email, r.Path, err)
+		}
+	}
+	if r.FolderID == "" {
+		return
+	}
+	if n.dir {
+		n.moveTo(ctx, r.FolderID)
+		return
+	}
+	n.mu.Lock()
+	n.pendingMove = r.FolderID
+	n.mu.Unlock()
+}
+
+// moveTo moves n from its parent to the drive folder with folderID.
+func (n *node) moveTo(ctx context.Context, folderID string) {
+	n.system.mu.Lock()
+	n.mu.Lock()
+	var parentID string
+	for id := range n.parents {
+		parentID = id
+		break
+	}
+	n.mu.Unlock()
+	n.system.mu.Unlock()
+	if parentID == "" || parentID == folderID {
+		return
+	}
+
+	g, err := n.gd.Rename(ctx, n.id, "", parentID, folderID)
+	if err != nil {
+		logging.Errorf("Unable to move %q to %q: %v", n.id, folderID, err)
+		return
+	}
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	n.update(g)
+}
@@ -0,0 +1,177 @@
+package mntgdrive
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// xattrGdriveShare says who a node is shared with, as a comma separated
+// list of who:role, where who is an email address, group: followed by
+// a group's email address, a domain or "anyone".  Setting it to such a
+// list makes each change in it: who:role shares the node with who, or
+// changes their role if it is already shared with them, and who:none
+// stops sharing it with them.  Entries that are already so change
+// nothing, so what reading it gives can be edited and written back.
+const xattrGdriveShare = "user.gdrive.share"
+
+// the roles programs may give out, plus shareNone which takes them away
+var shareRoles = map[string]bool{"reader": true, "commenter": true, "writer": true, shareNone: true}
+
+// the roles drive may tell us about that programs can't give out
+var heldRoles = map[string]bool{"owner": true, "organizer": true, "fileOrganizer": true}
+
+const shareNone = "none"
+
+// what a who starts with when it is a google group
+const groupPrefix = "group:"
+
+// share is a change to who a node is shared with.
+type share struct {
+	kind  string // "user", "group", "domain" or "anyone"
+	email string // the email address or domain; empty for anyone
+	role  string
+}
+
+// parseShares parses a comma separated list of who:role.
+func parseShares(value string) ([]share, bool) {
+	var shares []share
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		sh, ok := parseShare(entry)
+		if !ok {
+			return nil, false
+		}
+		shares = append(shares, sh)
+	}
+	return shares, true
+}
+
+// parseShare parses who:role.
+func parseShare(value string) (share, bool) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return share{}, false
+	}
+	who, role := strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	if who == "" || !(shareRoles[role] || heldRoles[role]) {
+		return share{}, false
+	}
+	switch {
+	case strings.HasPrefix(who, groupPrefix):
+		email := strings.TrimSpace(strings.TrimPrefix(who, groupPrefix))
+		if !strings.Contains(email, "@") {
+			return share{}, false
+		}
+		return share{"group", email, role}, true
+	case who == "anyone":
+		return share{"anyone", "", role}, true
+	case strings.Contains(who, "@"):
+		return share{"user", who, role}, true
+	default:
+		return share{"domain", who, role}, true
+	}
+}
+
+// matches returns true if p is for the same people as sh.  A bare email
+// address matches a group with it too, so lists written before we told
+// groups apart still change them.
+func (sh share) matches(p *gdrive.Permission) bool {
+	kind := p.Type
+	if kind == "group" && sh.kind == "user" {
+		kind = "user"
+	}
+	return kind == sh.kind && strings.EqualFold(p.Email, sh.email)
+}
+
+// shareXattr returns who n is shared with, as xattrGdriveShare
+// describes.
+func (n *node) shareXattr(ctx context.Context) (string, error) {
+	perms, err := n.gd.Permissions(ctx, n.id)
+	if err == fuse.EPERM {
+		// only those who may share a node get to see who it is
+		// shared with
+		return "", fuse.ErrNoXattr
+	}
+	if err != nil {
+		return "", fuse.EIO
+	}
+	var shares []string
+	for _, p := range perms {
+		who := p.Email
+		switch p.Type {
+		case "anyone":
+			who = "anyone"
+		case "group":
+			who = groupPrefix + p.Email
+		}
+		shares = append(shares, who+":"+p.Role)
+	}
+	return strings.Join(shares, ","), nil
+}
+
+// shareChange is what setShare does about one share.
+type shareChange struct {
+	sh       share
+	existing *gdrive.Permission
+}
+
+// setShare changes who n is shared with, as xattrGdriveShare
+// describes.  We check every share before making any change.
+func (n *node) setShare(ctx context.Context, value string) error {
+	shares, ok := parseShares(value)
+	if !ok {
+		logging.For(ctx).Debugf("Setxattr: failing because %q isn't a list of who:role", value)
+		return fuse.Errno(syscall.EINVAL)
+	}
+	perms, err := n.gd.Permissions(ctx, n.id)
+	if err == fuse.EPERM {
+		return fuse.EPERM
+	}
+	if err != nil {
+		return fuse.EIO
+	}
+	var changes []shareChange
+	for _, sh := range shares {
+		var existing *gdrive.Permission
+		for _, p := range perms {
+			if sh.matches(p) {
+				existing = p
+				break
+			}
+		}
+		switch {
+		case existing == nil && sh.role == shareNone:
+			return fuse.ErrNoXattr
+		case existing != nil && existing.Role == sh.role:
+			// as it is already
+			continue
+		case heldRoles[sh.role], existing != nil && heldRoles[existing.Role]:
+			// giving the file away, or taking it from its owner, is
+			// more than an extended attribute should do
+			return fuse.EPERM
+		}
+		changes = append(changes, shareChange{sh, existing})
+	}
+	for _, c := range changes {
+		switch {
+		case c.existing == nil:
+			err = n.gd.Share(ctx, n.id, c.sh.kind, c.sh.email, c.sh.role)
+		case c.sh.role == shareNone:
+			err = n.gd.Unshare(ctx, n.id, c.existing.ID)
+		default:
+			err = n.gd.ChangePermission(ctx, n.id, c.existing.ID, c.sh.role)
+		}
+		if err != nil {
+			return fuse.EIO
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package mntgdrive
+
+import (
+	"testing"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+)
+
+func TestParseShare(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  share
+		ok    bool
+	}{
+		{"alice@example.com:reader", share{"user", "alice@example.com", "reader"}, true},
+		{" alice@example.com : writer", share{"user", "alice@example.com", "writer"}, true},
+		{"example.com:commenter", share{"domain", "example.com", "commenter"}, true},
+		{"anyone:reader", share{"anyone", "", "reader"}, true},
+		{"group:team@example.com:writer", share{"group", "team@example.com", "writer"}, true},
+		{"group:example.com:reader", share{}, false},
+		{"alice@example.com:none", share{"user", "alice@example.com", "none"}, true},
+		// so what we read parses, though it may not be set
+		{"alice@example.com:owner", share{"user", "alice@example.com", "owner"}, true},
+		{"alice@example.com:boss", share{}, false},
+		{"alice@example.com", share{}, false},
+		{":reader", share{}, false},
+	} {
+		got, ok := parseShare(tc.value)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseShare(%q) = %+v, %t, want %+v, %t", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseShares(t *testing.T) {
+	got, ok := parseShares("alice@example.com:owner,anyone:reader")
+	if !ok || len(got) != 2 || got[0] != (share{"user", "alice@example.com", "owner"}) || got[1] != (share{"anyone", "", "reader"}) {
+		t.Errorf("parseShares of two = %+v, %t", got, ok)
+	}
+	if got, ok := parseShares(""); !ok || len(got) != 0 {
+		t.Errorf("parseShares(\"\") = %+v, %t, want none", got, ok)
+	}
+	if _, ok := parseShares("anyone:reader,bob"); ok {
+		t.Errorf("parseShares with a bad entry succeeded")
+	}
+}
+
+func TestShareMatches(t *testing.T) {
+	group := &gdrive.Permission{Type: "group", Email: "team@example.com"}
+	user := &gdrive.Permission{Type: "user", Email: "team@example.com"}
+	assert(t, share{"group", "team@example.com", "reader"}.matches(group), "group share doesn't match its group")
+	assert(t, !share{"group", "team@example.com", "reader"}.matches(user), "group share matches a user")
+	assert(t, share{"user", "Team@example.com", "reader"}.matches(group), "bare address doesn't match its group")
+}
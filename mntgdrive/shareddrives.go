@@ -0,0 +1,217 @@
+package mntgdrive
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const sharedDrivesName = ".shared-drives"
+
+// how far apart the inode numbers of each subsystem start, so they
+// don't collide with ours or each other's
+const subsystemInodeShift = 40
+
+var _ fs.HandleReadDirAller = (*sharedDrivesDirType)(nil)
+var _ fs.NodeStringLookuper = (*sharedDrivesDirType)(nil)
+
+// sharedDrivesDirType is the .shared-drives folder at the top of a
+// mount.  It has a folder for each shared drive we can see, named after
+// the drive.  Each is the top of its own system, which keeps up with
+// changes within that drive.
+type sharedDrivesDirType struct {
+	root *node
+
+	mu sync.Mutex
+	// the drives as of when we last listed them, by local name; nil if
+	// we haven't yet
+	byName map[string]*system
+}
+
+// sharedDriveSystem returns the system for shared drive d, making it if
+// this is the first we have heard of d.
+func (s *system) sharedDriveSystem(d *gdrive.SharedDrive) (*system, error) {
+	s.mu.Lock()
+	sub, ok := s.sharedDriveSystems[d.ID]
+	s.mu.Unlock()
+	if ok {
+		return sub, nil
+	}
+
+	gd, err := s.gd.ForSharedDrive(d.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.sharedDriveSystems[d.ID]; ok {
+		return sub, nil
+	}
+	// The root folder of a shared drive has the same id as the drive
+	sub = s.newSubsystem(gd, d.ID)
+	s.sharedDriveSystems[d.ID] = sub
+	return sub, nil
+}
+
+// newSubsystem returns a system for something drive keeps apart from
+// what we mount, e.g. a shared drive, with rootFolderID at its top.  It
+// gets its own range of inode numbers and stops watching for changes
+// when we do.  Assumes we have the system lock.
+func (s *system) newSubsystem(gd gdrive.DriveLike, rootFolderID string) *system {
+	sub := newSystem(gd, s.server, s.readonly)
+	sub.parentSystem = s
+	sub.profile = s.profile
+	sub.rootFolderID = rootFolderID
+	sub.others = s.others
+	sub.refreshAfter = s.refreshAfter
+	sub.prefetchCount = s.prefetchCount
+	sub.exportZip = s.exportZip
+	sub.exportFormats = s.exportFormats
+	sub.stubs = s.stubs
+	sub.strictPOSIX = s.strictPOSIX
+	sub.excludes = s.excludes
+	sub.owners = s.owners
+	sub.audit = s.audit
+	sub.jobs = s.jobs
+	sub.hooks = s.hooks
+	sub.readonlyPaths = s.readonlyPaths
+	sub.rules = s.rules
+	sub.metadataDelay = s.metadataDelay
+	s.subsystemsMade++
+	sub.nextInode = index(s.subsystemsMade) << subsystemInodeShift
+	sub.watching, sub.stopWatching = context.WithCancel(s.watching)
+	if sub.metadataDelay > 0 {
+		sub.goBackground(sub.sendMetadataPeriodically)
+	}
+	return sub
+}
+
+// setMountPrefix says where sub's root is within the mount, which may
+// change when what it is named after is renamed.
+func (sub *system) setMountPrefix(prefix string) {
+	sub.mu.Lock()
+	sub.mountPrefix = prefix
+	sub.mu.Unlock()
+}
+
+// subsystems returns the systems we have made for things within our
+// mount.
+func (s *system) subsystems() []*system {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subs []*system
+	for _, sub := range s.sharedDriveSystems {
+		subs = append(subs, sub)
+	}
+	for _, sub := range s.computerSystems {
+		subs = append(subs, sub)
+	}
+	if s.appDataSystem != nil {
+		subs = append(subs, s.appDataSystem)
+	}
+	return subs
+}
+
+// keepSharedDrives forgets the systems for shared drives that aren't
+// in ids, e.g. because they were deleted or we were removed from them.
+func (s *system) keepSharedDrives(ids map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sub := range s.sharedDriveSystems {
+		if !ids[id] {
+			logging.Infof("Forgetting shared drive %s, which we can no longer see", id)
+			sub.stopWatching()
+			delete(s.sharedDriveSystems, id)
+		}
+	}
+}
+
+// rootNode returns our root node, fetching it if we haven't yet.
+func (s *system) rootNode() (*node, error) {
+	s.mu.Lock()
+	root := s.idMap[s.rootID]
+	s.mu.Unlock()
+	if root != nil {
+		return root, nil
+	}
+	return s.driveRoot()
+}
+
+// list returns the shared drives by local name, asking drive for them
+// if fresh is true or if we haven't yet.
+func (d *sharedDrivesDirType) list(ctx context.Context, fresh bool) (map[string]*system, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byName != nil && !fresh {
+		return d.byName, nil
+	}
+	drives, err := d.root.gd.SharedDrives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*system{}
+	ids := map[string]bool{}
+	for _, sd := range drives {
+		sub, err := d.root.sharedDriveSystem(sd)
+		if err != nil {
+			logging.For(ctx).Errorf("Unable to open shared drive %s (%s): %v", sd.Name, sd.ID, err)
+			continue
+		}
+		byName[localName(sd.Name)] = sub
+		sub.setMountPrefix(path.Join(sharedDrivesName, localName(sd.Name)))
+		ids[sd.ID] = true
+	}
+	d.root.keepSharedDrives(ids)
+	d.byName = byName
+	return byName, nil
+}
+
+func (d *sharedDrivesDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = sharedDrivesIdx
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *sharedDrivesDirType) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	byName, err := d.list(ctx, false)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list shared drives: %v", err)
+		return nil, fuse.EIO
+	}
+	sub, ok := byName[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return sub.rootNode()
+}
+
+func (d *sharedDrivesDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	byName, err := d.list(ctx, true)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list shared drives: %v", err)
+		return nil, fuse.EIO
+	}
+	var ds []fuse.Dirent
+	for name, sub := range byName {
+		root, err := sub.rootNode()
+		if err != nil {
+			logging.For(ctx).Errorf("Unable to fetch the top of shared drive %s: %v", name, err)
+			continue
+		}
+		ds = append(ds, fuse.Dirent{Inode: uint64(root.idx), Type: fuse.DT_Dir, Name: name})
+	}
+	return ds, nil
+}
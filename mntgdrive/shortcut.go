@@ -0,0 +1,92 @@
+package mntgdrive
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// how far up from a shortcut's target we go looking for our root
+const maxShortcutDepth = 64
+
+var _ fs.NodeReadlinker = (*node)(nil)
+
+// shortcutTarget returns the id of what g points at, if it is a
+// shortcut.
+func shortcutTarget(g *gdrive.Node) string {
+	if !g.Shortcut() {
+		return ""
+	}
+	return g.ShortcutTargetID
+}
+
+// Readlink answers for shortcuts, which we present as symlinks to
+// whatever they point at, relative to the folder they are in.
+func (n *node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	n.mu.Lock()
+	target := n.target
+	n.mu.Unlock()
+	if target == "" {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	to, err := n.pathOf(ctx, target)
+	if err != nil {
+		logging.For(ctx).Infof("Shortcut %s points at %s, which we can't find under our root: %v", n, target, err)
+		return "", fuse.ENOENT
+	}
+	n.system.mu.Lock()
+	from := n.path()
+	n.system.mu.Unlock()
+	rel, err := filepath.Rel(filepath.Dir("/"+from), "/"+to)
+	if err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// pathOf returns the path, from our root, of the node with id, asking
+// drive about any of it we haven't loaded.
+func (s *system) pathOf(ctx context.Context, id string) (string, error) {
+	var names []string
+	for i := 0; i < maxShortcutDepth; i++ {
+		s.mu.Lock()
+		if id == s.rootID {
+			s.mu.Unlock()
+			return joinUp(names), nil
+		}
+		var p string
+		if n := s.idMap[id]; n != nil {
+			p = n.path()
+		}
+		s.mu.Unlock()
+		if p != "" {
+			return joinUp(append(names, p)), nil
+		}
+
+		g, err := s.gd.FetchNode(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		if g.Trashed || len(g.ParentIDs) == 0 {
+			return "", fuse.ENOENT
+		}
+		names = append(names, s.shownName(g.Name, g.MimeType))
+		id = g.ParentIDs[0]
+	}
+	return "", fuse.ENOENT
+}
+
+// joinUp joins names, which go from the bottom up, into a path.
+func joinUp(names []string) string {
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/")
+}
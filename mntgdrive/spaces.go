@@ -0,0 +1,225 @@
+package mntgdrive
+
+import (
+	"os"
+	"sync"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// With --spaces, the top of the mount holds the whole account side by
+// side, like the web UI's sidebar:
+//
+//	mydrive/          My Drive, as we usually present it at the top
+//	shared-with-me/   what other people shared with us
+//	shared-drives/    a folder for each shared drive
+//	trash/            what is in the trash
+//	recent/           the files we looked at most recently
+//
+// Everything in them is a node of My Drive's system, or of a shared
+// drive's, so it keeps up with the change feed wherever it shows up.
+const (
+	myDriveName            = "mydrive"
+	sharedWithMeName       = "shared-with-me"
+	spacesSharedDrivesName = "shared-drives"
+	spacesTrashName        = "trash"
+	recentName             = "recent"
+)
+
+// how many files recent/ holds
+const recentCount = 50
+
+var _ fs.HandleReadDirAller = (*spacesDirType)(nil)
+var _ fs.NodeStringLookuper = (*spacesDirType)(nil)
+
+// spacesDirType is the top of a mount with --spaces.
+type spacesDirType struct {
+	root         *node
+	sharedWithMe *queryDirType
+	recent       *queryDirType
+}
+
+// spacesRoot returns the top of a mount with --spaces, with My Drive
+// in it.
+func (s *system) spacesRoot() (fs.Node, error) {
+	root, err := s.driveRoot()
+	if err != nil {
+		return nil, err
+	}
+	s.initSpacesOnce.Do(func() {
+		s.spacesNode = &spacesDirType{
+			root:         root,
+			sharedWithMe: &queryDirType{root: root, idx: sharedWithMeIdx, name: sharedWithMeName, fetch: s.gd.SharedWithMe},
+			recent: &queryDirType{root: root, idx: recentIdx, name: recentName, fetch: func(ctx context.Context) ([]*gdrive.Node, error) {
+				return s.gd.Recent(ctx, recentCount)
+			}},
+		}
+	})
+	return s.spacesNode, nil
+}
+
+// trashView returns the .Trash folder at the top of n, which is our
+// root.
+func (n *node) trashView() *trashViewType {
+	n.initTrashViewOnce.Do(func() {
+		n.trashViewNode = &trashViewType{root: n}
+	})
+	return n.trashViewNode
+}
+
+// sharedDrivesDir returns the .shared-drives folder at the top of n,
+// which is our root.
+func (n *node) sharedDrivesDir() *sharedDrivesDirType {
+	n.initSharedDrivesOnce.Do(func() {
+		n.sharedDrivesNode = &sharedDrivesDirType{root: n}
+	})
+	return n.sharedDrivesNode
+}
+
+func (d *spacesDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = spacesIdx
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *spacesDirType) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	switch name {
+	case myDriveName:
+		return d.root, nil
+	case sharedWithMeName:
+		return d.sharedWithMe, nil
+	case spacesSharedDrivesName:
+		return d.root.sharedDrivesDir(), nil
+	case spacesTrashName:
+		return d.root.trashView(), nil
+	case recentName:
+		return d.recent, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *spacesDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Inode: uint64(d.root.idx), Type: fuse.DT_Dir, Name: myDriveName},
+		{Inode: sharedWithMeIdx, Type: fuse.DT_Dir, Name: sharedWithMeName},
+		{Inode: sharedDrivesIdx, Type: fuse.DT_Dir, Name: spacesSharedDrivesName},
+		{Inode: trashViewIdx, Type: fuse.DT_Dir, Name: spacesTrashName},
+		{Inode: recentIdx, Type: fuse.DT_Dir, Name: recentName},
+	}, nil
+}
+
+var _ fs.HandleReadDirAller = (*queryDirType)(nil)
+var _ fs.NodeRequestLookuper = (*queryDirType)(nil)
+
+// queryDirType is a read-only folder listing what a drive query
+// returns, e.g. shared-with-me.  What is in it are the same nodes we
+// present everywhere else, so changes to them show up here too, but
+// what it lists only changes when it is listed again.  The kernel
+// doesn't hold on to what we look up in it, since we can't tell it when
+// that changes.
+type queryDirType struct {
+	root  *node
+	idx   index
+	name  string
+	fetch func(ctx context.Context) ([]*gdrive.Node, error)
+
+	mu sync.Mutex
+	// what the query returned when we last listed the folder, by local
+	// name; nil if we haven't yet
+	byName map[string]*node
+}
+
+// list returns what the query returns, by local name, asking drive if
+// fresh is true or if we haven't yet.
+func (d *queryDirType) list(ctx context.Context, fresh bool) (map[string]*node, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byName != nil && !fresh {
+		return d.byName, nil
+	}
+	gs, err := d.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := d.root.system
+	byName := map[string]*node{}
+	taken := map[string]bool{}
+	for _, g := range gs {
+		if !s.presented(g) {
+			continue
+		}
+		name := localName(g.Name)
+		if taken[name] {
+			name = uniqueName(name, g.ID, taken)
+		}
+		taken[name] = true
+		byName[name] = s.getOrMakeNode(g)
+	}
+	d.byName = byName
+	return byName, nil
+}
+
+func (d *queryDirType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(d.idx)
+	a.Mode = os.ModeDir | modeReadOnly
+	d.root.system.mu.Lock()
+	a.Ctime = d.root.serverStart
+	a.Crtime = d.root.serverStart
+	a.Mtime = d.root.serverStart
+	d.root.system.mu.Unlock()
+	return nil
+}
+
+func (d *queryDirType) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = 0
+	byName, err := d.list(ctx, false)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list %s: %v", d.name, err)
+		return nil, fuse.EIO
+	}
+	n, ok := byName[req.Name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	// it may have been trashed since we listed it
+	s := d.root.system
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.getNodeIfExists(n.id) != n {
+		return nil, fuse.ENOENT
+	}
+	return n, nil
+}
+
+func (d *queryDirType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	byName, err := d.list(ctx, true)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to list %s: %v", d.name, err)
+		return nil, fuse.EIO
+	}
+	var ds []fuse.Dirent
+	for name, n := range byName {
+		dt := fuse.DT_File
+		n.mu.Lock()
+		switch {
+		case n.dir:
+			dt = fuse.DT_Dir
+		case n.target != "":
+			dt = fuse.DT_Link
+		}
+		n.mu.Unlock()
+		ds = append(ds, fuse.Dirent{Inode: uint64(n.idx), Type: dt, Name: name})
+	}
+	d.root.sortDirents(ds)
+	return ds, nil
+}
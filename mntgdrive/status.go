@@ -0,0 +1,43 @@
+package mntgdrive
+
+import (
+	"time"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+)
+
+// staleChangesAfter is how long we can go without fetching changes
+// before status calls the mount stale.  Several failed polls in a row
+// is more than a blip.
+const staleChangesAfter = 6 * changeFetchSleep
+
+func (s *system) status() control.MountStatus {
+	s.mu.Lock()
+	lastChanges := s.changesTime
+	s.mu.Unlock()
+	s.pendingMu.Lock()
+	pending := len(s.pendingRenames)
+	s.pendingMu.Unlock()
+
+	cacheBytes, err := phantomfile.CacheUsage()
+	if err != nil {
+		logging.Warnf("Unable to measure cache usage: %v", err)
+	}
+	cs := gdrive.Connections()
+	return control.MountStatus{
+		LastChanges:    lastChanges,
+		Stale:          time.Since(lastChanges) > staleChangesAfter,
+		DirtyFiles:     phantomfile.DirtyCount(),
+		PendingRenames: pending,
+		CacheDir:       phantomfile.CacheDir(),
+		CacheBytes:     cacheBytes,
+		Requests:       cs.Requests,
+		Errors:         cs.Errors,
+
+		RetryingUploads: phantomfile.RetryingCount(),
+		UploadFailures:  phantomfile.UploadFailures(),
+	}
+}
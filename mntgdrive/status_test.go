@@ -0,0 +1,17 @@
+package mntgdrive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	s, _ := loadedSystem(t)
+	s.queueRename(s.idMap["file_one_id"], "renamed", "root", "root", nil)
+
+	st := s.status()
+	assert(t, time.Since(st.LastChanges) < time.Minute, "last changes %v too long ago", st.LastChanges)
+	assert(t, !st.Stale, "fresh mount is stale")
+	equals(t, 1, st.PendingRenames)
+	assert(t, st.CacheDir != "", "no cache dir")
+}
@@ -0,0 +1,52 @@
+package mntgdrive
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+)
+
+// stubExtensions are the extensions of the stubs for each kind of
+// google docs file (and similar), the same ones Drive File Stream uses,
+// so file managers that know them open them in a browser.
+var stubExtensions = map[string]string{
+	"document":     ".gdoc",
+	"spreadsheet":  ".gsheet",
+	"presentation": ".gslides",
+	"drawing":      ".gdraw",
+	"form":         ".gform",
+	"map":          ".gmap",
+	"site":         ".gsite",
+	"jam":          ".gjam",
+}
+
+// the extension of stubs for kinds that aren't in stubExtensions
+const stubLinkExtension = ".glink"
+
+// stubExtension returns the extension of the stub for google files
+// with mimeType, if they are google docs files (or similar).
+func stubExtension(mimeType string) (string, bool) {
+	g := gdrive.Node{MimeType: mimeType}
+	if !g.GoogleNative() {
+		return "", false
+	}
+	if ext, ok := stubExtensions[strings.TrimPrefix(mimeType, gdrive.GoogleMimeType(""))]; ok {
+		return ext, true
+	}
+	return stubLinkExtension, true
+}
+
+// stubContent returns what the stub for n holds: the link that opens
+// it in a browser, and its id.  Assumes we have the node lock.
+func (n *node) stubContent() []byte {
+	url := n.webViewLink
+	if url == "" {
+		url = "https://drive.google.com/open?id=" + n.id
+	}
+	b, _ := json.Marshal(struct {
+		URL   string `json:"url"`
+		DocID string `json:"doc_id"`
+	}{url, n.id})
+	return append(b, '\n')
+}
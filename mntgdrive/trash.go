@@ -0,0 +1,307 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// how we name the top level folders of a trash mount
+const trashDateLayout = "2006-01-02"
+
+var _ fs.HandleReadDirAller = (*trashDir)(nil)
+var _ fs.NodeStringLookuper = (*trashDir)(nil)
+var _ fs.NodeOpener = (*trashFile)(nil)
+
+// trashDir is a read-only folder in a trash mount.  Some stand for
+// folders that are in the trash and the rest are there to recreate
+// where things used to be.
+type trashDir struct {
+	*system
+	idx      index
+	children map[string]fs.Node
+	// the folders in children, by the id of the drive folder each
+	// stands for (for the days, the day), since names may be shared
+	subdirs map[string]*trashDir
+	// the folder in the trash that we stand for, if any
+	g *gdrive.Node
+	// where we are, relative to the top of the mount
+	path string
+}
+
+// trashFile is a read-only file that is in the trash.
+type trashFile struct {
+	*system
+	idx index
+	g   *gdrive.Node
+	pf  *phantomfile.PhantomFile
+	// where we are, relative to the top of the mount
+	path string
+}
+
+// trashRoot builds the tree we present when mounting the trash.  At
+// the top is a folder for each day something was trashed.  Below that,
+// each trashed file or folder is where it used to be, e.g.
+// 2016-08-20/Projects/2016/notes.txt.  The tree is a snapshot; things
+// trashed or restored afterwards don't show up until we are mounted
+// again.
+func (s *system) trashRoot(ctx context.Context) (*trashDir, error) {
+	tops, childrenOf, err := s.fetchTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ancestors := map[string]*gdrive.Node{}
+	paths := make([][]trashStep, len(tops))
+	for i, g := range tops {
+		paths[i] = s.originalPath(ctx, g, ancestors)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root := s.newTrashDir()
+	for i, g := range tops {
+		// nothing else at the top could take a day's name
+		day := g.TrashedAt().Local().Format(trashDateLayout)
+		d := root.subdir(day, day)
+		for _, step := range paths[i] {
+			d = d.subdir(step.name, step.id)
+		}
+		d.addTrashed(g, childrenOf, map[string]bool{})
+	}
+	return root, nil
+}
+
+// fetchTrash returns what is in the trash.  tops are the things that
+// aren't inside a trashed folder and childrenOf lists what is inside
+// each trashed folder, by id.
+func (s *system) fetchTrash(ctx context.Context) (tops []*gdrive.Node, childrenOf map[string][]*gdrive.Node, err error) {
+	trashed, err := s.gd.FetchTrash(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	byID := map[string]*gdrive.Node{}
+	for _, g := range trashed {
+		byID[g.ID] = g
+	}
+	childrenOf = map[string][]*gdrive.Node{}
+	for _, g := range trashed {
+		top := true
+		for _, p := range g.ParentIDs {
+			if _, ok := byID[p]; ok {
+				childrenOf[p] = append(childrenOf[p], g)
+				top = false
+			}
+		}
+		if top {
+			tops = append(tops, g)
+		}
+	}
+	// drive lists them in no particular order, so we put them in one,
+	// which decides who keeps a name that several want
+	oldestFirst(tops)
+	for _, gs := range childrenOf {
+		oldestFirst(gs)
+	}
+	return tops, childrenOf, nil
+}
+
+// oldestFirst sorts gs by when they were created, or, if they were
+// created together, by id, as childNames does.
+func oldestFirst(gs []*gdrive.Node) {
+	sort.Slice(gs, func(i, j int) bool {
+		if !gs[i].Ctime.Equal(gs[j].Ctime) {
+			return gs[i].Ctime.Before(gs[j].Ctime)
+		}
+		return gs[i].ID < gs[j].ID
+	})
+}
+
+// trashStep is a folder on the way to where something in the trash
+// used to be.
+type trashStep struct {
+	name string
+	id   string
+}
+
+// originalPath returns the folders that g used to live in, starting
+// from the top of the drive.  ancestors caches the folders
+// we have already looked up.  If we can't find a folder (e.g. it
+// belongs to someone else), we use its id instead and stop there.
+func (s *system) originalPath(ctx context.Context, g *gdrive.Node, ancestors map[string]*gdrive.Node) []trashStep {
+	var steps []trashStep
+	seen := map[string]bool{}
+	for parents := g.ParentIDs; len(parents) != 0; {
+		id := parents[0]
+		if seen[id] {
+			break
+		}
+		seen[id] = true
+		p, ok := ancestors[id]
+		if !ok {
+			var err error
+			if p, err = s.gd.FetchNode(ctx, id); err != nil {
+				logging.Warnf("Unable to find folder %q that %s was trashed from: %v", id, g.ID, err)
+				steps = append(steps, trashStep{id, id})
+				break
+			}
+			ancestors[id] = p
+		}
+		if len(p.ParentIDs) == 0 {
+			// the top of the drive, which we don't name
+			break
+		}
+		steps = append(steps, trashStep{localName(p.Name), id})
+		parents = p.ParentIDs
+	}
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+	return steps
+}
+
+// Assumes we have the system lock
+func (s *system) newTrashDir() *trashDir {
+	s.nextInode++
+	return &trashDir{system: s, idx: s.nextInode, children: map[string]fs.Node{}, subdirs: map[string]*trashDir{}}
+}
+
+// subdir returns the folder in d for the drive folder with id, making
+// it, called name, if needed.  Assumes we have the system lock.
+func (d *trashDir) subdir(name string, id string) *trashDir {
+	if c, ok := d.subdirs[id]; ok {
+		return c
+	}
+	c := d.newTrashDir()
+	c.path = path.Join(d.path, d.add(name, id, c))
+	d.subdirs[id] = c
+	return c
+}
+
+// add puts c, which stands for the drive file or folder with id, into
+// d as name, returning the name it ended up with.  Drive is happy to
+// have several things with the same name in one folder, so if the name
+// is taken we add a tag derived from id, as disambiguate does, so the
+// same file gets the same name every time we are mounted.  Assumes we
+// have the system lock.
+func (d *trashDir) add(name string, id string, c fs.Node) string {
+	if _, ok := d.children[name]; ok {
+		taken := make(map[string]bool, len(d.children))
+		for n := range d.children {
+			taken[n] = true
+		}
+		name = uniqueName(name, id, taken)
+	}
+	d.children[name] = c
+	return name
+}
+
+// addTrashed adds g to d, along with everything below it if it is a
+// folder.  Assumes we have the system lock.
+func (d *trashDir) addTrashed(g *gdrive.Node, childrenOf map[string][]*gdrive.Node, seen map[string]bool) {
+	if seen[g.ID] {
+		return
+	}
+	seen[g.ID] = true
+	name := localName(g.Name)
+	if !g.Dir() {
+		d.nextInode++
+		f := &trashFile{system: d.system, idx: d.nextInode, g: g}
+		f.pf = phantomfile.NewPhantomFile(d.watching, f)
+		f.path = path.Join(d.path, d.add(name, g.ID, f))
+		return
+	}
+	sub := d.subdir(name, g.ID)
+	sub.g = g
+	for _, c := range childrenOf[g.ID] {
+		sub.addTrashed(c, childrenOf, seen)
+	}
+}
+
+func (d *trashDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(d.idx)
+	a.Mode = os.ModeDir | modeReadOnly
+	a.Ctime = d.serverStart
+	a.Crtime = d.serverStart
+	a.Mtime = d.serverStart
+	return nil
+}
+
+func (d *trashDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if c, ok := d.children[name]; ok {
+		return c, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *trashDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var ds []fuse.Dirent
+	for name, c := range d.children {
+		switch c := c.(type) {
+		case *trashDir:
+			ds = append(ds, fuse.Dirent{Inode: uint64(c.idx), Type: fuse.DT_Dir, Name: name})
+		case *trashFile:
+			ds = append(ds, fuse.Dirent{Inode: uint64(c.idx), Type: fuse.DT_File, Name: name})
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].Name < ds[j].Name })
+	return ds, nil
+}
+
+func (f *trashFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(f.idx)
+	a.Size = f.g.Size
+	a.Ctime = f.g.Ctime
+	a.Crtime = f.g.Ctime
+	a.Mtime = f.g.Mtime
+	a.Mode = modeReadOnly
+	return nil
+}
+
+func (f *trashFile) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if xlateAccessMode(req.Flags) != phantomfile.ReadOnly {
+		return nil, fuse.EPERM
+	}
+	if f.audit == nil {
+		// nothing in the trash changes while we present it
+		res.Flags |= fuse.OpenKeepCache
+	}
+	fm := phantomfile.ProactiveFetch
+	if f.g.Size == 0 {
+		fm = phantomfile.NoFetch
+	}
+	h, err := f.pf.Open(ctx, phantomfile.ReadOnly, fm, processOf(req.Pid))
+	if err != nil {
+		return nil, err
+	}
+	return f.observed(f.audited(h, req, f.g.ID, func() string { return f.path })), nil
+}
+
+func (f *trashFile) Download(ctx context.Context, file *os.File) error {
+	return f.gd.Download(ctx, f.g.ID, file)
+}
+
+func (f *trashFile) Upload(ctx context.Context, file *os.File) error {
+	return fuse.EPERM
+}
+
+func (f *trashFile) ID() string {
+	return f.g.ID
+}
+
+func (f *trashFile) Name() string {
+	return f.g.Name
+}
+
+func (f *trashFile) String() string {
+	return fmt.Sprintf("%s/%s (trashed)", f.g.ID, f.g.Name)
+}
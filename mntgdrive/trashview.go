@@ -0,0 +1,165 @@
+package mntgdrive
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const trashViewName = ".Trash"
+
+var _ fs.HandleReadDirAller = (*trashViewType)(nil)
+var _ fs.NodeRequestLookuper = (*trashViewType)(nil)
+var _ fs.NodeRenamer = (*trashViewType)(nil)
+
+// trashViewType is the .Trash folder at the top of a regular mount.
+// It holds what is in the trash, each thing under its own name, and
+// moving something out of it takes it out of the trash.
+type trashViewType struct {
+	root *node
+
+	mu sync.Mutex
+	// what was in the trash when we last looked; nil if we need to
+	// look again
+	dir *trashDir
+}
+
+// snapshot returns what is in the trash, looking again if fresh is
+// true or if we haven't looked yet.
+func (v *trashViewType) snapshot(ctx context.Context, fresh bool) (*trashDir, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.dir != nil && !fresh {
+		return v.dir, nil
+	}
+	s := v.root.system
+	tops, childrenOf, err := s.fetchTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := s.newTrashDir()
+	dir.path = v.root.inMount(trashViewName)
+	seen := map[string]bool{}
+	for _, g := range tops {
+		dir.addTrashed(g, childrenOf, seen)
+	}
+	v.dir = dir
+	return dir, nil
+}
+
+func (v *trashViewType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(trashViewIdx)
+	a.Mode = os.ModeDir | modeReadOnly
+	v.root.system.mu.Lock()
+	a.Ctime = v.root.serverStart
+	a.Crtime = v.root.serverStart
+	a.Mtime = v.root.serverStart
+	v.root.system.mu.Unlock()
+	return nil
+}
+
+func (v *trashViewType) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	// Restoring moves the kernel's entry, which then stands for the
+	// wrong node until it asks again, so we have it ask every time.
+	resp.EntryValid = 0
+	dir, err := v.snapshot(ctx, false)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to fetch the trash: %v", err)
+		return nil, fuse.EIO
+	}
+	return dir.Lookup(ctx, req.Name)
+}
+
+func (v *trashViewType) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dir, err := v.snapshot(ctx, true)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to fetch the trash: %v", err)
+		return nil, fuse.EIO
+	}
+	return dir.ReadDirAll(ctx)
+}
+
+// Rename restores req.OldName from the trash, into newDir as
+// req.NewName.
+func (v *trashViewType) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if v.root.readonly {
+		return fuse.ENOTSUP
+	}
+	newParent, ok := newDir.(*node)
+	if !ok {
+		// still in the trash, which we don't rearrange
+		return fuse.EPERM
+	}
+	if newParent.system != v.root.system {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if !newParent.dir || !newParent.isWriteable() {
+		logging.For(ctx).Debugf("Rename: failing because we may not change %q", newParent.id)
+		return fuse.EPERM
+	}
+	if !newParent.isAddable() {
+		logging.For(ctx).Debugf("Rename: failing because drive won't let us add to %q", newParent.id)
+		return fuse.Errno(syscall.EACCES)
+	}
+	if newParent.nameTouchesReadonly(req.NewName) {
+		logging.For(ctx).Debugf("Rename: failing because %q in %q is in a readonly path", req.NewName, newParent.id)
+		return fuse.EPERM
+	}
+	dir, err := v.snapshot(ctx, false)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to fetch the trash: %v", err)
+		return fuse.EIO
+	}
+	var g *gdrive.Node
+	switch c := dir.children[req.OldName].(type) {
+	case *trashFile:
+		g = c.g
+	case *trashDir:
+		g = c.g
+	}
+	if g == nil {
+		return fuse.ENOENT
+	}
+
+	// as with any other rename, we replace what has the new name
+	replaced, err := newParent.replacedBy(ctx, g.ID, g.Dir(), req.NewName)
+	if err != nil {
+		logging.For(ctx).Debugf("Rename: failing because we can't replace %q in %q: %v", req.NewName, newParent.id, err)
+		return err
+	}
+
+	newName := req.NewName
+	if newName == localName(g.Name) {
+		newName = g.Name
+	}
+	logging.For(ctx).Debugf("Restoring %q from the trash to %q in %q", g.ID, newName, newParent.id)
+	restored, err := v.root.gd.Untrash(ctx, g.ID, newName, g.ParentIDs, newParent.id)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to restore %q from the trash: %v", g.ID, err)
+		return fuse.EIO
+	}
+	v.root.getOrMakeNode(restored)
+	if replaced != nil {
+		if err := newParent.trashChild(ctx, replaced); err != nil {
+			logging.For(ctx).Errorf("Rename: unable to trash %q, which %q replaced: %v", replaced.id, g.ID, err)
+			return fuse.EIO
+		}
+	}
+	// the kernel moves the trash entry to the new name, so have it
+	// look that up again once we have replied, in case it kept it
+	go v.root.invalidateEntries([]staleEntry{{newParent, req.NewName}})
+
+	v.mu.Lock()
+	v.dir = nil
+	v.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,93 @@
+package mntgdrive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultVolumeName = "GDrive"
+	// Finder shows this file, at the top of a volume, as the volume's
+	// icon
+	volumeIconName = ".VolumeIcon.icns"
+	// macOS keeps Finder flags, like the one that says a volume has a
+	// custom icon, here
+	xattrFinderInfo = "com.apple.FinderInfo"
+)
+
+// expandVolumeName fills in the placeholders in a volume name: {email}
+// becomes the address of the account we are using and {root} the name
+// of the folder or drive we are mounting.
+func expandVolumeName(name string, email string, root string) string {
+	return strings.NewReplacer("{email}", email, "{root}", root).Replace(name)
+}
+
+// volumeFinderInfo is what we report for the root's Finder info when
+// we have a volume icon.  The only thing set is the flag that says
+// there is a custom icon.
+func volumeFinderInfo() string {
+	info := make([]byte, 32)
+	info[8] = 0x04
+	return string(info)
+}
+
+// volumeIconNodeType is a magic file at the root with the content of
+// the icon file we were given.
+type volumeIconNodeType struct {
+	root *node
+}
+
+func (v *volumeIconNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	fi, err := os.Stat(v.root.volumeIcon)
+	if err != nil {
+		return fuse.ENOENT
+	}
+	a.Inode = volumeIconIdx
+	a.Size = uint64(fi.Size())
+	a.Mode = modeReadOnly
+
+	v.root.system.mu.Lock()
+	a.Ctime = v.root.serverStart
+	a.Crtime = v.root.serverStart
+	v.root.system.mu.Unlock()
+	a.Mtime = fi.ModTime()
+
+	return nil
+}
+
+func (v *volumeIconNodeType) ReadAll(ctx context.Context) (result []byte, err error) {
+	return ioutil.ReadFile(v.root.volumeIcon)
+}
+
+// volumeName returns the volume name for m, before expanding
+// placeholders.  def is the name for mounts that don't have their own.
+func volumeName(m config.Mount, def string) string {
+	if m.VolumeName != "" {
+		return m.VolumeName
+	}
+	return def
+}
+
+// volumeIcon returns the icon file for m, if it has one.  def is the
+// icon for mounts that don't have their own.
+func volumeIcon(m config.Mount, def string) (string, error) {
+	icon := m.VolumeIcon
+	if icon == "" {
+		icon = def
+	}
+	if icon == "" {
+		return "", nil
+	}
+	icon = config.ExpandHome(icon)
+	if _, err := os.Stat(icon); err != nil {
+		return "", fmt.Errorf("Unable to use volume icon: %v", err)
+	}
+	return icon, nil
+}
@@ -0,0 +1,9 @@
+package mntgdrive
+
+import "testing"
+
+func TestExpandVolumeName(t *testing.T) {
+	equals(t, "GDrive", expandVolumeName("GDrive", "me@example.com", "My Drive"))
+	equals(t, "me@example.com - Projects", expandVolumeName("{email} - {root}", "me@example.com", "Projects"))
+	equals(t, "{other}", expandVolumeName("{other}", "me@example.com", "Projects"))
+}
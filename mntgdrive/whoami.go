@@ -0,0 +1,247 @@
+package mntgdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+	"github.com/ginabythebay/mnt-gdrive/internal/phantomfile"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const (
+	whoamiName = "whoami"
+	configName = "config"
+)
+
+var _ fs.HandleReadAller = (*whoamiNodeType)(nil)
+var _ fs.NodeOpener = (*whoamiNodeType)(nil)
+var _ fs.HandleReadAller = (*configNodeType)(nil)
+
+// account is who a mount talks to google as.  A *gdrive.Connection is
+// one; mounts of a fake drive don't have one.
+type account interface {
+	UserEmail(ctx context.Context) (string, error)
+	Scopes(ctx context.Context) ([]string, error)
+}
+
+// whoamiNodeType is the .mntgdrive/whoami file, which says which
+// account the mount uses and what google lets us do with it.
+type whoamiNodeType struct {
+	root *node
+
+	mu sync.Mutex
+	// content, once we have managed to ask google
+	content []byte
+}
+
+func (w *whoamiNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = whoamiIdx
+	a.Mode = modeReadOnly
+	w.mu.Lock()
+	// we don't ask google just to stat the file; reads don't go by size
+	a.Size = uint64(len(w.content))
+	w.mu.Unlock()
+	w.root.system.mu.Lock()
+	a.Ctime = w.root.serverStart
+	a.Crtime = w.root.serverStart
+	a.Mtime = w.root.serverStart
+	w.root.system.mu.Unlock()
+	return nil
+}
+
+func (w *whoamiNodeType) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	// the size we gave before asking google was wrong
+	res.Flags |= fuse.OpenDirectIO
+	return w, nil
+}
+
+func (w *whoamiNodeType) ReadAll(ctx context.Context) (result []byte, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.content != nil {
+		return w.content, nil
+	}
+	var mountpoint string
+	if mc := w.root.system.mountConfig; mc != nil {
+		mountpoint = mc.Mountpoint
+	}
+	content, err := whoamiContent(ctx, w.root.system.account, mountpoint)
+	if err != nil {
+		logging.For(ctx).Warnf("Unable to find who we are: %v", err)
+		return nil, fuse.EIO
+	}
+	w.content = content
+	return content, nil
+}
+
+// whoamiContent is what the whoami file says for a mount of mountpoint
+// that uses acct, which is nil for a fake drive.
+func whoamiContent(ctx context.Context, acct account, mountpoint string) ([]byte, error) {
+	email, scopes := "(none)", []string{"(none)"}
+	if acct != nil {
+		var err error
+		if email, err = acct.UserEmail(ctx); err != nil {
+			return nil, err
+		}
+		if scopes, err = acct.Scopes(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "account     %s\n", email)
+	fmt.Fprintf(&b, "scopes      %s\n", strings.Join(scopes, " "))
+	fmt.Fprintf(&b, "mountpoint  %s\n", mountpoint)
+	return b.Bytes(), nil
+}
+
+// configNodeType is the .mntgdrive/config file, which says how the
+// mount was set up, leaving out anything secret.
+type configNodeType struct {
+	root *node
+}
+
+func (c *configNodeType) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = configIdx
+	a.Mode = modeReadOnly
+	a.Size = uint64(len(configContent(c.root.system.mountConfig)))
+	c.root.system.mu.Lock()
+	a.Ctime = c.root.serverStart
+	a.Crtime = c.root.serverStart
+	a.Mtime = c.root.serverStart
+	c.root.system.mu.Unlock()
+	return nil
+}
+
+func (c *configNodeType) ReadAll(ctx context.Context) ([]byte, error) {
+	return configContent(c.root.system.mountConfig), nil
+}
+
+func configContent(mc *mountConfig) []byte {
+	if mc == nil {
+		// e.g. tests, which set up a system without Mount
+		mc = &mountConfig{}
+	}
+	b, err := json.MarshalIndent(mc, "", "  ")
+	if err != nil {
+		// a mountConfig always encodes
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// mountConfig is what the config file shows: the settings one mount
+// runs with, after defaults and the config file are applied.
+type mountConfig struct {
+	Mountpoint    string `json:"mountpoint"`
+	RootFolderID  string `json:"rootFolderId"`
+	SharedDriveID string `json:"sharedDriveId,omitempty"`
+	Profile       string `json:"profile,omitempty"`
+	VolumeName    string `json:"volumeName"`
+
+	Readonly    bool   `json:"readonly"`
+	DryRun      bool   `json:"dryRun,omitempty"`
+	Trash       bool   `json:"trash,omitempty"`
+	Spaces      bool   `json:"spaces,omitempty"`
+	Stubs       bool   `json:"stubs,omitempty"`
+	ExportZip   bool   `json:"exportZip,omitempty"`
+	StrictPOSIX bool   `json:"strictPosix,omitempty"`
+	AllowOther  bool   `json:"allowOther,omitempty"`
+	AppData     bool   `json:"appData,omitempty"`
+	Scope       string `json:"scope"`
+	Others      string `json:"others"`
+
+	CacheDir      string           `json:"cacheDir"`
+	CacheSizeMB   int64            `json:"cacheSizeMB,omitempty"`
+	CacheQuotasMB map[string]int64 `json:"cacheQuotasMB,omitempty"`
+	AuditLog      string           `json:"auditLog,omitempty"`
+
+	ReadonlyPaths []string      `json:"readonlyPaths,omitempty"`
+	Rules         []config.Rule `json:"rules,omitempty"`
+	Excludes      []string      `json:"excludes,omitempty"`
+
+	Prefetch               int     `json:"prefetch"`
+	MetadataDelay          string  `json:"metadataDelay"`
+	RefreshAfter           string  `json:"refreshAfter"`
+	UploadSpacing          string  `json:"uploadSpacing"`
+	ListCacheTTL           string  `json:"listCacheTTL"`
+	StallTimeout           string  `json:"stallTimeout"`
+	RetryBudget            string  `json:"retryBudget"`
+	InteractiveRetryBudget string  `json:"interactiveRetryBudget"`
+	RequestsPerSecond      float64 `json:"requestsPerSecond,omitempty"`
+
+	// Proxy leaves out any password
+	Proxy    string `json:"proxy,omitempty"`
+	CABundle string `json:"caBundle,omitempty"`
+}
+
+// newMountConfig returns the settings the mount of m runs with, given
+// opts, and what Mount worked out from them.
+func newMountConfig(opts Options, m config.Mount, rootFolderID, volumeName string, readonly bool) *mountConfig {
+	drive := mountDriveOptions(m, opts.Drive)
+	return &mountConfig{
+		Mountpoint:    m.Mountpoint,
+		RootFolderID:  rootFolderID,
+		SharedDriveID: m.SharedDriveID,
+		Profile:       drive.Profile,
+		VolumeName:    volumeName,
+
+		Readonly:    readonly,
+		DryRun:      opts.DryRun,
+		Trash:       opts.Trash,
+		Spaces:      opts.Spaces,
+		Stubs:       opts.Stubs,
+		ExportZip:   opts.ExportZip,
+		StrictPOSIX: opts.StrictPOSIX,
+		AllowOther:  opts.AllowOther,
+		AppData:     opts.Drive.AppData,
+		Scope:       opts.Drive.Scope.String(),
+		Others:      opts.Drive.Others.String(),
+
+		CacheDir:      phantomfile.CacheDir(),
+		CacheSizeMB:   opts.CacheSizeMB,
+		CacheQuotasMB: opts.CacheQuotasMB,
+		AuditLog:      opts.AuditLog,
+
+		ReadonlyPaths: opts.ReadonlyPaths,
+		Rules:         opts.Rules,
+		Excludes:      opts.Excludes,
+
+		Prefetch:               opts.Prefetch,
+		MetadataDelay:          opts.MetadataDelay.String(),
+		RefreshAfter:           opts.RefreshAfter.String(),
+		UploadSpacing:          opts.UploadSpacing.String(),
+		ListCacheTTL:           opts.Drive.ListCacheTTL.String(),
+		StallTimeout:           opts.Drive.StallTimeout.String(),
+		RetryBudget:            opts.Drive.RetryBudget.String(),
+		InteractiveRetryBudget: opts.InteractiveRetryBudget.String(),
+		RequestsPerSecond:      opts.Drive.RequestsPerSecond,
+
+		Proxy:    redactURL(drive.ProxyURL),
+		CABundle: drive.CABundle,
+	}
+}
+
+// redactURL returns u without any password in it.
+func redactURL(u string) string {
+	if u == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		// it may be nothing like a url, so show none of it
+		return "(unparseable)"
+	}
+	return parsed.Redacted()
+}
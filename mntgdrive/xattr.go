@@ -0,0 +1,323 @@
+package mntgdrive
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/internal/logging"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+var _ fs.NodeGetxattrer = (*node)(nil)
+var _ fs.NodeListxattrer = (*node)(nil)
+var _ fs.NodeSetxattrer = (*node)(nil)
+var _ fs.NodeRemovexattrer = (*node)(nil)
+
+// Programs may set extended attributes that start with userXattrPrefix,
+// other than ours, and we keep them in drive as app properties, so they
+// go wherever the file does.
+const (
+	userXattrPrefix   = "user."
+	ourXattrPrefix    = "user.mntgdrive."
+	gdriveXattrPrefix = "user.gdrive."
+)
+
+// drive limits the key and value of each app property, together, to
+// this many bytes
+const maxAppPropertyLen = 124
+
+// setxattr flags, which are the same on linux and os x
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// extended attributes we present on every node
+const (
+	xattrMine = "user.mntgdrive.mine"
+)
+
+// extended attributes that say what drive knows about a node, so
+// scripts needn't ask it themselves.  Nobody may change them.  We leave
+// out md5 and webViewLink when drive doesn't give us them.
+const (
+	xattrGdriveID          = "user.gdrive.id"
+	xattrGdriveMimeType    = "user.gdrive.mimeType"
+	xattrGdriveMD5         = "user.gdrive.md5"
+	xattrGdriveWebViewLink = "user.gdrive.webViewLink"
+	xattrGdriveVersion     = "user.gdrive.version"
+)
+
+// extended attributes that say what drive knows about a node, which
+// programs may change.  Setting them changes the node in drive.
+// starred and locked are "true" or "false", and we leave out
+// description when there isn't one.  Only files have locked; nobody
+// may change a locked file until someone unlocks it.
+const (
+	xattrGdriveStarred     = "user.gdrive.starred"
+	xattrGdriveDescription = "user.gdrive.description"
+	xattrGdriveLocked      = "user.gdrive.locked"
+)
+
+// what drive shows as the reason for locks we make
+const lockReason = "Locked with mnt-gdrive"
+
+// extended attributes we present on folders, saying how fresh what we
+// list in them is
+const (
+	// when we listed the folder's children, as an RFC 3339 time in
+	// UTC.  We keep them up to date with the change feed after that.
+	xattrLastRefreshed = "user.gdrive.last_refreshed"
+	// how many seconds it has been since the change feed last worked
+	xattrFeedLag = "user.gdrive.feed_lag"
+)
+
+// feedTime returns when we last fetched changes without an error.
+func (s *system) feedTime() time.Time {
+	if s.sharesChanges {
+		return s.parentSystem.feedTime()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changesTime
+}
+
+// xattrs returns the extended attributes of n.
+func (n *node) xattrs() map[string]string {
+	xattrs := map[string]string{}
+	if n.volumeIcon != "" && n.isRoot(n) {
+		xattrs[xattrFinderInfo] = volumeFinderInfo()
+	}
+
+	if n.dir {
+		xattrs[xattrFeedLag] = strconv.FormatInt(int64(time.Since(n.feedTime())/time.Second), 10)
+		n.cmu.Lock()
+		if !n.listed.IsZero() {
+			xattrs[xattrLastRefreshed] = n.listed.UTC().Format(time.RFC3339)
+		}
+		n.cmu.Unlock()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, v := range n.appProperties {
+		if storedXattr(k) {
+			xattrs[k] = v
+		}
+	}
+	xattrs[xattrMine] = "true"
+	if !n.mine {
+		xattrs[xattrMine] = "false"
+	}
+	xattrs[xattrGdriveID] = n.id
+	xattrs[xattrGdriveMimeType] = n.mimeType
+	xattrs[xattrGdriveVersion] = strconv.FormatInt(n.version, 10)
+	if n.md5 != "" {
+		xattrs[xattrGdriveMD5] = n.md5
+	}
+	if n.webViewLink != "" {
+		xattrs[xattrGdriveWebViewLink] = n.webViewLink
+	}
+	xattrs[xattrGdriveStarred] = strconv.FormatBool(n.starred)
+	if n.description != "" {
+		xattrs[xattrGdriveDescription] = n.description
+	}
+	if !n.dir {
+		xattrs[xattrGdriveLocked] = strconv.FormatBool(n.locked)
+	}
+	return xattrs
+}
+
+func (n *node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name == xattrGdriveShare {
+		// we have to ask drive, so we only do it when asked
+		v, err := n.shareXattr(ctx)
+		if err != nil {
+			return err
+		}
+		resp.Xattr = []byte(v)
+		return nil
+	}
+	v, ok := n.xattrs()[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(v)
+	return nil
+}
+
+func (n *node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	for name := range n.xattrs() {
+		resp.Append(name)
+	}
+	// we leave out xattrGdriveShare: finding it means asking drive,
+	// and most people we list attributes for may not read it
+	return nil
+}
+
+// storedXattr returns true if name is an extended attribute programs
+// may set, which we keep in drive.
+func storedXattr(name string) bool {
+	return strings.HasPrefix(name, userXattrPrefix) && !reservedXattr(name)
+}
+
+// reservedXattr returns true if name is in one of the namespaces we
+// present ourselves.
+func reservedXattr(name string) bool {
+	return strings.HasPrefix(name, ourXattrPrefix) || strings.HasPrefix(name, gdriveXattrPrefix)
+}
+
+// driveXattr returns true if name is an extended attribute that
+// stands for a field of the node in drive, which programs may change.
+func driveXattr(name string) bool {
+	switch name {
+	case xattrGdriveStarred, xattrGdriveDescription, xattrGdriveLocked, xattrGdriveShare:
+		return true
+	}
+	return false
+}
+
+func (n *node) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	defer n.observe("Setxattr", time.Now(), &err)
+	if err := n.checkXattrChange(req.Name); err != nil {
+		return err
+	}
+	value := string(req.Xattr)
+	if !utf8.ValidString(value) {
+		logging.For(ctx).Debugf("Setxattr: failing because the value of %s isn't text", req.Name)
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if req.Name == xattrGdriveShare {
+		return n.setShare(ctx, value)
+	}
+	if driveXattr(req.Name) {
+		return n.setDriveXattr(ctx, req.Name, value, req.Flags)
+	}
+	if len(req.Name)+len(value) > maxAppPropertyLen {
+		return fuse.Errno(syscall.E2BIG)
+	}
+	n.mu.Lock()
+	_, exists := n.appProperties[req.Name]
+	n.mu.Unlock()
+	switch {
+	case req.Flags&xattrCreate != 0 && exists:
+		return fuse.EEXIST
+	case req.Flags&xattrReplace != 0 && !exists:
+		return fuse.ErrNoXattr
+	}
+	return n.editXattr(ctx, req.Name, gdrive.Edit{AppProperties: map[string]*string{req.Name: &value}})
+}
+
+// setDriveXattr changes the field of n in drive that the extended
+// attribute called name stands for.
+func (n *node) setDriveXattr(ctx context.Context, name string, value string, flags uint32) error {
+	var e gdrive.Edit
+	n.mu.Lock()
+	exists := name == xattrGdriveStarred || name == xattrGdriveLocked || n.description != ""
+	n.mu.Unlock()
+	switch {
+	case flags&xattrCreate != 0 && exists:
+		return fuse.EEXIST
+	case flags&xattrReplace != 0 && !exists:
+		return fuse.ErrNoXattr
+	}
+	switch name {
+	case xattrGdriveStarred:
+		starred, err := strconv.ParseBool(value)
+		if err != nil {
+			logging.For(ctx).Debugf("Setxattr: failing because %q isn't true or false", value)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		e.Starred = &starred
+	case xattrGdriveLocked:
+		locked, err := strconv.ParseBool(value)
+		if err != nil {
+			logging.For(ctx).Debugf("Setxattr: failing because %q isn't true or false", value)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		e.Locked = &locked
+		e.LockReason = lockReason
+	case xattrGdriveDescription:
+		e.Description = &value
+	}
+	return n.editXattr(ctx, name, e)
+}
+
+func (n *node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	defer n.observe("Removexattr", time.Now(), &err)
+	if err := n.checkXattrChange(req.Name); err != nil {
+		return err
+	}
+	switch req.Name {
+	case xattrGdriveStarred, xattrGdriveLocked:
+		// they are always there; set them to false instead
+		return fuse.EPERM
+	case xattrGdriveShare:
+		// that would stop sharing it with everyone at once; set it
+		// to who:none for each instead
+		return fuse.EPERM
+	case xattrGdriveDescription:
+		n.mu.Lock()
+		exists := n.description != ""
+		n.mu.Unlock()
+		if !exists {
+			return fuse.ErrNoXattr
+		}
+		empty := ""
+		return n.editXattr(ctx, req.Name, gdrive.Edit{Description: &empty})
+	}
+	n.mu.Lock()
+	_, exists := n.appProperties[req.Name]
+	n.mu.Unlock()
+	if !exists {
+		return fuse.ErrNoXattr
+	}
+	return n.editXattr(ctx, req.Name, gdrive.Edit{AppProperties: map[string]*string{req.Name: nil}})
+}
+
+// checkXattrChange fails unless we may change the extended attribute
+// of n called name.
+func (n *node) checkXattrChange(name string) error {
+	switch {
+	case reservedXattr(name) && !driveXattr(name):
+		return fuse.EPERM
+	case !storedXattr(name) && !driveXattr(name):
+		return fuse.ENOTSUP
+	case n.readonly:
+		return n.readonlyErr()
+	case name == xattrGdriveStarred:
+		// starring only changes how the node looks to us, so anyone
+		// who can see it may do it
+		return nil
+	case name == xattrGdriveLocked:
+		// locked files aren't writeable, so drive has the final say
+		if !n.isLockable() {
+			return fuse.EPERM
+		}
+		return nil
+	case !n.isWriteable():
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// editXattr makes e, which changes the extended attribute of n called
+// name, in drive.
+func (n *node) editXattr(ctx context.Context, name string, e gdrive.Edit) error {
+	g, err := n.gd.Edit(ctx, n.id, e)
+	if err != nil {
+		logging.For(ctx).Errorf("Unable to change extended attribute %s of %q: %v", name, n.id, err)
+		return fuse.EIO
+	}
+	n.system.mu.Lock()
+	defer n.system.mu.Unlock()
+	n.update(n.system.withPendingRename(g))
+	return nil
+}
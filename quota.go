@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+
+	"golang.org/x/net/context"
+)
+
+var quotaCommand = cli.Command{
+	Name:   "quota",
+	Usage:  "show how much storage your account has and what is using it",
+	Flags:  driveFlags,
+	Action: quota,
+}
+
+func quota(ctx *cli.Context) error {
+	opts, err := driveOptions(ctx, true)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	conn, err := gdrive.Connect(opts)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	q, err := conn.Quota(context.Background())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to get quota: %v", err), 1)
+	}
+	writeQuota(os.Stdout, q)
+	return nil
+}
+
+// writeQuota writes q the way the quota command shows it.
+func writeQuota(w io.Writer, q gdrive.Quota) {
+	if q.Limit > 0 {
+		fmt.Fprintf(w, "used        %s of %s (%.0f%%)\n", formatBytes(q.Usage), formatBytes(q.Limit),
+			100*float64(q.Usage)/float64(q.Limit))
+		free := q.Limit - q.Usage
+		if free < 0 {
+			free = 0
+		}
+		fmt.Fprintf(w, "free        %s\n", formatBytes(free))
+	} else {
+		fmt.Fprintf(w, "used        %s (no limit)\n", formatBytes(q.Usage))
+	}
+	fmt.Fprintf(w, "drive       %s\n", formatBytes(q.UsageInDrive-q.UsageInTrash))
+	fmt.Fprintf(w, "trash       %s\n", formatBytes(q.UsageInTrash))
+	// gmail and photos, which Drive doesn't break down any further
+	fmt.Fprintf(w, "other       %s\n", formatBytes(q.Usage-q.UsageInDrive))
+}
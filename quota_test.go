@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+)
+
+func TestWriteQuota(t *testing.T) {
+	var b bytes.Buffer
+	writeQuota(&b, gdrive.Quota{Limit: 16 << 30, Usage: 4 << 30, UsageInDrive: 3 << 30, UsageInTrash: 1 << 30})
+	equals(t, strings.Join([]string{
+		"used        4.0GB of 16.0GB (25%)",
+		"free        12.0GB",
+		"drive       2.0GB",
+		"trash       1.0GB",
+		"other       1.0GB",
+		""}, "\n"), b.String())
+
+	b.Reset()
+	writeQuota(&b, gdrive.Quota{Usage: 2048, UsageInDrive: 2048})
+	equals(t, strings.Join([]string{
+		"used        2.0KB (no limit)",
+		"drive       2.0KB",
+		"trash       0B",
+		"other       0B",
+		""}, "\n"), b.String())
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+)
+
+var resyncCommand = cli.Command{
+	Name:      "resync",
+	Usage:     "list the folders of a running mount again, in case it missed changes",
+	ArgsUsage: "MOUNTPOINT [PATH]",
+	Action:    resync,
+}
+
+func resync(ctx *cli.Context) error {
+	if ctx.NArg() < 1 || ctx.NArg() > 2 {
+		return cli.NewExitError("You must specify the mount point of a running mount and, optionally, a path below it.", 1)
+	}
+	mountpoint := ctx.Args().First()
+	req := control.Request{Op: control.OpResync}
+	if ctx.NArg() == 2 {
+		req.Args = []string{ctx.Args().Get(1)}
+	}
+	if err := callJob(mountpoint, req); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to resync %s: %v", mountpoint, err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/config"
+	"github.com/ginabythebay/mnt-gdrive/internal/gdrive"
+	"github.com/ginabythebay/mnt-gdrive/mntgdrive"
+
+	"golang.org/x/net/context"
+)
+
+const defaultCacheSizeMB = 1024
+
+var setupCommand = cli.Command{
+	Name:   "setup",
+	Usage:  "walk through first-time setup: client secret, authorization and cache settings",
+	Flags:  driveFlags,
+	Action: setup,
+}
+
+func setup(ctx *cli.Context) error {
+	cfgDir, err := config.Dir()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = os.MkdirAll(cfgDir, 0700); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Println("Step 1: client secret")
+	if err = setupClientSecret(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Println("\nStep 2: authorization")
+	writeable := askYesNo("Do you want to be able to mount your drive in writeable mode?", false)
+	opts, err := driveOptions(ctx, !writeable)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if !ctx.IsSet("scope") {
+		fmt.Println("mnt-gdrive can be limited to the files it creates itself.  It won't")
+		fmt.Println("see anything else in your drive, which is safest if you only want")
+		fmt.Println("it for new files.")
+		opts.Scope = gdrive.FullScope
+		if askYesNo("Do you want to limit it to the files it creates?", cfg.Scope == gdrive.FileScope.String()) {
+			opts.Scope = gdrive.FileScope
+		}
+	}
+	cfg.Scope = opts.Scope.String()
+	if err = gdrive.Authorize(opts); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Println("\nStep 3: checking access")
+	failed := false
+	for _, c := range gdrive.Diagnose(context.Background(), opts) {
+		if c.Err != nil {
+			failed = true
+			fmt.Printf("FAILED  %s: %v\n        %s\n", c.Name, c.Err, c.Fix)
+		} else {
+			fmt.Printf("ok      %s\n", c.Name)
+		}
+	}
+	if failed {
+		return cli.NewExitError("Unable to access google drive; fix the problems above and run setup again.", 1)
+	}
+
+	fmt.Println("\nStep 4: local cache")
+	if err = setupCache(cfg); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = cfg.Save(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	cfgPath, _ := config.Path()
+	fmt.Printf("\nWrote %s.  You are all set; mount your drive with\n\n  mnt-gdrive ", cfgPath)
+	if writeable {
+		fmt.Print("--writeable ")
+	}
+	if opts.Profile != "" {
+		fmt.Printf("--profile %s ", opts.Profile)
+	}
+	fmt.Println("/path/to/mountpoint")
+	return nil
+}
+
+func setupClientSecret() error {
+	secretFile, err := gdrive.SecretFile()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(secretFile); err == nil {
+		if !askYesNo(fmt.Sprintf("Found %s.  Do you want to replace it?", secretFile), false) {
+			return nil
+		}
+	}
+	fmt.Println("Follow the directions under 'Step 1: Turn on the Drive API' at")
+	fmt.Println("  https://developers.google.com/drive/v3/web/quickstart/go")
+	fmt.Println("and download the client secret file it gives you.")
+	for {
+		src := config.ExpandHome(ask("Path to the downloaded client secret file", ""))
+		if src == "" {
+			continue
+		}
+		if err = gdrive.InstallClientSecret(src); err != nil {
+			fmt.Printf("That didn't work: %v\n", err)
+			continue
+		}
+		fmt.Printf("Saved client secret to %s\n", secretFile)
+		return nil
+	}
+}
+
+func setupCache(cfg *config.Config) error {
+	defaultDir := cfg.CacheDir
+	if defaultDir == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return err
+		}
+		defaultDir = filepath.Join(usr.HomeDir, ".cache", "mnt-gdrive")
+	}
+	for {
+		dir := config.ExpandHome(ask("Where should local copies of files be kept?", defaultDir))
+		if err := mntgdrive.CheckCacheDir(dir, 0); err != nil {
+			fmt.Printf("That didn't work: %v\n", err)
+			continue
+		}
+		cfg.CacheDir = dir
+		break
+	}
+
+	defaultSize := cfg.CacheSizeMB
+	if defaultSize == 0 {
+		defaultSize = defaultCacheSizeMB
+	}
+	for {
+		answer := ask("How much space, in MB, may local copies use (0 for no limit)?", strconv.FormatInt(defaultSize, 10))
+		size, err := strconv.ParseInt(answer, 10, 64)
+		if err != nil || size < 0 {
+			fmt.Println("Please enter a whole number of megabytes.")
+			continue
+		}
+		cfg.CacheSizeMB = size
+		return nil
+	}
+}
+
+// ask prompts for a line of input, returning def if the user just hits return.
+func ask(prompt string, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", prompt, def)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+	answer := strings.TrimSpace(readLine())
+	if answer == "" {
+		return def
+	}
+	return answer
+}
+
+func askYesNo(prompt string, def bool) bool {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		fmt.Printf("%s [%s]: ", prompt, choices)
+		switch strings.ToLower(strings.TrimSpace(readLine())) {
+		case "":
+			return def
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
+
+// readLine reads a line from stdin a byte at a time, so that we don't
+// buffer anything that a later reader of stdin (like the
+// authorization code prompt) expects to see.
+func readLine() string {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if len(line) == 0 {
+				// nothing more is coming, so give up rather than
+				// prompting forever
+				fmt.Println()
+				os.Exit(1)
+			}
+			break
+		}
+	}
+	return string(line)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+)
+
+var statusCommand = cli.Command{
+	Name:      "status",
+	Usage:     "show how healthy a running mount is",
+	ArgsUsage: "MOUNTPOINT",
+	Action:    status,
+}
+
+func status(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("You must specify a single argument which is the mount point of a running mount.", 1)
+	}
+	sockPath, err := control.SocketPath(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	var st control.MountStatus
+	err = control.Call(sockPath, control.OpStatus, func(dec *json.Decoder) error {
+		return dec.Decode(&st)
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	age := time.Since(st.LastChanges)
+	health := "healthy"
+	if st.Stale {
+		health = "stale, unable to fetch changes from google"
+	}
+	fmt.Printf("health          %s\n", health)
+	fmt.Printf("last changes    %s ago\n", age.Round(time.Second))
+	fmt.Printf("dirty files     %d\n", st.DirtyFiles)
+	fmt.Printf("retrying        %d (%d failed uploads so far)\n", st.RetryingUploads, st.UploadFailures)
+	fmt.Printf("pending renames %d\n", st.PendingRenames)
+	fmt.Printf("cache           %s in %s\n", formatBytes(st.CacheBytes), st.CacheDir)
+	fmt.Printf("requests        %d\n", st.Requests)
+	fmt.Printf("errors          %d\n", st.Errors)
+	return nil
+}
+
+// formatBytes returns n in the biggest unit that keeps it at or above
+// one.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
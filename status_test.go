@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KB"},
+		{1536, "1.5KB"},
+		{5 << 20, "5.0MB"},
+		{3 << 30, "3.0GB"},
+	}
+	for _, tc := range tests {
+		equals(t, tc.want, formatBytes(tc.n))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+)
+
+var umountCommand = cli.Command{
+	Name:      "umount",
+	Usage:     "upload any pending changes of a running mount, then unmount it",
+	ArgsUsage: "MOUNTPOINT",
+	Action:    umount,
+}
+
+func umount(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("You must specify a single argument which is the mount point of a running mount.", 1)
+	}
+	mountpoint := ctx.Args().First()
+	sockPath, err := control.SocketPath(mountpoint)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = control.Do(sockPath, control.OpUmount); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to unmount %s: %v", mountpoint, err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/codegangsta/cli"
+)
+
+// Set at build time, e.g.
+//
+//	go install -ldflags "-X main.version=v0.3.0 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version = ""
+	commit  = ""
+)
+
+const driveAPIModule = "google.golang.org/api"
+
+var versionCommand = cli.Command{
+	Name:   "version",
+	Usage:  "print what this binary is and what it was built with, for bug reports",
+	Action: printVersion,
+}
+
+func printVersion(ctx *cli.Context) error {
+	writeVersion(os.Stdout, buildVersions())
+	return nil
+}
+
+// versions describes a binary.
+type versions struct {
+	version  string
+	commit   string
+	goVer    string
+	driveAPI string
+}
+
+// buildVersions returns what we know about this binary.  When nothing
+// was set at build time, we go with what the go tool recorded, which
+// is a module version for `go get` builds and "(devel)" otherwise.
+func buildVersions() versions {
+	v := versions{
+		version:  version,
+		commit:   commit,
+		goVer:    runtime.Version(),
+		driveAPI: "unknown",
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v.version == "" {
+			v.version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == driveAPIModule {
+				v.driveAPI = dep.Version
+				if dep.Replace != nil {
+					v.driveAPI = dep.Replace.Version
+				}
+			}
+		}
+	}
+	if v.version == "" {
+		v.version = "unknown"
+	}
+	if v.commit == "" {
+		v.commit = "unknown"
+	}
+	return v
+}
+
+func writeVersion(w io.Writer, v versions) {
+	fmt.Fprintf(w, "mnt-gdrive  %s\n", v.version)
+	fmt.Fprintf(w, "commit      %s\n", v.commit)
+	fmt.Fprintf(w, "go          %s\n", v.goVer)
+	fmt.Fprintf(w, "drive api   %s %s\n", driveAPIModule, v.driveAPI)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuildVersions(t *testing.T) {
+	v := buildVersions()
+	equals(t, runtime.Version(), v.goVer)
+	assert(t, v.version != "", "no version")
+	assert(t, v.commit != "", "no commit")
+
+	var b bytes.Buffer
+	writeVersion(&b, versions{version: "v1.2.3", commit: "abc1234", goVer: "go1.15", driveAPI: "v0.31.0"})
+	equals(t, strings.Join([]string{
+		"mnt-gdrive  v1.2.3",
+		"commit      abc1234",
+		"go          go1.15",
+		"drive api   google.golang.org/api v0.31.0",
+		""}, "\n"), b.String())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/ginabythebay/mnt-gdrive/internal/control"
+)
+
+var watchCommand = cli.Command{
+	Name:      "watch",
+	Usage:     "print remote changes applied to a running mount, one json object per line",
+	ArgsUsage: "MOUNTPOINT",
+	Action:    watch,
+}
+
+func watch(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("You must specify a single argument which is the mount point of a running mount.", 1)
+	}
+	sockPath, err := control.SocketPath(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	err = control.Watch(sockPath, func(e control.Event) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}